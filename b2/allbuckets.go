@@ -0,0 +1,211 @@
+// Copyright 2018, the Blazer authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package b2
+
+import (
+	"context"
+	"io"
+	"sort"
+	"sync"
+)
+
+// ListBucketConcurrency sets how many buckets ListAllBuckets lists at once.
+// The default is four.  Bucket.List ignores it.
+func ListBucketConcurrency(n int) ListOption {
+	return func(o *objectIteratorOptions) {
+		o.buckets = n
+	}
+}
+
+// ListAllBuckets returns an iterator over the objects in every bucket in the
+// account.  The options are applied to the listing of each bucket; for
+// example, ListPrefix finds the objects with a given prefix in every bucket.
+//
+// Buckets are listed in order of name, and each bucket's objects are returned
+// before any of the next bucket's, but the next few buckets are listed in
+// the background; see ListBucketConcurrency.  If a bucket can't be listed,
+// as when the client's key is restricted to another bucket, the iterator
+// returns an item for it whose BucketErr is set, and goes on to the next.
+func (c *Client) ListAllBuckets(ctx context.Context, opts ...ListOption) *AccountIterator {
+	ctx, cancel := context.WithCancel(ctx)
+	a := &AccountIterator{
+		c:      c,
+		ctx:    ctx,
+		cancel: cancel,
+		lopts:  opts,
+	}
+	for _, opt := range opts {
+		opt(&a.opts)
+	}
+	return a
+}
+
+// AccountIterator iterates over the objects in every bucket in an account.
+//
+// It is intended to be called in a loop:
+//
+//	for iter.Next() {
+//	  if err := iter.BucketErr(); err != nil {
+//	    // handle the failure to list iter.Bucket()
+//	    continue
+//	  }
+//	  obj := iter.Object()
+//	  // act on iter.Bucket() and obj
+//	}
+//	if err := iter.Err(); err != nil {
+//	  // handle err
+//	}
+//
+// A caller that stops before Next returns false should call Close, or cancel
+// the iterator's context.
+type AccountIterator struct {
+	c      *Client
+	ctx    context.Context
+	cancel context.CancelFunc
+	lopts  []ListOption
+	opts   objectIteratorOptions
+	init   sync.Once
+	err    error
+	queue  []chan bucketItem // one per bucket, in order
+	cur    bucketItem
+}
+
+// bucketItem is an object, or a failure to list a bucket.
+type bucketItem struct {
+	b   *Bucket
+	obj *Object
+	err error
+}
+
+func (a *AccountIterator) setup() {
+	buckets, err := a.c.ListBuckets(a.ctx)
+	if err != nil {
+		a.err = err
+		return
+	}
+	sort.Slice(buckets, func(i, j int) bool { return buckets[i].Name() < buckets[j].Name() })
+	n := a.opts.buckets
+	if n < 1 {
+		n = 4
+	}
+	sem := make(chan struct{}, n)
+	chs := make([]chan bucketItem, len(buckets))
+	for i := range chs {
+		chs[i] = make(chan bucketItem)
+	}
+	a.queue = chs
+	go func() {
+		// Buckets are started in order, and each finishes once the caller has
+		// taken its objects, so the bucket the caller is waiting for has
+		// always been started.
+		for i, b := range buckets {
+			select {
+			case sem <- struct{}{}:
+			case <-a.ctx.Done():
+				return
+			}
+			go func(b *Bucket, ch chan bucketItem) {
+				defer func() { <-sem }()
+				defer close(ch)
+				a.listBucket(b, ch)
+			}(b, chs[i])
+		}
+	}()
+}
+
+// listBucket sends the objects in b on ch, followed by an item with the error
+// that ended the listing, if there was one.
+func (a *AccountIterator) listBucket(b *Bucket, ch chan<- bucketItem) {
+	iter := b.List(a.ctx, a.lopts...)
+	defer iter.Close()
+	for iter.Next() {
+		select {
+		case ch <- bucketItem{b: b, obj: iter.Object()}:
+		case <-a.ctx.Done():
+			return
+		}
+	}
+	if err := iter.Err(); err != nil && a.ctx.Err() == nil {
+		select {
+		case ch <- bucketItem{b: b, err: err}:
+		case <-a.ctx.Done():
+		}
+	}
+}
+
+// Next advances the iterator to the next object, or to the next bucket that
+// could not be listed.  Once Next returns false, it is important to check the
+// return value of Err().
+func (a *AccountIterator) Next() bool {
+	a.init.Do(a.setup)
+	for a.err == nil {
+		if len(a.queue) == 0 {
+			a.err = io.EOF
+			break
+		}
+		select {
+		case it, ok := <-a.queue[0]:
+			if !ok {
+				a.queue = a.queue[1:]
+				continue
+			}
+			a.cur = it
+			return true
+		case <-a.ctx.Done():
+			a.err = a.ctx.Err()
+		}
+	}
+	a.cancel()
+	return false
+}
+
+// Bucket returns the bucket of the current item.
+func (a *AccountIterator) Bucket() *Bucket {
+	return a.cur.b
+}
+
+// Object returns the current object, or nil if the current item is a bucket
+// that could not be listed.
+func (a *AccountIterator) Object() *Object {
+	return a.cur.obj
+}
+
+// BucketErr returns the error that ended the listing of the current item's
+// bucket, or nil if the current item is an object.  Any objects in the bucket
+// before the error have already been returned.
+func (a *AccountIterator) BucketErr() error {
+	return a.cur.err
+}
+
+// Err returns the error that ended the iteration, or nil if every bucket was
+// listed.  Errors listing a particular bucket are returned by BucketErr
+// instead.
+func (a *AccountIterator) Err() error {
+	if a.err == io.EOF {
+		return nil
+	}
+	return a.err
+}
+
+// Close stops the iterator, and the listings it is doing in the background.
+// After Close, Next returns false.
+func (a *AccountIterator) Close() error {
+	a.init.Do(a.setup)
+	a.cancel()
+	if a.err == nil {
+		a.err = io.EOF
+	}
+	return nil
+}
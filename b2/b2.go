@@ -29,14 +29,20 @@ package b2
 
 import (
 	"context"
+	"crypto/sha1"
+	"errors"
 	"fmt"
+	"hash"
 	"io"
 	"net/http"
 	"net/url"
 	"regexp"
-	"strconv"
+	"strings"
 	"sync"
 	"time"
+
+	"github.com/kurin/blazer"
+	"github.com/kurin/blazer/internal/b2types"
 )
 
 // Client is a Backblaze B2 client.
@@ -83,6 +89,19 @@ type clientOptions struct {
 	apiBase         string
 	userAgents      []string
 	writerOpts      []WriterOption
+	minBytes        int64         // see MinThroughput
+	window          time.Duration // see MinThroughput
+	hostFailures    int           // see UploadHostFailures
+	hostWindow      time.Duration // see UploadHostFailures
+	hostLatency     float64       // see UploadHostLatency
+	onCap           func(*CapExceededError)
+	hashFunc        func() hash.Hash // see HashFunc
+}
+
+// LibraryVersion returns the version of Blazer that this program was built
+// with.  It is the version in the default User-Agent header.
+func LibraryVersion() string {
+	return blazer.Version
 }
 
 // A ClientOption allows callers to adjust various per-client settings.
@@ -138,6 +157,70 @@ func ForceCapExceeded() ClientOption {
 	}
 }
 
+// ErrCapExceeded matches, with errors.Is, the errors returned when the
+// account has reached one of the caps set in the B2 console.  Requests that
+// fail this way are not retried.
+var ErrCapExceeded = errors.New("b2: account cap exceeded")
+
+// Cap names a B2 account cap.
+type Cap string
+
+// The caps that B2 distinguishes.  When B2 doesn't say which cap was reached,
+// the Cap is "".
+const (
+	CapStorage     Cap = "storage"
+	CapDownload    Cap = "download"
+	CapTransaction Cap = "transaction"
+)
+
+// CapExceededError is returned when a request fails because the account has
+// reached one of its caps.  Use errors.As to find it in an error chain.
+type CapExceededError struct {
+	Cap Cap
+	Err error
+}
+
+func (e *CapExceededError) Error() string {
+	if e.Cap == "" {
+		return fmt.Sprintf("b2: account cap exceeded: %v", e.Err)
+	}
+	return fmt.Sprintf("b2: account %s cap exceeded: %v", e.Cap, e.Err)
+}
+
+func (e *CapExceededError) Unwrap() error { return e.Err }
+
+// Is makes CapExceededError match ErrCapExceeded.
+func (e *CapExceededError) Is(target error) bool { return target == ErrCapExceeded }
+
+// OnCapExceeded calls f whenever a request fails because the account has
+// reached one of its caps, so that an application can alert an operator as
+// soon as it happens.  f is called once for each failed request, possibly
+// concurrently, and should return quickly.
+func OnCapExceeded(f func(*CapExceededError)) ClientOption {
+	return func(c *clientOptions) {
+		c.onCap = f
+	}
+}
+
+// HashFunc replaces crypto/sha1 with another implementation of SHA1, such as
+// one accelerated by hardware, wherever the client hashes content: uploaded
+// objects and parts, and downloads being verified.  f must return a hash.Hash
+// that computes SHA1; B2 rejects uploads whose hashes don't match.
+func HashFunc(f func() hash.Hash) ClientOption {
+	return func(c *clientOptions) {
+		c.hashFunc = f
+	}
+}
+
+// newHash returns a hash from the function given to HashFunc, or else a
+// crypto/sha1 hash.
+func (c clientOptions) newHash() hash.Hash {
+	if c.hashFunc != nil {
+		return c.hashFunc()
+	}
+	return sha1.New()
+}
+
 func client(cl *Client) ClientOption {
 	return func(c *clientOptions) {
 		c.client = cl
@@ -176,13 +259,31 @@ func (ct *clientTransport) RoundTrip(r *http.Request) (*http.Response, error) {
 	return resp, nil
 }
 
-// Bucket is a reference to a B2 bucket.
+// Bucket is a reference to a B2 bucket.  It is safe for concurrent use, as are
+// the Objects it returns.
 type Bucket struct {
-	b beBucketInterface
 	r beRootInterface
 
 	c       *Client
 	urlPool *urlPool
+
+	mu       sync.Mutex // protects b and defaults, which Attrs and Update refresh
+	b        beBucketInterface
+	defaults *Attrs
+}
+
+// backend returns the bucket's backend, which Attrs may replace.
+func (b *Bucket) backend() beBucketInterface {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.b
+}
+
+// objectDefaults returns the attributes set by DefaultObjectAttrs.
+func (b *Bucket) objectDefaults() *Attrs {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.defaults
 }
 
 type BucketType string
@@ -209,6 +310,16 @@ type BucketAttrs struct {
 	// the rules are not modified.  A bucket's rules can be removed by updating
 	// with an empty slice.
 	LifecycleRules []LifecycleRule
+
+	// DefaultObjectAttrs are the attributes that every Writer created from the
+	// bucket starts with.  Its ContentType is used when the Writer's is not
+	// set, and its Info keys are added to the Writer's, except where the
+	// Writer sets the same key.  Other fields are ignored.
+	//
+	// Unlike the other attributes, these are not stored in B2, but only in the
+	// Bucket value given to NewBucket or Update.  If nil during a
+	// bucket.Update, the defaults are not modified.
+	DefaultObjectAttrs *Attrs
 }
 
 // A LifecycleRule describes an object's life cycle, namely how many days after
@@ -234,22 +345,82 @@ type b2err struct {
 	err              error
 	notFoundErr      bool
 	isUpdateConflict bool
+	unauthorized     bool
 }
 
 func (e b2err) Error() string {
 	return e.err.Error()
 }
 
+func (e b2err) Unwrap() error {
+	return e.err
+}
+
+// ErrNotExist is not returned by this package, which reports missing objects
+// and buckets with errors from B2, but fakes of BucketInterface and
+// ObjectInterface may return it, or wrap it, to the same effect.
+var ErrNotExist = errors.New("b2: object or bucket does not exist")
+
 // IsNotExist reports whether a given error indicates that an object or bucket
 // does not exist.
 func IsNotExist(err error) bool {
-	berr, ok := err.(b2err)
-	if !ok {
+	if errors.Is(err, ErrNotExist) {
+		return true
+	}
+	var berr b2err
+	if !errors.As(err, &berr) {
 		return false
 	}
 	return berr.notFoundErr
 }
 
+// Error is returned by Reader, Writer, ObjectIterator, Object, and Bucket
+// methods when a request fails.  It records the operation that was being
+// performed and the bucket and object it was performed on.  The underlying
+// error is available through errors.Unwrap, and so helpers like IsNotExist,
+// as well as the base package's Action and Code, see through it.
+type Error struct {
+	// Op is the operation that failed, e.g. "read", "write", or "delete".
+	Op string
+
+	// Bucket and Object name the target of the operation.  Object is empty
+	// for bucket operations, and is the prefix for listings.
+	Bucket string
+	Object string
+
+	// Err is the underlying error.
+	Err error
+}
+
+func (e *Error) Error() string {
+	target := e.Bucket
+	if e.Object != "" {
+		target += "/" + e.Object
+	}
+	return fmt.Sprintf("b2: %s %s: %v", e.Op, target, e.Err)
+}
+
+// Unwrap returns the underlying error.
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// wrap annotates err with the operation and the bucket and object it was
+// performed on.  Sentinel errors that callers compare directly, like io.EOF and
+// context cancellation, are returned as they are, as are errors that have
+// already been wrapped.
+func wrap(op, bucket, object string, err error) error {
+	switch err {
+	case nil, io.EOF, context.Canceled, context.DeadlineExceeded, errNoMoreContent, ErrWriterClosed, ErrNotModified, ErrObjectChanged:
+		return err
+	}
+	var e *Error
+	if errors.As(err, &e) {
+		return err
+	}
+	return &Error{Op: op, Bucket: bucket, Object: object, Err: err}
+}
+
 const uploadURLPoolSize = 100
 
 type urlPool struct {
@@ -282,7 +453,7 @@ func (p *urlPool) put(u beURLInterface) {
 
 // Bucket returns a bucket if it exists.
 func (c *Client) Bucket(ctx context.Context, name string) (*Bucket, error) {
-	buckets, err := c.backend.listBuckets(ctx)
+	buckets, err := c.backend.listBuckets(ctx, name)
 	if err != nil {
 		return nil, err
 	}
@@ -306,18 +477,22 @@ func (c *Client) Bucket(ctx context.Context, name string) (*Bucket, error) {
 // if it does not already exist.  If attrs is nil, it is created as a private
 // bucket with no info metadata and no lifecycle rules.
 func (c *Client) NewBucket(ctx context.Context, name string, attrs *BucketAttrs) (*Bucket, error) {
-	buckets, err := c.backend.listBuckets(ctx)
+	buckets, err := c.backend.listBuckets(ctx, name)
 	if err != nil {
 		return nil, err
 	}
 	for _, bucket := range buckets {
 		if bucket.name() == name {
-			return &Bucket{
+			b := &Bucket{
 				b:       bucket,
 				r:       c.backend,
 				c:       c,
 				urlPool: newURLPool(),
-			}, nil
+			}
+			if attrs != nil {
+				b.defaults = copyAttrs(attrs.DefaultObjectAttrs)
+			}
+			return b, nil
 		}
 	}
 	if attrs == nil {
@@ -328,16 +503,17 @@ func (c *Client) NewBucket(ctx context.Context, name string, attrs *BucketAttrs)
 		return nil, err
 	}
 	return &Bucket{
-		b:       b,
-		r:       c.backend,
-		c:       c,
-		urlPool: newURLPool(),
+		b:        b,
+		r:        c.backend,
+		c:        c,
+		urlPool:  newURLPool(),
+		defaults: copyAttrs(attrs.DefaultObjectAttrs),
 	}, err
 }
 
 // ListBuckets returns all the available buckets.
 func (c *Client) ListBuckets(ctx context.Context) ([]*Bucket, error) {
-	bs, err := c.backend.listBuckets(ctx)
+	bs, err := c.backend.listBuckets(ctx, "")
 	if err != nil {
 		return nil, err
 	}
@@ -353,38 +529,98 @@ func (c *Client) ListBuckets(ctx context.Context) ([]*Bucket, error) {
 	return buckets, nil
 }
 
+func isUnauthorized(err error) bool {
+	var e b2err
+	if !errors.As(err, &e) {
+		return false
+	}
+	return e.unauthorized
+}
+
 // IsUpdateConflict reports whether a given error is the result of a bucket
 // update conflict.
 func IsUpdateConflict(err error) bool {
-	e, ok := err.(b2err)
-	if !ok {
+	var e b2err
+	if !errors.As(err, &e) {
 		return false
 	}
 	return e.isUpdateConflict
 }
 
+// IsTransient reports whether err is the result of a condition that is
+// expected to clear up on its own, such as the service being busy or an
+// upload endpoint going away, so that the whole operation may be retried
+// later.  Requests are already retried internally; this is for callers, like
+// job schedulers, that need to decide whether to try again from the top.
+func IsTransient(err error) bool {
+	return errors.Is(err, errStalled) || errTransient(err)
+}
+
+// IsAuthError reports whether err was caused by the account's credentials:
+// the key is invalid, has expired or been deleted, or lacks the capability
+// for the request.  Retrying such an error without new credentials won't
+// help.
+func IsAuthError(err error) bool {
+	return isUnauthorized(err) || errAuth(err)
+}
+
+// RetryAfter returns how long the service asked the caller to wait before
+// trying again, if it did, over all the attempts that led to err.
+func RetryAfter(err error) (time.Duration, bool) {
+	d := errRetryAfter(err)
+	return d, d > 0
+}
+
 // Update modifies the given bucket with new attributes.  It is possible that
 // this method could fail with an update conflict, in which case you should
 // retrieve the latest bucket attributes with Attrs and try again.
 func (b *Bucket) Update(ctx context.Context, attrs *BucketAttrs) error {
-	return b.b.updateBucket(ctx, attrs)
+	if err := b.backend().updateBucket(ctx, attrs); err != nil {
+		return b.wrap("update", err)
+	}
+	if attrs != nil && attrs.DefaultObjectAttrs != nil {
+		b.mu.Lock()
+		b.defaults = copyAttrs(attrs.DefaultObjectAttrs)
+		b.mu.Unlock()
+	}
+	return nil
 }
 
 // Attrs retrieves and returns the current bucket's attributes.
 func (b *Bucket) Attrs(ctx context.Context) (*BucketAttrs, error) {
 	bucket, err := b.c.Bucket(ctx, b.Name())
 	if err != nil {
-		return nil, err
+		return nil, b.wrap("attrs", err)
 	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
 	b.b = bucket.b
-	return b.b.attrs(), nil
+	attrs := b.b.attrs()
+	if attrs != nil {
+		attrs.DefaultObjectAttrs = copyAttrs(b.defaults)
+	}
+	return attrs, nil
+}
+
+func copyAttrs(a *Attrs) *Attrs {
+	if a == nil {
+		return nil
+	}
+	c := *a
+	if a.Info != nil {
+		c.Info = make(map[string]string)
+		for k, v := range a.Info {
+			c.Info[k] = v
+		}
+	}
+	return &c
 }
 
 var bNotExist = regexp.MustCompile("Bucket.*does not exist")
 
 // Delete removes a bucket.  The bucket must be empty.
 func (b *Bucket) Delete(ctx context.Context) error {
-	err := b.b.deleteBucket(ctx)
+	err := b.backend().deleteBucket(ctx)
 	if err == nil {
 		return err
 	}
@@ -395,37 +631,61 @@ func (b *Bucket) Delete(ctx context.Context) error {
 	// they update the implementation to match the documentation, we're just going
 	// to regexp over the error message and hope it's okay.
 	if bNotExist.MatchString(err.Error()) {
-		return b2err{
+		err = b2err{
 			err:         err,
 			notFoundErr: true,
 		}
 	}
-	return err
+	return b.wrap("delete", err)
+}
+
+func (b *Bucket) wrap(op string, err error) error {
+	return wrap(op, b.Name(), "", err)
 }
 
 // BaseURL returns the base URL to use for all files uploaded to this bucket.
 func (b *Bucket) BaseURL() string {
-	return b.b.baseURL()
+	return b.backend().baseURL()
 }
 
 // Name returns the bucket's name.
 func (b *Bucket) Name() string {
-	return b.b.name()
+	return b.backend().name()
 }
 
-// Object represents a B2 object.
+// Object represents a B2 object.  It is safe for concurrent use.
 type Object struct {
 	attrs *Attrs
 	name  string
-	f     beFileInterface
 	b     *Bucket
+	asOf  time.Time // if set, f is the version current at this time
+
+	pinned bool // if set, f is the version to read, whatever is current
+
+	mu sync.Mutex // protects f, which is resolved on first use
+	f  beFileInterface
+}
+
+// file returns the version of the object that has been resolved, or nil.
+func (o *Object) file() beFileInterface {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.f
+}
+
+// setFile records f as the object's version, as when a Writer replaces it.
+func (o *Object) setFile(f beFileInterface) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.f = f
 }
 
 // Attrs holds an object's metadata.
 type Attrs struct {
+	ID              string            // Not used on upload.
 	Name            string            // Not used on upload.
 	Size            int64             // Not used on upload.
-	ContentType     string            // Used on upload, default is "application/octet-stream".
+	ContentType     string            // Used on upload, default is "b2/x-auto"; see WithContentSniffing.
 	Status          ObjectState       // Not used on upload.
 	UploadTimestamp time.Time         // Not used on upload.
 	SHA1            string            // Can be "none" for large files.  If set on upload, will be used for large files.
@@ -438,40 +698,42 @@ func (o *Object) Name() string {
 	return o.name
 }
 
+func (o *Object) wrap(op string, err error) error {
+	return wrap(op, o.b.Name(), o.name, err)
+}
+
 // Attrs returns an object's attributes.
 func (o *Object) Attrs(ctx context.Context) (*Attrs, error) {
-	if err := o.ensure(ctx); err != nil {
-		return nil, err
+	f, err := o.ensure(ctx)
+	if err != nil {
+		return nil, o.wrap("attrs", err)
 	}
-	fi, err := o.f.getFileInfo(ctx)
+	fi, err := f.getFileInfo(ctx)
 	if err != nil {
-		return nil, err
+		return nil, o.wrap("attrs", err)
 	}
-	name, sha, size, ct, info, st, stamp := fi.stats()
-	var state ObjectState
-	switch st {
-	case "upload":
-		state = Uploaded
-	case "start":
-		state = Started
-	case "hide":
-		state = Hider
-	case "folder":
-		state = Folder
+	name, sha, size, ct, finfo, st, stamp := fi.stats()
+	state := objectState(st)
+	// The info map may be shared with other callers, so it is copied before
+	// being modified.
+	info := make(map[string]string, len(finfo))
+	for k, v := range finfo {
+		info[k] = v
 	}
 	var mtime time.Time
 	if v, ok := info["src_last_modified_millis"]; ok {
-		ms, err := strconv.ParseInt(v, 10, 64)
+		ms, err := b2types.ParseMillis(v)
 		if err != nil {
-			return nil, err
+			return nil, o.wrap("attrs", err)
 		}
-		mtime = time.Unix(ms/1e3, (ms%1e3)*1e6)
+		mtime = ms.Time()
 		delete(info, "src_last_modified_millis")
 	}
 	if v, ok := info["large_file_sha1"]; ok {
 		sha = v
 	}
 	return &Attrs{
+		ID:              f.id(),
 		Name:            name,
 		Size:            size,
 		ContentType:     ct,
@@ -502,6 +764,21 @@ const (
 	Folder
 )
 
+// objectState translates the action strings returned by B2.
+func objectState(action string) ObjectState {
+	switch action {
+	case "upload":
+		return Uploaded
+	case "start":
+		return Started
+	case "hide":
+		return Hider
+	case "folder":
+		return Folder
+	}
+	return Unknown
+}
+
 // Object returns a reference to the named object in the bucket.  Hidden
 // objects cannot be referenced in this manner; they can only be found by
 // finding the appropriate reference in ListObjects.
@@ -512,9 +789,75 @@ func (b *Bucket) Object(name string) *Object {
 	}
 }
 
-// URL returns the full URL to the given object.
+// AsOf returns a reference to the version of the object that was current at
+// t: the newest version uploaded at or before t.  Readers, Attrs, and Delete
+// act on that version, which is resolved on first use.  If the object did not
+// exist or was hidden at t, they return an error for which IsNotExist is true.
+//
+// URL, DownloadURL, and AuthURL always refer to the current version.
+func (o *Object) AsOf(t time.Time) *Object {
+	return &Object{
+		name: o.name,
+		b:    o.b,
+		asOf: t,
+	}
+}
+
+// version returns the newest version of name uploaded at or before t.
+func (b *Bucket) version(ctx context.Context, name string, t time.Time) (beFileInterface, error) {
+	iter := b.List(ctx, ListPrefix(name), ListHidden(), ListSkip(Started))
+	defer iter.Close()
+	for iter.Next() {
+		obj := iter.Object()
+		if obj.name != name {
+			break
+		}
+		if obj.f.timestamp().After(t) {
+			continue
+		}
+		if objectState(obj.f.status()) == Hider {
+			break
+		}
+		return obj.f, nil
+	}
+	if err := iter.Err(); err != nil {
+		return nil, err
+	}
+	return nil, b2err{err: fmt.Errorf("%s: not found as of %v", name, t), notFoundErr: true}
+}
+
+// URL returns the full URL to the given object.  The object name is escaped
+// as B2 requires; this is the same URL that the B2 web console shows as the
+// object's "friendly URL".
 func (o *Object) URL() string {
-	return fmt.Sprintf("%s/file/%s/%s", o.b.BaseURL(), o.b.Name(), o.name)
+	return fmt.Sprintf("%s/file/%s/%s", o.b.BaseURL(), o.b.Name(), escapeName(o.name))
+}
+
+// DownloadURL returns a URL for the given object suitable for handing to
+// browsers.  If valid is positive, the URL carries an authorization token,
+// good for that long, so that objects in private buckets can be downloaded;
+// see AuthURL.  Otherwise the URL is unauthorized, and only works for public
+// buckets.  If b2cd is not blank, it is passed as the b2ContentDisposition
+// argument, which B2 returns as the Content-Disposition header.
+func (o *Object) DownloadURL(ctx context.Context, valid time.Duration, b2cd string) (string, error) {
+	if valid > 0 {
+		u, err := o.AuthURL(ctx, valid, b2cd)
+		if err != nil {
+			return "", err
+		}
+		return u.String(), nil
+	}
+	if b2cd == "" {
+		return o.URL(), nil
+	}
+	return fmt.Sprintf("%s?b2ContentDisposition=%s", o.URL(), url.QueryEscape(b2cd)), nil
+}
+
+// escapeName escapes an object name for use in a download URL.  B2 decodes
+// '+' as a space, and so a literal '+' must be escaped, while '/' is left as
+// is.  This matches the escaping used by package base.
+func escapeName(name string) string {
+	return strings.Replace(url.QueryEscape(name), "%2F", "/", -1)
 }
 
 // NewWriter returns a new writer for the given object.  Objects that are
@@ -535,6 +878,16 @@ func (o *Object) NewWriter(ctx context.Context, opts ...WriterOption) *Writer {
 	for _, f := range opts {
 		f(w)
 	}
+	if d := o.b.objectDefaults(); d != nil {
+		if w.contentType == "" {
+			w.contentType = d.ContentType
+		}
+		for k, v := range d.Info {
+			if _, ok := w.info[k]; !ok {
+				w.setInfo(k, v)
+			}
+		}
+	}
 	return w
 }
 
@@ -542,7 +895,7 @@ func (o *Object) NewWriter(ctx context.Context, opts ...WriterOption) *Writer {
 // bytes.  If length is negative, the rest of the object is read.
 func (o *Object) NewRangeReader(ctx context.Context, offset, length int64) *Reader {
 	ctx, cancel := context.WithCancel(ctx)
-	return &Reader{
+	r := &Reader{
 		ctx:    ctx,
 		cancel: cancel,
 		o:      o,
@@ -551,6 +904,10 @@ func (o *Object) NewRangeReader(ctx context.Context, offset, length int64) *Read
 		length: length,
 		offset: offset,
 	}
+	if o.pinned {
+		r.id = o.file().id()
+	}
+	return r
 }
 
 // NewReader returns a reader for the given object.
@@ -558,42 +915,158 @@ func (o *Object) NewReader(ctx context.Context) *Reader {
 	return o.NewRangeReader(ctx, 0, -1)
 }
 
-func (o *Object) ensure(ctx context.Context) error {
+// ensure returns the object's version, resolving it if necessary.
+func (o *Object) ensure(ctx context.Context) (beFileInterface, error) {
+	if f := o.file(); f != nil {
+		return f, nil
+	}
+	var f beFileInterface
+	if !o.asOf.IsZero() {
+		v, err := o.b.version(ctx, o.name, o.asOf)
+		if err != nil {
+			return nil, err
+		}
+		f = v
+	} else {
+		obj, err := o.b.getObject(ctx, o.name)
+		if err != nil {
+			return nil, err
+		}
+		f = obj.f
+	}
+	// Another caller may have resolved it in the meantime.
+	o.mu.Lock()
+	defer o.mu.Unlock()
 	if o.f == nil {
-		f, err := o.b.getObject(ctx, o.name)
+		o.f = f
+	}
+	return o.f, nil
+}
+
+// Exists reports whether the object is currently visible in the bucket.  It
+// issues a HEAD request against the object's download URL, and so does not
+// download any part of the object.  If the client's key lacks the readFiles
+// capability, Exists falls back to listing the exact name instead.
+//
+// Exists returns (false, nil) if the object does not exist or is hidden.
+func (o *Object) Exists(ctx context.Context) (bool, error) {
+	if !o.asOf.IsZero() {
+		_, err := o.ensure(ctx)
+		if IsNotExist(err) {
+			return false, nil
+		}
+		return err == nil, o.wrap("exists", err)
+	}
+	fr, err := o.b.backend().downloadFileByName(ctx, o.name, "", 0, 0, true)
+	if err == nil {
+		fr.Close()
+		o.mu.Lock()
+		if o.f == nil {
+			o.f = o.b.backend().file(fr.id(), o.name)
+		}
+		o.mu.Unlock()
+		return true, nil
+	}
+	if IsNotExist(err) {
+		return false, nil
+	}
+	if !isUnauthorized(err) && !headRefused(err) {
+		return false, o.wrap("exists", err)
+	}
+	st, _, err := o.b.NameState(ctx, o.name)
+	if err != nil {
+		return false, o.wrap("exists", err)
+	}
+	return st == Live, nil
+}
+
+// State describes what a bucket holds under a name.
+type State int
+
+const (
+	// Absent means that there are no versions of the name.
+	Absent State = iota
+	// Live means that the newest version of the name is an object that can be
+	// read.
+	Live
+	// Hidden means that the newest version of the name is a hide marker.  The
+	// name can't be read, but older versions remain.
+	Hidden
+)
+
+func (s State) String() string {
+	switch s {
+	case Live:
+		return "live"
+	case Hidden:
+		return "hidden"
+	}
+	return "absent"
+}
+
+// NameState reports whether name is live, hidden, or absent, along with the
+// attributes of its newest version, which are nil if it is absent.  It
+// usually makes a single b2_list_file_versions call.
+//
+// Syncing tools can use NameState to treat hidden objects as absent when
+// reading, but as present when checking for conflicting changes.
+func (b *Bucket) NameState(ctx context.Context, name string) (State, *Attrs, error) {
+	var nextID string
+	nextName := name
+	for {
+		// Versions are listed newest first, so the first is the newest, unless
+		// it is an unfinished large file, which doesn't count.
+		fs, n, id, err := b.backend().listFileVersions(ctx, 1, nextName, nextID, name, "")
 		if err != nil {
-			return err
+			return Absent, nil, wrap("state", b.Name(), name, err)
+		}
+		if len(fs) == 0 || fs[0].name() != name {
+			return Absent, nil, nil
 		}
-		o.f = f.f
+		f := fs[0]
+		switch objectState(f.status()) {
+		case Started:
+			if n != name {
+				return Absent, nil, nil
+			}
+			nextName, nextID = n, id
+			continue
+		case Hider:
+			attrs, err := (&Object{name: name, f: f, b: b}).Attrs(ctx)
+			return Hidden, attrs, err
+		}
+		attrs, err := (&Object{name: name, f: f, b: b}).Attrs(ctx)
+		return Live, attrs, err
 	}
-	return nil
 }
 
 // Delete removes the given object.
 func (o *Object) Delete(ctx context.Context) error {
-	if err := o.ensure(ctx); err != nil {
-		return err
+	f, err := o.ensure(ctx)
+	if err != nil {
+		return o.wrap("delete", err)
 	}
-	return o.f.deleteFileVersion(ctx)
+	return o.wrap("delete", f.deleteFileVersion(ctx))
 }
 
 // Hide hides the object from name-based listing.
 func (o *Object) Hide(ctx context.Context) error {
-	if err := o.ensure(ctx); err != nil {
-		return err
+	if _, err := o.ensure(ctx); err != nil {
+		return o.wrap("hide", err)
 	}
-	_, err := o.b.b.hideFile(ctx, o.name)
-	return err
+	_, err := o.b.backend().hideFile(ctx, o.name)
+	return o.wrap("hide", err)
 }
 
 // Reveal unhides (if hidden) the named object.  If there are multiple objects
 // of a given name, it will reveal the most recent.
 func (b *Bucket) Reveal(ctx context.Context, name string) error {
 	iter := b.List(ctx, ListPrefix(name), ListHidden())
+	defer iter.Close()
 	for iter.Next() {
 		obj := iter.Object()
 		if obj.Name() == name {
-			if obj.f.status() == "hide" {
+			if objectState(obj.f.status()) == Hider {
 				return obj.Delete(ctx)
 			}
 			return nil
@@ -602,7 +1075,7 @@ func (b *Bucket) Reveal(ctx context.Context, name string) error {
 			break
 		}
 	}
-	return b2err{err: fmt.Errorf("%s: not found", name), notFoundErr: true}
+	return wrap("reveal", b.Name(), name, b2err{err: fmt.Errorf("%s: not found", name), notFoundErr: true})
 }
 
 // I don't want to import all of ioutil for this.
@@ -613,7 +1086,7 @@ func (discard) Write(p []byte) (int, error) {
 }
 
 func (b *Bucket) getObject(ctx context.Context, name string) (*Object, error) {
-	fr, err := b.b.downloadFileByName(ctx, name, 0, 0, true)
+	fr, err := b.backend().downloadFileByName(ctx, name, "", 0, 0, true)
 	if err != nil {
 		fmt.Printf("%v: %T\n", err, err)
 		return nil, err
@@ -622,7 +1095,7 @@ func (b *Bucket) getObject(ctx context.Context, name string) (*Object, error) {
 	fr.Close()
 	return &Object{
 		name: name,
-		f:    b.b.file(fr.id(), name),
+		f:    b.backend().file(fr.id(), name),
 		b:    b,
 	}, nil
 }
@@ -631,16 +1104,20 @@ func (b *Bucket) getObject(ctx context.Context, name string) (*Object, error) {
 // in a private bucket.  Only objects that begin with prefix can be accessed.
 // The token expires after the given duration.
 func (b *Bucket) AuthToken(ctx context.Context, prefix string, valid time.Duration) (string, error) {
-	return b.b.getDownloadAuthorization(ctx, prefix, valid, "")
+	token, err := b.backend().getDownloadAuthorization(ctx, prefix, valid, "")
+	if err != nil {
+		return "", wrap("authorize", b.Name(), prefix, err)
+	}
+	return token, nil
 }
 
 // AuthURL returns a URL for the given object with embedded token and,
 // possibly, b2ContentDisposition arguments.  Leave b2cd blank for no content
 // disposition.
 func (o *Object) AuthURL(ctx context.Context, valid time.Duration, b2cd string) (*url.URL, error) {
-	token, err := o.b.b.getDownloadAuthorization(ctx, o.name, valid, b2cd)
+	token, err := o.b.backend().getDownloadAuthorization(ctx, o.name, valid, b2cd)
 	if err != nil {
-		return nil, err
+		return nil, o.wrap("authorize", err)
 	}
 	urlString := fmt.Sprintf("%s?Authorization=%s", o.URL(), url.QueryEscape(token))
 	if b2cd != "" {
@@ -648,7 +1125,7 @@ func (o *Object) AuthURL(ctx context.Context, valid time.Duration, b2cd string)
 	}
 	u, err := url.Parse(urlString)
 	if err != nil {
-		return nil, err
+		return nil, o.wrap("authorize", err)
 	}
 	return u, nil
 }
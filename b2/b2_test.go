@@ -18,15 +18,21 @@ import (
 	"bytes"
 	"context"
 	"crypto/sha1"
+	"errors"
 	"fmt"
+	"hash"
 	"io"
 	"io/ioutil"
 	"net/http"
+	"net/url"
 	"sort"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
+
+	"github.com/kurin/blazer/base"
 )
 
 const (
@@ -69,9 +75,61 @@ type testRoot struct {
 	errs      *errCont
 	auths     int
 	bucketMap map[string]map[string]string
+	metaMap   map[string]map[string]*testMeta
+	keys      []*testKey
+	open      int           // unfinished large files
+	started   int           // large files begun
+	delay     time.Duration // before replying to uploads and downloads
+	replies   int32         // uploads and downloads; accessed atomically
+	minPart   int           // smallest part accepted; 1 if unset
+	copies    int           // server-side copies made
+	partHosts []string      // handed out in turn with upload part URLs
+	partURLs  int           // upload part URLs handed out
+	slowHost  string        // a part host that takes longer to reply
+	hostParts map[string]int
+}
+
+// testMeta records the current version of a file in a testBucket.
+type testMeta struct {
+	id   string
+	info map[string]string
+}
+
+var testFileID int
+
+func newTestFileID() string {
+	testFileID++
+	return fmt.Sprintf("file%06d", testFileID)
+}
+
+func (t *testRoot) stats() Stats           { return Stats{} }
+func (t *testRoot) capabilities() []string { return nil }
+
+func (t *testRoot) minPartSize() int {
+	if t.minPart == 0 {
+		return 1
+	}
+	return t.minPart
+}
+
+func (t *testRoot) bucketMeta(name string) map[string]*testMeta {
+	gmux.Lock()
+	defer gmux.Unlock()
+	if t.metaMap == nil {
+		t.metaMap = make(map[string]map[string]*testMeta)
+	}
+	if _, ok := t.metaMap[name]; !ok {
+		t.metaMap[name] = make(map[string]*testMeta)
+	}
+	return t.metaMap[name]
 }
 
-func (t *testRoot) authorizeAccount(context.Context, string, string, clientOptions) error {
+func (t *testRoot) authorizeAccount(_ context.Context, account, secret string, _ clientOptions) error {
+	for _, k := range t.keys {
+		if k.i == account && k.s != secret {
+			return fmt.Errorf("%s: bad application key", account)
+		}
+	}
 	t.auths++
 	return nil
 }
@@ -108,11 +166,67 @@ func (t *testRoot) transient(err error) bool {
 	return e.retry || e.reupload || e.backoff > 0
 }
 
-func (t *testRoot) createKey(context.Context, string, []string, time.Duration, string, string) (b2KeyInterface, error) {
-	return nil, nil
+func (t *testRoot) createKey(_ context.Context, name string, caps []string, valid time.Duration, bucketID, prefix string) (b2KeyInterface, error) {
+	gmux.Lock()
+	defer gmux.Unlock()
+	k := &testKey{
+		root: t,
+		n:    name,
+		i:    fmt.Sprintf("key%04d", len(t.keys)),
+		s:    fmt.Sprintf("secret%04d", len(t.keys)),
+		c:    caps,
+	}
+	if valid > 0 {
+		k.e = time.Now().Add(valid)
+	}
+	t.keys = append(t.keys, k)
+	return k, nil
+}
+
+func (t *testRoot) listKeys(_ context.Context, max int, next string) ([]b2KeyInterface, string, error) {
+	gmux.Lock()
+	defer gmux.Unlock()
+	var ks []b2KeyInterface
+	for i, k := range t.keys {
+		if k.i < next {
+			continue
+		}
+		if len(ks) == max {
+			return ks, k.i, nil
+		}
+		// Listed keys don't carry secrets.
+		lk := *t.keys[i]
+		lk.s = ""
+		ks = append(ks, &lk)
+	}
+	return ks, "", nil
+}
+
+type testKey struct {
+	root *testRoot
+	n    string
+	i    string
+	s    string
+	c    []string
+	e    time.Time
 }
-func (t *testRoot) listKeys(context.Context, int, string) ([]b2KeyInterface, string, error) {
-	return nil, "", nil
+
+func (t *testKey) caps() []string     { return t.c }
+func (t *testKey) name() string       { return t.n }
+func (t *testKey) expires() time.Time { return t.e }
+func (t *testKey) secret() string     { return t.s }
+func (t *testKey) id() string         { return t.i }
+
+func (t *testKey) del(context.Context) error {
+	gmux.Lock()
+	defer gmux.Unlock()
+	for i, k := range t.root.keys {
+		if k.i == t.i {
+			t.root.keys = append(t.root.keys[:i], t.root.keys[i+1:]...)
+			return nil
+		}
+	}
+	return fmt.Errorf("%s: key not found", t.i)
 }
 
 func (t *testRoot) createBucket(_ context.Context, name, _ string, _ map[string]string, _ []LifecycleRule) (b2BucketInterface, error) {
@@ -128,25 +242,44 @@ func (t *testRoot) createBucket(_ context.Context, name, _ string, _ map[string]
 		n:     name,
 		errs:  t.errs,
 		files: m,
+		meta:  t.bucketMeta(name),
+		root:  t,
 	}, nil
 }
 
-func (t *testRoot) listBuckets(context.Context) ([]b2BucketInterface, error) {
+func (t *testRoot) listBuckets(_ context.Context, name string) ([]b2BucketInterface, error) {
 	var b []b2BucketInterface
 	for k, v := range t.bucketMap {
+		if name != "" && k != name {
+			continue
+		}
 		b = append(b, &testBucket{
 			n:     k,
 			errs:  t.errs,
 			files: v,
+			meta:  t.bucketMeta(k),
+			root:  t,
 		})
 	}
 	return b, nil
 }
 
+// reply counts an upload or download and waits for the root's delay, as a
+// server would while it stores or finds the data.
+func (t *testRoot) reply(ctx context.Context) error {
+	if t == nil {
+		return nil
+	}
+	atomic.AddInt32(&t.replies, 1)
+	return sleepCtx(ctx, t.delay)
+}
+
 type testBucket struct {
 	n     string
 	errs  *errCont
 	files map[string]string
+	meta  map[string]*testMeta
+	root  *testRoot
 }
 
 func (t *testBucket) name() string                                     { return t.n }
@@ -162,15 +295,24 @@ func (t *testBucket) getUploadURL(context.Context) (b2URLInterface, error) {
 	}
 	return &testURL{
 		files: t.files,
+		meta:  t.meta,
+		root:  t.root,
 	}, nil
 }
 
-func (t *testBucket) startLargeFile(_ context.Context, name, _ string, _ map[string]string) (b2LargeFileInterface, error) {
+func (t *testBucket) startLargeFile(_ context.Context, name, _ string, info map[string]string) (b2LargeFileInterface, error) {
+	gmux.Lock()
+	defer gmux.Unlock()
+	t.root.open++
+	t.root.started++
 	return &testLargeFile{
 		name:  name,
 		parts: make(map[int][]byte),
 		files: t.files,
+		meta:  t.meta,
+		info:  info,
 		errs:  t.errs,
+		root:  t.root,
 	}, nil
 }
 
@@ -186,11 +328,16 @@ func (t *testBucket) listFileNames(ctx context.Context, count int, cont, pfx, de
 	var b []b2FileInterface
 	var next string
 	for i := idx; i < len(f) && i-idx < count; i++ {
-		b = append(b, &testFile{
+		tf := &testFile{
 			n:     f[i],
 			s:     int64(len(t.files[f[i]])),
 			files: t.files,
-		})
+			meta:  t.meta,
+		}
+		if m, ok := t.meta[f[i]]; ok {
+			tf.i = m.id
+		}
+		b = append(b, tf)
 		if i+1 < len(f) {
 			next = f[i+1]
 		}
@@ -206,14 +353,41 @@ func (t *testBucket) listFileVersions(ctx context.Context, count int, a, b, c, d
 	return x, y, "", z
 }
 
+func (t *testBucket) listFileNamesFunc(ctx context.Context, count int, cont, pfx, del string, fn func(b2FileInterface) error) (string, error) {
+	fs, next, err := t.listFileNames(ctx, count, cont, pfx, del)
+	if err != nil {
+		return "", err
+	}
+	for _, f := range fs {
+		if err := fn(f); err != nil {
+			return "", err
+		}
+	}
+	return next, nil
+}
+
+func (t *testBucket) listFileVersionsFunc(ctx context.Context, count int, a, b, c, d string, fn func(b2FileInterface) error) (string, string, error) {
+	next, err := t.listFileNamesFunc(ctx, count, a, c, d, fn)
+	return next, "", err
+}
+
 func (t *testBucket) listUnfinishedLargeFiles(ctx context.Context, count int, cont string) ([]b2FileInterface, string, error) {
 	return nil, "", fmt.Errorf("testBucket.listUnfinishedLargeFiles(ctx, %d, %q): not implemented", count, cont)
 }
 
-func (t *testBucket) downloadFileByName(_ context.Context, name string, offset, size int64, _ bool) (b2FileReaderInterface, error) {
+func (t *testBucket) downloadFileByName(ctx context.Context, name, _ string, offset, size int64, _ bool) (b2FileReaderInterface, error) {
+	if err := t.errs.getError("downloadFileByName"); err != nil {
+		return nil, err
+	}
+	if err := t.root.reply(ctx); err != nil {
+		return nil, err
+	}
 	gmux.Lock()
 	defer gmux.Unlock()
-	f := t.files[name]
+	f, ok := t.files[name]
+	if !ok {
+		return nil, b2err{err: fmt.Errorf("%s: not found", name), notFoundErr: true}
+	}
 	end := int(offset + size)
 	if end >= len(f) {
 		end = len(f)
@@ -222,37 +396,78 @@ func (t *testBucket) downloadFileByName(_ context.Context, name string, offset,
 		return nil, errNoMoreContent
 	}
 	return &testFileReader{
-		b: ioutil.NopCloser(bytes.NewBufferString(f[offset:end])),
-		s: end - int(offset),
-		n: name,
+		b:     ioutil.NopCloser(bytes.NewBufferString(f[offset:end])),
+		s:     end - int(offset),
+		n:     name,
+		total: int64(len(f)),
 	}, nil
 }
 
+// Files in testBucket are identified by name.
+func (t *testBucket) downloadFileByID(ctx context.Context, id, sha1 string, offset, size int64, header bool) (b2FileReaderInterface, error) {
+	return t.downloadFileByName(ctx, id, sha1, offset, size, header)
+}
+
 func (t *testBucket) hideFile(context.Context, string) (b2FileInterface, error) { return nil, nil }
-func (t *testBucket) getDownloadAuthorization(context.Context, string, time.Duration, string) (string, error) {
-	return "", nil
+
+func (t *testBucket) copyFile(_ context.Context, src, name, _ string, info map[string]string) (b2FileInterface, error) {
+	gmux.Lock()
+	defer gmux.Unlock()
+	t.root.copies++
+	for n, m := range t.meta {
+		if m.id != src {
+			continue
+		}
+		t.files[name] = t.files[n]
+		id := newTestFileID()
+		t.meta[name] = &testMeta{id: id, info: info}
+		return &testFile{
+			n:     name,
+			i:     id,
+			s:     int64(len(t.files[name])),
+			files: t.files,
+			meta:  t.meta,
+		}, nil
+	}
+	return nil, fmt.Errorf("%s: file not found", src)
+}
+func (t *testBucket) getDownloadAuthorization(_ context.Context, prefix string, _ time.Duration, _ string) (string, error) {
+	return "token/" + prefix, nil
 }
-func (t *testBucket) baseURL() string                      { return "" }
+func (t *testBucket) baseURL() string                      { return "https://f001.backblazeb2.com" }
 func (t *testBucket) file(id, name string) b2FileInterface { return nil }
 
 type testURL struct {
 	files map[string]string
+	meta  map[string]*testMeta
+	root  *testRoot
 }
 
+func (t *testURL) host() string                 { return "" }
 func (t *testURL) reload(context.Context) error { return nil }
 
-func (t *testURL) uploadFile(_ context.Context, r io.Reader, _ int, name, _, _ string, _ map[string]string) (b2FileInterface, error) {
+func (t *testURL) uploadFile(ctx context.Context, r io.Reader, _ int, name, _, sha1 string, info map[string]string) (b2FileInterface, error) {
 	buf := &bytes.Buffer{}
 	if _, err := io.Copy(buf, r); err != nil {
 		return nil, err
 	}
+	if sha1 == "hex_digits_at_end" {
+		buf.Truncate(buf.Len() - 40)
+	}
+	if err := t.root.reply(ctx); err != nil {
+		return nil, err
+	}
 	gmux.Lock()
 	defer gmux.Unlock()
 	t.files[name] = buf.String()
+	id := newTestFileID()
+	t.meta[name] = &testMeta{id: id, info: info}
 	return &testFile{
 		n:     name,
+		i:     id,
 		s:     int64(len(t.files[name])),
 		files: t.files,
+		meta:  t.meta,
 	}, nil
 }
 
@@ -260,7 +475,10 @@ type testLargeFile struct {
 	name  string
 	parts map[int][]byte
 	files map[string]string
+	meta  map[string]*testMeta
+	info  map[string]string
 	errs  *errCont
+	root  *testRoot
 }
 
 func (t *testLargeFile) finishLargeFile(context.Context) (b2FileInterface, error) {
@@ -271,32 +489,55 @@ func (t *testLargeFile) finishLargeFile(context.Context) (b2FileInterface, error
 		total = append(total, t.parts[i]...)
 	}
 	t.files[t.name] = string(total)
+	t.root.open--
+	id := newTestFileID()
+	t.meta[t.name] = &testMeta{id: id, info: t.info}
 	return &testFile{
 		n:     t.name,
+		i:     id,
 		s:     int64(len(total)),
 		files: t.files,
+		meta:  t.meta,
 	}, nil
 }
 
 func (t *testLargeFile) getUploadPartURL(context.Context) (b2FileChunkInterface, error) {
 	gmux.Lock()
 	defer gmux.Unlock()
+	var host string
+	if n := len(t.root.partHosts); n > 0 {
+		host = t.root.partHosts[t.root.partURLs%n]
+	}
+	t.root.partURLs++
 	return &testFileChunk{
+		h:     host,
 		parts: t.parts,
 		errs:  t.errs,
+		root:  t.root,
 	}, nil
 }
 
-func (t *testLargeFile) cancel(ctx context.Context) error { return ctx.Err() }
+func (t *testLargeFile) cancel(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	gmux.Lock()
+	defer gmux.Unlock()
+	t.root.open--
+	return nil
+}
 
 type testFileChunk struct {
+	h     string
 	parts map[int][]byte
 	errs  *errCont
+	root  *testRoot
 }
 
+func (t *testFileChunk) host() string                 { return t.h }
 func (t *testFileChunk) reload(context.Context) error { return nil }
 
-func (t *testFileChunk) uploadPart(_ context.Context, r io.Reader, _ string, _, index int) (int, error) {
+func (t *testFileChunk) uploadPart(ctx context.Context, r io.Reader, _ string, _, index int) (int, error) {
 	if err := t.errs.getError("uploadPart"); err != nil {
 		return 0, err
 	}
@@ -305,20 +546,35 @@ func (t *testFileChunk) uploadPart(_ context.Context, r io.Reader, _ string, _,
 	if err != nil {
 		return int(i), err
 	}
+	if err := t.root.reply(ctx); err != nil {
+		return int(i), err
+	}
+	if t.h != "" && t.h == t.root.slowHost {
+		if err := sleepCtx(ctx, 20*time.Millisecond); err != nil {
+			return int(i), err
+		}
+	}
 	gmux.Lock()
 	defer gmux.Unlock()
 	t.parts[index] = buf.Bytes()
+	if t.root.hostParts == nil {
+		t.root.hostParts = make(map[string]int)
+	}
+	t.root.hostParts[t.h]++
 	return int(i), nil
 }
 
 type testFile struct {
 	n     string
+	i     string
 	s     int64
 	t     time.Time
 	a     string
 	files map[string]string
+	meta  map[string]*testMeta
 }
 
+func (t *testFile) id() string           { return t.i }
 func (t *testFile) name() string         { return t.n }
 func (t *testFile) size() int64          { return t.s }
 func (t *testFile) timestamp() time.Time { return t.t }
@@ -329,7 +585,26 @@ func (t *testFile) compileParts(int64, map[int]string) b2LargeFileInterface {
 }
 
 func (t *testFile) getFileInfo(context.Context) (b2FileInfoInterface, error) {
-	return nil, nil
+	gmux.Lock()
+	defer gmux.Unlock()
+	var info map[string]string
+	if m, ok := t.meta[t.n]; ok {
+		info = m.info
+	}
+	// The fake doesn't record content types; this is what B2 chooses for
+	// "b2/x-auto" when the name has no known extension.
+	return &testFileInfo{name: t.n, size: t.s, ctype: "application/octet-stream", info: info, status: t.a, stamp: t.t}, nil
+}
+
+type testFileInfo struct {
+	name, ctype, status string
+	size                int64
+	info                map[string]string
+	stamp               time.Time
+}
+
+func (t *testFileInfo) stats() (string, string, int64, string, map[string]string, string, time.Time) {
+	return t.name, "", t.size, t.ctype, t.info, t.status, t.stamp
 }
 
 func (t *testFile) listParts(context.Context, int, int) ([]b2FilePartInterface, int, error) {
@@ -339,20 +614,28 @@ func (t *testFile) listParts(context.Context, int, int) ([]b2FilePartInterface,
 func (t *testFile) deleteFileVersion(context.Context) error {
 	gmux.Lock()
 	defer gmux.Unlock()
+	if m, ok := t.meta[t.n]; ok && t.i != "" && m.id != t.i {
+		// This is a superseded version; the current one is unaffected.
+		return nil
+	}
 	delete(t.files, t.n)
+	delete(t.meta, t.n)
 	return nil
 }
 
 type testFileReader struct {
-	b io.ReadCloser
-	s int
-	n string
+	b     io.ReadCloser
+	s     int
+	n     string
+	total int64
 }
 
 func (t *testFileReader) Read(p []byte) (int, error)                      { return t.b.Read(p) }
 func (t *testFileReader) Close() error                                    { return nil }
 func (t *testFileReader) stats() (int, string, string, map[string]string) { return t.s, "", "", nil }
 func (t *testFileReader) id() string                                      { return t.n }
+func (t *testFileReader) fileSize() int64                                 { return t.total }
+func (t *testFileReader) timestamp() time.Time                            { return time.Time{} }
 
 type zReader struct{}
 
@@ -576,6 +859,90 @@ func TestBackoffWithoutRetryAfter(t *testing.T) {
 	}
 }
 
+func TestMinThroughputIgnoresReplyTime(t *testing.T) {
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	// The fake takes much longer than the window to reply once it has read an
+	// upload, and to start sending a download.
+	root := &testRoot{
+		bucketMap: make(map[string]map[string]string),
+		errs:      &errCont{},
+		delay:     200 * time.Millisecond,
+	}
+	client := &Client{
+		backend: &beRoot{
+			b2i: root,
+		},
+	}
+	MinThroughput(1, 20*time.Millisecond)(&client.opts)
+	bucket, err := client.NewBucket(ctx, bucketName, &BucketAttrs{Type: Private})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	small, ssha, err := writeFile(ctx, bucket, smallFileName, 1e3, 1e4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	large, lsha, err := writeFile(ctx, bucket, largeFileName, 3e4, 1e4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// One simple upload and three parts; nothing was sent twice.
+	if n := atomic.LoadInt32(&root.replies); n != 4 {
+		t.Errorf("got %d uploads, want 4", n)
+	}
+	if err := readFile(ctx, small, ssha, 1e4, 1); err != nil {
+		t.Error(err)
+	}
+	if err := readFile(ctx, large, lsha, 1e5, 1); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestBackoffUntilDeadline(t *testing.T) {
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, 100*time.Millisecond)
+	defer cancel()
+
+	defer func(f func(time.Duration) <-chan time.Time) { after = f }(after)
+	after = func(time.Duration) <-chan time.Time { return nil } // wait forever
+
+	root := &testRoot{
+		bucketMap: make(map[string]map[string]string),
+		errs: &errCont{
+			errMap: map[string]map[int]error{
+				"createBucket": {
+					0: testError{backoff: time.Second},
+				},
+			},
+		},
+	}
+	client := &Client{
+		backend: &beRoot{
+			b2i: root,
+		},
+	}
+	_, err := client.NewBucket(ctx, "fun", &BucketAttrs{Type: Private})
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("NewBucket: got %v, want %v", err, context.DeadlineExceeded)
+	}
+	if n := base.Attempts(err); n != 1 {
+		t.Errorf("Attempts(%v): got %d, want 1", err, n)
+	}
+	if d := base.Waited(err); d <= 0 {
+		t.Errorf("Waited(%v): got %v, want more than 0", err, d)
+	}
+	if d := base.RetryAfter(err); d != time.Second {
+		t.Errorf("RetryAfter(%v): got %v, want 1s", err, d)
+	}
+	if _, ok := base.LastError(err).(testError); !ok {
+		t.Errorf("LastError(%v): got %v, want the last testError", err, base.LastError(err))
+	}
+}
+
 type badTransport struct{}
 
 func (badTransport) RoundTrip(r *http.Request) (*http.Response, error) {
@@ -726,6 +1093,157 @@ func TestLargeFileCancellation(t *testing.T) {
 	}
 }
 
+func TestWriterCleansUp(t *testing.T) {
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	uploadErrs := map[int]error{}
+	for i := 0; i < 100; i++ {
+		uploadErrs[i] = testError{}
+	}
+
+	table := []struct {
+		desc string
+		errs map[string]map[int]error
+		f    func(context.Context, *Writer) error
+	}{
+		{
+			desc: "failed parts",
+			errs: map[string]map[int]error{"uploadPart": uploadErrs},
+			f: func(ctx context.Context, w *Writer) error {
+				if _, err := io.Copy(w, io.LimitReader(zReader{}, 1e5)); err == nil {
+					return errors.New("io.Copy: expected an error")
+				}
+				if err := w.Close(); err == nil {
+					return errors.New("Close: expected an error")
+				}
+				return nil
+			},
+		},
+		{
+			desc: "canceled context",
+			f: func(ctx context.Context, w *Writer) error {
+				if _, err := io.Copy(w, io.LimitReader(zReader{}, 1e5)); err != nil {
+					return err
+				}
+				w.cancel() // as if the caller's context were canceled
+				if err := w.Close(); err != context.Canceled {
+					return fmt.Errorf("Close: got %v, want %v", err, context.Canceled)
+				}
+				return nil
+			},
+		},
+		{
+			desc: "explicit cancel",
+			f: func(ctx context.Context, w *Writer) error {
+				if _, err := io.Copy(w, io.LimitReader(zReader{}, 1e5)); err != nil {
+					return err
+				}
+				if err := w.Cancel(ctx); err != nil {
+					return err
+				}
+				if err := w.Close(); err != context.Canceled {
+					return fmt.Errorf("Close: got %v, want %v", err, context.Canceled)
+				}
+				return nil
+			},
+		},
+		{
+			desc: "small file cancel",
+			f: func(ctx context.Context, w *Writer) error {
+				if _, err := io.Copy(w, io.LimitReader(zReader{}, 1e3)); err != nil {
+					return err
+				}
+				return w.Cancel(ctx)
+			},
+		},
+	}
+
+	for _, e := range table {
+		root := &testRoot{
+			bucketMap: make(map[string]map[string]string),
+			errs:      &errCont{errMap: e.errs},
+		}
+		client := &Client{
+			backend: &beRoot{
+				b2i: root,
+			},
+		}
+		bucket, err := client.NewBucket(ctx, bucketName, &BucketAttrs{Type: Private})
+		if err != nil {
+			t.Fatal(err)
+		}
+		w := bucket.Object("file").NewWriter(ctx)
+		w.ChunkSize = 1e4
+		w.ConcurrentUploads = 3
+		if err := e.f(ctx, w); err != nil {
+			t.Errorf("%s: %v", e.desc, err)
+		}
+		gmux.Lock()
+		open := root.open
+		gmux.Unlock()
+		if open != 0 {
+			t.Errorf("%s: %d unfinished large files remain", e.desc, open)
+		}
+	}
+}
+
+func TestWriterCancel(t *testing.T) {
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	root := &testRoot{
+		bucketMap: make(map[string]map[string]string),
+		errs:      &errCont{},
+	}
+	client := &Client{
+		backend: &beRoot{
+			b2i: root,
+		},
+	}
+	bucket, err := client.NewBucket(ctx, bucketName, &BucketAttrs{Type: Private})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A failed b2_cancel_large_file is reported by Cancel, and by every
+	// subsequent Cancel.
+	w := bucket.Object("file").NewWriter(ctx)
+	w.ChunkSize = 1e4
+	if _, err := io.Copy(w, io.LimitReader(zReader{}, 1e5)); err != nil {
+		t.Fatal(err)
+	}
+	dead, kill := context.WithCancel(ctx)
+	kill()
+	if err := w.Cancel(dead); err != context.Canceled {
+		t.Errorf("Cancel with a canceled context: got %v, want %v", err, context.Canceled)
+	}
+	if err := w.Cancel(ctx); err != context.Canceled {
+		t.Errorf("second Cancel: got %v, want %v", err, context.Canceled)
+	}
+	if err := w.Close(); err != context.Canceled {
+		t.Errorf("Close after Cancel: got %v, want %v", err, context.Canceled)
+	}
+
+	// Cancel after a successful Close leaves the object alone.
+	w = bucket.Object("file").NewWriter(ctx)
+	w.ChunkSize = 1e4
+	if _, err := io.Copy(w, io.LimitReader(zReader{}, 1e5)); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Cancel(ctx); err != nil {
+		t.Errorf("Cancel after Close: %v", err)
+	}
+	if _, err := w.File(); err != nil {
+		t.Errorf("File after Cancel: %v", err)
+	}
+}
+
 func TestReadRangeReturnsRight(t *testing.T) {
 	ctx := context.Background()
 	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
@@ -764,6 +1282,29 @@ func TestReadRangeReturnsRight(t *testing.T) {
 	if i != 1400 {
 		t.Errorf("NewRangeReader(_, 200, 1400): want 1400, got %d", i)
 	}
+	if got := r.Size(); got != 1e6+42 {
+		t.Errorf("Size(): got %d, want %d", got, int64(1e6+42))
+	}
+
+	// Before any reads, the attributes are fetched with a HEAD request.
+	r = obj.NewRangeReader(ctx, 200, 1400)
+	defer r.Close()
+	if got := r.Size(); got != 1e6+42 {
+		t.Errorf("Size() before Read: got %d, want %d", got, int64(1e6+42))
+	}
+	if err := r.StatErr(); err != nil {
+		t.Errorf("StatErr(): %v", err)
+	}
+
+	// If the HEAD request fails, the error is kept for StatErr.
+	mr := bucket.Object("missing").NewReader(ctx)
+	defer mr.Close()
+	if got := mr.Size(); got != 0 {
+		t.Errorf("Size() of a missing object: got %d, want 0", got)
+	}
+	if err := mr.StatErr(); !IsNotExist(err) {
+		t.Errorf("StatErr() of a missing object: got %v, want a not-exist error", err)
+	}
 }
 
 func TestWriterReturnsError(t *testing.T) {
@@ -805,31 +1346,627 @@ func TestWriterReturnsError(t *testing.T) {
 	}
 }
 
-func TestFileBuffer(t *testing.T) {
-	r := io.LimitReader(zReader{}, 1e8)
-	w, err := newFileBuffer("")
-	if err != nil {
-		t.Fatal(err)
-	}
-	defer w.Close()
-	if _, err := io.Copy(w, r); err != nil {
-		t.Fatal(err)
-	}
-	bReader, err := w.Reader()
-	if err != nil {
-		t.Fatal(err)
-	}
-	hsh := sha1.New()
-	if _, err := io.Copy(hsh, bReader); err != nil {
-		t.Fatal(err)
-	}
-	hshText := fmt.Sprintf("%x", hsh.Sum(nil))
-	if hshText != w.Hash() {
-		t.Errorf("hashes are not equal: bufferWriter is %q, read buffer is %q", w.Hash(), hshText)
-	}
-}
+func TestExists(t *testing.T) {
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
 
-func TestNonBuffer(t *testing.T) {
+	table := []struct {
+		errs *errCont
+	}{
+		{
+			errs: &errCont{},
+		},
+		{
+			// Keys without readFiles fall back to listing.
+			errs: &errCont{
+				errMap: map[string]map[int]error{
+					"downloadFileByName": {
+						0: b2err{err: errors.New("unauthorized"), unauthorized: true},
+						1: b2err{err: errors.New("unauthorized"), unauthorized: true},
+					},
+				},
+			},
+		},
+	}
+
+	for _, e := range table {
+		client := &Client{
+			backend: &beRoot{
+				b2i: &testRoot{
+					bucketMap: make(map[string]map[string]string),
+					errs:      e.errs,
+				},
+			},
+		}
+		bucket, err := client.NewBucket(ctx, bucketName, &BucketAttrs{Type: Private})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, _, err := writeFile(ctx, bucket, "exists", 10, 1e8); err != nil {
+			t.Fatal(err)
+		}
+		for name, want := range map[string]bool{"exists": true, "exist": false, "existsnot": false} {
+			got, err := bucket.Object(name).Exists(ctx)
+			if err != nil {
+				t.Errorf("Exists(%q): %v", name, err)
+				continue
+			}
+			if got != want {
+				t.Errorf("Exists(%q): got %v, want %v", name, got, want)
+			}
+		}
+	}
+}
+
+func TestKeys(t *testing.T) {
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	root := &testRoot{
+		bucketMap: make(map[string]map[string]string),
+		errs:      &errCont{},
+	}
+	client := &Client{
+		backend: &beRoot{
+			b2i: root,
+		},
+	}
+	bucket, err := client.NewBucket(ctx, bucketName, &BucketAttrs{Type: Private})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := client.CreateKey(ctx, "global", Prefix("foo/")); err == nil {
+		t.Errorf("CreateKey with a prefix but no bucket: expected error, got none")
+	}
+
+	n := 2*keyPageSize + 10
+	for i := 0; i < n; i++ {
+		key, err := client.CreateKey(ctx, fmt.Sprintf("key-%d", i), Capabilities("listFiles"), RestrictToBucket(bucket), Prefix("foo/"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if key.Secret() == "" {
+			t.Fatalf("CreateKey: secret missing on newly created key")
+		}
+		if i > 0 {
+			continue
+		}
+		c2 := &Client{
+			backend: &beRoot{
+				b2i: root,
+			},
+		}
+		if err := c2.backend.authorizeAccount(ctx, key.ID(), key.Secret(), clientOptions{}); err != nil {
+			t.Errorf("authorizing with new key: %v", err)
+		}
+	}
+
+	var got int
+	iter := client.ListKeys(ctx)
+	for iter.Next() {
+		if s := iter.Key().Secret(); s != "" {
+			t.Errorf("ListKeys: got secret %q, want none", s)
+		}
+		got++
+	}
+	if err := iter.Err(); err != nil {
+		t.Fatalf("ListKeys: %v", err)
+	}
+	if got != n {
+		t.Errorf("ListKeys: got %d keys, want %d", got, n)
+	}
+
+	iter = client.ListKeys(ctx)
+	if !iter.Next() {
+		t.Fatalf("ListKeys: no keys: %v", iter.Err())
+	}
+	if err := iter.Key().Delete(ctx); err != nil {
+		t.Errorf("Delete: %v", err)
+	}
+	if len(root.keys) != n-1 {
+		t.Errorf("Delete: got %d keys remaining, want %d", len(root.keys), n-1)
+	}
+}
+
+func TestLargeFileSHA1(t *testing.T) {
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	root := &testRoot{
+		bucketMap: make(map[string]map[string]string),
+		errs:      &errCont{},
+	}
+	client := &Client{
+		backend: &beRoot{
+			b2i: root,
+		},
+	}
+	bucket, err := client.NewBucket(ctx, bucketName, &BucketAttrs{Type: Private})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Streamed: the SHA1 is added with a copy after the fact.
+	obj, wsha, err := writeFile(ctx, bucket, "streamed", 1e5+7, 1e4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	meta := root.metaMap[bucketName]
+	if got := meta["streamed"].info[largeFileSHA1Key]; got != wsha {
+		t.Errorf("streamed: got %s %q, want %q", largeFileSHA1Key, got, wsha)
+	}
+	if err := readFile(ctx, obj, wsha, 1e3, 3); err != nil {
+		t.Errorf("streamed: %v", err)
+	}
+
+	if root.copies != 1 {
+		t.Errorf("streamed: made %d copies, want 1", root.copies)
+	}
+
+	// Seekable: the SHA1 is computed first and given when the large file is
+	// started, so no copy is needed.
+	root.copies = 0
+	rs := &zReadSeeker{size: 1e5 + 7}
+	h := sha1.New()
+	if _, err := io.Copy(h, rs); err != nil {
+		t.Fatal(err)
+	}
+	rsha := fmt.Sprintf("%x", h.Sum(nil))
+	rs.pos = 0
+	w := bucket.Object("seeker").NewWriter(ctx)
+	w.ChunkSize = 1e4
+	if _, err := w.ReadFrom(rs); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if got := meta["seeker"].info[largeFileSHA1Key]; got != rsha {
+		t.Errorf("seeker: got %s %q, want %q", largeFileSHA1Key, got, rsha)
+	}
+	if root.copies != 0 {
+		t.Errorf("seeker: made %d copies, want 0", root.copies)
+	}
+}
+
+func TestWriterClose(t *testing.T) {
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	client := &Client{
+		backend: &beRoot{
+			b2i: &testRoot{
+				bucketMap: make(map[string]map[string]string),
+				errs:      &errCont{},
+			},
+		},
+	}
+	bucket, err := client.NewBucket(ctx, bucketName, &BucketAttrs{Type: Private})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	table := []struct {
+		name string
+		size int64
+	}{
+		{name: "small", size: 1e3},
+		{name: "large", size: 1e5 + 7},
+	}
+
+	for _, e := range table {
+		w := bucket.Object(e.name).NewWriter(ctx)
+		w.ChunkSize = 1e4
+		if _, err := w.File(); err == nil {
+			t.Errorf("%s: File before Close: expected an error", e.name)
+		}
+		h := sha1.New()
+		if _, err := io.Copy(io.MultiWriter(w, h), io.LimitReader(zReader{}, e.size)); err != nil {
+			t.Fatalf("%s: %v", e.name, err)
+		}
+		for i := 0; i < 2; i++ {
+			if err := w.Close(); err != nil {
+				t.Errorf("%s: Close #%d: %v", e.name, i+1, err)
+			}
+		}
+		if _, err := w.Write([]byte("more")); err != ErrWriterClosed {
+			t.Errorf("%s: Write after Close: got %v, want %v", e.name, err, ErrWriterClosed)
+		}
+		attrs, err := w.File()
+		if err != nil {
+			t.Errorf("%s: File: %v", e.name, err)
+			continue
+		}
+		if attrs.ID == "" {
+			t.Errorf("%s: File: empty ID", e.name)
+		}
+		if attrs.Size != e.size {
+			t.Errorf("%s: File: got size %d, want %d", e.name, attrs.Size, e.size)
+		}
+		if want := fmt.Sprintf("%x", h.Sum(nil)); attrs.SHA1 != want {
+			t.Errorf("%s: File: got SHA1 %q, want %q", e.name, attrs.SHA1, want)
+		}
+	}
+
+	// Close returns the first error every time.
+	w := bucket.Object("failed").NewWriter(ctx)
+	w.ChunkSize = 1e4
+	w.setErr(testError{})
+	for i := 0; i < 2; i++ {
+		if err := w.Close(); !errors.Is(err, testError{}) {
+			t.Errorf("failed: Close #%d: got %v, want %v", i+1, err, testError{})
+		}
+	}
+	if _, err := w.File(); err == nil {
+		t.Error("failed: File: expected an error")
+	}
+}
+
+func TestWriterFlush(t *testing.T) {
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	client := &Client{
+		backend: &beRoot{
+			b2i: &testRoot{
+				bucketMap: make(map[string]map[string]string),
+				errs:      &errCont{},
+				minPart:   5e6,
+			},
+		},
+	}
+	bucket, err := client.NewBucket(ctx, bucketName, &BucketAttrs{Type: Private})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w := bucket.Object("flushed").NewWriter(ctx)
+	w.ChunkSize = 6e6
+	h := sha1.New()
+	mw := io.MultiWriter(w, h)
+	if _, err := mw.Write(make([]byte, 1e3)); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Flush(); err == nil {
+		t.Error("Flush before a large file: expected an error")
+	}
+	// A full first chunk is still sent by Close as a simple file.
+	if _, err := io.Copy(mw, io.LimitReader(zReader{}, 6e6-1e3)); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Flush(); err == nil {
+		t.Error("Flush of a full first chunk: expected an error")
+	}
+	if _, err := io.Copy(mw, io.LimitReader(zReader{}, 1e3)); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Flush(); err == nil {
+		t.Error("Flush of a part under 5MB: expected an error")
+	}
+	if _, err := io.Copy(mw, io.LimitReader(zReader{}, 5e6)); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Flush(); err != nil {
+		t.Fatalf("Flush: %v", err)
+	}
+	if err := w.Flush(); err != nil {
+		t.Fatalf("Flush with nothing buffered: %v", err)
+	}
+	if _, err := io.Copy(mw, io.LimitReader(zReader{}, 1e4)); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Flush(); err != ErrWriterClosed {
+		t.Errorf("Flush after Close: got %v, want %v", err, ErrWriterClosed)
+	}
+	if err := readFile(ctx, bucket.Object("flushed"), fmt.Sprintf("%x", h.Sum(nil)), 1e5, 3); err != nil {
+		t.Error(err)
+	}
+}
+
+// TestWriterFlushFullChunk checks that a Writer given exactly one chunk and
+// then flushed and closed uploads a simple file, not a large file of one part.
+func TestWriterFlushFullChunk(t *testing.T) {
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	root := &testRoot{
+		bucketMap: make(map[string]map[string]string),
+		errs:      &errCont{},
+	}
+	client := &Client{
+		backend: &beRoot{
+			b2i: root,
+		},
+	}
+	bucket, err := client.NewBucket(ctx, bucketName, &BucketAttrs{Type: Private})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w := bucket.Object("one-chunk").NewWriter(ctx)
+	w.ChunkSize = 1e4
+	if _, err := w.Write(make([]byte, 1e4)); err != nil {
+		t.Fatal(err)
+	}
+	w.Flush()
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if root.started != 0 {
+		t.Error("one chunk was uploaded as a large file")
+	}
+}
+
+func TestHostTrackerSlow(t *testing.T) {
+	var ht hostTracker
+	for i := 0; i < minHostSamples; i++ {
+		ht.record("a", 1e3, time.Millisecond, nil)
+		ht.record("b", 1e4, 10*time.Millisecond, nil)
+		if i < minHostSamples-1 {
+			ht.record("c", 1e3, 10*time.Millisecond, nil)
+		}
+	}
+	if ht.slow("c", 4, time.Minute) {
+		t.Error("c is slow after too few uploads")
+	}
+	ht.record("c", 1e3, 10*time.Millisecond, nil)
+	ht.record("c", 1e3, 0, errors.New("failed"))
+	for _, e := range []struct {
+		host   string
+		factor float64
+		want   bool
+	}{
+		{host: "a", factor: 4},
+		{host: "b", factor: 4},
+		{host: "c", factor: 4, want: true},
+		{host: "c", factor: 20},
+		{host: "c", factor: 0},
+		{host: "d", factor: 4},
+	} {
+		if got := ht.slow(e.host, e.factor, time.Minute); got != e.want {
+			t.Errorf("slow(%q, %v): got %v, want %v", e.host, e.factor, got, e.want)
+		}
+	}
+	stats := ht.stats(3, time.Minute, 4)
+	if !stats["c"].Slow || stats["a"].Slow || stats["c"].Failing {
+		t.Errorf("stats: got %+v, want only c slow", stats)
+	}
+	// The samples age out of the window.
+	time.Sleep(10 * time.Millisecond)
+	if ht.slow("c", 4, 5*time.Millisecond) {
+		t.Error("c is still slow after its samples left the window")
+	}
+}
+
+// TestWriterReplacesSlowHost checks that upload threads with no part waiting
+// swap their URLs for a slow host for new ones.
+func TestWriterReplacesSlowHost(t *testing.T) {
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	root := &testRoot{
+		bucketMap: make(map[string]map[string]string),
+		errs:      &errCont{},
+		partHosts: []string{"fast1", "slow", "fast2"},
+		slowHost:  "slow",
+	}
+	client := &Client{
+		backend: &beRoot{
+			b2i: root,
+		},
+	}
+	bucket, err := client.NewBucket(ctx, bucketName, &BucketAttrs{Type: Private})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w := bucket.Object("hosts").NewWriter(ctx)
+	w.ChunkSize = 1e4
+	w.ConcurrentUploads = 3
+	h := sha1.New()
+	mw := io.MultiWriter(w, h)
+	// The parts come slowly enough that the threads are often idle.
+	for i := 0; i < 60; i++ {
+		if _, err := io.Copy(mw, io.LimitReader(zReader{}, 1e4)); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := readFile(ctx, bucket.Object("hosts"), fmt.Sprintf("%x", h.Sum(nil)), 1e5, 3); err != nil {
+		t.Error(err)
+	}
+	gmux.Lock()
+	defer gmux.Unlock()
+	if root.partURLs <= w.ConcurrentUploads {
+		t.Errorf("got %d upload part URLs, want more than one per thread", root.partURLs)
+	}
+	// The slow host keeps its thread until it has been judged slow, and the
+	// thread is next idle; after that, it is replaced whenever it is handed out.
+	if n := root.hostParts["slow"]; n > 2*minHostSamples {
+		t.Errorf("slow host sent %d parts, want at most %d", n, 2*minHostSamples)
+	}
+}
+
+// TestWriterSmallChunks checks that, with a ChunkSize below the minimum part
+// size, a stream of several chunks but shorter than the minimum is uploaded
+// as a simple file, and a longer one as a large file.
+func TestWriterSmallChunks(t *testing.T) {
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	root := &testRoot{
+		bucketMap: make(map[string]map[string]string),
+		errs:      &errCont{},
+		minPart:   1e5,
+	}
+	client := &Client{
+		backend: &beRoot{
+			b2i: root,
+		},
+	}
+	bucket, err := client.NewBucket(ctx, bucketName, &BucketAttrs{Type: Private})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	table := []struct {
+		name  string
+		size  int64
+		large bool
+	}{
+		{name: "under", size: 5e4 + 7},
+		{name: "exact", size: 1e5},
+		{name: "over", size: 2e5 + 7, large: true},
+	}
+	for _, e := range table {
+		for _, seekable := range []bool{false, true} {
+			started := root.started
+			data := make([]byte, e.size)
+			for i := range data {
+				data[i] = byte(i * 7 / 3)
+			}
+			var r io.Reader = bytes.NewReader(data)
+			if !seekable {
+				r = io.LimitReader(r, e.size)
+			}
+			w := bucket.Object(e.name).NewWriter(ctx)
+			w.ChunkSize = 1e4
+			if _, err := w.ReadFrom(r); err != nil {
+				t.Fatal(err)
+			}
+			if err := w.Close(); err != nil {
+				t.Fatal(err)
+			}
+			if large := root.started > started; large != e.large {
+				t.Errorf("%s (seekable %v): large file: got %v, want %v", e.name, seekable, large, e.large)
+			}
+			if err := readFile(ctx, bucket.Object(e.name), fmt.Sprintf("%x", sha1.Sum(data)), 1e4, 3); err != nil {
+				t.Errorf("%s (seekable %v): %v", e.name, seekable, err)
+			}
+		}
+	}
+}
+
+func TestObjectURL(t *testing.T) {
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	client := &Client{
+		backend: &beRoot{
+			b2i: &testRoot{
+				bucketMap: make(map[string]map[string]string),
+				errs:      &errCont{},
+			},
+		},
+	}
+	bucket, err := client.NewBucket(ctx, bucketName, &BucketAttrs{Type: Private})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// As generated by the B2 web console.
+	table := []struct {
+		name, want string
+	}{
+		{
+			name: "plain.txt",
+			want: "https://f001.backblazeb2.com/file/b2-tests/plain.txt",
+		},
+		{
+			name: "with spaces/and+plus.txt",
+			want: "https://f001.backblazeb2.com/file/b2-tests/with+spaces/and%2Bplus.txt",
+		},
+		{
+			name: "ünïcödé/日本語.txt",
+			want: "https://f001.backblazeb2.com/file/b2-tests/%C3%BCn%C3%AFc%C3%B6d%C3%A9/%E6%97%A5%E6%9C%AC%E8%AA%9E.txt",
+		},
+		{
+			name: "what?&=#%.txt",
+			want: "https://f001.backblazeb2.com/file/b2-tests/what%3F%26%3D%23%25.txt",
+		},
+	}
+
+	for _, e := range table {
+		obj := bucket.Object(e.name)
+		got := obj.URL()
+		if got != e.want {
+			t.Errorf("URL(%q): got %q, want %q", e.name, got, e.want)
+		}
+		u, err := url.Parse(got)
+		if err != nil {
+			t.Errorf("URL(%q): %v", e.name, err)
+			continue
+		}
+		name, err := url.QueryUnescape(strings.TrimPrefix(u.EscapedPath(), "/file/"+bucketName+"/"))
+		if err != nil {
+			t.Errorf("URL(%q): %v", e.name, err)
+			continue
+		}
+		if name != e.name {
+			t.Errorf("URL(%q): round trip: got %q", e.name, name)
+		}
+
+		got, err = obj.DownloadURL(ctx, 0, "attachment; filename=x.txt")
+		if err != nil {
+			t.Errorf("DownloadURL(%q): %v", e.name, err)
+			continue
+		}
+		if want := e.want + "?b2ContentDisposition=attachment%3B+filename%3Dx.txt"; got != want {
+			t.Errorf("DownloadURL(%q): got %q, want %q", e.name, got, want)
+		}
+
+		got, err = obj.DownloadURL(ctx, time.Hour, "")
+		if err != nil {
+			t.Errorf("DownloadURL(%q): %v", e.name, err)
+			continue
+		}
+		if want := e.want + "?Authorization=" + url.QueryEscape("token/"+e.name); got != want {
+			t.Errorf("DownloadURL(%q): got %q, want %q", e.name, got, want)
+		}
+	}
+}
+
+func TestFileBuffer(t *testing.T) {
+	r := io.LimitReader(zReader{}, 1e8)
+	w, err := newFileBuffer("", sha1.New)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	if _, err := io.Copy(w, r); err != nil {
+		t.Fatal(err)
+	}
+	bReader, err := w.Reader()
+	if err != nil {
+		t.Fatal(err)
+	}
+	hsh := sha1.New()
+	if _, err := io.Copy(hsh, bReader); err != nil {
+		t.Fatal(err)
+	}
+	hshText := fmt.Sprintf("%x", hsh.Sum(nil))
+	if hshText != w.Hash() {
+		t.Errorf("hashes are not equal: bufferWriter is %q, read buffer is %q", w.Hash(), hshText)
+	}
+}
+
+func TestNonBuffer(t *testing.T) {
 	table := []struct {
 		str  string
 		off  int64
@@ -857,7 +1994,7 @@ func TestNonBuffer(t *testing.T) {
 	}
 
 	for _, e := range table {
-		nb := newNonBuffer(strings.NewReader(e.str), e.off, e.len)
+		nb := newNonBuffer(strings.NewReader(e.str), e.off, e.len, "", sha1.New)
 		want := fmt.Sprintf("%s%x", e.want, sha1.Sum([]byte(e.str[int(e.off):int(e.off+e.len)])))
 		r, err := nb.Reader()
 		if err != nil {
@@ -913,3 +2050,89 @@ func readFile(ctx context.Context, obj *Object, sha string, chunk, concur int) e
 	}
 	return nil
 }
+
+func TestNamePaths(t *testing.T) {
+	for _, sep := range []byte{'/', '\\'} {
+		local := func(s string) string { return strings.Replace(s, "/", string(sep), -1) }
+		for _, name := range []string{"a", "photos/2016/a.jpg", "with space/x.y"} {
+			p, err := pathFromName(name, sep)
+			if err != nil {
+				t.Errorf("pathFromName(%q, %q): %v", name, sep, err)
+				continue
+			}
+			if p != local(name) {
+				t.Errorf("pathFromName(%q, %q): got %q, want %q", name, sep, p, local(name))
+			}
+			back, err := nameFromPath(p, sep, "")
+			if err != nil {
+				t.Errorf("nameFromPath(%q, %q): %v", p, sep, err)
+				continue
+			}
+			if back != name {
+				t.Errorf("nameFromPath(%q, %q): got %q, want %q", p, sep, back, name)
+			}
+		}
+		for _, name := range []string{"", "/abs", "a//b", "a/", "../up", "a/./b", `back\slash`} {
+			if p, err := pathFromName(name, sep); err == nil {
+				t.Errorf("pathFromName(%q, %q): got %q, want error", name, sep, p)
+			}
+		}
+		for _, p := range []string{"", local("/abs"), local("a/../../b")} {
+			if name, err := nameFromPath(p, sep, ""); err == nil {
+				t.Errorf("nameFromPath(%q, %q): got %q, want error", p, sep, name)
+			}
+		}
+	}
+
+	// On hosts that separate with '/', a backslash is part of a file name, and
+	// would be read back as a separator on Windows.
+	if name, err := nameFromPath(`photos\2016`, '/', ""); err == nil {
+		t.Errorf(`nameFromPath("photos\\2016", '/'): got %q, want error`, name)
+	}
+	// On Windows, both separators are accepted.
+	if name, err := nameFromPath(`photos\2016/a.jpg`, '\\', ""); err != nil || name != "photos/2016/a.jpg" {
+		t.Errorf(`nameFromPath("photos\\2016/a.jpg", '\\'): got %q, %v, want "photos/2016/a.jpg"`, name, err)
+	}
+	if name, err := nameFromPath(`C:\photos`, '\\', "C:"); err == nil {
+		t.Errorf(`nameFromPath("C:\\photos", '\\'): got %q, want error`, name)
+	}
+}
+
+// stubHash is a "hash" that does no work, standing in for a fast
+// implementation.
+type stubHash struct{}
+
+func (stubHash) Write(p []byte) (int, error) { return len(p), nil }
+func (stubHash) Sum(b []byte) []byte         { return append(b, make([]byte, sha1.Size)...) }
+func (stubHash) Reset()                      {}
+func (stubHash) Size() int                   { return sha1.Size }
+func (stubHash) BlockSize() int              { return sha1.BlockSize }
+
+// BenchmarkHashFunc buffers parts as the Writer does.  The default and
+// HashFunc(sha1.New) should match, and the stub shows what is left once
+// hashing is free.
+func BenchmarkHashFunc(b *testing.B) {
+	data := make([]byte, 8e6)
+	for _, e := range []struct {
+		name string
+		opts []ClientOption
+	}{
+		{name: "default"},
+		{name: "sha1", opts: []ClientOption{HashFunc(sha1.New)}},
+		{name: "stub", opts: []ClientOption{HashFunc(func() hash.Hash { return stubHash{} })}},
+	} {
+		var o clientOptions
+		for _, opt := range e.opts {
+			opt(&o)
+		}
+		b.Run(e.name, func(b *testing.B) {
+			b.SetBytes(int64(len(data)))
+			for i := 0; i < b.N; i++ {
+				mb := newMemoryBuffer(o.newHash)
+				mb.Write(data)
+				mb.Hash()
+				mb.Close()
+			}
+		})
+	}
+}
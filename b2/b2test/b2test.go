@@ -0,0 +1,1175 @@
+// Copyright 2018, the Blazer authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package b2test provides an in-memory implementation of the B2 API, for
+// testing code that uses package b2 without network access or a Backblaze
+// account.
+//
+// Code under test continues to use *b2.Client, *b2.Bucket, and *b2.Object;
+// only the client is constructed differently:
+//
+//	srv := b2test.NewServer()
+//	defer srv.Close()
+//	client, err := srv.NewClient(ctx)
+//
+// The server supports buckets, simple and large file uploads, downloads by
+// name or ID (including ranges), listing, hiding, copying, and deleting file versions.
+// Like B2, it fails some uploads when clients are created with
+// b2.FailSomeUploads.  It does not enforce part size minimums, application key
+// capabilities, or lifecycle rules.
+//
+// Tests can also be run against the real service; see LiveClient and
+// TempBucket.
+package b2test
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kurin/blazer/b2"
+	"github.com/kurin/blazer/internal/b2types"
+)
+
+const (
+	accountID = "b2test-account"
+	authToken = "b2test-token"
+
+	uploadFilePath = b2types.V1api + "b2_upload_file/"
+	uploadPartPath = b2types.V1api + "b2_upload_part/"
+)
+
+// Server is an in-memory B2 service.  Its zero value is not usable; call
+// NewServer.
+type Server struct {
+	srv *httptest.Server
+
+	mu      sync.Mutex
+	buckets map[string]*bucket // by id
+	files   map[string]*file   // by id, in all buckets
+	dlAuth  map[string]dlAuth  // download authorization tokens
+	nextID  int
+	stamp   b2types.Millis
+	uploads int // count of uploads in fail_some_uploads mode
+
+	rtt       time.Duration // see SimulateNetwork
+	bandwidth int64
+
+	denyDownloads bool // see DenyDownloads
+}
+
+type bucket struct {
+	id, name, typ string
+	info          map[string]string
+	rules         []b2types.LifecycleRule
+	revision      int
+}
+
+type file struct {
+	id, name, bucket string
+	ctype, sha1      string
+	info             map[string]string
+	data             []byte
+	action           string // "upload", "hide", or "start"
+	stamp            b2types.Millis
+	parts            map[int]part // for unfinished large files
+}
+
+type part struct {
+	sha1 string
+	data []byte
+}
+
+type dlAuth struct {
+	bucket, prefix, b2cd string
+	expires              time.Time
+}
+
+// NewServer starts and returns a new, empty server.  Callers should call Close
+// when finished.
+func NewServer() *Server {
+	s := &Server{
+		buckets: make(map[string]*bucket),
+		files:   make(map[string]*file),
+		dlAuth:  make(map[string]dlAuth),
+	}
+	s.srv = httptest.NewServer(s)
+	return s
+}
+
+// URL returns the base URL of the server, suitable for b2.APIBase.
+func (s *Server) URL() string { return s.srv.URL }
+
+// Close shuts down the server.
+func (s *Server) Close() { s.srv.Close() }
+
+// NewClient returns a b2.Client that talks to the server.  Any account ID and
+// key are accepted, so none are required.
+func (s *Server) NewClient(ctx context.Context, opts ...b2.ClientOption) (*b2.Client, error) {
+	opts = append(opts, b2.APIBase(s.URL()))
+	return b2.NewClient(ctx, accountID, "b2test-key", opts...)
+}
+
+type apiError struct {
+	status int
+	code   string
+	msg    string
+}
+
+func (e apiError) Error() string { return e.msg }
+
+func badRequest(format string, args ...interface{}) error {
+	return apiError{status: 400, code: "bad_request", msg: fmt.Sprintf(format, args...)}
+}
+
+func notFound(format string, args ...interface{}) error {
+	return apiError{status: 404, code: "not_found", msg: fmt.Sprintf(format, args...)}
+}
+
+func writeError(rw http.ResponseWriter, err error) {
+	e, ok := err.(apiError)
+	if !ok {
+		e = apiError{status: 500, code: "internal_error", msg: err.Error()}
+	}
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(e.status)
+	json.NewEncoder(rw).Encode(&b2types.ErrorMessage{
+		Status: e.status,
+		Code:   e.code,
+		Msg:    e.msg,
+	})
+}
+
+// SimulateNetwork makes the server behave as if it were further away: every
+// request is delayed by rtt, and request bodies arrive at no more than
+// bandwidth bytes per second per connection.  Zero values disable either
+// effect.  This is intended for benchmarks.
+func (s *Server) SimulateNetwork(rtt time.Duration, bandwidth int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.rtt = rtt
+	s.bandwidth = bandwidth
+}
+
+// DenyDownloads makes the server refuse every download made with the account
+// token, as B2 does for keys without the readFiles capability.  Like B2's,
+// the refusal of a HEAD request has no body.
+func (s *Server) DenyDownloads(deny bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.denyDownloads = deny
+}
+
+// CorruptFile flips a bit in the stored contents of the file with the given
+// ID, leaving its recorded SHA1 alone, as though the data had been damaged at
+// rest.  It does nothing if there is no such file.
+func (s *Server) CorruptFile(id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if f, ok := s.files[id]; ok && len(f.data) > 0 {
+		f.data[0] ^= 1
+	}
+}
+
+// slowReader limits reads to bps bytes per second.
+type slowReader struct {
+	r     io.Reader
+	bps   int64
+	start time.Time
+	n     int64
+}
+
+func (r *slowReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.n += int64(n)
+	due := time.Duration(float64(r.n) / float64(r.bps) * float64(time.Second))
+	if d := due - time.Since(r.start); d > 0 {
+		time.Sleep(d)
+	}
+	return n, err
+}
+
+func (s *Server) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	rtt, bandwidth := s.rtt, s.bandwidth
+	s.mu.Unlock()
+	time.Sleep(rtt)
+	if bandwidth > 0 {
+		r.Body = ioutil.NopCloser(&slowReader{r: r.Body, bps: bandwidth, start: time.Now()})
+	}
+	if err := s.serve(rw, r); err != nil {
+		writeError(rw, err)
+	}
+}
+
+func (s *Server) serve(rw http.ResponseWriter, r *http.Request) error {
+	path := r.URL.Path
+	if strings.HasPrefix(path, "/file/") {
+		return s.download(rw, r)
+	}
+	if path == b2types.V1api+"b2_download_file_by_id" {
+		return s.downloadByID(rw, r)
+	}
+	if path == b2types.V1api+"b2_authorize_account" {
+		return s.authorizeAccount(rw, r)
+	}
+	if r.Header.Get("Authorization") != authToken {
+		return apiError{status: 401, code: "bad_auth_token", msg: "invalid authorization token"}
+	}
+	if strings.HasPrefix(path, uploadFilePath) || strings.HasPrefix(path, uploadPartPath) {
+		if err := s.failSomeUploads(r); err != nil {
+			return err
+		}
+		if err := forceCapExceeded(r); err != nil {
+			return err
+		}
+	}
+	switch {
+	case strings.HasPrefix(path, uploadFilePath):
+		return s.uploadFile(rw, r, strings.TrimPrefix(path, uploadFilePath))
+	case strings.HasPrefix(path, uploadPartPath):
+		return s.uploadPart(rw, r, strings.TrimPrefix(path, uploadPartPath))
+	}
+	h, ok := s.handlers()[strings.TrimPrefix(path, b2types.V1api)]
+	if !ok {
+		return badRequest("%s: unsupported", path)
+	}
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	resp, err := h(body)
+	s.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	return reply(rw, resp)
+}
+
+// autoType resolves the "b2/x-auto" content type from name's extension, as
+// B2 does.
+func autoType(ctype, name string) string {
+	if ctype != "b2/x-auto" {
+		return ctype
+	}
+	if t := mime.TypeByExtension(path.Ext(name)); t != "" {
+		return t
+	}
+	return "application/octet-stream"
+}
+
+// failSomeUploads fails every third upload from clients that ask for it, so
+// that their retry logic is exercised.
+func (s *Server) failSomeUploads(r *http.Request) error {
+	var fail bool
+	for _, mode := range r.Header["X-Bz-Test-Mode"] {
+		fail = fail || mode == "fail_some_uploads"
+	}
+	if !fail {
+		return nil
+	}
+	s.mu.Lock()
+	s.uploads++
+	n := s.uploads
+	s.mu.Unlock()
+	if n%3 != 0 {
+		return nil
+	}
+	io.Copy(ioutil.Discard, r.Body)
+	return apiError{status: 503, code: "service_unavailable", msg: "b2test: failing some uploads"}
+}
+
+// forceCapExceeded fails every upload from clients that ask for it, as though
+// the account had reached its storage cap.
+func forceCapExceeded(r *http.Request) error {
+	for _, mode := range r.Header["X-Bz-Test-Mode"] {
+		if mode == "force_cap_exceeded" {
+			io.Copy(ioutil.Discard, r.Body)
+			return apiError{status: 403, code: "storage_cap_exceeded", msg: "b2test: cap exceeded"}
+		}
+	}
+	return nil
+}
+
+func reply(rw http.ResponseWriter, resp interface{}) error {
+	rw.Header().Set("Content-Type", "application/json")
+	if resp == nil {
+		resp = struct{}{}
+	}
+	return json.NewEncoder(rw).Encode(resp)
+}
+
+// handlers maps API methods that take JSON arguments to their
+// implementations, which are called with s.mu held.
+func (s *Server) handlers() map[string]func([]byte) (interface{}, error) {
+	return map[string]func([]byte) (interface{}, error){
+		"b2_create_bucket":               s.createBucket,
+		"b2_delete_bucket":               s.deleteBucket,
+		"b2_update_bucket":               s.updateBucket,
+		"b2_list_buckets":                s.listBuckets,
+		"b2_get_upload_url":              s.getUploadURL,
+		"b2_delete_file_version":         s.deleteFileVersion,
+		"b2_hide_file":                   s.hideFile,
+		"b2_get_file_info":               s.getFileInfo,
+		"b2_list_file_names":             s.listFileNames,
+		"b2_list_file_versions":          s.listFileVersions,
+		"b2_copy_file":                   s.copyFile,
+		"b2_get_download_authorization":  s.getDownloadAuthorization,
+		"b2_start_large_file":            s.startLargeFile,
+		"b2_get_upload_part_url":         s.getUploadPartURL,
+		"b2_finish_large_file":           s.finishLargeFile,
+		"b2_cancel_large_file":           s.cancelLargeFile,
+		"b2_list_parts":                  s.listParts,
+		"b2_list_unfinished_large_files": s.listUnfinishedLargeFiles,
+	}
+}
+
+func (s *Server) newID(prefix string) string {
+	s.nextID++
+	return fmt.Sprintf("%s_b2test_%08d", prefix, s.nextID)
+}
+
+// now returns a strictly increasing timestamp in milliseconds, so that file
+// versions are well ordered.
+func (s *Server) now() b2types.Millis {
+	ms := b2types.ToMillis(time.Now())
+	if ms <= s.stamp {
+		ms = s.stamp + 1
+	}
+	s.stamp = ms
+	return ms
+}
+
+func (s *Server) authorizeAccount(rw http.ResponseWriter, r *http.Request) error {
+	if _, _, ok := r.BasicAuth(); !ok {
+		return apiError{status: 401, code: "unauthorized", msg: "missing credentials"}
+	}
+	return reply(rw, &b2types.AuthorizeAccountResponse{
+		AccountID:      accountID,
+		AuthToken:      authToken,
+		URI:            s.URL(),
+		DownloadURI:    s.URL(),
+		MinPartSize:    5e6,
+		PartSize:       1e8,
+		AbsMinPartSize: 1, // parts of any size are accepted
+		Allowed: b2types.Allowance{
+			Capabilities: []string{
+				"listKeys", "writeKeys", "deleteKeys", "listBuckets", "writeBuckets",
+				"deleteBuckets", "listFiles", "readFiles", "shareFiles", "writeFiles",
+				"deleteFiles",
+			},
+		},
+	})
+}
+
+func (s *Server) getBucket(id string) (*bucket, error) {
+	b, ok := s.buckets[id]
+	if !ok {
+		// This is what B2 returns.
+		return nil, badRequest("Bucket %s does not exist", id)
+	}
+	return b, nil
+}
+
+func bucketResponse(b *bucket) b2types.CreateBucketResponse {
+	return b2types.CreateBucketResponse{
+		BucketID:       b.id,
+		Name:           b.name,
+		Type:           b.typ,
+		Info:           b.info,
+		LifecycleRules: b.rules,
+		Revision:       b.revision,
+	}
+}
+
+func (s *Server) createBucket(body []byte) (interface{}, error) {
+	req := &b2types.CreateBucketRequest{}
+	if err := json.Unmarshal(body, req); err != nil {
+		return nil, badRequest("%v", err)
+	}
+	for _, b := range s.buckets {
+		if b.name == req.Name {
+			return nil, apiError{status: 400, code: "duplicate_bucket_name", msg: "Bucket name is already in use."}
+		}
+	}
+	if req.Type != "allPrivate" && req.Type != "allPublic" {
+		return nil, badRequest("invalid bucket type %q", req.Type)
+	}
+	b := &bucket{
+		id:       s.newID("b"),
+		name:     req.Name,
+		typ:      req.Type,
+		info:     req.Info,
+		rules:    req.LifecycleRules,
+		revision: 1,
+	}
+	s.buckets[b.id] = b
+	resp := bucketResponse(b)
+	return &resp, nil
+}
+
+func (s *Server) deleteBucket(body []byte) (interface{}, error) {
+	req := &b2types.DeleteBucketRequest{}
+	if err := json.Unmarshal(body, req); err != nil {
+		return nil, badRequest("%v", err)
+	}
+	b, err := s.getBucket(req.BucketID)
+	if err != nil {
+		return nil, err
+	}
+	for _, f := range s.files {
+		if f.bucket == b.id {
+			return nil, badRequest("Cannot delete non-empty bucket")
+		}
+	}
+	delete(s.buckets, b.id)
+	resp := bucketResponse(b)
+	return &resp, nil
+}
+
+func (s *Server) updateBucket(body []byte) (interface{}, error) {
+	req := &b2types.UpdateBucketRequest{}
+	if err := json.Unmarshal(body, req); err != nil {
+		return nil, badRequest("%v", err)
+	}
+	b, err := s.getBucket(req.BucketID)
+	if err != nil {
+		return nil, err
+	}
+	if req.IfRevisionIs != 0 && req.IfRevisionIs != b.revision {
+		return nil, apiError{status: 409, code: "conflict", msg: "revision number mismatch"}
+	}
+	if req.Type != "" {
+		b.typ = req.Type
+	}
+	if req.Info != nil {
+		b.info = req.Info
+	}
+	if req.LifecycleRules != nil {
+		b.rules = req.LifecycleRules
+	}
+	b.revision++
+	resp := bucketResponse(b)
+	return &resp, nil
+}
+
+func (s *Server) listBuckets(body []byte) (interface{}, error) {
+	req := &b2types.ListBucketsRequest{}
+	if err := json.Unmarshal(body, req); err != nil {
+		return nil, badRequest("%v", err)
+	}
+	resp := &b2types.ListBucketsResponse{}
+	for _, b := range s.buckets {
+		if req.Bucket != "" && req.Bucket != b.id {
+			continue
+		}
+		if req.Name != "" && req.Name != b.name {
+			continue
+		}
+		resp.Buckets = append(resp.Buckets, bucketResponse(b))
+	}
+	sort.Slice(resp.Buckets, func(i, j int) bool { return resp.Buckets[i].Name < resp.Buckets[j].Name })
+	return resp, nil
+}
+
+func (s *Server) getUploadURL(body []byte) (interface{}, error) {
+	req := &b2types.GetUploadURLRequest{}
+	if err := json.Unmarshal(body, req); err != nil {
+		return nil, badRequest("%v", err)
+	}
+	if _, err := s.getBucket(req.BucketID); err != nil {
+		return nil, err
+	}
+	return &b2types.GetUploadURLResponse{
+		URI:   s.URL() + uploadFilePath + req.BucketID,
+		Token: authToken,
+	}, nil
+}
+
+// readUpload reads the body of an upload request, and verifies its SHA1.
+func readUpload(r *http.Request) ([]byte, string, error) {
+	data, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return nil, "", err
+	}
+	if int64(len(data)) != r.ContentLength {
+		return nil, "", badRequest("got %d bytes, want %d", len(data), r.ContentLength)
+	}
+	want := r.Header.Get("X-Bz-Content-Sha1")
+	if want == "hex_digits_at_end" {
+		if len(data) < 40 {
+			return nil, "", badRequest("missing trailing SHA1")
+		}
+		want = string(data[len(data)-40:])
+		data = data[:len(data)-40]
+	}
+	got := fmt.Sprintf("%x", sha1.Sum(data))
+	if want != "do_not_verify" && got != want {
+		return nil, "", badRequest("sha1 did not match data received")
+	}
+	return data, got, nil
+}
+
+func (s *Server) uploadFile(rw http.ResponseWriter, r *http.Request, bucketID string) error {
+	name, err := url.QueryUnescape(r.Header.Get("X-Bz-File-Name"))
+	if err != nil {
+		return badRequest("%v", err)
+	}
+	info := make(map[string]string)
+	for k := range r.Header {
+		if !strings.HasPrefix(k, "X-Bz-Info-") {
+			continue
+		}
+		key, err := url.QueryUnescape(strings.TrimPrefix(k, "X-Bz-Info-"))
+		if err != nil {
+			return badRequest("%v", err)
+		}
+		val, err := url.QueryUnescape(r.Header.Get(k))
+		if err != nil {
+			return badRequest("%v", err)
+		}
+		info[strings.ToLower(key)] = val
+	}
+	data, sum, err := readUpload(r)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, err := s.getBucket(bucketID); err != nil {
+		return err
+	}
+	f := &file{
+		id:     s.newID("f"),
+		name:   name,
+		bucket: bucketID,
+		ctype:  autoType(r.Header.Get("Content-Type"), name),
+		sha1:   sum,
+		info:   info,
+		data:   data,
+		action: "upload",
+		stamp:  s.now(),
+	}
+	s.files[f.id] = f
+	return reply(rw, fileResponse(f))
+}
+
+func fileResponse(f *file) *b2types.GetFileInfoResponse {
+	return &b2types.GetFileInfoResponse{
+		FileID:      f.id,
+		Name:        f.name,
+		AccountID:   accountID,
+		BucketID:    f.bucket,
+		Size:        int64(len(f.data)),
+		SHA1:        f.sha1,
+		ContentType: f.ctype,
+		Info:        f.info,
+		Action:      f.action,
+		Timestamp:   f.stamp,
+	}
+}
+
+func (s *Server) getFile(id string) (*file, error) {
+	f, ok := s.files[id]
+	if !ok {
+		return nil, badRequest("Invalid fileId: %s", id)
+	}
+	return f, nil
+}
+
+func (s *Server) deleteFileVersion(body []byte) (interface{}, error) {
+	req := &b2types.DeleteFileVersionRequest{}
+	if err := json.Unmarshal(body, req); err != nil {
+		return nil, badRequest("%v", err)
+	}
+	f, err := s.getFile(req.FileID)
+	if err != nil {
+		return nil, err
+	}
+	if f.name != req.Name {
+		return nil, badRequest("File not present: %s %s", req.Name, req.FileID)
+	}
+	delete(s.files, f.id)
+	return req, nil
+}
+
+func (s *Server) hideFile(body []byte) (interface{}, error) {
+	req := &b2types.HideFileRequest{}
+	if err := json.Unmarshal(body, req); err != nil {
+		return nil, badRequest("%v", err)
+	}
+	if _, err := s.getBucket(req.BucketID); err != nil {
+		return nil, err
+	}
+	f := &file{
+		id:     s.newID("f"),
+		name:   req.File,
+		bucket: req.BucketID,
+		action: "hide",
+		stamp:  s.now(),
+	}
+	s.files[f.id] = f
+	return &b2types.HideFileResponse{
+		ID:        f.id,
+		Timestamp: f.stamp,
+		Action:    f.action,
+	}, nil
+}
+
+func (s *Server) getFileInfo(body []byte) (interface{}, error) {
+	req := &b2types.GetFileInfoRequest{}
+	if err := json.Unmarshal(body, req); err != nil {
+		return nil, badRequest("%v", err)
+	}
+	f, err := s.getFile(req.ID)
+	if err != nil {
+		return nil, err
+	}
+	return fileResponse(f), nil
+}
+
+// versions returns every version of every file in the bucket whose name
+// begins with prefix, ordered as B2 orders them: by name, and then from newest
+// to oldest.
+func (s *Server) versions(bucketID, prefix string) []*file {
+	var fs []*file
+	for _, f := range s.files {
+		if f.bucket == bucketID && strings.HasPrefix(f.name, prefix) {
+			fs = append(fs, f)
+		}
+	}
+	sort.Slice(fs, func(i, j int) bool {
+		if fs[i].name != fs[j].name {
+			return fs[i].name < fs[j].name
+		}
+		return fs[i].stamp > fs[j].stamp
+	})
+	return fs
+}
+
+// collapse replaces the files whose names contain delimiter after prefix with
+// a single "folder" entry.
+func collapse(fs []*file, prefix, delimiter string) []*file {
+	if delimiter == "" {
+		return fs
+	}
+	var out []*file
+	for _, f := range fs {
+		i := strings.Index(f.name[len(prefix):], delimiter)
+		if i < 0 {
+			out = append(out, f)
+			continue
+		}
+		dir := f.name[:len(prefix)+i+len(delimiter)]
+		if len(out) > 0 && out[len(out)-1].name == dir {
+			continue
+		}
+		out = append(out, &file{name: dir, bucket: f.bucket, action: "folder"})
+	}
+	return out
+}
+
+func pageSize(count int) int {
+	if count <= 0 {
+		return 100
+	}
+	if count > 10000 {
+		return 10000
+	}
+	return count
+}
+
+func (s *Server) listFileNames(body []byte) (interface{}, error) {
+	req := &b2types.ListFileNamesRequest{}
+	if err := json.Unmarshal(body, req); err != nil {
+		return nil, badRequest("%v", err)
+	}
+	if _, err := s.getBucket(req.BucketID); err != nil {
+		return nil, err
+	}
+	var latest []*file
+	for _, f := range s.versions(req.BucketID, req.Prefix) {
+		if len(latest) > 0 && latest[len(latest)-1].name == f.name {
+			continue
+		}
+		if f.action == "start" {
+			continue
+		}
+		latest = append(latest, f)
+	}
+	var visible []*file
+	for _, f := range latest {
+		if f.action == "upload" {
+			visible = append(visible, f)
+		}
+	}
+	fs := collapse(visible, req.Prefix, req.Delimiter)
+	i := sort.Search(len(fs), func(i int) bool { return fs[i].name >= req.Continuation })
+	fs = fs[i:]
+	resp := &b2types.ListFileNamesResponse{Files: []b2types.GetFileInfoResponse{}}
+	if n := pageSize(req.Count); len(fs) > n {
+		resp.Continuation = fs[n].name
+		fs = fs[:n]
+	}
+	for _, f := range fs {
+		resp.Files = append(resp.Files, *fileResponse(f))
+	}
+	return resp, nil
+}
+
+func (s *Server) listFileVersions(body []byte) (interface{}, error) {
+	req := &b2types.ListFileVersionsRequest{}
+	if err := json.Unmarshal(body, req); err != nil {
+		return nil, badRequest("%v", err)
+	}
+	if _, err := s.getBucket(req.BucketID); err != nil {
+		return nil, err
+	}
+	fs := collapse(s.versions(req.BucketID, req.Prefix), req.Prefix, req.Delimiter)
+	i := sort.Search(len(fs), func(i int) bool { return fs[i].name >= req.StartName })
+	if req.StartID != "" {
+		for j := i; j < len(fs) && fs[j].name == req.StartName; j++ {
+			if fs[j].id == req.StartID {
+				i = j
+				break
+			}
+		}
+	}
+	fs = fs[i:]
+	resp := &b2types.ListFileVersionsResponse{Files: []b2types.GetFileInfoResponse{}}
+	if n := pageSize(req.Count); len(fs) > n {
+		resp.NextName = fs[n].name
+		resp.NextID = fs[n].id
+		fs = fs[:n]
+	}
+	for _, f := range fs {
+		resp.Files = append(resp.Files, *fileResponse(f))
+	}
+	return resp, nil
+}
+
+func (s *Server) copyFile(body []byte) (interface{}, error) {
+	req := &b2types.CopyFileRequest{}
+	if err := json.Unmarshal(body, req); err != nil {
+		return nil, badRequest("%v", err)
+	}
+	src, err := s.getFile(req.SourceID)
+	if err != nil {
+		return nil, err
+	}
+	if src.action != "upload" {
+		return nil, badRequest("%s: not a file", req.SourceID)
+	}
+	dst := req.DestBucketID
+	if dst == "" {
+		dst = src.bucket
+	}
+	if _, err := s.getBucket(dst); err != nil {
+		return nil, err
+	}
+	f := &file{
+		id:     s.newID("f"),
+		name:   req.Name,
+		bucket: dst,
+		ctype:  src.ctype,
+		sha1:   src.sha1,
+		info:   src.info,
+		data:   src.data,
+		action: "upload",
+		stamp:  s.now(),
+	}
+	if req.MetadataDirective == "REPLACE" {
+		f.ctype = autoType(req.ContentType, req.Name)
+		f.info = req.Info
+	}
+	s.files[f.id] = f
+	return fileResponse(f), nil
+}
+
+func (s *Server) getDownloadAuthorization(body []byte) (interface{}, error) {
+	req := &b2types.GetDownloadAuthorizationRequest{}
+	if err := json.Unmarshal(body, req); err != nil {
+		return nil, badRequest("%v", err)
+	}
+	if _, err := s.getBucket(req.BucketID); err != nil {
+		return nil, err
+	}
+	token := s.newID("d")
+	s.dlAuth[token] = dlAuth{
+		bucket:  req.BucketID,
+		prefix:  req.Prefix,
+		b2cd:    req.ContentDisposition,
+		expires: time.Now().Add(time.Duration(req.Valid) * time.Second),
+	}
+	return &b2types.GetDownloadAuthorizationResponse{
+		BucketID: req.BucketID,
+		Prefix:   req.Prefix,
+		Token:    token,
+	}, nil
+}
+
+func (s *Server) startLargeFile(body []byte) (interface{}, error) {
+	req := &b2types.StartLargeFileRequest{}
+	if err := json.Unmarshal(body, req); err != nil {
+		return nil, badRequest("%v", err)
+	}
+	if _, err := s.getBucket(req.BucketID); err != nil {
+		return nil, err
+	}
+	f := &file{
+		id:     s.newID("f"),
+		name:   req.Name,
+		bucket: req.BucketID,
+		ctype:  autoType(req.ContentType, req.Name),
+		sha1:   "none",
+		info:   req.Info,
+		action: "start",
+		stamp:  s.now(),
+		parts:  make(map[int]part),
+	}
+	s.files[f.id] = f
+	return &b2types.StartLargeFileResponse{ID: f.id}, nil
+}
+
+func (s *Server) getLargeFile(id string) (*file, error) {
+	f, err := s.getFile(id)
+	if err != nil {
+		return nil, err
+	}
+	if f.action != "start" {
+		return nil, badRequest("%s: large file is not in progress", id)
+	}
+	return f, nil
+}
+
+func (s *Server) getUploadPartURL(body []byte) (interface{}, error) {
+	req := &b2types.CancelLargeFileRequest{} // same shape: {"fileId": ...}
+	if err := json.Unmarshal(body, req); err != nil {
+		return nil, badRequest("%v", err)
+	}
+	if _, err := s.getLargeFile(req.ID); err != nil {
+		return nil, err
+	}
+	return &b2types.GetUploadURLResponse{
+		URI:   s.URL() + uploadPartPath + req.ID,
+		Token: authToken,
+	}, nil
+}
+
+func (s *Server) uploadPart(rw http.ResponseWriter, r *http.Request, id string) error {
+	n, err := strconv.Atoi(r.Header.Get("X-Bz-Part-Number"))
+	if err != nil || n < 1 || n > 10000 {
+		return badRequest("invalid part number %q", r.Header.Get("X-Bz-Part-Number"))
+	}
+	data, sum, err := readUpload(r)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	f, err := s.getLargeFile(id)
+	if err != nil {
+		return err
+	}
+	f.parts[n] = part{sha1: sum, data: data}
+	return reply(rw, map[string]interface{}{
+		"fileId":        id,
+		"partNumber":    n,
+		"contentLength": len(data),
+		"contentSha1":   sum,
+	})
+}
+
+func (s *Server) finishLargeFile(body []byte) (interface{}, error) {
+	req := &b2types.FinishLargeFileRequest{}
+	if err := json.Unmarshal(body, req); err != nil {
+		return nil, badRequest("%v", err)
+	}
+	f, err := s.getLargeFile(req.ID)
+	if err != nil {
+		return nil, err
+	}
+	if len(req.Hashes) != len(f.parts) {
+		return nil, badRequest("got %d part hashes, but %d parts were uploaded", len(req.Hashes), len(f.parts))
+	}
+	var data []byte
+	for i, sum := range req.Hashes {
+		p, ok := f.parts[i+1]
+		if !ok {
+			return nil, badRequest("part %d is missing", i+1)
+		}
+		if p.sha1 != sum {
+			return nil, badRequest("part %d: sha1 mismatch", i+1)
+		}
+		data = append(data, p.data...)
+	}
+	f.data = data
+	f.parts = nil
+	f.action = "upload"
+	return &b2types.FinishLargeFileResponse{
+		Name:        f.name,
+		FileID:      f.id,
+		Timestamp:   f.stamp,
+		Action:      f.action,
+		Size:        int64(len(f.data)),
+		ContentType: f.ctype,
+		SHA1:        f.sha1,
+		Info:        f.info,
+	}, nil
+}
+
+func (s *Server) cancelLargeFile(body []byte) (interface{}, error) {
+	req := &b2types.CancelLargeFileRequest{}
+	if err := json.Unmarshal(body, req); err != nil {
+		return nil, badRequest("%v", err)
+	}
+	f, err := s.getLargeFile(req.ID)
+	if err != nil {
+		return nil, err
+	}
+	delete(s.files, f.id)
+	return map[string]string{
+		"fileId":    f.id,
+		"fileName":  f.name,
+		"bucketId":  f.bucket,
+		"accountId": accountID,
+	}, nil
+}
+
+func (s *Server) listParts(body []byte) (interface{}, error) {
+	req := &b2types.ListPartsRequest{}
+	if err := json.Unmarshal(body, req); err != nil {
+		return nil, badRequest("%v", err)
+	}
+	f, err := s.getLargeFile(req.ID)
+	if err != nil {
+		return nil, err
+	}
+	var nums []int
+	for n := range f.parts {
+		if n >= req.Start {
+			nums = append(nums, n)
+		}
+	}
+	sort.Ints(nums)
+	resp := &b2types.ListPartsResponse{}
+	if n := pageSize(req.Count); len(nums) > n {
+		resp.Next = nums[n]
+		nums = nums[:n]
+	}
+	for _, n := range nums {
+		p := f.parts[n]
+		resp.Parts = append(resp.Parts, struct {
+			ID     string `json:"fileId"`
+			Number int    `json:"partNumber"`
+			SHA1   string `json:"contentSha1"`
+			Size   int64  `json:"contentLength"`
+		}{ID: f.id, Number: n, SHA1: p.sha1, Size: int64(len(p.data))})
+	}
+	return resp, nil
+}
+
+func (s *Server) listUnfinishedLargeFiles(body []byte) (interface{}, error) {
+	req := &b2types.ListUnfinishedLargeFilesRequest{}
+	if err := json.Unmarshal(body, req); err != nil {
+		return nil, badRequest("%v", err)
+	}
+	if _, err := s.getBucket(req.BucketID); err != nil {
+		return nil, err
+	}
+	var fs []*file
+	for _, f := range s.files {
+		if f.bucket == req.BucketID && f.action == "start" && f.id >= req.Continuation {
+			fs = append(fs, f)
+		}
+	}
+	sort.Slice(fs, func(i, j int) bool { return fs[i].id < fs[j].id })
+	resp := &b2types.ListUnfinishedLargeFilesResponse{Files: []b2types.GetFileInfoResponse{}}
+	if n := pageSize(req.Count); len(fs) > n {
+		resp.Continuation = fs[n].id
+		fs = fs[:n]
+	}
+	for _, f := range fs {
+		resp.Files = append(resp.Files, *fileResponse(f))
+	}
+	return resp, nil
+}
+
+// authorizedDownload reports whether r may download the named file from b.
+func (s *Server) authorizedDownload(r *http.Request, b *bucket, name string) bool {
+	if b.typ == "allPublic" {
+		return true
+	}
+	token := r.Header.Get("Authorization")
+	if token == "" {
+		token = r.URL.Query().Get("Authorization")
+	}
+	if token == authToken {
+		return !s.denyDownloads
+	}
+	auth, ok := s.dlAuth[token]
+	if !ok || auth.bucket != b.id || time.Now().After(auth.expires) {
+		return false
+	}
+	if auth.b2cd != "" && auth.b2cd != r.URL.Query().Get("b2ContentDisposition") {
+		return false
+	}
+	return strings.HasPrefix(name, auth.prefix)
+}
+
+func (s *Server) download(rw http.ResponseWriter, r *http.Request) error {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		return badRequest("%s: method not allowed", r.Method)
+	}
+	parts := strings.SplitN(strings.TrimPrefix(r.URL.EscapedPath(), "/file/"), "/", 2)
+	if len(parts) != 2 {
+		return badRequest("invalid download path %q", r.URL.Path)
+	}
+	name, err := url.QueryUnescape(parts[1])
+	if err != nil {
+		return badRequest("%v", err)
+	}
+
+	s.mu.Lock()
+	var b *bucket
+	for _, bk := range s.buckets {
+		if bk.name == parts[0] {
+			b = bk
+		}
+	}
+	if b == nil {
+		s.mu.Unlock()
+		return notFound("bucket %s does not exist", parts[0])
+	}
+	if !s.authorizedDownload(r, b, name) {
+		s.mu.Unlock()
+		return apiError{status: 401, code: "unauthorized", msg: "not authorized to download " + name}
+	}
+	var f *file
+	for _, v := range s.versions(b.id, name) {
+		if v.name == name && v.action != "start" {
+			f = v
+			break
+		}
+	}
+	s.mu.Unlock()
+	if f == nil || f.action != "upload" {
+		return notFound("file %s does not exist", name)
+	}
+	return serveFile(rw, r, f)
+}
+
+func (s *Server) downloadByID(rw http.ResponseWriter, r *http.Request) error {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		return badRequest("%s: method not allowed", r.Method)
+	}
+	id := r.URL.Query().Get("fileId")
+	s.mu.Lock()
+	f, ok := s.files[id]
+	if !ok || f.action != "upload" {
+		s.mu.Unlock()
+		return notFound("file %s does not exist", id)
+	}
+	b := s.buckets[f.bucket]
+	if !s.authorizedDownload(r, b, f.name) {
+		s.mu.Unlock()
+		return apiError{status: 401, code: "unauthorized", msg: "not authorized to download " + f.name}
+	}
+	s.mu.Unlock()
+	return serveFile(rw, r, f)
+}
+
+func serveFile(rw http.ResponseWriter, r *http.Request, f *file) error {
+	data := f.data
+	status := http.StatusOK
+	if rng := r.Header.Get("Range"); rng != "" {
+		start, end, err := parseRange(rng, int64(len(data)))
+		if err != nil {
+			return err
+		}
+		rw.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end, len(data)))
+		data = data[start : end+1]
+		status = http.StatusPartialContent
+	}
+	h := rw.Header()
+	h.Set("Content-Length", fmt.Sprintf("%d", len(data)))
+	h.Set("Content-Type", f.ctype)
+	h.Set("Accept-Ranges", "bytes")
+	h.Set("X-Bz-File-Id", f.id)
+	h.Set("X-Bz-File-Name", url.QueryEscape(f.name))
+	h.Set("X-Bz-Content-Sha1", f.sha1)
+	h.Set("X-Bz-Upload-Timestamp", f.stamp.String())
+	for k, v := range f.info {
+		h.Set("X-Bz-Info-"+url.QueryEscape(k), url.QueryEscape(v))
+	}
+	if cd := r.URL.Query().Get("b2ContentDisposition"); cd != "" {
+		h.Set("Content-Disposition", cd)
+	}
+	if inm := r.Header.Get("If-None-Match"); inm != "" && strings.Trim(inm, `"`) == f.sha1 {
+		status = http.StatusNotModified
+	}
+	rw.WriteHeader(status)
+	if status == http.StatusNotModified {
+		return nil
+	}
+	if r.Method == "GET" {
+		rw.Write(data)
+	}
+	return nil
+}
+
+// parseRange parses a single "bytes=start-end" range, returning inclusive
+// bounds.
+func parseRange(rng string, size int64) (int64, int64, error) {
+	bad := badRequest("invalid range %q", rng)
+	if !strings.HasPrefix(rng, "bytes=") {
+		return 0, 0, bad
+	}
+	parts := strings.SplitN(strings.TrimPrefix(rng, "bytes="), "-", 2)
+	if len(parts) != 2 {
+		return 0, 0, bad
+	}
+	start, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return 0, 0, bad
+	}
+	end := size - 1
+	if parts[1] != "" {
+		end, err = strconv.ParseInt(parts[1], 10, 64)
+		if err != nil {
+			return 0, 0, bad
+		}
+	}
+	if start >= size || end < start {
+		return 0, 0, apiError{status: 416, code: "range_not_satisfiable", msg: "the range is not satisfiable"}
+	}
+	if end >= size {
+		end = size - 1
+	}
+	return start, end, nil
+}
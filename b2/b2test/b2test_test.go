@@ -0,0 +1,256 @@
+// Copyright 2018, the Blazer authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package b2test
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/kurin/blazer/b2"
+)
+
+// newTestClient starts a server, which is closed when t finishes, and returns
+// it along with a client made with opts.
+func newTestClient(ctx context.Context, t *testing.T, opts ...b2.ClientOption) (*Server, *b2.Client) {
+	t.Helper()
+	srv := NewServer()
+	t.Cleanup(srv.Close)
+	client, err := srv.NewClient(ctx, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return srv, client
+}
+
+// newTestBucket is like newTestClient, and also creates a bucket called name.
+func newTestBucket(ctx context.Context, t *testing.T, name string, opts ...b2.ClientOption) (*Server, *b2.Client, *b2.Bucket) {
+	t.Helper()
+	srv, client := newTestClient(ctx, t, opts...)
+	bucket, err := client.NewBucket(ctx, name, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return srv, client, bucket
+}
+
+func writeObject(ctx context.Context, o *b2.Object, data []byte, chunkSize int) error {
+	w := o.NewWriter(ctx)
+	w.ChunkSize = chunkSize
+	w.ConcurrentUploads = 3
+	if _, err := io.Copy(w, bytes.NewBuffer(data)); err != nil {
+		w.Close()
+		return err
+	}
+	return w.Close()
+}
+
+func readObject(ctx context.Context, o *b2.Object, offset, length int64) ([]byte, error) {
+	r := o.NewRangeReader(ctx, offset, length)
+	r.ChunkSize = 1e3
+	defer r.Close()
+	return ioutil.ReadAll(r)
+}
+
+func TestReadWriteListDelete(t *testing.T) {
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+
+	_, _, bucket := newTestBucket(ctx, t, "b2test-bucket")
+
+	large := bytes.Repeat([]byte("0123456789abcdef"), 1e3+7)
+	files := map[string][]byte{
+		"small":         []byte("hello, world"),
+		"large":         large,
+		"dir/one":       []byte("one"),
+		"dir/two":       []byte("two"),
+		"with space+.x": []byte("escaped"),
+	}
+	for name, data := range files {
+		if err := writeObject(ctx, bucket.Object(name), data, 1e4); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+	}
+
+	for name, want := range files {
+		got, err := readObject(ctx, bucket.Object(name), 0, -1)
+		if err != nil {
+			t.Errorf("%s: %v", name, err)
+			continue
+		}
+		if !bytes.Equal(got, want) {
+			t.Errorf("%s: got %d bytes, want %d", name, len(got), len(want))
+		}
+	}
+	got, err := readObject(ctx, bucket.Object("large"), 1e4+3, 500)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := large[1e4+3 : 1e4+503]; !bytes.Equal(got, want) {
+		t.Errorf("large: range: got %q, want %q", got, want)
+	}
+
+	attrs, err := bucket.Object("large").Attrs(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if attrs.Size != int64(len(large)) {
+		t.Errorf("large: got size %d, want %d", attrs.Size, len(large))
+	}
+
+	list := func(opts ...b2.ListOption) []string {
+		var names []string
+		iter := bucket.List(ctx, opts...)
+		for iter.Next() {
+			names = append(names, iter.Object().Name())
+		}
+		if err := iter.Err(); err != nil {
+			t.Fatal(err)
+		}
+		return names
+	}
+	if got, want := list(), []string{"dir/one", "dir/two", "large", "small", "with space+.x"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("List: got %v, want %v", got, want)
+	}
+	if got, want := list(b2.ListDelimiter("/"), b2.ListPageSize(1)), []string{"dir/", "large", "small", "with space+.x"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("List with delimiter: got %v, want %v", got, want)
+	}
+
+	if err := bucket.Object("small").Hide(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := readObject(ctx, bucket.Object("small"), 0, -1); !b2.IsNotExist(err) {
+		t.Errorf("reading hidden object: got %v, want a not-exist error", err)
+	}
+	if got, want := list(b2.ListPrefix("s")), []string(nil); !reflect.DeepEqual(got, want) {
+		t.Errorf("List after hide: got %v, want %v", got, want)
+	}
+	if got, want := list(b2.ListPrefix("s"), b2.ListHidden()), []string{"small", "small"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("List hidden: got %v, want %v", got, want)
+	}
+	var n int
+	iter := bucket.List(ctx, b2.ListPrefix("s"), b2.ListHidden(), b2.ListSkip(b2.Hider))
+	for iter.Next() {
+		n++
+		attrs, err := iter.Object().Attrs(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if attrs.Status != b2.Uploaded {
+			t.Errorf("List hidden without hide markers: got %s in state %v", attrs.Name, attrs.Status)
+		}
+	}
+	if err := iter.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 {
+		t.Errorf("List hidden without hide markers: got %d objects, want 1", n)
+	}
+
+	iter = bucket.List(ctx, b2.ListHidden())
+	for iter.Next() {
+		if err := iter.Object().Delete(ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := iter.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if got := list(b2.ListHidden()); len(got) != 0 {
+		t.Errorf("List after delete: got %v, want nothing", got)
+	}
+	if err := bucket.Delete(ctx); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDownloadAuthorization(t *testing.T) {
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	_, client := newTestClient(ctx, t)
+	bucket, err := client.NewBucket(ctx, "private", &b2.BucketAttrs{Type: b2.Private})
+	if err != nil {
+		t.Fatal(err)
+	}
+	obj := bucket.Object("secret")
+	if err := writeObject(ctx, obj, []byte("data"), 1e4); err != nil {
+		t.Fatal(err)
+	}
+
+	get := func(u string) int {
+		resp, err := http.Get(u)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	if code := get(obj.URL()); code != http.StatusUnauthorized {
+		t.Errorf("unauthorized GET: got status %d, want %d", code, http.StatusUnauthorized)
+	}
+	u, err := obj.AuthURL(ctx, time.Minute, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code := get(u.String()); code != http.StatusOK {
+		t.Errorf("authorized GET: got status %d, want %d", code, http.StatusOK)
+	}
+}
+
+func TestScenarios(t *testing.T) {
+	ctx := context.Background()
+	_, client := newTestClient(ctx, t, b2.FailSomeUploads())
+	var name string
+	t.Run("run", func(t *testing.T) {
+		bucket := TempBucket(ctx, t, client, nil)
+		name = bucket.Name()
+		RunScenarios(t, bucket)
+	})
+	if s := client.Stats(); s.Errors["service_unavailable"] == 0 {
+		t.Errorf("no uploads failed; errors: %v", s.Errors)
+	}
+	if _, err := client.Bucket(ctx, name); !b2.IsNotExist(err) {
+		t.Errorf("bucket %s was not removed: %v", name, err)
+	}
+}
+
+func TestScenariosLive(t *testing.T) {
+	ctx := context.Background()
+	client := LiveClient(ctx, t, b2.FailSomeUploads(), b2.ExpireSomeAuthTokens())
+	RunScenarios(t, TempBucket(ctx, t, client, nil))
+}
+
+func TestTempBucketsAreUnique(t *testing.T) {
+	ctx := context.Background()
+	// The server is closed by a cleanup registered before TempBucket's, and so
+	// it outlives them.
+	_, client := newTestClient(ctx, t)
+	seen := make(map[string]bool)
+	for i := 0; i < 10; i++ {
+		name := TempBucket(ctx, t, client, nil).Name()
+		if seen[name] {
+			t.Fatalf("TempBucket: %s was returned twice", name)
+		}
+		seen[name] = true
+	}
+}
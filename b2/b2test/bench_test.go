@@ -0,0 +1,119 @@
+// Copyright 2018, the Blazer authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package b2test
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"fmt"
+	"io"
+	"math/rand"
+	"testing"
+	"time"
+)
+
+// BenchmarkUpload measures large file uploads over a simulated network, for
+// several part sizes and numbers of concurrent uploads.  Besides throughput,
+// it reports net-efficiency: the time the network alone should take (a round
+// trip plus the transfer time for each part, with the parts spread over the
+// connections) as a fraction of the time actually taken.  Parts are hashed
+// while earlier parts are in flight, so this should stay close to 1 however
+// fast the network is made; if hashing were on the critical path, it would
+// fall as the bandwidth approaches the speed of SHA1 (see BenchmarkSHA1).
+// The server runs in the same process, and competes with the client for CPU,
+// so on small machines the figure is a lower bound.
+func BenchmarkUpload(b *testing.B) {
+	const (
+		size      = 64e6
+		rtt       = 5 * time.Millisecond
+		bandwidth = 50e6 // bytes per second, per connection
+	)
+	data := make([]byte, size)
+	rand.New(rand.NewSource(1)).Read(data)
+
+	for _, chunk := range []int{8e6, 16e6} {
+		for _, threads := range []int{1, 4} {
+			for _, seek := range []bool{false, true} {
+				src := "stream"
+				if seek {
+					src = "seek"
+				}
+				name := fmt.Sprintf("chunk=%dMB/threads=%d/%s", chunk/1e6, threads, src)
+				b.Run(name, func(b *testing.B) {
+					benchmarkUpload(b, data, chunk, threads, seek, rtt, bandwidth)
+				})
+			}
+		}
+	}
+}
+
+func benchmarkUpload(b *testing.B, data []byte, chunk, threads int, seek bool, rtt time.Duration, bandwidth int64) {
+	ctx := context.Background()
+	srv := NewServer()
+	defer srv.Close()
+	client, err := srv.NewClient(ctx)
+	if err != nil {
+		b.Fatal(err)
+	}
+	bucket, err := client.NewBucket(ctx, "b2test-bench", nil)
+	if err != nil {
+		b.Fatal(err)
+	}
+	srv.SimulateNetwork(rtt, bandwidth)
+
+	parts := (len(data) + chunk - 1) / chunk
+	rounds := (parts + threads - 1) / threads
+	perPart := rtt + time.Duration(float64(chunk)/float64(bandwidth)*float64(time.Second))
+	ideal := time.Duration(rounds) * perPart
+
+	b.SetBytes(int64(len(data)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		obj := bucket.Object("obj")
+		w := obj.NewWriter(ctx)
+		w.ChunkSize = chunk
+		w.ConcurrentUploads = threads
+		var err error
+		if seek {
+			_, err = w.ReadFrom(bytes.NewReader(data))
+		} else {
+			_, err = io.Copy(w, struct{ io.Reader }{bytes.NewReader(data)})
+		}
+		if err != nil {
+			b.Fatal(err)
+		}
+		if err := w.Close(); err != nil {
+			b.Fatal(err)
+		}
+		b.StopTimer()
+		if err := obj.Delete(ctx); err != nil {
+			b.Fatal(err)
+		}
+		b.StartTimer()
+	}
+	per := b.Elapsed() / time.Duration(b.N)
+	b.ReportMetric(float64(ideal)/float64(per), "net-efficiency")
+}
+
+// BenchmarkSHA1 is the speed at which parts are hashed, for comparison with
+// the simulated bandwidth in BenchmarkUpload.
+func BenchmarkSHA1(b *testing.B) {
+	data := make([]byte, 8e6)
+	b.SetBytes(int64(len(data)))
+	for i := 0; i < b.N; i++ {
+		sha1.Sum(data)
+	}
+}
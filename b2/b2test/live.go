@@ -0,0 +1,153 @@
+// Copyright 2018, the Blazer authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package b2test
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/kurin/blazer/b2"
+)
+
+// The environment variables that LiveClient reads.  B2_SECRET_KEY, which
+// blazer's own integration tests have always used, is accepted in place of
+// B2_APPLICATION_KEY.
+const (
+	AccountIDEnv = "B2_ACCOUNT_ID"
+	KeyEnv       = "B2_APPLICATION_KEY"
+)
+
+// cleanupTimeout bounds the time spent removing a temporary bucket.
+const cleanupTimeout = 5 * time.Minute
+
+// LiveClient returns a client for the B2 account named by the environment.
+// If the credentials are not set, t is skipped, so that tests using it pass
+// offline.
+func LiveClient(ctx context.Context, t testing.TB, opts ...b2.ClientOption) *b2.Client {
+	id := os.Getenv(AccountIDEnv)
+	key := os.Getenv(KeyEnv)
+	if key == "" {
+		key = os.Getenv("B2_SECRET_KEY")
+	}
+	if id == "" || key == "" {
+		t.Skipf("%s or %s unset; skipping integration tests", AccountIDEnv, KeyEnv)
+	}
+	client, err := b2.NewClient(ctx, id, key, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return client
+}
+
+// TempBucket creates a new bucket with a unique name, made from the time and
+// a random suffix, so that any number of tests may run at once against the
+// same account.  The bucket is emptied and deleted when t finishes, whether
+// or not it passed.  If the test binary is interrupted, every temporary
+// bucket still in use is removed before it exits.
+func TempBucket(ctx context.Context, t testing.TB, client *b2.Client, attrs *b2.BucketAttrs) *b2.Bucket {
+	suffix := make([]byte, 4)
+	if _, err := rand.Read(suffix); err != nil {
+		t.Fatal(err)
+	}
+	name := fmt.Sprintf("b2test-%s-%s", time.Now().UTC().Format("20060102150405"), hex.EncodeToString(suffix))
+	bucket, err := client.NewBucket(ctx, name, attrs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	live.add(bucket)
+	t.Cleanup(func() {
+		defer live.remove(bucket)
+		ctx, cancel := context.WithTimeout(context.Background(), cleanupTimeout)
+		defer cancel()
+		if err := RemoveBucket(ctx, bucket); err != nil {
+			t.Errorf("removing bucket %s: %v", bucket.Name(), err)
+		}
+	})
+	return bucket
+}
+
+// RemoveBucket deletes every version of every object in bucket, including
+// hide markers and unfinished large files, and then the bucket itself.
+func RemoveBucket(ctx context.Context, bucket *b2.Bucket) error {
+	iter := bucket.List(ctx, b2.ListHidden())
+	for iter.Next() {
+		if err := iter.Object().Delete(ctx); err != nil && !b2.IsNotExist(err) {
+			return err
+		}
+	}
+	if err := iter.Err(); err != nil && !b2.IsNotExist(err) {
+		return err
+	}
+	if err := bucket.Delete(ctx); err != nil && !b2.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// live tracks the temporary buckets that have yet to be removed.
+var live = &liveBuckets{m: make(map[*b2.Bucket]bool)}
+
+type liveBuckets struct {
+	mu    sync.Mutex
+	m     map[*b2.Bucket]bool
+	watch sync.Once
+}
+
+func (l *liveBuckets) add(b *b2.Bucket) {
+	l.watch.Do(func() {
+		ch := make(chan os.Signal, 1)
+		signal.Notify(ch, os.Interrupt, syscall.SIGTERM)
+		go func() {
+			<-ch
+			l.removeAll()
+			os.Exit(1)
+		}()
+	})
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.m[b] = true
+}
+
+func (l *liveBuckets) remove(b *b2.Bucket) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.m, b)
+}
+
+func (l *liveBuckets) removeAll() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	ctx, cancel := context.WithTimeout(context.Background(), cleanupTimeout)
+	defer cancel()
+	var wg sync.WaitGroup
+	for b := range l.m {
+		wg.Add(1)
+		go func(b *b2.Bucket) {
+			defer wg.Done()
+			if err := RemoveBucket(ctx, b); err != nil {
+				fmt.Fprintf(os.Stderr, "b2test: removing bucket %s: %v\n", b.Name(), err)
+			}
+		}(b)
+	}
+	wg.Wait()
+}
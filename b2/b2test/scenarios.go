@@ -0,0 +1,130 @@
+// Copyright 2018, the Blazer authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package b2test
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/kurin/blazer/b2"
+)
+
+// minPartSize is the smallest part B2 accepts in a large file.
+const minPartSize = 5e6
+
+// RunScenarios exercises the basic operations of package b2 against bucket,
+// as subtests of t: simple and large uploads, listing, and whole and ranged
+// downloads.  It is meant to be run against an empty bucket from TempBucket,
+// either on a Server or on the real service; with a client made with
+// b2.FailSomeUploads, it also checks that failed uploads are retried.
+func RunScenarios(t *testing.T, bucket *b2.Bucket) {
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Minute)
+	defer cancel()
+
+	rng := rand.New(rand.NewSource(time.Now().UnixNano()))
+	random := func(n int) []byte {
+		b := make([]byte, n)
+		rng.Read(b)
+		return b
+	}
+	roundTrip := func(t *testing.T, name string, data []byte, chunkSize int) {
+		w := bucket.Object(name).NewWriter(ctx)
+		w.ChunkSize = chunkSize
+		w.ConcurrentUploads = 2
+		if _, err := io.Copy(w, bytes.NewReader(data)); err != nil {
+			w.Close()
+			t.Fatalf("writing %s: %v", name, err)
+		}
+		if err := w.Close(); err != nil {
+			t.Fatalf("writing %s: %v", name, err)
+		}
+		r := bucket.Object(name).NewReader(ctx)
+		defer r.Close()
+		got, err := ioutil.ReadAll(r)
+		if err != nil {
+			t.Fatalf("reading %s: %v", name, err)
+		}
+		if !bytes.Equal(got, data) {
+			t.Fatalf("reading %s: got %d bytes that differ from the %d written", name, len(got), len(data))
+		}
+	}
+
+	t.Run("small", func(t *testing.T) {
+		roundTrip(t, "scenarios/small", random(1e5+7), minPartSize)
+	})
+
+	t.Run("large", func(t *testing.T) {
+		data := random(2*minPartSize + 1e4)
+		roundTrip(t, "scenarios/large", data, minPartSize)
+		attrs, err := bucket.Object("scenarios/large").Attrs(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if attrs.Size != int64(len(data)) {
+			t.Errorf("large: got size %d, want %d", attrs.Size, len(data))
+		}
+	})
+
+	t.Run("list", func(t *testing.T) {
+		names := []string{"scenarios/list/a", "scenarios/list/b", "scenarios/list/dir/c"}
+		for _, name := range names {
+			roundTrip(t, name, []byte(name), minPartSize)
+		}
+		list := func(opts ...b2.ListOption) []string {
+			var got []string
+			iter := bucket.List(ctx, opts...)
+			for iter.Next() {
+				got = append(got, iter.Object().Name())
+			}
+			if err := iter.Err(); err != nil {
+				t.Fatal(err)
+			}
+			return got
+		}
+		if got := list(b2.ListPrefix("scenarios/list/"), b2.ListPageSize(2)); !reflect.DeepEqual(got, names) {
+			t.Errorf("List: got %v, want %v", got, names)
+		}
+		want := []string{"scenarios/list/a", "scenarios/list/b", "scenarios/list/dir/"}
+		if got := list(b2.ListPrefix("scenarios/list/"), b2.ListDelimiter("/")); !reflect.DeepEqual(got, want) {
+			t.Errorf("List with delimiter: got %v, want %v", got, want)
+		}
+	})
+
+	t.Run("download", func(t *testing.T) {
+		data := random(3e5)
+		roundTrip(t, "scenarios/download", data, minPartSize)
+		r := bucket.Object("scenarios/download").NewRangeReader(ctx, 1e5+3, 1e5)
+		r.ChunkSize = 3e4
+		r.ConcurrentDownloads = 3
+		defer r.Close()
+		got, err := ioutil.ReadAll(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := data[1e5+3 : 2e5+3]; !bytes.Equal(got, want) {
+			t.Errorf("range: got %d bytes that differ from the %d wanted", len(got), len(want))
+		}
+		if _, err := ioutil.ReadAll(bucket.Object("scenarios/missing").NewReader(ctx)); !b2.IsNotExist(err) {
+			t.Errorf("reading a missing object: got %v, want a not-exist error", err)
+		}
+	})
+}
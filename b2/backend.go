@@ -16,6 +16,7 @@ package b2
 
 import (
 	"context"
+	"errors"
 	"io"
 	"math/rand"
 	"time"
@@ -31,15 +32,23 @@ type beRootInterface interface {
 	authorizeAccount(context.Context, string, string, clientOptions) error
 	reauthorizeAccount(context.Context) error
 	createBucket(ctx context.Context, name, btype string, info map[string]string, rules []LifecycleRule) (beBucketInterface, error)
-	listBuckets(context.Context) ([]beBucketInterface, error)
+	listBuckets(context.Context, string) ([]beBucketInterface, error)
 	createKey(context.Context, string, []string, time.Duration, string, string) (beKeyInterface, error)
 	listKeys(context.Context, int, string) ([]beKeyInterface, string, error)
+	capabilities() []string
+	minPartSize() int
+	stats() Stats
+	recordUpload(string, int, time.Duration, error)
+	hostFailing(string) bool
+	hostSlow(string) bool
+	checkCap(error) error
 }
 
 type beRoot struct {
 	account, key string
 	b2i          b2RootInterface
 	options      clientOptions
+	hosts        hostTracker
 }
 
 type beBucketInterface interface {
@@ -53,9 +62,13 @@ type beBucketInterface interface {
 	startLargeFile(ctx context.Context, name, contentType string, info map[string]string) (beLargeFileInterface, error)
 	listFileNames(context.Context, int, string, string, string) ([]beFileInterface, string, error)
 	listFileVersions(context.Context, int, string, string, string, string) ([]beFileInterface, string, string, error)
+	listFileNamesFunc(context.Context, int, string, string, string, func(beFileInterface) error) (string, error)
+	listFileVersionsFunc(context.Context, int, string, string, string, string, func(beFileInterface) error) (string, string, error)
 	listUnfinishedLargeFiles(context.Context, int, string) ([]beFileInterface, string, error)
-	downloadFileByName(context.Context, string, int64, int64, bool) (beFileReaderInterface, error)
+	downloadFileByName(context.Context, string, string, int64, int64, bool) (beFileReaderInterface, error)
+	downloadFileByID(context.Context, string, string, int64, int64, bool) (beFileReaderInterface, error)
 	hideFile(context.Context, string) (beFileInterface, error)
+	copyFile(context.Context, string, string, string, map[string]string) (beFileInterface, error)
 	getDownloadAuthorization(context.Context, string, time.Duration, string) (string, error)
 	baseURL() string
 	file(string, string) beFileInterface
@@ -67,6 +80,7 @@ type beBucket struct {
 }
 
 type beURLInterface interface {
+	host() string
 	uploadFile(context.Context, readResetter, int, string, string, string, map[string]string) (beFileInterface, error)
 }
 
@@ -76,6 +90,7 @@ type beURL struct {
 }
 
 type beFileInterface interface {
+	id() string
 	name() string
 	size() int64
 	timestamp() time.Time
@@ -104,6 +119,7 @@ type beLargeFile struct {
 }
 
 type beFileChunkInterface interface {
+	host() string
 	reload(context.Context) error
 	uploadPart(context.Context, readResetter, string, int, int) (int, error)
 }
@@ -117,6 +133,8 @@ type beFileReaderInterface interface {
 	io.ReadCloser
 	stats() (int, string, string, map[string]string)
 	id() string
+	fileSize() int64
+	timestamp() time.Time
 }
 
 type beFileReader struct {
@@ -166,7 +184,52 @@ type beKey struct {
 func (r *beRoot) backoff(err error) time.Duration { return r.b2i.backoff(err) }
 func (r *beRoot) reauth(err error) bool           { return r.b2i.reauth(err) }
 func (r *beRoot) reupload(err error) bool         { return r.b2i.reupload(err) }
-func (r *beRoot) transient(err error) bool        { return r.b2i.transient(err) }
+func (r *beRoot) transient(err error) bool        { return r.b2i.transient(err) && !isHostFailing(err) }
+
+func (r *beRoot) capabilities() []string { return r.b2i.capabilities() }
+func (r *beRoot) minPartSize() int       { return r.b2i.minPartSize() }
+
+func (r *beRoot) stats() Stats {
+	s := r.b2i.stats()
+	n, window := r.options.hostLimits()
+	s.UploadHosts = r.hosts.stats(n, window, r.options.hostSlowness())
+	return s
+}
+
+// recordUpload notes the outcome of an attempt to upload size bytes to host.
+// Attempts that were canceled, or that were refused for reasons that have
+// nothing to do with the host, such as a bad request or a full account, aren't
+// counted.
+func (r *beRoot) recordUpload(host string, size int, d time.Duration, err error) {
+	if errors.Is(err, context.Canceled) || (err != nil && !hostFault(err)) {
+		return
+	}
+	r.hosts.record(host, int64(size), d, err)
+}
+
+// checkCap returns err as a *CapExceededError if the account has reached one
+// of its caps, and reports it to the client's OnCapExceeded callback.
+func (r *beRoot) checkCap(err error) error {
+	c, ok := capExceeded(err)
+	if !ok {
+		return err
+	}
+	ce := &CapExceededError{Cap: c, Err: err}
+	if f := r.options.onCap; f != nil {
+		f(ce)
+	}
+	return ce
+}
+
+func (r *beRoot) hostFailing(host string) bool {
+	n, window := r.options.hostLimits()
+	return r.hosts.failing(host, n, window)
+}
+
+func (r *beRoot) hostSlow(host string) bool {
+	_, window := r.options.hostLimits()
+	return r.hosts.slow(host, r.options.hostSlowness(), window)
+}
 
 func (r *beRoot) authorizeAccount(ctx context.Context, account, key string, c clientOptions) error {
 	f := func() error {
@@ -207,11 +270,13 @@ func (r *beRoot) createBucket(ctx context.Context, name, btype string, info map[
 	return bi, nil
 }
 
-func (r *beRoot) listBuckets(ctx context.Context) ([]beBucketInterface, error) {
+// listBuckets lists the buckets in the account, or if name is set, only the
+// bucket called name.
+func (r *beRoot) listBuckets(ctx context.Context, name string) ([]beBucketInterface, error) {
 	var buckets []beBucketInterface
 	f := func() error {
 		g := func() error {
-			bs, err := r.b2i.listBuckets(ctx)
+			bs, err := r.b2i.listBuckets(ctx, name)
 			if err != nil {
 				return err
 			}
@@ -401,6 +466,66 @@ func (b *beBucket) listFileVersions(ctx context.Context, count int, nextName, ne
 	return files, name, id, nil
 }
 
+// listFileNamesFunc is listFileNames, but passes each file to fn as soon as it
+// is decoded.  fn sees each file once: if the page is retried, the files it
+// was already given are skipped, since B2 lists them in the same order.
+func (b *beBucket) listFileNamesFunc(ctx context.Context, count int, continuation, prefix, delimiter string, fn func(beFileInterface) error) (string, error) {
+	var cont string
+	var seen int
+	f := func() error {
+		g := func() error {
+			var i int
+			c, err := b.b2bucket.listFileNamesFunc(ctx, count, continuation, prefix, delimiter, func(f b2FileInterface) error {
+				if i++; i <= seen {
+					return nil
+				}
+				seen = i
+				return fn(&beFile{b2file: f, ri: b.ri})
+			})
+			if err != nil {
+				return err
+			}
+			cont = c
+			return nil
+		}
+		return withReauth(ctx, b.ri, g)
+	}
+	if err := withBackoff(ctx, b.ri, f); err != nil {
+		return "", err
+	}
+	return cont, nil
+}
+
+// listFileVersionsFunc is listFileVersions, but passes each file to fn as soon
+// as it is decoded, in the manner of listFileNamesFunc.
+func (b *beBucket) listFileVersionsFunc(ctx context.Context, count int, nextName, nextID, prefix, delimiter string, fn func(beFileInterface) error) (string, string, error) {
+	var name, id string
+	var seen int
+	f := func() error {
+		g := func() error {
+			var i int
+			n, d, err := b.b2bucket.listFileVersionsFunc(ctx, count, nextName, nextID, prefix, delimiter, func(f b2FileInterface) error {
+				if i++; i <= seen {
+					return nil
+				}
+				seen = i
+				return fn(&beFile{b2file: f, ri: b.ri})
+			})
+			if err != nil {
+				return err
+			}
+			name = n
+			id = d
+			return nil
+		}
+		return withReauth(ctx, b.ri, g)
+	}
+	if err := withBackoff(ctx, b.ri, f); err != nil {
+		return "", "", err
+	}
+	return name, id, nil
+}
+
 func (b *beBucket) listUnfinishedLargeFiles(ctx context.Context, count int, continuation string) ([]beFileInterface, string, error) {
 	var cont string
 	var files []beFileInterface
@@ -427,23 +552,39 @@ func (b *beBucket) listUnfinishedLargeFiles(ctx context.Context, count int, cont
 	return files, cont, nil
 }
 
-func (b *beBucket) downloadFileByName(ctx context.Context, name string, offset, size int64, header bool) (beFileReaderInterface, error) {
+func (b *beBucket) downloadFileByName(ctx context.Context, name, sha1 string, offset, size int64, header bool) (beFileReaderInterface, error) {
+	return b.download(ctx, func() (b2FileReaderInterface, error) {
+		return b.b2bucket.downloadFileByName(ctx, name, sha1, offset, size, header)
+	})
+}
+
+func (b *beBucket) downloadFileByID(ctx context.Context, id, sha1 string, offset, size int64, header bool) (beFileReaderInterface, error) {
+	return b.download(ctx, func() (b2FileReaderInterface, error) {
+		return b.b2bucket.downloadFileByID(ctx, id, sha1, offset, size, header)
+	})
+}
+
+func (b *beBucket) download(ctx context.Context, dl func() (b2FileReaderInterface, error)) (beFileReaderInterface, error) {
 	var reader beFileReaderInterface
 	f := func() error {
 		g := func() error {
-			fr, err := b.b2bucket.downloadFileByName(ctx, name, offset, size, header)
-			if err != nil {
+			fr, err := dl()
+			if err != nil && !errors.Is(err, ErrNotModified) {
 				return err
 			}
 			reader = &beFileReader{
 				b2fileReader: fr,
 				ri:           b.ri,
 			}
-			return nil
+			return err
 		}
 		return withReauth(ctx, b.ri, g)
 	}
 	if err := withBackoff(ctx, b.ri, f); err != nil {
+		if errors.Is(err, ErrNotModified) {
+			// The reader holds the object's attributes, but no content.
+			return reader, err
+		}
 		return nil, err
 	}
 	return reader, nil
@@ -471,6 +612,28 @@ func (b *beBucket) hideFile(ctx context.Context, name string) (beFileInterface,
 	return file, nil
 }
 
+func (b *beBucket) copyFile(ctx context.Context, src, name, ct string, info map[string]string) (beFileInterface, error) {
+	var file beFileInterface
+	f := func() error {
+		g := func() error {
+			f, err := b.b2bucket.copyFile(ctx, src, name, ct, info)
+			if err != nil {
+				return err
+			}
+			file = &beFile{
+				b2file: f,
+				ri:     b.ri,
+			}
+			return nil
+		}
+		return withReauth(ctx, b.ri, g)
+	}
+	if err := withBackoff(ctx, b.ri, f); err != nil {
+		return nil, err
+	}
+	return file, nil
+}
+
 func (b *beBucket) getDownloadAuthorization(ctx context.Context, p string, v time.Duration, s string) (string, error) {
 	var tok string
 	f := func() error {
@@ -507,8 +670,14 @@ func (b *beURL) uploadFile(ctx context.Context, r readResetter, size int, name,
 		if err := r.Reset(); err != nil {
 			return err
 		}
+		host := b.b2url.host()
+		start := time.Now()
 		f, err := b.b2url.uploadFile(ctx, r, size, name, ct, sha1, info)
+		b.ri.recordUpload(host, size, time.Since(start), err)
 		if err != nil {
+			if b.ri.hostFailing(host) {
+				return errHostFailing{host: host, err: err}
+			}
 			return err
 		}
 		file = &beFile{
@@ -538,6 +707,10 @@ func (b *beFile) size() int64 {
 	return b.b2file.size()
 }
 
+func (b *beFile) id() string {
+	return b.b2file.id()
+}
+
 func (b *beFile) name() string {
 	return b.b2file.name()
 }
@@ -665,6 +838,9 @@ func (b *beLargeFile) cancel(ctx context.Context) error {
 	return withBackoff(ctx, b.ri, f)
 }
 
+func (b *beURL) host() string       { return b.b2url.host() }
+func (b *beFileChunk) host() string { return b.b2fileChunk.host() }
+
 func (b *beFileChunk) reload(ctx context.Context) error {
 	f := func() error {
 		g := func() error {
@@ -683,8 +859,14 @@ func (b *beFileChunk) uploadPart(ctx context.Context, r readResetter, sha1 strin
 		if err := r.Reset(); err != nil {
 			return err
 		}
+		host := b.b2fileChunk.host()
+		start := time.Now()
 		j, err := b.b2fileChunk.uploadPart(ctx, r, sha1, size, index)
+		b.ri.recordUpload(host, size, time.Since(start), err)
 		if err != nil {
+			if b.ri.hostFailing(host) {
+				return errHostFailing{host: host, err: err}
+			}
 			return err
 		}
 		i = j
@@ -708,7 +890,9 @@ func (b *beFileReader) stats() (int, string, string, map[string]string) {
 	return b.b2fileReader.stats()
 }
 
-func (b *beFileReader) id() string { return b.b2fileReader.id() }
+func (b *beFileReader) id() string           { return b.b2fileReader.id() }
+func (b *beFileReader) fileSize() int64      { return b.b2fileReader.fileSize() }
+func (b *beFileReader) timestamp() time.Time { return b.b2fileReader.timestamp() }
 
 func (b *beFileInfo) stats() (string, string, int64, string, map[string]string, string, time.Time) {
 	return b.name, b.sha, b.size, b.ct, b.info, b.status, b.stamp
@@ -743,21 +927,33 @@ var after = time.After
 
 func withBackoff(ctx context.Context, ri beRootInterface, f func() error) error {
 	backoff := 500 * time.Millisecond
-	for {
+	var waited, retryAfter time.Duration
+	var last error
+	for attempts := 1; ; attempts++ {
 		err := f()
+		if err != nil && last != nil && ctx.Err() != nil {
+			// The context ended during this attempt; report the loop's history
+			// along with the context error.
+			return interrupted(ctx.Err(), err, attempts, waited, retryAfter)
+		}
 		if !ri.transient(err) {
-			return err
+			return withRetries(ri.checkCap(err), attempts, waited, retryAfter)
 		}
+		last = err
 		bo := ri.backoff(err)
 		if bo > 0 {
 			backoff = bo
+			retryAfter = bo
 		} else {
 			backoff = getBackoff(backoff)
 		}
+		start := time.Now()
 		select {
 		case <-ctx.Done():
-			return ctx.Err()
+			waited += time.Since(start)
+			return interrupted(ctx.Err(), last, attempts, waited, retryAfter)
 		case <-after(backoff):
+			waited += backoff
 		}
 	}
 }
@@ -18,6 +18,8 @@ import (
 	"context"
 	"io"
 	"net/http"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/kurin/blazer/base"
@@ -33,9 +35,12 @@ type b2RootInterface interface {
 	reauth(error) bool
 	reupload(error) bool
 	createBucket(context.Context, string, string, map[string]string, []LifecycleRule) (b2BucketInterface, error)
-	listBuckets(context.Context) ([]b2BucketInterface, error)
+	listBuckets(context.Context, string) ([]b2BucketInterface, error)
 	createKey(context.Context, string, []string, time.Duration, string, string) (b2KeyInterface, error)
 	listKeys(context.Context, int, string) ([]b2KeyInterface, string, error)
+	capabilities() []string
+	minPartSize() int
+	stats() Stats
 }
 
 type b2BucketInterface interface {
@@ -49,20 +54,26 @@ type b2BucketInterface interface {
 	startLargeFile(ctx context.Context, name, contentType string, info map[string]string) (b2LargeFileInterface, error)
 	listFileNames(context.Context, int, string, string, string) ([]b2FileInterface, string, error)
 	listFileVersions(context.Context, int, string, string, string, string) ([]b2FileInterface, string, string, error)
+	listFileNamesFunc(context.Context, int, string, string, string, func(b2FileInterface) error) (string, error)
+	listFileVersionsFunc(context.Context, int, string, string, string, string, func(b2FileInterface) error) (string, string, error)
 	listUnfinishedLargeFiles(context.Context, int, string) ([]b2FileInterface, string, error)
-	downloadFileByName(context.Context, string, int64, int64, bool) (b2FileReaderInterface, error)
+	downloadFileByName(context.Context, string, string, int64, int64, bool) (b2FileReaderInterface, error)
+	downloadFileByID(context.Context, string, string, int64, int64, bool) (b2FileReaderInterface, error)
 	hideFile(context.Context, string) (b2FileInterface, error)
+	copyFile(context.Context, string, string, string, map[string]string) (b2FileInterface, error)
 	getDownloadAuthorization(context.Context, string, time.Duration, string) (string, error)
 	baseURL() string
 	file(string, string) b2FileInterface
 }
 
 type b2URLInterface interface {
+	host() string
 	reload(context.Context) error
 	uploadFile(context.Context, io.Reader, int, string, string, string, map[string]string) (b2FileInterface, error)
 }
 
 type b2FileInterface interface {
+	id() string
 	name() string
 	size() int64
 	timestamp() time.Time
@@ -80,6 +91,7 @@ type b2LargeFileInterface interface {
 }
 
 type b2FileChunkInterface interface {
+	host() string
 	reload(context.Context) error
 	uploadPart(context.Context, io.Reader, string, int, int) (int, error)
 }
@@ -88,6 +100,8 @@ type b2FileReaderInterface interface {
 	io.ReadCloser
 	stats() (int, string, string, map[string]string)
 	id() string
+	fileSize() int64
+	timestamp() time.Time
 }
 
 type b2FileInfoInterface interface {
@@ -110,11 +124,13 @@ type b2KeyInterface interface {
 }
 
 type b2Root struct {
-	b *base.B2
+	b        *base.B2
+	counters base.Counters
 }
 
 type b2Bucket struct {
-	b *base.Bucket
+	mu sync.Mutex
+	b  *base.Bucket
 }
 
 type b2URL struct {
@@ -122,7 +138,8 @@ type b2URL struct {
 }
 
 type b2File struct {
-	b *base.File
+	mu sync.Mutex
+	b  *base.File
 }
 
 type b2LargeFile struct {
@@ -156,6 +173,7 @@ func (b *b2Root) authorizeAccount(ctx context.Context, account, key string, c cl
 		ct.rt = c.transport
 	}
 	aopts = append(aopts, base.Transport(ct))
+	aopts = append(aopts, base.WithCounters(&b.counters))
 	if c.failSomeUploads {
 		aopts = append(aopts, base.FailSomeUploads())
 	}
@@ -183,6 +201,25 @@ func (b *b2Root) authorizeAccount(ctx context.Context, account, key string, c cl
 	return nil
 }
 
+func (b *b2Root) stats() Stats {
+	s := b.counters.Stats()
+	return Stats{
+		Calls:     s.Calls,
+		Errors:    s.Errors,
+		BytesUp:   s.BytesUp,
+		BytesDown: s.BytesDown,
+		InFlight:  s.InFlight,
+	}
+}
+
+func (b *b2Root) capabilities() []string {
+	return b.b.Capabilities()
+}
+
+func (b *b2Root) minPartSize() int {
+	return b.b.AbsoluteMinPartSize()
+}
+
 func (*b2Root) backoff(err error) time.Duration {
 	if base.Action(err) != base.Retry {
 		return 0
@@ -215,17 +252,23 @@ func (b *b2Root) createBucket(ctx context.Context, name, btype string, info map[
 	if err != nil {
 		return nil, err
 	}
-	return &b2Bucket{bucket}, nil
+	return &b2Bucket{b: bucket}, nil
 }
 
-func (b *b2Root) listBuckets(ctx context.Context) ([]b2BucketInterface, error) {
-	buckets, err := b.b.ListBuckets(ctx)
+func (b *b2Root) listBuckets(ctx context.Context, name string) ([]b2BucketInterface, error) {
+	var buckets []*base.Bucket
+	var err error
+	if name == "" {
+		buckets, err = b.b.ListBuckets(ctx)
+	} else {
+		buckets, err = b.b.ListBucketsByName(ctx, name)
+	}
 	if err != nil {
 		return nil, err
 	}
 	var rtn []b2BucketInterface
 	for _, bucket := range buckets {
-		rtn = append(rtn, &b2Bucket{bucket})
+		rtn = append(rtn, &b2Bucket{b: bucket})
 	}
 	return rtn, err
 }
@@ -234,11 +277,14 @@ func (b *b2Bucket) updateBucket(ctx context.Context, attrs *BucketAttrs) error {
 	if attrs == nil {
 		return nil
 	}
+	// Update sends the fields of the bucket it is called on, so they are set
+	// on a copy, which replaces the original if the update succeeds.
+	cp := *b.bucket()
 	if attrs.Type != UnknownType {
-		b.b.Type = string(attrs.Type)
+		cp.Type = string(attrs.Type)
 	}
 	if attrs.Info != nil {
-		b.b.Info = attrs.Info
+		cp.Info = attrs.Info
 	}
 	if attrs.LifecycleRules != nil {
 		rules := []base.LifecycleRule{}
@@ -249,11 +295,13 @@ func (b *b2Bucket) updateBucket(ctx context.Context, attrs *BucketAttrs) error {
 				Prefix:                 rule.Prefix,
 			})
 		}
-		b.b.LifecycleRules = rules
+		cp.LifecycleRules = rules
 	}
-	newBucket, err := b.b.Update(ctx)
+	newBucket, err := cp.Update(ctx)
 	if err == nil {
+		b.mu.Lock()
 		b.b = newBucket
+		b.mu.Unlock()
 	}
 	code, _ := base.Code(err)
 	if code == 409 {
@@ -285,21 +333,28 @@ func (b *b2Root) listKeys(ctx context.Context, max int, next string) ([]b2KeyInt
 	return k, next, nil
 }
 
+// bucket returns the underlying bucket, which updateBucket may replace.
+func (b *b2Bucket) bucket() *base.Bucket {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.b
+}
+
 func (b *b2Bucket) deleteBucket(ctx context.Context) error {
-	return b.b.DeleteBucket(ctx)
+	return b.bucket().DeleteBucket(ctx)
 }
 
 func (b *b2Bucket) name() string {
-	return b.b.Name
+	return b.bucket().Name
 }
 
 func (b *b2Bucket) btype() string {
-	return b.b.Type
+	return b.bucket().Type
 }
 
 func (b *b2Bucket) attrs() *BucketAttrs {
 	var rules []LifecycleRule
-	for _, rule := range b.b.LifecycleRules {
+	for _, rule := range b.bucket().LifecycleRules {
 		rules = append(rules, LifecycleRule{
 			DaysNewUntilHidden:     rule.DaysNewUntilHidden,
 			DaysHiddenUntilDeleted: rule.DaysHiddenUntilDeleted,
@@ -308,15 +363,15 @@ func (b *b2Bucket) attrs() *BucketAttrs {
 	}
 	return &BucketAttrs{
 		LifecycleRules: rules,
-		Info:           b.b.Info,
-		Type:           BucketType(b.b.Type),
+		Info:           b.bucket().Info,
+		Type:           BucketType(b.bucket().Type),
 	}
 }
 
-func (b *b2Bucket) id() string { return b.b.ID }
+func (b *b2Bucket) id() string { return b.bucket().ID }
 
 func (b *b2Bucket) getUploadURL(ctx context.Context) (b2URLInterface, error) {
-	url, err := b.b.GetUploadURL(ctx)
+	url, err := b.bucket().GetUploadURL(ctx)
 	if err != nil {
 		return nil, err
 	}
@@ -324,7 +379,7 @@ func (b *b2Bucket) getUploadURL(ctx context.Context) (b2URLInterface, error) {
 }
 
 func (b *b2Bucket) startLargeFile(ctx context.Context, name, ct string, info map[string]string) (b2LargeFileInterface, error) {
-	lf, err := b.b.StartLargeFile(ctx, name, ct, info)
+	lf, err := b.bucket().StartLargeFile(ctx, name, ct, info)
 	if err != nil {
 		return nil, err
 	}
@@ -332,119 +387,263 @@ func (b *b2Bucket) startLargeFile(ctx context.Context, name, ct string, info map
 }
 
 func (b *b2Bucket) listFileNames(ctx context.Context, count int, continuation, prefix, delimiter string) ([]b2FileInterface, string, error) {
-	fs, c, err := b.b.ListFileNames(ctx, count, continuation, prefix, delimiter)
+	fs, c, err := b.bucket().ListFileNames(ctx, count, continuation, prefix, delimiter)
 	if err != nil {
 		return nil, "", err
 	}
 	var files []b2FileInterface
 	for _, f := range fs {
-		files = append(files, &b2File{f})
+		files = append(files, &b2File{b: f})
 	}
 	return files, c, nil
 }
 
 func (b *b2Bucket) listFileVersions(ctx context.Context, count int, nextName, nextID, prefix, delimiter string) ([]b2FileInterface, string, string, error) {
-	fs, name, id, err := b.b.ListFileVersions(ctx, count, nextName, nextID, prefix, delimiter)
+	fs, name, id, err := b.bucket().ListFileVersions(ctx, count, nextName, nextID, prefix, delimiter)
 	if err != nil {
 		return nil, "", "", err
 	}
 	var files []b2FileInterface
 	for _, f := range fs {
-		files = append(files, &b2File{f})
+		files = append(files, &b2File{b: f})
 	}
 	return files, name, id, nil
 }
 
+func (b *b2Bucket) listFileNamesFunc(ctx context.Context, count int, continuation, prefix, delimiter string, fn func(b2FileInterface) error) (string, error) {
+	return b.bucket().ListFileNamesFunc(ctx, count, continuation, prefix, delimiter, func(f *base.File) error {
+		return fn(&b2File{b: f})
+	})
+}
+
+func (b *b2Bucket) listFileVersionsFunc(ctx context.Context, count int, nextName, nextID, prefix, delimiter string, fn func(b2FileInterface) error) (string, string, error) {
+	return b.bucket().ListFileVersionsFunc(ctx, count, nextName, nextID, prefix, delimiter, func(f *base.File) error {
+		return fn(&b2File{b: f})
+	})
+}
+
 func (b *b2Bucket) listUnfinishedLargeFiles(ctx context.Context, count int, continuation string) ([]b2FileInterface, string, error) {
-	fs, cont, err := b.b.ListUnfinishedLargeFiles(ctx, count, continuation)
+	fs, cont, err := b.bucket().ListUnfinishedLargeFiles(ctx, count, continuation)
 	if err != nil {
 		return nil, "", err
 	}
 	var files []b2FileInterface
 	for _, f := range fs {
-		files = append(files, &b2File{f})
+		files = append(files, &b2File{b: f})
 	}
 	return files, cont, nil
 }
 
-func (b *b2Bucket) downloadFileByName(ctx context.Context, name string, offset, size int64, header bool) (b2FileReaderInterface, error) {
-	fr, err := b.b.DownloadFileByName(ctx, name, offset, size, header)
+func (b *b2Bucket) downloadFileByName(ctx context.Context, name, sha1 string, offset, size int64, header bool) (b2FileReaderInterface, error) {
+	fr, err := b.bucket().DownloadFileByNameIfNoneMatch(ctx, name, sha1, offset, size, header)
+	if err == base.ErrNotModified {
+		return &b2FileReader{fr}, ErrNotModified
+	}
+	if err != nil {
+		return nil, downloadErr(err)
+	}
+	return &b2FileReader{fr}, nil
+}
+
+func (b *b2Bucket) downloadFileByID(ctx context.Context, id, sha1 string, offset, size int64, header bool) (b2FileReaderInterface, error) {
+	fr, err := b.bucket().DownloadFileByIDIfNoneMatch(ctx, id, sha1, offset, size, header)
+	if err == base.ErrNotModified {
+		return &b2FileReader{fr}, ErrNotModified
+	}
 	if err != nil {
-		code, _ := base.Code(err)
-		switch code {
-		case http.StatusRequestedRangeNotSatisfiable:
-			return nil, errNoMoreContent
-		case http.StatusNotFound:
-			return nil, b2err{err: err, notFoundErr: true}
-		}
-		return nil, err
+		return nil, downloadErr(err)
 	}
 	return &b2FileReader{fr}, nil
 }
 
+// withRetries annotates the error that ended a retry loop with the loop's
+// history, for base.Attempts and friends to report.
+func withRetries(err error, attempts int, waited, retryAfter time.Duration) error {
+	return base.WithRetries(err, attempts, waited, retryAfter)
+}
+
+// interrupted annotates the error of a context that cut a retry loop short
+// with the loop's history and the final attempt's error.
+func interrupted(ctxErr, last error, attempts int, waited, retryAfter time.Duration) error {
+	return base.Interrupted(ctxErr, last, attempts, waited, retryAfter)
+}
+
+// errTransient, errAuth, and errRetryAfter implement IsTransient,
+// IsAuthError, and RetryAfter for errors from the base package.
+func errTransient(err error) bool {
+	switch base.Action(err) {
+	case base.Retry, base.AttemptNewUpload:
+		return true
+	}
+	return false
+}
+
+func errAuth(err error) bool {
+	code, _ := base.Code(err)
+	return code == http.StatusUnauthorized && base.Action(err) != base.AttemptNewUpload
+}
+
+func errRetryAfter(err error) time.Duration {
+	return base.RetryAfter(err)
+}
+
+// hostFault reports whether err, from an upload, may be the fault of the
+// host it was sent to: the request failed without a response, timed out, or
+// met a server error.
+func hostFault(err error) bool {
+	code, _ := base.Code(err)
+	return code == 0 || code == http.StatusRequestTimeout || code >= 500
+}
+
+// headRefused reports whether err is the refusal of a HEAD request that
+// survived reauthorization.  B2 sends no body with such a refusal, so it
+// lacks the "unauthorized" code that downloadErr looks for; it most likely
+// means that the key can't read files.
+func headRefused(err error) bool {
+	if _, capped := base.CapExceeded(err); capped {
+		return false
+	}
+	code, _ := base.Code(err)
+	return code == http.StatusUnauthorized || code == http.StatusForbidden
+}
+
+// healthProblem classifies an error met by HealthCheck.
+func healthProblem(err error) HealthProblem {
+	code, mcode, _ := base.MsgCode(err)
+	_, capped := base.CapExceeded(err)
+	switch {
+	case code == http.StatusUnauthorized && base.Action(err) == base.Punt:
+		// b2_authorize_account refused the key.
+		return BadCredentials
+	case code == http.StatusUnauthorized && mcode == "unauthorized":
+		// The token is good, but the key can't do this.
+		return MissingCapability
+	case code == http.StatusUnauthorized:
+		// The token was still refused after reauthorizing.
+		return BadCredentials
+	case code == http.StatusForbidden && !capped:
+		return MissingCapability
+	}
+	return Unavailable
+}
+
+// capExceeded reports which cap, if any, err says the account has reached.
+func capExceeded(err error) (Cap, bool) {
+	c, ok := base.CapExceeded(err)
+	return Cap(c), ok
+}
+
+func downloadErr(err error) error {
+	code, _ := base.Code(err)
+	switch code {
+	case http.StatusRequestedRangeNotSatisfiable:
+		return errNoMoreContent
+	case http.StatusNotFound:
+		return b2err{err: err, notFoundErr: true}
+	case http.StatusUnauthorized:
+		// An "unauthorized" code (as opposed to an expired or bad token) means
+		// the key lacks the capability to read this file; reauthenticating
+		// won't help.
+		if _, mcode, _ := base.MsgCode(err); mcode == "unauthorized" {
+			return b2err{err: err, unauthorized: true}
+		}
+	}
+	return err
+}
+
 func (b *b2Bucket) hideFile(ctx context.Context, name string) (b2FileInterface, error) {
-	f, err := b.b.HideFile(ctx, name)
+	f, err := b.bucket().HideFile(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	return &b2File{b: f}, nil
+}
+
+func (b *b2Bucket) copyFile(ctx context.Context, src, name, ct string, info map[string]string) (b2FileInterface, error) {
+	f, err := b.bucket().CopyFile(ctx, src, name, ct, info)
 	if err != nil {
 		return nil, err
 	}
-	return &b2File{f}, nil
+	return &b2File{b: f}, nil
 }
 
 func (b *b2Bucket) getDownloadAuthorization(ctx context.Context, p string, v time.Duration, s string) (string, error) {
-	return b.b.GetDownloadAuthorization(ctx, p, v, s)
+	return b.bucket().GetDownloadAuthorization(ctx, p, v, s)
 }
 
 func (b *b2Bucket) baseURL() string {
-	return b.b.BaseURL()
+	return b.bucket().BaseURL()
 }
 
-func (b *b2Bucket) file(id, name string) b2FileInterface { return &b2File{b.b.File(id, name)} }
+func (b *b2Bucket) file(id, name string) b2FileInterface {
+	return &b2File{b: b.bucket().File(id, name)}
+}
 
 func (b *b2URL) uploadFile(ctx context.Context, r io.Reader, size int, name, contentType, sha1 string, info map[string]string) (b2FileInterface, error) {
 	file, err := b.b.UploadFile(ctx, r, size, name, contentType, sha1, info)
 	if err != nil {
 		return nil, err
 	}
-	return &b2File{file}, nil
+	return &b2File{b: file}, nil
 }
 
+func (b *b2URL) host() string { return b.b.Host() }
+
 func (b *b2URL) reload(ctx context.Context) error {
 	return b.b.Reload(ctx)
 }
 
 func (b *b2File) deleteFileVersion(ctx context.Context) error {
-	return b.b.DeleteFileVersion(ctx)
+	return b.file().DeleteFileVersion(ctx)
+}
+
+func (b *b2File) id() string {
+	return b.file().ID
 }
 
 func (b *b2File) name() string {
-	return b.b.Name
+	return b.file().Name
 }
 
 func (b *b2File) size() int64 {
-	return b.b.Size
+	return b.file().Size
 }
 
 func (b *b2File) timestamp() time.Time {
-	return b.b.Timestamp
+	return b.file().Timestamp
 }
 
 func (b *b2File) status() string {
-	return b.b.Status
+	return b.file().Status
+}
+
+// file returns the underlying file.  GetFileInfo updates the file it is
+// called on, so getFileInfo calls it on a copy, which then replaces the
+// original; this keeps b2File safe for concurrent use.
+func (b *b2File) file() *base.File {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.b
 }
 
 func (b *b2File) getFileInfo(ctx context.Context) (b2FileInfoInterface, error) {
-	if b.b.Info != nil {
-		return &b2FileInfo{b.b.Info}, nil
+	f := b.file()
+	if f.Info != nil {
+		return &b2FileInfo{f.Info}, nil
 	}
-	fi, err := b.b.GetFileInfo(ctx)
+	cp := *f
+	fi, err := cp.GetFileInfo(ctx)
 	if err != nil {
 		return nil, err
 	}
+	b.mu.Lock()
+	b.b = &cp
+	b.mu.Unlock()
 	return &b2FileInfo{fi}, nil
 }
 
 func (b *b2File) listParts(ctx context.Context, next, count int) ([]b2FilePartInterface, int, error) {
-	parts, n, err := b.b.ListParts(ctx, next, count)
+	parts, n, err := b.file().ListParts(ctx, next, count)
 	if err != nil {
 		return nil, 0, err
 	}
@@ -456,7 +655,7 @@ func (b *b2File) listParts(ctx context.Context, next, count int) ([]b2FilePartIn
 }
 
 func (b *b2File) compileParts(size int64, seen map[int]string) b2LargeFileInterface {
-	return &b2LargeFile{b.b.CompileParts(size, seen)}
+	return &b2LargeFile{b.file().CompileParts(size, seen)}
 }
 
 func (b *b2LargeFile) finishLargeFile(ctx context.Context) (b2FileInterface, error) {
@@ -464,7 +663,7 @@ func (b *b2LargeFile) finishLargeFile(ctx context.Context) (b2FileInterface, err
 	if err != nil {
 		return nil, err
 	}
-	return &b2File{f}, nil
+	return &b2File{b: f}, nil
 }
 
 func (b *b2LargeFile) getUploadPartURL(ctx context.Context) (b2FileChunkInterface, error) {
@@ -479,6 +678,8 @@ func (b *b2LargeFile) cancel(ctx context.Context) error {
 	return b.b.CancelLargeFile(ctx)
 }
 
+func (b *b2FileChunk) host() string { return b.b.Host() }
+
 func (b *b2FileChunk) reload(ctx context.Context) error {
 	return b.b.Reload(ctx)
 }
@@ -496,10 +697,18 @@ func (b *b2FileReader) Close() error {
 }
 
 func (b *b2FileReader) stats() (int, string, string, map[string]string) {
-	return b.b.ContentLength, b.b.ContentType, b.b.SHA1, b.b.Info
+	// The download headers come back in canonical MIME case; B2 itself
+	// stores info keys in lower case, which is what Attrs reports.
+	info := make(map[string]string, len(b.b.Info))
+	for k, v := range b.b.Info {
+		info[strings.ToLower(k)] = v
+	}
+	return b.b.ContentLength, b.b.ContentType, b.b.SHA1, info
 }
 
-func (b *b2FileReader) id() string { return b.b.ID }
+func (b *b2FileReader) id() string           { return b.b.ID }
+func (b *b2FileReader) fileSize() int64      { return b.b.Size }
+func (b *b2FileReader) timestamp() time.Time { return b.b.UploadTimestamp }
 
 func (b *b2FileInfo) stats() (string, string, int64, string, map[string]string, string, time.Time) {
 	return b.b.Name, b.b.SHA1, b.b.Size, b.b.ContentType, b.b.Info, b.b.Status, b.b.Timestamp
@@ -16,7 +16,6 @@ package b2
 
 import (
 	"bytes"
-	"crypto/sha1"
 	"errors"
 	"fmt"
 	"hash"
@@ -52,30 +51,50 @@ type writeBuffer interface {
 // nonBuffer doesn't buffer anything, but passes values directly from the
 // source readseeker.  Many nonBuffers can point at different parts of the same
 // underlying source, and be accessed by multiple goroutines simultaneously.
-func newNonBuffer(rs io.ReaderAt, offset, size int64) writeBuffer {
+//
+// If sum, the SHA1 of the section, is known, it is sent as a header.
+// Otherwise the section is hashed as it is sent, and the SHA1 is appended.
+func newNonBuffer(rs io.ReaderAt, offset, size int64, sum string, newHash func() hash.Hash) writeBuffer {
 	return &nonBuffer{
 		r:    io.NewSectionReader(rs, offset, size),
 		size: int(size),
-		hsh:  sha1.New(),
+		sum:  sum,
+		hsh:  newHash(),
 	}
 }
 
 type nonBuffer struct {
 	r    *io.SectionReader
 	size int
+	sum  string
 	hsh  hash.Hash
 
 	isEOF bool
 	buf   *strings.Reader
 }
 
-func (nb *nonBuffer) Len() int                      { return nb.size + 40 }
-func (nb *nonBuffer) Hash() string                  { return "hex_digits_at_end" }
 func (nb *nonBuffer) Close() error                  { return nil }
 func (nb *nonBuffer) Reader() (readResetter, error) { return nb, nil }
 func (nb *nonBuffer) Write([]byte) (int, error)     { return 0, errors.New("writes not supported") }
 
+func (nb *nonBuffer) Len() int {
+	if nb.sum != "" {
+		return nb.size
+	}
+	return nb.size + 40
+}
+
+func (nb *nonBuffer) Hash() string {
+	if nb.sum != "" {
+		return nb.sum
+	}
+	return "hex_digits_at_end"
+}
+
 func (nb *nonBuffer) Read(p []byte) (int, error) {
+	if nb.sum != "" {
+		return nb.r.Read(p)
+	}
 	if nb.isEOF {
 		return nb.buf.Read(p)
 	}
@@ -109,9 +128,9 @@ func init() {
 	bufpool.New = func() interface{} { return &bytes.Buffer{} }
 }
 
-func newMemoryBuffer() *memoryBuffer {
+func newMemoryBuffer(newHash func() hash.Hash) *memoryBuffer {
 	mb := &memoryBuffer{
-		hsh: sha1.New(),
+		hsh: newHash(),
 	}
 	mb.buf = bufpool.Get().(*bytes.Buffer)
 	mb.w = io.MultiWriter(mb.hsh, mb.buf)
@@ -142,14 +161,14 @@ type fileBuffer struct {
 	s   int
 }
 
-func newFileBuffer(loc string) (*fileBuffer, error) {
+func newFileBuffer(loc string, newHash func() hash.Hash) (*fileBuffer, error) {
 	f, err := ioutil.TempFile(loc, "blazer")
 	if err != nil {
 		return nil, err
 	}
 	fb := &fileBuffer{
 		f:   f,
-		hsh: sha1.New(),
+		hsh: newHash(),
 	}
 	fb.w = io.MultiWriter(fb.f, fb.hsh)
 	return fb, nil
@@ -0,0 +1,576 @@
+// Copyright 2018, the Blazer authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package b2_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"expvar"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/kurin/blazer"
+	"github.com/kurin/blazer/b2"
+	"github.com/kurin/blazer/base"
+)
+
+func TestStats(t *testing.T) {
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	srv, client := newTestClient(ctx, t)
+	// expvar names can't be unpublished, so each run needs its own.
+	prefix := fmt.Sprintf("b2test_%d_", time.Now().UnixNano())
+	if err := client.PublishStats(prefix); err != nil {
+		t.Fatal(err)
+	}
+	bucket, err := client.NewBucket(ctx, "b2test-stats", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := bytes.Repeat([]byte("x"), 12345)
+	if err := writeObject(ctx, bucket.Object("obj"), data, 1e4); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := readObject(ctx, bucket.Object("obj"), 0, -1); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := readObject(ctx, bucket.Object("missing"), 0, -1); !b2.IsNotExist(err) {
+		t.Fatalf("reading missing object: got %v, want a not-exist error", err)
+	}
+
+	s := client.Stats()
+	for _, m := range []string{"b2_authorize_account", "b2_start_large_file", "b2_upload_part", "b2_finish_large_file", "b2_download_file_by_name"} {
+		if s.Calls[m] == 0 {
+			t.Errorf("Calls[%q]: got 0, want more", m)
+		}
+	}
+	if s.Errors["not_found"] != 1 {
+		t.Errorf(`Errors["not_found"]: got %d, want 1`, s.Errors["not_found"])
+	}
+	if s.BytesUp != int64(len(data)) {
+		t.Errorf("BytesUp: got %d, want %d", s.BytesUp, len(data))
+	}
+	if s.BytesDown != int64(len(data)) {
+		t.Errorf("BytesDown: got %d, want %d", s.BytesDown, len(data))
+	}
+	if s.InFlight != 0 {
+		t.Errorf("InFlight: got %d, want 0", s.InFlight)
+	}
+	if v := expvar.Get(prefix + "bytes_down"); v == nil || v.String() != fmt.Sprint(len(data)) {
+		t.Errorf("expvar %sbytes_down: got %v, want %d", prefix, v, len(data))
+	}
+
+	// Publishing again switches the variables to the new client.
+	other, err := srv.NewClient(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := other.PublishStats(prefix); err != nil {
+		t.Fatalf("PublishStats again: %v", err)
+	}
+	if v := expvar.Get(prefix + "bytes_down"); v == nil || v.String() != "0" {
+		t.Errorf("expvar %sbytes_down after publishing another client: got %v, want 0", prefix, v)
+	}
+
+	// Names taken by other variables are left alone.
+	taken := fmt.Sprintf("b2test_%d_", time.Now().UnixNano())
+	expvar.NewInt(taken + "errors")
+	if err := client.PublishStats(taken); err == nil {
+		t.Error("PublishStats over another variable: got no error")
+	}
+	if v := expvar.Get(taken + "calls"); v != nil {
+		t.Errorf("PublishStats over another variable published %scalls", taken)
+	}
+}
+
+func TestUsage(t *testing.T) {
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+
+	srv, client := newTestClient(ctx, t)
+	one, err := client.NewBucket(ctx, "b2test-usage-one", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	two, err := client.NewBucket(ctx, "b2test-usage-two", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	writes := []struct {
+		b    *b2.Bucket
+		name string
+		size int
+	}{
+		{one, "a/x", 10},
+		{one, "a/x", 20}, // the 10-byte version is now hidden
+		{one, "a/b/y", 5},
+		{one, "top", 7},
+		{one, "gone", 3},
+		{two, "z/1", 100},
+		{two, "z/2", 200},
+	}
+	for _, w := range writes {
+		if err := writeObject(ctx, w.b.Object(w.name), bytes.Repeat([]byte("x"), w.size), 1e4); err != nil {
+			t.Fatalf("%s: %v", w.name, err)
+		}
+	}
+	if err := one.Object("gone").Hide(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	acct, err := base.AuthorizeAccount(ctx, "b2test-account", "b2test-key", base.SetAPIBase(srv.URL()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	bs, err := acct.ListBuckets(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, b := range bs {
+		if b.Name != "b2test-usage-two" {
+			continue
+		}
+		if _, err := b.StartLargeFile(ctx, "z/unfinished", "", nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	want := map[string]b2.BucketUsage{
+		"b2test-usage-one": {
+			Usage: b2.Usage{
+				Live:   b2.UsageCount{Objects: 3, Bytes: 32},
+				Hidden: b2.UsageCount{Objects: 2, Bytes: 13},
+			},
+			Prefixes: map[string]*b2.Usage{
+				"a/": {
+					Live:   b2.UsageCount{Objects: 2, Bytes: 25},
+					Hidden: b2.UsageCount{Objects: 1, Bytes: 10},
+				},
+				"": {
+					Live:   b2.UsageCount{Objects: 1, Bytes: 7},
+					Hidden: b2.UsageCount{Objects: 1, Bytes: 3},
+				},
+			},
+		},
+		"b2test-usage-two": {
+			Usage: b2.Usage{
+				Live:       b2.UsageCount{Objects: 2, Bytes: 300},
+				Unfinished: b2.UsageCount{Objects: 1},
+			},
+			Prefixes: map[string]*b2.Usage{
+				"z/": {
+					Live:       b2.UsageCount{Objects: 2, Bytes: 300},
+					Unfinished: b2.UsageCount{Objects: 1},
+				},
+			},
+		},
+	}
+	check := func(r b2.UsageReport) {
+		t.Helper()
+		if r.Cursor != nil {
+			t.Errorf("Usage: got a cursor for a complete walk")
+		}
+		if len(r.Buckets) != len(want) {
+			t.Errorf("Usage: got %d buckets, want %d", len(r.Buckets), len(want))
+		}
+		for name, w := range want {
+			got := r.Buckets[name]
+			if got == nil {
+				t.Errorf("Usage: no report for %s", name)
+				continue
+			}
+			if !reflect.DeepEqual(*got, w) {
+				t.Errorf("Usage: %s: got %+v, want %+v", name, *got, w)
+			}
+		}
+	}
+
+	var progress []b2.UsageProgress
+	r, err := client.Usage(ctx, b2.UsageConcurrency(2), b2.UsageProgressFunc(func(p b2.UsageProgress) {
+		progress = append(progress, p)
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	check(r)
+	if tot := r.Total(); tot.Live.Bytes != 332 || tot.Live.Objects != 5 {
+		t.Errorf("Total(): got %+v, want 5 live objects of 332 bytes", tot.Live)
+	}
+	if len(progress) == 0 {
+		t.Fatal("Usage: progress func never called")
+	}
+
+	// Resuming from any point should give the same result.
+	for _, p := range progress {
+		r, err := client.Usage(ctx, b2.UsageResume(p.Cursor))
+		if err != nil {
+			t.Fatal(err)
+		}
+		check(r)
+	}
+
+	// A walk whose context ends between buckets is partial, even though no
+	// bucket's walk failed.
+	stopped, stop := context.WithCancel(ctx)
+	defer stop()
+	r, err = client.Usage(stopped, b2.UsageConcurrency(1), b2.UsageProgressFunc(func(p b2.UsageProgress) {
+		if p.Cursor.Done[p.Bucket] {
+			stop()
+		}
+	}))
+	if err != context.Canceled {
+		t.Fatalf("Usage with a canceled context: got %v, want %v", err, context.Canceled)
+	}
+	if r.Cursor == nil {
+		t.Fatal("Usage with a canceled context: got no cursor")
+	}
+	r, err = client.Usage(ctx, b2.UsageResume(r.Cursor))
+	if err != nil {
+		t.Fatal(err)
+	}
+	check(r)
+}
+
+func TestErrorInspection(t *testing.T) {
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	// fail returns the error from an authorization that the service refuses
+	// with the given status.
+	fail := func(status int, retryAfter string) error {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if retryAfter != "" {
+				w.Header().Set("Retry-After", retryAfter)
+			}
+			w.WriteHeader(status)
+			fmt.Fprintf(w, `{"status": %d, "code": "nope", "message": "nope"}`, status)
+		}))
+		defer srv.Close()
+		_, err := base.AuthorizeAccount(ctx, "id", "key", base.SetAPIBase(srv.URL))
+		if err == nil {
+			t.Fatalf("AuthorizeAccount with status %d: got no error", status)
+		}
+		// Errors reach callers wrapped, after any retries.
+		return &b2.Error{Op: "read", Bucket: "bucket", Object: "object", Err: base.WithRetries(err, 3, time.Second, 0)}
+	}
+
+	busy := fail(http.StatusServiceUnavailable, "7")
+	if !b2.IsTransient(busy) {
+		t.Errorf("IsTransient(%v): got false, want true", busy)
+	}
+	if b2.IsAuthError(busy) {
+		t.Errorf("IsAuthError(%v): got true, want false", busy)
+	}
+	if d, ok := b2.RetryAfter(busy); !ok || d != 7*time.Second {
+		t.Errorf("RetryAfter(%v): got %v, %v, want 7s, true", busy, d, ok)
+	}
+
+	denied := fail(http.StatusUnauthorized, "")
+	if b2.IsTransient(denied) {
+		t.Errorf("IsTransient(%v): got true, want false", denied)
+	}
+	if !b2.IsAuthError(denied) {
+		t.Errorf("IsAuthError(%v): got false, want true", denied)
+	}
+	if d, ok := b2.RetryAfter(denied); ok {
+		t.Errorf("RetryAfter(%v): got %v, true, want false", denied, d)
+	}
+
+	for _, err := range []error{nil, errors.New("nope"), context.Canceled, io.EOF} {
+		if b2.IsTransient(err) || b2.IsAuthError(err) {
+			t.Errorf("%v: reported as transient or an authorization error", err)
+		}
+	}
+}
+
+func TestCapExceeded(t *testing.T) {
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	var mu sync.Mutex
+	var reported []b2.Cap
+	_, client, bucket := newTestBucket(ctx, t, "b2test-cap", b2.ForceCapExceeded(), b2.OnCapExceeded(func(e *b2.CapExceededError) {
+		mu.Lock()
+		defer mu.Unlock()
+		reported = append(reported, e.Cap)
+	}))
+
+	for _, size := range []int{10, 25e3} {
+		err := writeObject(ctx, bucket.Object("capped"), bytes.Repeat([]byte{'x'}, size), 1e4)
+		if !errors.Is(err, b2.ErrCapExceeded) {
+			t.Fatalf("writing %d bytes: got %v, want %v", size, err, b2.ErrCapExceeded)
+		}
+		var ce *b2.CapExceededError
+		if !errors.As(err, &ce) || ce.Cap != b2.CapStorage {
+			t.Errorf("writing %d bytes: got %v, want a storage cap error", size, err)
+		}
+	}
+	mu.Lock()
+	if len(reported) < 2 || reported[0] != b2.CapStorage {
+		t.Errorf("OnCapExceeded: got %v, want storage caps", reported)
+	}
+	mu.Unlock()
+
+	// The large file's parts don't linger.
+	iter := bucket.List(ctx, b2.ListUnfinished())
+	for iter.Next() {
+		t.Errorf("unfinished large file %q was not canceled", iter.Object().Name())
+	}
+	if err := iter.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if n := client.Stats().Calls["b2_upload_part"]; n > 3 {
+		t.Errorf("b2_upload_part calls: got %d, want no retries", n)
+	}
+}
+
+func TestUserAgentVersion(t *testing.T) {
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	if b2.LibraryVersion() != blazer.Version {
+		t.Errorf("LibraryVersion: got %q, want %q", b2.LibraryVersion(), blazer.Version)
+	}
+	var mu sync.Mutex
+	agents := make(map[string]bool)
+	ht := hookTransport{
+		rt: http.DefaultTransport,
+		before: func(req *http.Request) {
+			mu.Lock()
+			defer mu.Unlock()
+			agents[req.Header.Get("User-Agent")] = true
+		},
+		after: func(*http.Request) {},
+	}
+	_, _, bucket := newTestBucket(ctx, t, "b2test-agent", b2.Transport(ht), b2.UserAgent("b2test/1.0"))
+	if err := writeObject(ctx, bucket.Object("obj"), []byte("data"), 1e4); err != nil {
+		t.Fatal(err)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	want := "b2test/1.0 blazer/" + blazer.Version
+	if len(agents) != 1 || !agents[want] {
+		t.Errorf("User-Agent: got %v, want only %q", agents, want)
+	}
+}
+
+// revokeTransport, once revoked, answers the way B2 does after a key has been
+// deleted: auth tokens are refused, and so is the key.
+type revokeTransport struct {
+	rt      http.RoundTripper
+	revoked *int32
+}
+
+func (rt revokeTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if atomic.LoadInt32(rt.revoked) == 0 {
+		return rt.rt.RoundTrip(req)
+	}
+	body := `{"status":401,"code":"bad_auth_token","message":"invalid token"}`
+	if strings.HasSuffix(req.URL.Path, "/b2_authorize_account") {
+		body = `{"status":401,"code":"unauthorized","message":"key deleted"}`
+	}
+	return &http.Response{
+		StatusCode: http.StatusUnauthorized,
+		Header:     http.Header{"Content-Type": {"application/json"}},
+		Body:       ioutil.NopCloser(strings.NewReader(body)),
+		Request:    req,
+	}, nil
+}
+
+// keyTransport, if restricted, answers the way B2 does for a key restricted
+// to one bucket, which may not list buckets without naming one.  Once
+// narrowed is set, the next API call finds its auth token expired, and the
+// key is reauthorized without writeFiles.
+type keyTransport struct {
+	rt         http.RoundTripper
+	restricted bool
+	narrowed   *int32
+}
+
+func (kt keyTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	refuse := func(code string) (*http.Response, error) {
+		return &http.Response{
+			StatusCode: http.StatusUnauthorized,
+			Header:     http.Header{"Content-Type": {"application/json"}},
+			Body:       ioutil.NopCloser(strings.NewReader(fmt.Sprintf(`{"status":401,"code":%q,"message":"refused"}`, code))),
+			Request:    req,
+		}, nil
+	}
+	if strings.HasSuffix(req.URL.Path, "/b2_authorize_account") {
+		resp, err := kt.rt.RoundTrip(req)
+		if err != nil || atomic.LoadInt32(kt.narrowed) == 0 {
+			return resp, err
+		}
+		body, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		body = bytes.Replace(body, []byte(`"writeFiles",`), nil, 1)
+		resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+		resp.ContentLength = int64(len(body))
+		resp.Header.Del("Content-Length")
+		return resp, nil
+	}
+	if atomic.CompareAndSwapInt32(kt.narrowed, 1, 2) {
+		return refuse("expired_auth_token")
+	}
+	if kt.restricted && strings.HasSuffix(req.URL.Path, "/b2_list_buckets") && req.Body != nil {
+		body, err := ioutil.ReadAll(req.Body)
+		if err != nil {
+			return nil, err
+		}
+		req.Body = ioutil.NopCloser(bytes.NewReader(body))
+		if !bytes.Contains(body, []byte(`"bucketName"`)) {
+			return refuse("unauthorized")
+		}
+	}
+	return kt.rt.RoundTrip(req)
+}
+
+func TestHealthCheckRestrictedKey(t *testing.T) {
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	var narrowed int32
+	srv, client := newTestClient(ctx, t)
+	if _, err := client.NewBucket(ctx, "b2test-health", nil); err != nil {
+		t.Fatal(err)
+	}
+	restricted, err := srv.NewClient(ctx, b2.Transport(keyTransport{rt: http.DefaultTransport, restricted: true, narrowed: new(int32)}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := restricted.HealthCheck(ctx, b2.CanWriteFiles, b2.BucketAccess("b2test-health")); err != nil {
+		t.Errorf("restricted key: %v", err)
+	}
+
+	// The capabilities checked are those of the new authorization.
+	narrowing, err := srv.NewClient(ctx, b2.Transport(keyTransport{rt: http.DefaultTransport, narrowed: &narrowed}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, reqs := range [][]b2.Capability{
+		{b2.CanWriteFiles},
+		{b2.CanWriteFiles, b2.BucketAccess("b2test-health")},
+	} {
+		atomic.StoreInt32(&narrowed, 1)
+		err := narrowing.HealthCheck(ctx, reqs...)
+		var he *b2.HealthError
+		if !errors.As(err, &he) || he.Problem != b2.MissingCapability || !reflect.DeepEqual(he.Missing, []b2.Capability{b2.CanWriteFiles}) {
+			t.Errorf("narrowed key, %v: got %v, want missing %v", reqs, err, b2.CanWriteFiles)
+		}
+	}
+}
+
+func TestHealthCheck(t *testing.T) {
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	var revoked int32
+	srv, client := newTestClient(ctx, t, b2.Transport(revokeTransport{rt: http.DefaultTransport, revoked: &revoked}))
+	if _, err := client.NewBucket(ctx, "b2test-health", nil); err != nil {
+		t.Fatal(err)
+	}
+	denied := bucketID(ctx, t, srv, "b2test-health")
+	restricted, err := srv.NewClient(ctx, b2.Transport(denyTransport{rt: http.DefaultTransport, bucket: denied}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	problem := func(err error) string {
+		if err == nil {
+			return "healthy"
+		}
+		var he *b2.HealthError
+		if !errors.As(err, &he) {
+			return fmt.Sprintf("not a HealthError: %v", err)
+		}
+		return fmt.Sprintf("%v %v", he.Problem, he.Missing)
+	}
+
+	table := []struct {
+		desc   string
+		client *b2.Client
+		reqs   []b2.Capability
+		want   string
+	}{
+		{
+			desc:   "no requirements",
+			client: client,
+			want:   "healthy",
+		},
+		{
+			desc:   "granted capabilities and bucket",
+			client: client,
+			reqs:   []b2.Capability{b2.CanReadFiles, b2.CanWriteFiles, b2.BucketAccess("b2test-health")},
+			want:   "healthy",
+		},
+		{
+			desc:   "unknown capability",
+			client: client,
+			reqs:   []b2.Capability{b2.CanReadFiles, "readBucketEncryption"},
+			want:   "missing capability [readBucketEncryption]",
+		},
+		{
+			desc:   "absent bucket",
+			client: client,
+			reqs:   []b2.Capability{b2.BucketAccess("b2test-nowhere")},
+			want:   `missing capability [access to bucket "b2test-nowhere"]`,
+		},
+		{
+			desc:   "unlistable bucket",
+			client: restricted,
+			reqs:   []b2.Capability{b2.BucketAccess("b2test-health")},
+			want:   `missing capability [access to bucket "b2test-health"]`,
+		},
+	}
+	for _, e := range table {
+		if got := problem(e.client.HealthCheck(ctx, e.reqs...)); got != e.want {
+			t.Errorf("%s: got %s, want %s", e.desc, got, e.want)
+		}
+	}
+
+	atomic.StoreInt32(&revoked, 1)
+	if got, want := problem(client.HealthCheck(ctx)), "bad credentials []"; got != want {
+		t.Errorf("revoked key: got %s, want %s", got, want)
+	}
+
+	srv.Close()
+	tctx, tcancel := context.WithTimeout(ctx, time.Second)
+	defer tcancel()
+	if got, want := problem(restricted.HealthCheck(tctx)), "B2 unavailable []"; got != want {
+		t.Errorf("closed server: got %s, want %s", got, want)
+	}
+}
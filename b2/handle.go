@@ -0,0 +1,144 @@
+// Copyright 2017, the Blazer authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package b2
+
+import (
+	"context"
+	"errors"
+	"io"
+	"sync"
+
+	"github.com/kurin/blazer/internal/b2types"
+)
+
+// ObjectHandle is an object whose download has begun.  Its attributes are
+// available as soon as it is opened, and its contents can be read without
+// another request.  Handles must be closed.
+type ObjectHandle struct {
+	o     *Object
+	ctx   context.Context
+	attrs *Attrs
+
+	mu     sync.Mutex
+	fr     beFileReaderInterface
+	taken  bool
+	closed bool
+}
+
+// Open begins downloading the object and returns a handle carrying the
+// object's attributes, which are taken from the response headers.  This
+// suits callers that decide, based on the attributes, whether to read the
+// object at all: reading the handle continues the same download, and closing
+// it without reading abandons the download immediately.
+func (o *Object) Open(ctx context.Context) (*ObjectHandle, error) {
+	var fr beFileReaderInterface
+	var err error
+	if o.asOf.IsZero() {
+		fr, err = o.b.backend().downloadFileByName(ctx, o.name, "", 0, 0, false)
+	} else {
+		var f beFileInterface
+		if f, err = o.ensure(ctx); err == nil {
+			fr, err = o.b.backend().downloadFileByID(ctx, f.id(), "", 0, 0, false)
+		}
+	}
+	if err != nil {
+		return nil, o.wrap("open", err)
+	}
+	_, ctype, sha1, info := fr.stats()
+	attrs := &Attrs{
+		ID:              fr.id(),
+		Name:            o.name,
+		Size:            fr.fileSize(),
+		ContentType:     ctype,
+		Status:          Uploaded,
+		UploadTimestamp: fr.timestamp(),
+		SHA1:            sha1,
+		Info:            make(map[string]string),
+	}
+	for k, v := range info {
+		switch k {
+		case "src_last_modified_millis":
+			ms, err := b2types.ParseMillis(v)
+			if err != nil {
+				fr.Close()
+				return nil, o.wrap("open", err)
+			}
+			attrs.LastModified = ms.Time()
+		default:
+			attrs.Info[k] = v
+		}
+	}
+	return &ObjectHandle{
+		o:     o,
+		ctx:   ctx,
+		attrs: attrs,
+		fr:    fr,
+	}, nil
+}
+
+// Attrs returns the attributes of the object.
+func (h *ObjectHandle) Attrs() *Attrs {
+	return copyAttrs(h.attrs)
+}
+
+// Reader returns the object's contents.  The first call continues the
+// download begun by Open; later calls start a new download with NewReader.
+// Closing the first reader closes the handle.  Once the handle is closed,
+// the reader it returns fails every Read.
+func (h *ObjectHandle) Reader() io.ReadCloser {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.closed {
+		return handleReader{h}
+	}
+	if h.taken {
+		return h.o.NewReader(h.ctx)
+	}
+	h.taken = true
+	return handleReader{h}
+}
+
+// Close releases the handle's connection.  It is safe to call more than
+// once.
+func (h *ObjectHandle) Close() error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.closed {
+		return nil
+	}
+	h.closed = true
+	return h.fr.Close()
+}
+
+var errHandleClosed = errors.New("b2: read from closed ObjectHandle")
+
+type handleReader struct {
+	h *ObjectHandle
+}
+
+func (r handleReader) Read(p []byte) (int, error) {
+	r.h.mu.Lock()
+	closed := r.h.closed
+	r.h.mu.Unlock()
+	if closed {
+		return 0, errHandleClosed
+	}
+	n, err := r.h.fr.Read(p)
+	return n, r.h.o.wrap("read", err)
+}
+
+func (r handleReader) Close() error {
+	return r.h.Close()
+}
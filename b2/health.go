@@ -0,0 +1,231 @@
+// Copyright 2018, the Blazer authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package b2
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+// Capability names something an application key can be allowed to do.
+type Capability string
+
+// The capabilities that B2 grants to application keys.
+const (
+	CanListKeys      Capability = "listKeys"
+	CanWriteKeys     Capability = "writeKeys"
+	CanDeleteKeys    Capability = "deleteKeys"
+	CanListBuckets   Capability = "listBuckets"
+	CanWriteBuckets  Capability = "writeBuckets"
+	CanDeleteBuckets Capability = "deleteBuckets"
+	CanListFiles     Capability = "listFiles"
+	CanReadFiles     Capability = "readFiles"
+	CanShareFiles    Capability = "shareFiles"
+	CanWriteFiles    Capability = "writeFiles"
+	CanDeleteFiles   Capability = "deleteFiles"
+)
+
+// bucketAccess prefixes the Capabilities made by BucketAccess.  B2's
+// capability names never contain a colon.
+const bucketAccess = "bucket:"
+
+// BucketAccess is not a B2 capability, but a requirement for HealthCheck: that
+// the key can find the named bucket and list the files in it.
+func BucketAccess(name string) Capability {
+	return Capability(bucketAccess + name)
+}
+
+func (c Capability) bucket() (string, bool) {
+	if !strings.HasPrefix(string(c), bucketAccess) {
+		return "", false
+	}
+	return strings.TrimPrefix(string(c), bucketAccess), true
+}
+
+func (c Capability) String() string {
+	if name, ok := c.bucket(); ok {
+		return fmt.Sprintf("access to bucket %q", name)
+	}
+	return string(c)
+}
+
+// HealthProblem says why a HealthCheck failed.
+type HealthProblem int
+
+const (
+	// Unavailable means that B2 could not be reached, or could not answer:
+	// the network failed, the context expired, B2 returned a server error, or
+	// the account has reached one of its caps.
+	Unavailable HealthProblem = iota
+
+	// BadCredentials means that B2 refused the client's key or auth token.
+	BadCredentials
+
+	// MissingCapability means that the key is valid, but is not allowed to do
+	// everything that was asked of it.
+	MissingCapability
+)
+
+func (p HealthProblem) String() string {
+	switch p {
+	case Unavailable:
+		return "B2 unavailable"
+	case BadCredentials:
+		return "bad credentials"
+	case MissingCapability:
+		return "missing capability"
+	}
+	return fmt.Sprintf("HealthProblem(%d)", int(p))
+}
+
+// HealthError is returned by HealthCheck when the client is not healthy.  Use
+// errors.As to find it in an error chain.
+type HealthError struct {
+	Problem HealthProblem
+
+	// Missing lists the requirements that the key does not meet, when Problem
+	// is MissingCapability.
+	Missing []Capability
+
+	// Err is the error returned by B2, if any.
+	Err error
+}
+
+func (e *HealthError) Error() string {
+	msg := "b2: health check: " + e.Problem.String()
+	if len(e.Missing) > 0 {
+		var missing []string
+		for _, c := range e.Missing {
+			missing = append(missing, c.String())
+		}
+		msg += " " + strings.Join(missing, ", ")
+	}
+	if e.Err != nil {
+		msg += ": " + e.Err.Error()
+	}
+	return msg
+}
+
+func (e *HealthError) Unwrap() error { return e.Err }
+
+// HealthCheck reports whether the client can reach B2 with valid credentials
+// whose key has the given capabilities, making as few requests as it can.  It
+// is meant for readiness probes; a failure is returned as a *HealthError.
+//
+// The cached auth token is checked by listing buckets, which reauthorizes the
+// client if the token has expired.  If there are BucketAccess requirements,
+// only those buckets are listed, by name, which B2 allows even for a key
+// restricted to one bucket; each then costs a further listing of at most one
+// file.  Otherwise, if the key isn't allowed to list buckets, the client is
+// reauthorized instead.  The key's capabilities are checked once this is
+// done, so that they are those of the current authorization.
+func (c *Client) HealthCheck(ctx context.Context, requirements ...Capability) error {
+	var caps []Capability
+	var names []string
+	for _, r := range requirements {
+		if name, ok := r.bucket(); ok {
+			names = append(names, name)
+			continue
+		}
+		caps = append(caps, r)
+	}
+
+	buckets := make(map[string]beBucketInterface)
+	for _, name := range names {
+		bs, err := c.backend.listBuckets(ctx, name)
+		if err != nil {
+			return bucketHealthError(name, err)
+		}
+		for _, b := range bs {
+			if b.name() == name {
+				buckets[name] = b
+			}
+		}
+	}
+	if len(names) == 0 {
+		var err error
+		if c.hasCapability(CanListBuckets) {
+			_, err = c.backend.listBuckets(ctx, "")
+		} else {
+			err = c.backend.reauthorizeAccount(ctx)
+		}
+		if err != nil {
+			return &HealthError{Problem: healthProblem(err), Err: err}
+		}
+	}
+
+	var missing []Capability
+	for _, want := range caps {
+		if !c.hasCapability(want) {
+			missing = append(missing, want)
+		}
+	}
+	if len(missing) > 0 {
+		return &HealthError{Problem: MissingCapability, Missing: missing}
+	}
+
+	for _, name := range names {
+		if err := c.checkBucketAccess(ctx, name, buckets[name]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *Client) hasCapability(want Capability) bool {
+	for _, s := range c.backend.capabilities() {
+		if Capability(s) == want {
+			return true
+		}
+	}
+	return false
+}
+
+// bucketHealthError describes err, which kept the key from reaching the named
+// bucket.
+func bucketHealthError(name string, err error) *HealthError {
+	p := healthProblem(err)
+	he := &HealthError{Problem: p, Err: err}
+	if p == MissingCapability {
+		he.Missing = []Capability{BucketAccess(name)}
+	}
+	return he
+}
+
+// checkBucketAccess lists a file from the named bucket, b, which is nil if the
+// bucket wasn't found.
+func (c *Client) checkBucketAccess(ctx context.Context, name string, b beBucketInterface) error {
+	if b == nil {
+		return &HealthError{
+			Problem: MissingCapability,
+			Missing: []Capability{BucketAccess(name)},
+			Err:     b2err{err: fmt.Errorf("%s: bucket not found", name), notFoundErr: true},
+		}
+	}
+	bucket := &Bucket{
+		b:       b,
+		r:       c.backend,
+		c:       c,
+		urlPool: newURLPool(),
+	}
+	iter := bucket.List(ctx, ListPageSize(1), ListPrefetch(0))
+	iter.Next()
+	iter.Close()
+	if err := iter.Err(); err != nil {
+		return bucketHealthError(name, err)
+	}
+	return nil
+}
@@ -0,0 +1,278 @@
+// Copyright 2018, the Blazer authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package b2
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Upload URLs name a particular B2 pod.  When a pod is slow or failing, it is
+// better to ask for a new URL than to keep retrying against it, so the client
+// keeps track of how uploads to each host have fared.  A failing host is
+// avoided at once: uploads to it give up and get a new URL.  A slow host is
+// avoided when there is time to spare: its pooled URLs are passed over, and
+// an upload thread with no part waiting swaps its URL for a new one.
+
+const (
+	defaultHostFailures = 3
+	defaultHostWindow   = time.Minute
+	defaultHostSlowness = 4
+
+	// hostSamples is how many recent successful uploads are kept per host to
+	// judge its speed, and minHostSamples how many are needed, from the host
+	// and from the others, before it is judged.
+	hostSamples    = 16
+	minHostSamples = 3
+)
+
+// UploadHostFailures sets how many failed uploads to a single host within
+// window cause the client to stop using upload URLs for that host.  Once a
+// host is failing, uploads to it give up and fetch a new upload URL instead of
+// retrying, and pooled URLs for it are thrown away.  The default is three
+// failures in one minute.
+func UploadHostFailures(n int, window time.Duration) ClientOption {
+	return func(c *clientOptions) {
+		c.hostFailures = n
+		c.hostWindow = window
+	}
+}
+
+// UploadHostLatency sets how many times longer per byte than the client's
+// other upload hosts a host's recent successful uploads must take before the
+// client stops using it while it has a choice.  A host is judged once it and
+// the other hosts together have each had at least three successful uploads
+// within the window set by UploadHostFailures.  The default is four; a
+// negative factor turns this off.
+func UploadHostLatency(factor float64) ClientOption {
+	return func(c *clientOptions) {
+		c.hostLatency = factor
+	}
+}
+
+// UploadHostStats describes the uploads made to one B2 host.
+type UploadHostStats struct {
+	// Uploads and Errors count the upload requests made to the host, and the
+	// ones that failed.
+	Uploads int64
+	Errors  int64
+
+	// RecentErrors is the number of failures within the window set by
+	// UploadHostFailures.
+	RecentErrors int
+
+	// Latency is the mean duration of the successful uploads.
+	Latency time.Duration
+
+	// Failing is true if the client is avoiding the host for its errors.
+	Failing bool
+
+	// Slow is true if the client is avoiding the host because its recent
+	// uploads were much slower than those to other hosts; see
+	// UploadHostLatency.
+	Slow bool
+}
+
+// errHostFailing is returned by an upload that was abandoned because its
+// host has failed too often.  The caller should get a new upload URL.
+type errHostFailing struct {
+	host string
+	err  error
+}
+
+func (e errHostFailing) Error() string {
+	return fmt.Sprintf("upload host %s is failing: %v", e.host, e.err)
+}
+
+func (e errHostFailing) Unwrap() error { return e.err }
+
+func isHostFailing(err error) bool {
+	var e errHostFailing
+	return errors.As(err, &e)
+}
+
+type hostStat struct {
+	uploads, errors int64
+	elapsed         time.Duration // of successful uploads
+	recent          []time.Time   // failures within the window
+	samples         []hostSample  // recent successful uploads, oldest first
+}
+
+// hostSample is one successful upload.
+type hostSample struct {
+	at    time.Time
+	bytes int64
+	d     time.Duration
+}
+
+// hostTracker records the outcome of each upload attempt, by host.  The zero
+// value is ready to use.
+type hostTracker struct {
+	mu    sync.Mutex
+	hosts map[string]*hostStat
+}
+
+// hostSlowness returns the UploadHostLatency factor, or 0 if slow hosts are
+// not avoided.
+func (o clientOptions) hostSlowness() float64 {
+	switch f := o.hostLatency; {
+	case f < 0:
+		return 0
+	case f == 0:
+		return defaultHostSlowness
+	default:
+		return f
+	}
+}
+
+func (o clientOptions) hostLimits() (int, time.Duration) {
+	n, window := o.hostFailures, o.hostWindow
+	if n <= 0 {
+		n = defaultHostFailures
+	}
+	if window <= 0 {
+		window = defaultHostWindow
+	}
+	return n, window
+}
+
+// trim drops failures and samples that have fallen out of the window.
+func (hs *hostStat) trim(now time.Time, window time.Duration) {
+	var i int
+	for i < len(hs.recent) && now.Sub(hs.recent[i]) > window {
+		i++
+	}
+	hs.recent = hs.recent[i:]
+	i = 0
+	for i < len(hs.samples) && now.Sub(hs.samples[i].at) > window {
+		i++
+	}
+	hs.samples = hs.samples[i:]
+}
+
+// record notes an upload of size bytes to host that took d and returned err.
+func (t *hostTracker) record(host string, size int64, d time.Duration, err error) {
+	if host == "" {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.hosts == nil {
+		t.hosts = make(map[string]*hostStat)
+	}
+	hs, ok := t.hosts[host]
+	if !ok {
+		hs = &hostStat{}
+		t.hosts[host] = hs
+	}
+	hs.uploads++
+	if err == nil {
+		hs.elapsed += d
+		if len(hs.samples) == hostSamples {
+			hs.samples = hs.samples[1:]
+		}
+		hs.samples = append(hs.samples, hostSample{at: time.Now(), bytes: size, d: d})
+		return
+	}
+	hs.errors++
+	hs.recent = append(hs.recent, time.Now())
+}
+
+// failing reports whether host has failed at least n times within window.
+func (t *hostTracker) failing(host string, n int, window time.Duration) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	hs, ok := t.hosts[host]
+	if !ok {
+		return false
+	}
+	hs.trim(time.Now(), window)
+	return len(hs.recent) >= n
+}
+
+// slow reports whether host's recent uploads took more than factor times as
+// long per byte as those to the other hosts.
+func (t *hostTracker) slow(host string, factor float64, window time.Duration) bool {
+	if factor <= 0 {
+		return false
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.isSlow(host, factor, time.Now(), window)
+}
+
+// isSlow is slow with t.mu held.
+func (t *hostTracker) isSlow(host string, factor float64, now time.Time, window time.Duration) bool {
+	hs, ok := t.hosts[host]
+	if !ok || factor <= 0 {
+		return false
+	}
+	hs.trim(now, window)
+	if len(hs.samples) < minHostSamples {
+		return false
+	}
+	var others []hostSample
+	for h, other := range t.hosts {
+		if h != host {
+			other.trim(now, window)
+			others = append(others, other.samples...)
+		}
+	}
+	if len(others) < minHostSamples {
+		return false
+	}
+	return perByte(hs.samples) > factor*perByte(others)
+}
+
+// perByte returns the time the samples took per byte sent, in nanoseconds.
+func perByte(samples []hostSample) float64 {
+	var bytes int64
+	var d time.Duration
+	for _, s := range samples {
+		bytes += s.bytes
+		d += s.d
+	}
+	if bytes == 0 {
+		bytes = 1
+	}
+	return float64(d) / float64(bytes)
+}
+
+func (t *hostTracker) stats(n int, window time.Duration, factor float64) map[string]UploadHostStats {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if len(t.hosts) == 0 {
+		return nil
+	}
+	now := time.Now()
+	m := make(map[string]UploadHostStats, len(t.hosts))
+	for host, hs := range t.hosts {
+		hs.trim(now, window)
+		s := UploadHostStats{
+			Uploads:      hs.uploads,
+			Errors:       hs.errors,
+			RecentErrors: len(hs.recent),
+			Failing:      len(hs.recent) >= n,
+			Slow:         t.isSlow(host, factor, now, window),
+		}
+		if ok := hs.uploads - hs.errors; ok > 0 {
+			s.Latency = hs.elapsed / time.Duration(ok)
+		}
+		m[host] = s
+	}
+	return m
+}
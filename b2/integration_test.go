@@ -1193,22 +1193,16 @@ func TestListKeys(t *testing.T) {
 	}
 
 	var got []string
-	var cur string
-	for {
-		ks, c, err := bucket.c.ListKeys(ctx, 10, cur)
-		if err != nil && err != io.EOF {
-			t.Fatalf("ListKeys(): %v", err)
-		}
-		for _, k := range ks {
-			if strings.HasSuffix(k.Name(), "list-key-test") {
-				got = append(got, k.Name())
-			}
-		}
-		cur = c
-		if err == io.EOF {
-			break
+	iter := bucket.c.ListKeys(ctx)
+	for iter.Next() {
+		k := iter.Key()
+		if strings.HasSuffix(k.Name(), "list-key-test") {
+			got = append(got, k.Name())
 		}
 	}
+	if err := iter.Err(); err != nil {
+		t.Fatalf("ListKeys(): %v", err)
+	}
 	if len(got) != n {
 		t.Errorf("ListKeys(): got %d, want %d: %v", len(got), n, got)
 	}
@@ -0,0 +1,100 @@
+// Copyright 2018, the Blazer authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package b2
+
+import (
+	"context"
+	"io"
+)
+
+// BucketInterface is the part of a bucket that most programs use: finding,
+// listing, reading and writing its objects.  *Bucket satisfies it.  Code that
+// takes a BucketInterface instead of a *Bucket can be tested with a fake;
+// Migrate takes one for each of its buckets.
+//
+// A fake reports missing objects with ErrNotExist.  It is given ListOptions
+// and WriterOptions but can't inspect them, and may ignore them.
+type BucketInterface interface {
+	Name() string
+	Attrs(context.Context) (*BucketAttrs, error)
+	ObjectNamed(name string) ObjectInterface
+	ListObjects(ctx context.Context, opts ...ListOption) ObjectIteratorInterface
+}
+
+// ObjectInterface is the part of an object that most programs use.  *Object
+// satisfies it.
+type ObjectInterface interface {
+	Name() string
+	Attrs(context.Context) (*Attrs, error)
+	Delete(context.Context) error
+	Download(context.Context) io.ReadCloser
+	Upload(ctx context.Context, r io.Reader, opts ...WriterOption) (*Attrs, error)
+}
+
+// ObjectIteratorInterface is the part of an ObjectIterator that most programs
+// use.  *ObjectIterator satisfies it.  A fake may return an empty Cursor if it
+// can't resume.
+type ObjectIteratorInterface interface {
+	Next() bool
+	Current() ObjectInterface
+	Cursor() string
+	Err() error
+	Close() error
+}
+
+var (
+	_ BucketInterface         = (*Bucket)(nil)
+	_ ObjectInterface         = (*Object)(nil)
+	_ ObjectIteratorInterface = (*ObjectIterator)(nil)
+)
+
+// ObjectNamed returns Object(name), as an ObjectInterface.
+func (b *Bucket) ObjectNamed(name string) ObjectInterface {
+	return b.Object(name)
+}
+
+// ListObjects returns List(ctx, opts...), as an ObjectIteratorInterface.
+func (b *Bucket) ListObjects(ctx context.Context, opts ...ListOption) ObjectIteratorInterface {
+	return b.List(ctx, opts...)
+}
+
+// Current returns Object(), as an ObjectInterface, or nil if there is no
+// current object.
+func (o *ObjectIterator) Current() ObjectInterface {
+	if o.cur == nil {
+		return nil
+	}
+	return o.cur
+}
+
+// Download returns NewReader(ctx), as an io.ReadCloser.
+func (o *Object) Download(ctx context.Context) io.ReadCloser {
+	return o.NewReader(ctx)
+}
+
+// Upload writes the contents of r to the object with a Writer made with the
+// given options, and returns the attributes of the object written.  If r
+// fails, the upload is canceled.
+func (o *Object) Upload(ctx context.Context, r io.Reader, opts ...WriterOption) (*Attrs, error) {
+	w := o.NewWriter(ctx, opts...)
+	if _, err := io.Copy(w, r); err != nil {
+		w.Cancel(ctx)
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return w.File()
+}
@@ -18,14 +18,20 @@ import (
 	"context"
 	"io"
 	"sync"
+	"time"
 )
 
 // List returns an iterator for selecting objects in a bucket.  The default
-// behavior, with no options, is to list all currently un-hidden objects.
+// behavior, with no options, is to list the current version of every
+// un-hidden object; hide markers and unfinished large files are never
+// returned.  With ListHidden, every version is returned, including hide
+// markers (whose Status is Hider) and unfinished large files (Started); these
+// can be left out with ListSkip.
 func (b *Bucket) List(ctx context.Context, opts ...ListOption) *ObjectIterator {
 	o := &ObjectIterator{
 		bucket: b,
 		ctx:    ctx,
+		opts:   objectIteratorOptions{prefetch: 1},
 	}
 	for _, opt := range opts {
 		opt(&o.opts)
@@ -44,6 +50,12 @@ func (b *Bucket) List(ctx context.Context, opts ...ListOption) *ObjectIterator {
 //  if err := iter.Err(); err != nil {
 //    // handle err
 //  }
+//
+// While the caller works through one page of results, the iterator fetches
+// the next in the background; see ListPrefetch.  A caller that stops before
+// Next returns false should call Close, which cancels that fetch.  An
+// iterator that is simply dropped leaves nothing running for long: the
+// fetch ends with its page, and no more are started.
 type ObjectIterator struct {
 	bucket *Bucket
 	ctx    context.Context
@@ -52,32 +64,172 @@ type ObjectIterator struct {
 	idx    int
 	c      *cursor
 	opts   objectIteratorOptions
-	objs   []*Object
+	pg     *pageStream // the page being read, if any
+	cur    *Object
 	init   sync.Once
 	l      lister
 	count  int
+
+	pmu   sync.Mutex
+	ahead []*pageStream // pages fetched ahead of pg, oldest first
+	last  *pageStream   // the page most recently requested
 }
 
-type lister func(context.Context, int, *cursor) ([]*Object, *cursor, error)
+// A lister requests one page of results starting at c, passing each object to
+// fn as soon as it is decoded.  It returns the cursor for the next page, and
+// io.EOF if there is none.
+type lister func(ctx context.Context, count int, c *cursor, fn func(*Object)) (*cursor, error)
 
-func (o *ObjectIterator) page(ctx context.Context) error {
-	if o.opts.locker != nil {
-		o.opts.locker.Lock()
-		defer o.opts.locker.Unlock()
+// pageStream is a page of results that is still arriving.  Objects are added
+// as the reply is decoded; once the request is over, the page is done, and c
+// and err are set.
+type pageStream struct {
+	mu     sync.Mutex
+	more   *sync.Cond
+	objs   []*Object
+	done   bool
+	c      *cursor
+	err    error
+	cancel context.CancelFunc // ends the request early
+}
+
+func newPageStream() *pageStream {
+	pg := &pageStream{}
+	pg.more = sync.NewCond(&pg.mu)
+	return pg
+}
+
+func (pg *pageStream) add(obj *Object) {
+	pg.mu.Lock()
+	defer pg.mu.Unlock()
+	pg.objs = append(pg.objs, obj)
+	pg.more.Broadcast()
+}
+
+func (pg *pageStream) finish(c *cursor, err error) {
+	pg.mu.Lock()
+	defer pg.mu.Unlock()
+	pg.done = true
+	pg.c, pg.err = c, err
+	pg.more.Broadcast()
+}
+
+// at returns the i'th object on the page, waiting for it to arrive, or false
+// if the page ends before it.
+func (pg *pageStream) at(i int) (*Object, bool) {
+	pg.mu.Lock()
+	defer pg.mu.Unlock()
+	for i >= len(pg.objs) && !pg.done {
+		pg.more.Wait()
 	}
-	objs, c, err := o.l(ctx, o.count, o.c)
-	if err != nil && err != io.EOF {
-		if bNotExist.MatchString(err.Error()) {
-			return b2err{
+	if i < len(pg.objs) {
+		return pg.objs[i], true
+	}
+	return nil, false
+}
+
+// wait waits for the page to be done, and returns the cursor for the next page
+// and the error that ended this one.
+func (pg *pageStream) wait() (*cursor, error) {
+	pg.mu.Lock()
+	defer pg.mu.Unlock()
+	for !pg.done {
+		pg.more.Wait()
+	}
+	return pg.c, pg.err
+}
+
+// fetch starts requesting one page of results starting at c, and returns the
+// page as it arrives.  It reads only fields that are fixed by setup, and so is
+// safe to call from any goroutine.  The request ends, and with it the page,
+// if the iterator's context is canceled or the page's cancel is called.
+func (o *ObjectIterator) fetch(c *cursor) *pageStream {
+	ctx, cancel := context.WithCancel(o.ctx)
+	pg := newPageStream()
+	pg.cancel = cancel
+	go func() {
+		defer cancel()
+		if o.opts.locker != nil {
+			o.opts.locker.Lock()
+			defer o.opts.locker.Unlock()
+		}
+		next, err := o.l(ctx, o.count, c, pg.add)
+		if err != nil && err != io.EOF && bNotExist.MatchString(err.Error()) {
+			err = b2err{
 				err:         err,
 				notFoundErr: true,
 			}
 		}
+		pg.finish(next, err)
+	}()
+	return pg
+}
+
+// fetchAfter requests the page after pg once pg's cursor is known, provided
+// pg is still the last page requested and fewer than opts.prefetch pages are
+// waiting for the caller; page calls it again as the caller catches up.
+// Nothing here waits on the caller, only on pg's own request, so an iterator
+// that is dropped without Close stops fetching once the pages ahead are in.
+func (o *ObjectIterator) fetchAfter(pg *pageStream) {
+	if o.opts.prefetch == 0 {
+		return
+	}
+	go func() {
+		c, err := pg.wait()
+		if err != nil {
+			return
+		}
+		o.pmu.Lock()
+		defer o.pmu.Unlock()
+		if pg != o.last || len(o.ahead) >= o.opts.prefetch {
+			return
+		}
+		next := o.fetch(c)
+		o.ahead = append(o.ahead, next)
+		o.last = next
+		o.fetchAfter(next)
+	}()
+}
+
+// stopPrefetch cancels the requests for any pages fetched ahead of the
+// caller, and for the current page, and discards the pages.
+func (o *ObjectIterator) stopPrefetch() {
+	o.pmu.Lock()
+	defer o.pmu.Unlock()
+	for _, pg := range o.ahead {
+		pg.cancel()
+	}
+	if o.last != nil {
+		o.last.cancel()
+	}
+	o.ahead, o.last = nil, nil
+}
+
+// page starts reading the next page: the first of those fetched ahead, if
+// any, or else a new request from o.c.
+func (o *ObjectIterator) page() {
+	o.idx = 0
+	o.pmu.Lock()
+	if len(o.ahead) > 0 {
+		o.pg, o.ahead = o.ahead[0], o.ahead[1:]
+	} else {
+		o.pg = o.fetch(o.c)
+		o.last = o.pg
+	}
+	last := o.last
+	o.pmu.Unlock()
+	o.fetchAfter(last)
+}
+
+// endPage finishes with the current page, once its objects are used up, and
+// readies the iterator for the next one.
+func (o *ObjectIterator) endPage() error {
+	c, err := o.pg.wait()
+	o.pg = nil
+	if err != nil && err != io.EOF {
 		return err
 	}
 	o.c = c
-	o.objs = objs
-	o.idx = 0
 	if err == io.EOF {
 		o.final = true
 	}
@@ -89,27 +241,15 @@ func (o *ObjectIterator) page(ctx context.Context) error {
 // will be valid.  Once Next returns false, it is important to check the return
 // value of Err().
 func (o *ObjectIterator) Next() bool {
-	o.init.Do(func() {
-		o.count = o.opts.pageSize
-		if o.count < 0 || o.count > 1000 {
-			o.count = 1000
-		}
-		switch {
-		case o.opts.unfinished:
-			o.l = o.bucket.listUnfinishedLargeFiles
-			if o.count > 100 {
-				o.count = 100
-			}
-		case o.opts.hidden:
-			o.l = o.bucket.listObjects
-		default:
-			o.l = o.bucket.listCurrentObjects
-		}
-		o.c = &cursor{
-			prefix:    o.opts.prefix,
-			delimiter: o.opts.delimiter,
-		}
-	})
+	o.init.Do(o.setup)
+	if !o.next() {
+		o.stopPrefetch()
+		return false
+	}
+	return true
+}
+
+func (o *ObjectIterator) next() bool {
 	if o.err != nil {
 		return false
 	}
@@ -117,24 +257,155 @@ func (o *ObjectIterator) Next() bool {
 		o.err = o.ctx.Err()
 		return false
 	}
-	if o.idx >= len(o.objs) {
+	if o.pg == nil {
 		if o.final {
 			o.err = io.EOF
 			return false
 		}
-		if err := o.page(o.ctx); err != nil {
-			o.err = err
+		o.page()
+	}
+	obj, ok := o.pg.at(o.idx)
+	if !ok {
+		if err := o.endPage(); err != nil {
+			o.err = wrap("list", o.bucket.Name(), o.opts.prefix, err)
 			return false
 		}
-		return o.Next()
+		return o.next()
 	}
 	o.idx++
+	o.cur = obj
+	if o.tooOld(obj) {
+		o.skipVersions(obj.name)
+		return o.next()
+	}
+	if o.skipped(obj) {
+		return o.next()
+	}
 	return true
 }
 
+// Close stops the iterator, along with any listing it is doing in the
+// background.  After Close, Next returns false.  It is only needed when the
+// caller stops before Next returns false, and then only to save the rest of
+// a page fetched ahead.
+func (o *ObjectIterator) Close() error {
+	o.init.Do(o.setup)
+	o.stopPrefetch()
+	if o.err == nil {
+		o.err = io.EOF
+	}
+	return nil
+}
+
+func (o *ObjectIterator) setup() {
+	o.count = o.opts.pageSize
+	if o.count < 0 || o.count > 1000 {
+		o.count = 1000
+	}
+	switch {
+	case o.opts.unfinished:
+		o.l = o.bucket.listUnfinishedLargeFiles
+		if o.count > 100 {
+			o.count = 100
+		}
+	case o.opts.hidden:
+		o.l = o.bucket.listObjects
+	default:
+		o.l = o.bucket.listCurrentObjects
+		o.opts.skip = append(o.opts.skip, Hider, Started)
+	}
+	o.c = &cursor{
+		prefix:    o.opts.prefix,
+		delimiter: o.opts.delimiter,
+	}
+	if o.opts.cursor != "" {
+		o.resume(o.opts.cursor)
+	}
+}
+
+// tooOld reports whether obj was uploaded before the ListUploadedSince cutoff.
+// Since the versions of each object are listed newest first, once one version
+// is too old, so are the rest.
+func (o *ObjectIterator) tooOld(obj *Object) bool {
+	if o.opts.since.IsZero() || !o.opts.hidden || o.opts.unfinished {
+		return false
+	}
+	return obj.f.timestamp().Before(o.opts.since)
+}
+
+// skipVersions passes over the remaining versions of name, which are older
+// than the current one.  If they continue past this page, the listing
+// restarts just after name, so that they are never requested.
+func (o *ObjectIterator) skipVersions(name string) {
+	for {
+		obj, ok := o.pg.at(o.idx)
+		if !ok {
+			break
+		}
+		if obj.name != name {
+			return
+		}
+		o.idx++
+	}
+	if err := o.endPage(); err != nil {
+		o.err = wrap("list", o.bucket.Name(), o.opts.prefix, err)
+		return
+	}
+	if o.c != nil && o.c.name == name {
+		// Any page fetched ahead starts at the old cursor.
+		o.stopPrefetch()
+		o.c = &cursor{
+			prefix:    o.c.prefix,
+			delimiter: o.c.delimiter,
+			name:      name + "\x00",
+		}
+	}
+}
+
+func (o *ObjectIterator) skipped(obj *Object) bool {
+	if len(o.opts.skip) == 0 {
+		return false
+	}
+	state := objectState(obj.f.status())
+	for _, s := range o.opts.skip {
+		if s == state {
+			return true
+		}
+	}
+	return false
+}
+
 // Object returns the current object.
 func (o *ObjectIterator) Object() *Object {
-	return o.objs[o.idx-1]
+	return o.cur
+}
+
+// ObjectVersion describes one version of an object, as it was listed.
+type ObjectVersion struct {
+	Name            string
+	ID              string // empty for folders
+	Status          ObjectState
+	Size            int64
+	UploadTimestamp time.Time
+}
+
+// Version describes the current object as it was listed.  Unlike the
+// object's Attrs, it makes no request.  With ListHidden, each object's
+// versions are listed newest first, so a caller can stop reading an object's
+// history once it reaches a version that is old enough.  It returns nil if
+// there is no current object.
+func (o *ObjectIterator) Version() *ObjectVersion {
+	if o.cur == nil || o.cur.f == nil {
+		return nil
+	}
+	f := o.cur.f
+	return &ObjectVersion{
+		Name:            f.name(),
+		ID:              f.id(),
+		Status:          objectState(f.status()),
+		Size:            f.size(),
+		UploadTimestamp: f.timestamp(),
+	}
 }
 
 // Err returns the current error or nil.  If Next() returns false and Err() is
@@ -153,6 +424,11 @@ type objectIteratorOptions struct {
 	delimiter  string
 	pageSize   int
 	locker     sync.Locker
+	skip       []ObjectState
+	since      time.Time
+	cursor     string
+	prefetch   int
+	buckets    int // for ListAllBuckets
 }
 
 // A ListOption alters the default behavor of List.
@@ -173,6 +449,27 @@ func ListUnfinished() ListOption {
 	}
 }
 
+// ListSkip will leave objects in any of the given states out of the listing.
+// For example, ListHidden() and ListSkip(Hider, Started) together list every
+// finished version of every object, but not the markers that hide them or any
+// large files still being uploaded.
+func ListSkip(states ...ObjectState) ListOption {
+	return func(o *objectIteratorOptions) {
+		o.skip = append(o.skip, states...)
+	}
+}
+
+// ListUploadedSince, along with ListHidden, leaves out object versions
+// uploaded before t.  Because the versions of each object are listed newest
+// first, the iterator stops requesting an object's history once it reaches
+// one that is too old, which saves transactions on buckets with many old
+// versions.
+func ListUploadedSince(t time.Time) ListOption {
+	return func(o *objectIteratorOptions) {
+		o.since = t
+	}
+}
+
 // ListPrefix will restrict the output to objects whose names begin with
 // prefix.
 func ListPrefix(pfx string) ListOption {
@@ -208,6 +505,33 @@ func ListPageSize(count int) ListOption {
 	}
 }
 
+// ListPrefetch sets how many pages the iterator may request ahead of the
+// page the caller is working through, so that network and processing
+// overlap.  The default is 1; with 0, each page is requested only once the
+// previous one is used up.  Since each page is a transaction, prefetching
+// costs up to n extra calls when the caller stops early.  A negative n is
+// treated as 0.
+func ListPrefetch(n int) ListOption {
+	return func(o *objectIteratorOptions) {
+		if n < 0 {
+			n = 0
+		}
+		o.prefetch = n
+	}
+}
+
+// WithCursor resumes a listing from a cursor returned by an earlier
+// iterator's Cursor method.  The other options must describe the same listing
+// as the earlier iterator's did: the same prefix and delimiter, and the same
+// choice of current objects, all versions, or unfinished large files.  If
+// they don't, the iterator returns ErrCursorMismatch from Err without listing
+// anything.
+func WithCursor(cursor string) ListOption {
+	return func(o *objectIteratorOptions) {
+		o.cursor = cursor
+	}
+}
+
 // ListLocker passes the iterator a lock which will be held during network
 // round-trips.
 func ListLocker(l sync.Locker) ListOption {
@@ -238,13 +562,22 @@ type cursor struct {
 	id   string
 }
 
-func (b *Bucket) listObjects(ctx context.Context, count int, c *cursor) ([]*Object, *cursor, error) {
+func (b *Bucket) listObjects(ctx context.Context, count int, c *cursor, fn func(*Object)) (*cursor, error) {
 	if c == nil {
 		c = &cursor{}
 	}
-	fs, name, id, err := b.b.listFileVersions(ctx, count, c.name, c.id, c.prefix, c.delimiter)
+	var n int
+	name, id, err := b.backend().listFileVersionsFunc(ctx, count, c.name, c.id, c.prefix, c.delimiter, func(f beFileInterface) error {
+		n++
+		fn(&Object{
+			name: f.name(),
+			f:    f,
+			b:    b,
+		})
+		return nil
+	})
 	if err != nil {
-		return nil, nil, err
+		return nil, err
 	}
 	var next *cursor
 	if name != "" && id != "" {
@@ -255,28 +588,29 @@ func (b *Bucket) listObjects(ctx context.Context, count int, c *cursor) ([]*Obje
 			id:        id,
 		}
 	}
-	var objects []*Object
-	for _, f := range fs {
-		objects = append(objects, &Object{
-			name: f.name(),
-			f:    f,
-			b:    b,
-		})
-	}
 	var rtnErr error
-	if len(objects) == 0 || next == nil {
+	if n == 0 || next == nil {
 		rtnErr = io.EOF
 	}
-	return objects, next, rtnErr
+	return next, rtnErr
 }
 
-func (b *Bucket) listCurrentObjects(ctx context.Context, count int, c *cursor) ([]*Object, *cursor, error) {
+func (b *Bucket) listCurrentObjects(ctx context.Context, count int, c *cursor, fn func(*Object)) (*cursor, error) {
 	if c == nil {
 		c = &cursor{}
 	}
-	fs, name, err := b.b.listFileNames(ctx, count, c.name, c.prefix, c.delimiter)
+	var n int
+	name, err := b.backend().listFileNamesFunc(ctx, count, c.name, c.prefix, c.delimiter, func(f beFileInterface) error {
+		n++
+		fn(&Object{
+			name: f.name(),
+			f:    f,
+			b:    b,
+		})
+		return nil
+	})
 	if err != nil {
-		return nil, nil, err
+		return nil, err
 	}
 	var next *cursor
 	if name != "" {
@@ -286,28 +620,20 @@ func (b *Bucket) listCurrentObjects(ctx context.Context, count int, c *cursor) (
 			name:      name,
 		}
 	}
-	var objects []*Object
-	for _, f := range fs {
-		objects = append(objects, &Object{
-			name: f.name(),
-			f:    f,
-			b:    b,
-		})
-	}
 	var rtnErr error
-	if len(objects) == 0 || next == nil {
+	if n == 0 || next == nil {
 		rtnErr = io.EOF
 	}
-	return objects, next, rtnErr
+	return next, rtnErr
 }
 
-func (b *Bucket) listUnfinishedLargeFiles(ctx context.Context, count int, c *cursor) ([]*Object, *cursor, error) {
+func (b *Bucket) listUnfinishedLargeFiles(ctx context.Context, count int, c *cursor, fn func(*Object)) (*cursor, error) {
 	if c == nil {
 		c = &cursor{}
 	}
-	fs, name, err := b.b.listUnfinishedLargeFiles(ctx, count, c.name)
+	fs, name, err := b.backend().listUnfinishedLargeFiles(ctx, count, c.name)
 	if err != nil {
-		return nil, nil, err
+		return nil, err
 	}
 	var next *cursor
 	if name != "" {
@@ -315,17 +641,16 @@ func (b *Bucket) listUnfinishedLargeFiles(ctx context.Context, count int, c *cur
 			name: name,
 		}
 	}
-	var objects []*Object
 	for _, f := range fs {
-		objects = append(objects, &Object{
+		fn(&Object{
 			name: f.name(),
 			f:    f,
 			b:    b,
 		})
 	}
 	var rtnErr error
-	if len(objects) == 0 || next == nil {
+	if len(fs) == 0 || next == nil {
 		rtnErr = io.EOF
 	}
-	return objects, next, rtnErr
+	return next, rtnErr
 }
@@ -0,0 +1,440 @@
+// Copyright 2018, the Blazer authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package b2_test
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"reflect"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kurin/blazer/b2"
+)
+
+func TestListUploadedSince(t *testing.T) {
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	_, client, bucket := newTestBucket(ctx, t, "versions")
+	write := func(names ...string) {
+		for _, name := range names {
+			if err := writeObject(ctx, bucket.Object(name), []byte(name), 1e4); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	write("a", "a", "a", "b")
+	time.Sleep(10 * time.Millisecond)
+	cutoff := time.Now()
+	time.Sleep(10 * time.Millisecond)
+	write("a", "a", "c")
+
+	// Pages are not fetched ahead, so that every list call is one the
+	// iterator needed.
+	list := func(opts ...b2.ListOption) ([]string, int64) {
+		before := client.Stats().Calls["b2_list_file_versions"]
+		var names []string
+		iter := bucket.List(ctx, append(opts, b2.ListHidden(), b2.ListPageSize(1), b2.ListPrefetch(0))...)
+		for iter.Next() {
+			attrs, err := iter.Object().Attrs(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if attrs.UploadTimestamp.Before(cutoff) && len(opts) > 0 {
+				t.Errorf("%s: uploaded at %v, before %v", attrs.Name, attrs.UploadTimestamp, cutoff)
+			}
+			v := iter.Version()
+			want := &b2.ObjectVersion{
+				Name:            attrs.Name,
+				ID:              attrs.ID,
+				Status:          attrs.Status,
+				Size:            attrs.Size,
+				UploadTimestamp: attrs.UploadTimestamp,
+			}
+			if !reflect.DeepEqual(v, want) {
+				t.Errorf("Version: got %+v, want %+v", v, want)
+			}
+			names = append(names, attrs.Name)
+		}
+		if err := iter.Err(); err != nil {
+			t.Fatal(err)
+		}
+		return names, client.Stats().Calls["b2_list_file_versions"] - before
+	}
+	all, allCalls := list()
+	if want := []string{"a", "a", "a", "a", "a", "b", "c"}; !reflect.DeepEqual(all, want) {
+		t.Errorf("List: got %v, want %v", all, want)
+	}
+	// With one version per page, the listing restarts after the first old
+	// version of "a", and its two older versions are never requested.
+	recent, recentCalls := list(b2.ListUploadedSince(cutoff))
+	if want := []string{"a", "a", "c"}; !reflect.DeepEqual(recent, want) {
+		t.Errorf("List since cutoff: got %v, want %v", recent, want)
+	}
+	if want := allCalls - 2; recentCalls != want {
+		t.Errorf("List since cutoff: made %d list calls, want %d", recentCalls, want)
+	}
+}
+
+func TestListPrefetch(t *testing.T) {
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	_, client, bucket := newTestBucket(ctx, t, "b2test-prefetch")
+	var names []string
+	for i := 0; i < 20; i++ {
+		name := fmt.Sprintf("obj%02d", i)
+		if err := writeObject(ctx, bucket.Object(name), []byte(name), 1e4); err != nil {
+			t.Fatal(err)
+		}
+		names = append(names, name)
+	}
+	calls := func() int64 { return client.Stats().Calls["b2_list_file_names"] }
+
+	for _, prefetch := range []int{0, 1, 2, 10} {
+		var got []string
+		iter := bucket.List(ctx, b2.ListPageSize(4), b2.ListPrefetch(prefetch))
+		for iter.Next() {
+			got = append(got, iter.Object().Name())
+		}
+		if err := iter.Err(); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, names) {
+			t.Errorf("List with prefetch %d: got %v, want %v", prefetch, got, names)
+		}
+
+		// Read half a page, and give the fetcher time to get as far ahead
+		// as it will.
+		before := calls()
+		iter = bucket.List(ctx, b2.ListPageSize(4), b2.ListPrefetch(prefetch))
+		for i := 0; i < 2; i++ {
+			if !iter.Next() {
+				t.Fatalf("List with prefetch %d: %v", prefetch, iter.Err())
+			}
+		}
+		time.Sleep(50 * time.Millisecond)
+		iter.Close()
+		if n := calls() - before; n > int64(prefetch+1) {
+			t.Errorf("List with prefetch %d: reading half a page made %d list calls, want at most %d", prefetch, n, prefetch+1)
+		}
+		if iter.Next() {
+			t.Errorf("List with prefetch %d: Next after Close returned %q", prefetch, iter.Object().Name())
+		}
+		if err := iter.Err(); err != nil {
+			t.Errorf("List with prefetch %d: Err after Close: %v", prefetch, err)
+		}
+	}
+
+	// A negative prefetch is the same as none.
+	var got []string
+	iter := bucket.List(ctx, b2.ListPageSize(4), b2.ListPrefetch(-1))
+	for iter.Next() {
+		got = append(got, iter.Object().Name())
+	}
+	if err := iter.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, names) {
+		t.Errorf("List with prefetch -1: got %v, want %v", got, names)
+	}
+
+	// By default one page is fetched ahead, and a caller that abandons the
+	// iterator without Close leaves nothing running once it is in.
+	goroutines := runtime.NumGoroutine()
+	before := calls()
+	iter = bucket.List(ctx, b2.ListPageSize(4))
+	for i := 0; i < 2; i++ {
+		if !iter.Next() {
+			t.Fatal(iter.Err())
+		}
+	}
+	time.Sleep(50 * time.Millisecond)
+	if n := calls() - before; n != 2 {
+		t.Errorf("List by default: reading half a page made %d list calls, want 2", n)
+	}
+	for deadline := time.Now().Add(time.Second); runtime.NumGoroutine() > goroutines; {
+		if time.Now().After(deadline) {
+			t.Errorf("abandoned List: %d goroutines running, want at most %d", runtime.NumGoroutine(), goroutines)
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	lctx, lcancel := context.WithCancel(ctx)
+	iter = bucket.List(lctx, b2.ListPageSize(4), b2.ListPrefetch(1))
+	if !iter.Next() {
+		t.Fatal(iter.Err())
+	}
+	lcancel()
+	for iter.Next() {
+	}
+	if err := iter.Err(); err != context.Canceled {
+		t.Errorf("List after cancel: got %v, want %v", err, context.Canceled)
+	}
+}
+
+func TestListCursor(t *testing.T) {
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	_, _, bucket := newTestBucket(ctx, t, "b2test-cursor")
+	for i, name := range []string{"a", "a", "b", "c", "c", "c", "d/x", "d/y", "e"} {
+		if err := writeObject(ctx, bucket.Object(name), bytes.Repeat([]byte{'x'}, i), 1e4); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// list returns up to n entries, identified by name and size, and the
+	// cursor after them.
+	list := func(n int, opts ...b2.ListOption) ([]string, string) {
+		var got []string
+		iter := bucket.List(ctx, append(opts, b2.ListPageSize(2))...)
+		for len(got) < n && iter.Next() {
+			attrs, err := iter.Object().Attrs(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got = append(got, fmt.Sprintf("%s:%d", attrs.Name, attrs.Size))
+		}
+		if err := iter.Err(); err != nil {
+			t.Fatal(err)
+		}
+		return got, iter.Cursor()
+	}
+
+	for _, opts := range [][]b2.ListOption{
+		nil,
+		{b2.ListHidden()},
+		{b2.ListDelimiter("/")},
+		{b2.ListHidden(), b2.ListPrefix("c")},
+	} {
+		all, _ := list(100, opts...)
+		for n := 1; n <= len(all); n++ {
+			got, cursor := list(n, opts...)
+			for cursor != "" {
+				var more []string
+				more, next := list(n, append(opts, b2.WithCursor(cursor))...)
+				if len(more) == 0 {
+					break
+				}
+				got = append(got, more...)
+				cursor = next
+			}
+			if !reflect.DeepEqual(got, all) {
+				t.Errorf("List(%d at a time): got %v, want %v", n, got, all)
+			}
+		}
+	}
+
+	_, cursor := list(1)
+	for _, opts := range [][]b2.ListOption{
+		{b2.ListHidden()},
+		{b2.ListPrefix("c")},
+		{b2.ListDelimiter("/")},
+	} {
+		iter := bucket.List(ctx, append(opts, b2.WithCursor(cursor))...)
+		if iter.Next() {
+			t.Errorf("List with mismatched cursor: got %q", iter.Object().Name())
+		}
+		if err := iter.Err(); err != b2.ErrCursorMismatch {
+			t.Errorf("List with mismatched cursor: got %v, want %v", err, b2.ErrCursorMismatch)
+		}
+	}
+	iter := bucket.List(ctx, b2.WithCursor("bogus"))
+	if iter.Next() || iter.Err() == nil {
+		t.Error("List with a malformed cursor: got no error")
+	}
+}
+
+func TestListAllBuckets(t *testing.T) {
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	srv, client := newTestClient(ctx, t)
+	// Created out of order, to show the results are sorted by bucket.
+	var want []string
+	for _, name := range []string{"b2test-all-c", "b2test-all-a", "b2test-all-d", "b2test-all-b"} {
+		bucket, err := client.NewBucket(ctx, name, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 5; i++ {
+			obj := fmt.Sprintf("obj%d", i)
+			if err := writeObject(ctx, bucket.Object(obj), []byte(obj), 1e4); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := writeObject(ctx, bucket.Object("other"), []byte("other"), 1e4); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, name := range []string{"b2test-all-a", "b2test-all-b", "b2test-all-c", "b2test-all-d"} {
+		for i := 0; i < 5; i++ {
+			want = append(want, fmt.Sprintf("%s/obj%d", name, i))
+		}
+	}
+
+	list := func(client *b2.Client, opts ...b2.ListOption) ([]string, []string) {
+		var got, failed []string
+		iter := client.ListAllBuckets(ctx, opts...)
+		for iter.Next() {
+			if err := iter.BucketErr(); err != nil {
+				failed = append(failed, iter.Bucket().Name())
+				continue
+			}
+			got = append(got, iter.Bucket().Name()+"/"+iter.Object().Name())
+		}
+		if err := iter.Err(); err != nil {
+			t.Fatal(err)
+		}
+		return got, failed
+	}
+
+	for _, n := range []int{1, 2, 10} {
+		got, failed := list(client, b2.ListPrefix("obj"), b2.ListPageSize(2), b2.ListBucketConcurrency(n))
+		if len(failed) > 0 {
+			t.Errorf("ListAllBuckets with concurrency %d: failed buckets %v", n, failed)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("ListAllBuckets with concurrency %d: got %v, want %v", n, got, want)
+		}
+	}
+
+	// A bucket that can't be listed is reported, and the rest are listed.
+	denied := bucketID(ctx, t, srv, "b2test-all-b")
+	restricted, err := srv.NewClient(ctx, b2.Transport(denyTransport{rt: http.DefaultTransport, bucket: denied}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, failed := list(restricted, b2.ListPrefix("obj"))
+	if !reflect.DeepEqual(failed, []string{"b2test-all-b"}) {
+		t.Errorf("ListAllBuckets with a denied bucket: failed buckets %v, want [b2test-all-b]", failed)
+	}
+	var wantRest []string
+	for _, name := range want {
+		if !strings.HasPrefix(name, "b2test-all-b/") {
+			wantRest = append(wantRest, name)
+		}
+	}
+	if !reflect.DeepEqual(got, wantRest) {
+		t.Errorf("ListAllBuckets with a denied bucket: got %v, want %v", got, wantRest)
+	}
+
+	// Closing early stops the background listings.
+	iter := client.ListAllBuckets(ctx, b2.ListPageSize(1))
+	if !iter.Next() {
+		t.Fatal(iter.Err())
+	}
+	iter.Close()
+	if iter.Next() {
+		t.Error("Next after Close: got true, want false")
+	}
+	if err := iter.Err(); err != nil {
+		t.Errorf("Err after Close: %v", err)
+	}
+}
+
+// holdBody returns the first half of a reply, and the rest once release is
+// closed.
+type holdBody struct {
+	io.ReadCloser
+	first   *bytes.Reader
+	release chan struct{}
+}
+
+func (hb *holdBody) Read(p []byte) (int, error) {
+	if hb.first.Len() > 0 {
+		return hb.first.Read(p)
+	}
+	<-hb.release
+	return hb.ReadCloser.Read(p)
+}
+
+// holdTransport holds back the second half of each b2_list_file_names reply.
+type holdTransport struct {
+	rt      http.RoundTripper
+	release chan struct{}
+}
+
+func (ht holdTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := ht.rt.RoundTrip(req)
+	if err != nil || !strings.HasSuffix(req.URL.Path, "/b2_list_file_names") {
+		return resp, err
+	}
+	data, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	resp.Body = &holdBody{
+		ReadCloser: ioutil.NopCloser(bytes.NewReader(data[len(data)/2:])),
+		first:      bytes.NewReader(data[:len(data)/2]),
+		release:    ht.release,
+	}
+	return resp, nil
+}
+
+func TestListStreams(t *testing.T) {
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	release := make(chan struct{})
+	_, _, bucket := newTestBucket(ctx, t, "b2test-stream", b2.Transport(holdTransport{rt: http.DefaultTransport, release: release}))
+	var want []string
+	for i := 0; i < 10; i++ {
+		name := fmt.Sprintf("obj%02d", i)
+		if err := writeObject(ctx, bucket.Object(name), []byte(name), 1e4); err != nil {
+			t.Fatal(err)
+		}
+		want = append(want, name)
+	}
+
+	iter := bucket.List(ctx)
+	first := make(chan bool)
+	go func() { first <- iter.Next() }()
+	select {
+	case ok := <-first:
+		if !ok {
+			t.Fatal(iter.Err())
+		}
+	case <-time.After(5 * time.Second):
+		close(release)
+		t.Fatal("Next waited for the whole page")
+	}
+	close(release)
+	got := []string{iter.Object().Name()}
+	for iter.Next() {
+		got = append(got, iter.Object().Name())
+	}
+	if err := iter.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
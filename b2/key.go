@@ -54,6 +54,7 @@ func (k *Key) ID() string { return k.k.id() }
 type keyOptions struct {
 	caps     []string
 	prefix   string
+	bucket   *Bucket
 	lifetime time.Duration
 }
 
@@ -89,18 +90,30 @@ func Prefix(prefix string) KeyOption {
 	}
 }
 
-// CreateKey creates a global application key that is valid for all buckets in
-// this project.  The key's secret will only be accessible on the object
-// returned from this call.
+// RestrictToBucket limits the requested application key to be valid only for
+// the given bucket.
+func RestrictToBucket(b *Bucket) KeyOption {
+	return func(k *keyOptions) {
+		k.bucket = b
+	}
+}
+
+// CreateKey creates an application key.  Unless the RestrictToBucket option is
+// given, the key is valid for all buckets in this project.  The key's secret
+// will only be accessible on the object returned from this call.
 func (c *Client) CreateKey(ctx context.Context, name string, opts ...KeyOption) (*Key, error) {
 	var ko keyOptions
 	for _, o := range opts {
 		o(&ko)
 	}
-	if ko.prefix != "" {
+	var bucketID string
+	if ko.bucket != nil {
+		bucketID = ko.bucket.backend().id()
+	}
+	if ko.prefix != "" && ko.bucket == nil {
 		return nil, errors.New("Prefix is not a valid option for global application keys")
 	}
-	ki, err := c.backend.createKey(ctx, name, ko.caps, ko.lifetime, "", "")
+	ki, err := c.backend.createKey(ctx, name, ko.caps, ko.lifetime, bucketID, ko.prefix)
 	if err != nil {
 		return nil, err
 	}
@@ -110,47 +123,103 @@ func (c *Client) CreateKey(ctx context.Context, name string, opts ...KeyOption)
 	}, nil
 }
 
-// ListKeys lists all the keys associated with this project.  It takes the
-// maximum number of keys it should return in a call, as well as a cursor
-// (which should be empty for the initial call).  It will return up to count
-// keys, as well as the cursor for the next invocation.
+// ListKeys returns an iterator over all the keys associated with this
+// project.  Keys returned from the iterator do not carry their secrets.
+func (c *Client) ListKeys(ctx context.Context) *KeyIterator {
+	return &KeyIterator{
+		c:   c,
+		ctx: ctx,
+	}
+}
+
+// KeyIterator iterates over application keys, issuing b2_list_keys requests
+// as necessary.
 //
-// ListKeys returns io.EOF when there are no more keys, although it may do so
-// concurrently with the final set of keys.
-func (c *Client) ListKeys(ctx context.Context, count int, cursor string) ([]*Key, string, error) {
-	ks, next, err := c.backend.listKeys(ctx, count, cursor)
+// It is intended to be called in a loop:
+//
+//	for iter.Next() {
+//	  key := iter.Key()
+//	  // act on key
+//	}
+//	if err := iter.Err(); err != nil {
+//	  // handle err
+//	}
+type KeyIterator struct {
+	c      *Client
+	ctx    context.Context
+	final  bool
+	err    error
+	idx    int
+	cursor string
+	keys   []*Key
+}
+
+const keyPageSize = 1000
+
+func (k *KeyIterator) page() error {
+	ks, next, err := k.c.backend.listKeys(k.ctx, keyPageSize, k.cursor)
 	if err != nil {
-		return nil, "", err
+		return err
 	}
-	if len(ks) == 0 {
-		return nil, "", io.EOF
-	}
-	var keys []*Key
-	for _, k := range ks {
-		keys = append(keys, &Key{
-			c: c,
-			k: k,
+	k.keys = k.keys[:0]
+	for _, ki := range ks {
+		k.keys = append(k.keys, &Key{
+			c: k.c,
+			k: ki,
 		})
 	}
-	var rerr error
+	k.idx = 0
+	k.cursor = next
 	if next == "" {
-		rerr = io.EOF
+		k.final = true
 	}
-	return keys, next, rerr
+	return nil
 }
 
-// CreateKey creates a scoped application key that is valid only for this bucket.
-func (b *Bucket) CreateKey(ctx context.Context, name string, opts ...KeyOption) (*Key, error) {
-	var ko keyOptions
-	for _, o := range opts {
-		o(&ko)
+// Next advances the iterator to the next key.  It should be called before any
+// calls to Key().  If Next returns true, then the next call to Key() will be
+// valid.  Once Next returns false, it is important to check the return value
+// of Err().
+func (k *KeyIterator) Next() bool {
+	for {
+		if k.err != nil {
+			return false
+		}
+		if k.ctx.Err() != nil {
+			k.err = k.ctx.Err()
+			return false
+		}
+		if k.idx < len(k.keys) {
+			k.idx++
+			return true
+		}
+		if k.final {
+			k.err = io.EOF
+			return false
+		}
+		if err := k.page(); err != nil {
+			k.err = err
+			return false
+		}
 	}
-	ki, err := b.r.createKey(ctx, name, ko.caps, ko.lifetime, b.b.id(), ko.prefix)
-	if err != nil {
-		return nil, err
+}
+
+// Key returns the current key.
+func (k *KeyIterator) Key() *Key {
+	return k.keys[k.idx-1]
+}
+
+// Err returns the current error or nil.  If Next() returns false and Err() is
+// nil, then all keys have been seen.
+func (k *KeyIterator) Err() error {
+	if k.err == io.EOF {
+		return nil
 	}
-	return &Key{
-		c: b.c,
-		k: ki,
-	}, nil
+	return k.err
+}
+
+// CreateKey creates a scoped application key that is valid only for this bucket.
+func (b *Bucket) CreateKey(ctx context.Context, name string, opts ...KeyOption) (*Key, error) {
+	opts = append(opts, RestrictToBucket(b))
+	return b.c.CreateKey(ctx, name, opts...)
 }
@@ -0,0 +1,129 @@
+// Copyright 2018, the Blazer authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package b2
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// ErrCursorMismatch is returned by an iterator given a cursor from a
+// different kind of listing.
+var ErrCursorMismatch = errors.New("b2: cursor is from a listing with different options")
+
+// cursorVersion prefixes encoded cursors, so that the encoding can change.
+const cursorVersion = "1."
+
+// listPosition is the encoded form of a cursor.
+type listPosition struct {
+	Mode      string `json:"m"`
+	Prefix    string `json:"p,omitempty"`
+	Delimiter string `json:"d,omitempty"`
+	Name      string `json:"n,omitempty"`
+	ID        string `json:"i,omitempty"`
+	Done      bool   `json:"f,omitempty"`
+}
+
+func (o *ObjectIterator) mode() string {
+	switch {
+	case o.opts.unfinished:
+		return "unfinished"
+	case o.opts.hidden:
+		return "versions"
+	}
+	return "names"
+}
+
+// Cursor returns an opaque string marking the iterator's place in the
+// listing: a new iterator given it with WithCursor and the same options begins
+// with the object that this iterator's next call to Next would return.
+// Cursors may be saved, so that a long listing can be resumed by another
+// process.
+//
+// ListUploadedSince and ListSkip are not part of the cursor; they should be
+// given again when resuming.  If the listing failed partway through a page,
+// the cursor marks the start of that page, and resuming returns the objects
+// from it that this iterator already returned.
+func (o *ObjectIterator) Cursor() string {
+	o.init.Do(o.setup)
+	p := listPosition{
+		Mode:      o.mode(),
+		Prefix:    o.opts.prefix,
+		Delimiter: o.opts.delimiter,
+	}
+	var obj *Object
+	if o.pg != nil {
+		var ok bool
+		if obj, ok = o.pg.at(o.idx); !ok {
+			if err := o.endPage(); err != nil {
+				o.err = wrap("list", o.bucket.Name(), o.opts.prefix, err)
+			}
+		}
+	}
+	switch {
+	case obj != nil:
+		// Resume with the next object on this page.
+		switch p.Mode {
+		case "unfinished":
+			p.ID = obj.f.id()
+		case "versions":
+			p.Name, p.ID = obj.name, obj.f.id()
+		default:
+			p.Name = obj.name
+		}
+	case o.final || o.c == nil:
+		p.Done = true
+	default:
+		p.Name, p.ID = o.c.name, o.c.id
+		if p.Mode == "unfinished" {
+			p.Name, p.ID = "", o.c.name
+		}
+	}
+	data, _ := json.Marshal(p) // can't fail
+	return cursorVersion + base64.RawURLEncoding.EncodeToString(data)
+}
+
+// resume positions a new iterator at the place recorded by cursor.
+func (o *ObjectIterator) resume(cursor string) {
+	if !strings.HasPrefix(cursor, cursorVersion) {
+		o.err = fmt.Errorf("b2: invalid list cursor %q", cursor)
+		return
+	}
+	data, err := base64.RawURLEncoding.DecodeString(strings.TrimPrefix(cursor, cursorVersion))
+	if err != nil {
+		o.err = fmt.Errorf("b2: invalid list cursor %q: %v", cursor, err)
+		return
+	}
+	var p listPosition
+	if err := json.Unmarshal(data, &p); err != nil {
+		o.err = fmt.Errorf("b2: invalid list cursor %q: %v", cursor, err)
+		return
+	}
+	if p.Mode != o.mode() || p.Prefix != o.opts.prefix || p.Delimiter != o.opts.delimiter {
+		o.err = ErrCursorMismatch
+		return
+	}
+	if p.Done {
+		o.final = true
+		return
+	}
+	o.c.name, o.c.id = p.Name, p.ID
+	if p.Mode == "unfinished" {
+		o.c.name, o.c.id = p.ID, ""
+	}
+}
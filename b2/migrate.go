@@ -0,0 +1,131 @@
+// Copyright 2018, the Blazer authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package b2
+
+import (
+	"context"
+)
+
+// MigrateConcurrency sets the number of objects Migrate transfers at once.
+// The default is four.
+func MigrateConcurrency(n int) BulkOption {
+	return func(b *bulkOptions) {
+		b.concurrency = n
+	}
+}
+
+// MigrateCursor resumes a migration from the cursor of an earlier run's
+// Report.
+func MigrateCursor(cursor string) BulkOption {
+	return func(b *bulkOptions) {
+		b.cursor = cursor
+	}
+}
+
+// Migrate copies the current version of every object in src to dst,
+// preserving each object's content type, info, and last-modified time.
+//
+// When both buckets are *Buckets opened by the same Client, objects are
+// copied by B2 with b2_copy_file; otherwise, or if an object is too large to
+// be copied in one request, they are downloaded and uploaded again.  Either
+// bucket may be a fake.  Objects already in
+// dst with the same SHA1 are skipped, so that Migrate can be run again after
+// an interruption; MigrateCursor avoids listing the objects the earlier run
+// finished.  Large files whose SHA1 is unknown (they have no large_file_sha1
+// info entry) are skipped if the copy in dst has the same size and the same,
+// non-zero, LastModified time, which Migrate preserves; those without a
+// LastModified time are always migrated again.
+//
+// Unless StopOnError is given, a failure to migrate an object doesn't stop
+// the migration; it is listed in the report, and Migrate returns an error
+// once it is done.  Errors listing src, and context errors, end the migration
+// at once; objects abandoned in flight are not reported, and are migrated by
+// the next run.
+//
+// Each item of the report carries a cursor; see MigrateCursor.
+func Migrate(ctx context.Context, src, dst BucketInterface, opts ...BulkOption) (*Report, error) {
+	m := bulkOptions{concurrency: 4}
+	for _, opt := range opts {
+		opt(&m)
+	}
+	return runBulk(ctx, src, m, m.stop(false), "migrate", func(ctx context.Context, obj ObjectInterface) ReportItem {
+		return migrateObject(ctx, obj, dst)
+	})
+}
+
+// migrateObject migrates obj, the current version of an object in another
+// bucket, to dst.
+func migrateObject(ctx context.Context, obj ObjectInterface, dst BucketInterface) ReportItem {
+	res := ReportItem{Name: obj.Name()}
+	fail := func(err error) ReportItem {
+		res.Action = Failed
+		res.Err = err
+		return res
+	}
+	if err := ctx.Err(); err != nil {
+		return fail(err)
+	}
+	attrs, err := obj.Attrs(ctx)
+	if err != nil {
+		return fail(err)
+	}
+	res.Size = attrs.Size
+	to := dst.ObjectNamed(obj.Name())
+	if have, err := to.Attrs(ctx); err == nil {
+		if migrated(attrs, have) {
+			res.Action = Skipped
+			return res
+		}
+	} else if !IsNotExist(err) {
+		return fail(err)
+	}
+
+	from, ok := obj.(*Object)
+	into, ok2 := dst.(*Bucket)
+	if ok && ok2 && from.b.c == into.c && attrs.Size <= maxCopySize {
+		// Without a content type or info, the copy keeps the source's.
+		to := into.Object(from.name)
+		f, err := into.backend().copyFile(ctx, from.f.id(), from.name, "", nil)
+		if err != nil {
+			return fail(to.wrap("copy", err))
+		}
+		to.setFile(f)
+		res.Action = Copied
+		return res
+	}
+
+	// The source's large_file_sha1, if it has one, is among its info, and so
+	// is carried over; SHA1 itself must not be, or a small object would gain
+	// one, and a large object without one would be given "none".
+	wa := *attrs
+	wa.SHA1 = ""
+	r := obj.Download(ctx)
+	defer r.Close()
+	if _, err := to.Upload(ctx, r, WithAttrsOption(&wa)); err != nil {
+		return fail(err)
+	}
+	res.Action = Streamed
+	return res
+}
+
+// migrated reports whether have, an object in the destination bucket, is
+// already a copy of src.
+func migrated(src, have *Attrs) bool {
+	if src.SHA1 != "" && src.SHA1 != "none" {
+		return have.SHA1 == src.SHA1
+	}
+	// Without a SHA1 to compare, rely on what Migrate preserves.
+	return have.Size == src.Size && !src.LastModified.IsZero() && have.LastModified.Equal(src.LastModified)
+}
@@ -15,11 +15,14 @@
 package b2
 
 import (
+	"encoding/json"
+	"expvar"
 	"fmt"
 	"html/template"
 	"math"
 	"net/http"
 	"sort"
+	"sync"
 	"time"
 
 	"github.com/kurin/blazer/internal/b2assets"
@@ -37,6 +40,97 @@ type StatusInfo struct {
 	// RPCs contains information about recently made RPC calls over the last
 	// minute, five minutes, hour, and for all time.
 	RPCs map[time.Duration]MethodList
+
+	// Stats contains the client's cumulative counters.
+	Stats Stats
+}
+
+// Stats holds cumulative counters for the requests a client has made.
+type Stats struct {
+	// Calls is the number of requests made, by API method.  Retries are
+	// counted separately.
+	Calls map[string]int64
+
+	// Errors is the number of failed requests, by B2 error code (such as
+	// "bad_request") if there is one, and otherwise by HTTP status.  Requests
+	// that fail without a response are counted under "network".
+	Errors map[string]int64
+
+	// BytesUp and BytesDown count object data sent to and received from B2.
+	BytesUp   int64
+	BytesDown int64
+
+	// InFlight is the number of uploads and downloads in progress.
+	InFlight int64
+
+	// UploadHosts describes the uploads made to each B2 host; see
+	// UploadHostFailures.
+	UploadHosts map[string]UploadHostStats
+}
+
+// Stats returns the client's counters.  The counters are kept for every
+// client, and cost very little to maintain.
+func (c *Client) Stats() Stats {
+	return c.backend.stats()
+}
+
+// PublishStats publishes the client's counters with package expvar, so that
+// they are served from /debug/vars.  The variables are named prefix+"calls",
+// prefix+"errors", prefix+"bytes_up", prefix+"bytes_down", prefix+"in_flight",
+// and prefix+"upload_hosts".  If an earlier call published them, they report
+// this client's counters from now on.  If any of the names is in use by
+// another variable, PublishStats publishes nothing and returns an error.
+func (c *Client) PublishStats(prefix string) error {
+	vars := map[string]func(Stats) interface{}{
+		"calls":        func(s Stats) interface{} { return s.Calls },
+		"errors":       func(s Stats) interface{} { return s.Errors },
+		"bytes_up":     func(s Stats) interface{} { return s.BytesUp },
+		"bytes_down":   func(s Stats) interface{} { return s.BytesDown },
+		"in_flight":    func(s Stats) interface{} { return s.InFlight },
+		"upload_hosts": func(s Stats) interface{} { return s.UploadHosts },
+	}
+	publishMu.Lock()
+	defer publishMu.Unlock()
+	for name := range vars {
+		if v := expvar.Get(prefix + name); v != nil {
+			if _, ok := v.(*statsVar); !ok {
+				return fmt.Errorf("b2: expvar %q is already published", prefix+name)
+			}
+		}
+	}
+	for name, f := range vars {
+		if v, ok := expvar.Get(prefix + name).(*statsVar); ok {
+			v.setClient(c)
+			continue
+		}
+		expvar.Publish(prefix+name, &statsVar{c: c, f: f})
+	}
+	return nil
+}
+
+// publishMu keeps concurrent calls to PublishStats from publishing the same
+// name twice, which would panic.
+var publishMu sync.Mutex
+
+// statsVar is an expvar.Var that reports one of a client's counters.
+type statsVar struct {
+	mu sync.Mutex
+	c  *Client
+	f  func(Stats) interface{}
+}
+
+func (v *statsVar) setClient(c *Client) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.c = c
+}
+
+func (v *statsVar) String() string {
+	v.mu.Lock()
+	c := v.c
+	v.mu.Unlock()
+	data, _ := json.Marshal(v.f(c.Stats()))
+	return string(data)
 }
 
 // MethodList is an accumulation of RPC calls that have been made over a given
@@ -130,6 +224,8 @@ func (c *Client) Status() *StatusInfo {
 		si.RPCs[c.d] = c.retrieve()
 	}
 
+	si.Stats = c.Stats()
+
 	return si
 }
 
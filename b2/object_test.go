@@ -0,0 +1,1271 @@
+// Copyright 2018, the Blazer authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package b2_test
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/kurin/blazer/b2"
+	"github.com/kurin/blazer/base"
+)
+
+func TestExistsWithoutReadFiles(t *testing.T) {
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+
+	srv, _, bucket := newTestBucket(ctx, t, "b2test-bucket")
+	for _, name := range []string{"live", "hidden"} {
+		if err := writeObject(ctx, bucket.Object(name), []byte(name), 1e4); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := bucket.Object("hidden").Hide(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	// HEAD requests are now refused with a bare 401, so Exists must list.
+	srv.DenyDownloads(true)
+	for name, want := range map[string]bool{"live": true, "hidden": false, "missing": false} {
+		got, err := bucket.Object(name).Exists(ctx)
+		if err != nil {
+			t.Errorf("Exists(%q): %v", name, err)
+			continue
+		}
+		if got != want {
+			t.Errorf("Exists(%q): got %v, want %v", name, got, want)
+		}
+	}
+}
+
+func TestAsOf(t *testing.T) {
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	_, _, bucket := newTestBucket(ctx, t, "history")
+	obj := bucket.Object("obj")
+	tick := func() time.Time {
+		time.Sleep(5 * time.Millisecond)
+		now := time.Now()
+		time.Sleep(5 * time.Millisecond)
+		return now
+	}
+
+	before := tick()
+	if err := writeObject(ctx, obj, []byte("first"), 1e4); err != nil {
+		t.Fatal(err)
+	}
+	first := tick()
+	if err := writeObject(ctx, obj, []byte("second"), 1e4); err != nil {
+		t.Fatal(err)
+	}
+	second := tick()
+	if err := obj.Hide(ctx); err != nil {
+		t.Fatal(err)
+	}
+	hidden := tick()
+	if err := writeObject(ctx, obj, []byte("third"), 1e4); err != nil {
+		t.Fatal(err)
+	}
+
+	table := []struct {
+		t    time.Time
+		want string // empty if the object should not exist
+	}{
+		{t: before},
+		{t: first, want: "first"},
+		{t: second, want: "second"},
+		{t: hidden},
+		{t: time.Now(), want: "third"},
+	}
+	for i, e := range table {
+		o := obj.AsOf(e.t)
+		ok, err := o.Exists(ctx)
+		if err != nil {
+			t.Fatalf("%d: Exists: %v", i, err)
+		}
+		if ok != (e.want != "") {
+			t.Errorf("%d: Exists: got %v, want %v", i, ok, e.want != "")
+		}
+		got, err := readObject(ctx, o, 0, -1)
+		if e.want == "" {
+			if !b2.IsNotExist(err) {
+				t.Errorf("%d: read: got %v, want a not-exist error", i, err)
+			}
+			if _, err := o.Attrs(ctx); !b2.IsNotExist(err) {
+				t.Errorf("%d: Attrs: got %v, want a not-exist error", i, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%d: read: %v", i, err)
+		}
+		if string(got) != e.want {
+			t.Errorf("%d: read: got %q, want %q", i, got, e.want)
+		}
+		attrs, err := o.Attrs(ctx)
+		if err != nil {
+			t.Fatalf("%d: Attrs: %v", i, err)
+		}
+		if attrs.Size != int64(len(e.want)) || attrs.UploadTimestamp.After(e.t) {
+			t.Errorf("%d: Attrs: got size %d uploaded %v, want size %d uploaded before %v", i, attrs.Size, attrs.UploadTimestamp, len(e.want), e.t)
+		}
+	}
+}
+
+func TestErrorContext(t *testing.T) {
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	_, _, bucket := newTestBucket(ctx, t, "b2test-errs")
+	obj := bucket.Object("dir/missing")
+
+	_, rerr := ioutil.ReadAll(obj.NewReader(ctx))
+	_, aerr := obj.Attrs(ctx)
+	derr := obj.Delete(ctx)
+
+	table := []struct {
+		err error
+		op  string
+	}{
+		{err: rerr, op: "read"},
+		{err: aerr, op: "attrs"},
+		{err: derr, op: "delete"},
+	}
+	for _, e := range table {
+		if e.err == nil {
+			t.Errorf("%s: got no error", e.op)
+			continue
+		}
+		prefix := fmt.Sprintf("b2: %s b2test-errs/dir/missing: ", e.op)
+		if msg := e.err.Error(); !strings.HasPrefix(msg, prefix) {
+			t.Errorf("%s: got message %q, want prefix %q", e.op, msg, prefix)
+		}
+		var berr *b2.Error
+		if !errors.As(e.err, &berr) {
+			t.Errorf("%s: %v (%T) is not a *b2.Error", e.op, e.err, e.err)
+			continue
+		}
+		if berr.Op != e.op || berr.Bucket != "b2test-errs" || berr.Object != "dir/missing" {
+			t.Errorf("%s: got %+v", e.op, berr)
+		}
+		if errors.Unwrap(e.err) == nil {
+			t.Errorf("%s: nothing to unwrap", e.op)
+		}
+		if !b2.IsNotExist(e.err) {
+			t.Errorf("%s: IsNotExist(%v) = false", e.op, e.err)
+		}
+		if code, _ := base.Code(e.err); code != 404 {
+			t.Errorf("%s: base.Code(%v) = %d, want 404", e.op, e.err, code)
+		}
+		if base.Action(e.err) != base.Punt {
+			t.Errorf("%s: base.Action(%v) = %v, want Punt", e.op, e.err, base.Action(e.err))
+		}
+	}
+}
+
+func TestOpen(t *testing.T) {
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	_, client, bucket := newTestBucket(ctx, t, "handles")
+	data := bytes.Repeat([]byte("data"), 1e3)
+	mtime := time.Unix(1500000000, 0)
+	obj := bucket.Object("obj")
+	w := obj.NewWriter(ctx, b2.WithAttrsOption(&b2.Attrs{
+		ContentType:  "text/plain",
+		LastModified: mtime,
+		Info:         map[string]string{"key": "value"},
+	}))
+	if _, err := w.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	want, err := obj.Attrs(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	calls := func() int64 { return client.Stats().Calls["b2_download_file_by_name"] }
+	before := calls()
+	h, err := obj.Open(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := h.Attrs()
+	if got.ID != want.ID || got.Size != want.Size || got.SHA1 != want.SHA1 || got.ContentType != want.ContentType ||
+		!got.LastModified.Equal(mtime) || !reflect.DeepEqual(got.Info, want.Info) ||
+		got.UploadTimestamp.IsZero() || !got.UploadTimestamp.Equal(want.UploadTimestamp) {
+		t.Errorf("Attrs: got %+v, want %+v", got, want)
+	}
+	r := h.Reader()
+	body, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(body, data) {
+		t.Errorf("Reader: got %d bytes, want %d", len(body), len(data))
+	}
+	if err := r.Close(); err != nil {
+		t.Errorf("Close: %v", err)
+	}
+	if n := calls() - before; n != 1 {
+		t.Errorf("Open and Read made %d requests, want 1", n)
+	}
+
+	// While the handle is open, later readers start over.
+	h, err = obj.Open(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	first := h.Reader()
+	second := h.Reader()
+	body, err = ioutil.ReadAll(second)
+	second.Close()
+	if err != nil || !bytes.Equal(body, data) {
+		t.Errorf("second Reader: got %d bytes, %v; want %d bytes", len(body), err, len(data))
+	}
+	if err := first.Close(); err != nil {
+		t.Errorf("Close unread: %v", err)
+	}
+
+	// Once the handle is closed, it can't be read from.
+	body, err = ioutil.ReadAll(h.Reader())
+	if err == nil || len(body) != 0 {
+		t.Errorf("Reader after Close: got %d bytes, %v; want an error", len(body), err)
+	}
+
+	if _, err := bucket.Object("missing").Open(ctx); !b2.IsNotExist(err) {
+		t.Errorf("Open missing object: got %v, want a not-exist error", err)
+	}
+}
+
+func TestConditionalDownload(t *testing.T) {
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+
+	_, _, bucket := newTestBucket(ctx, t, "b2test-bucket")
+	obj := bucket.Object("cached")
+	if err := writeObject(ctx, obj, []byte("version one"), 1e4); err != nil {
+		t.Fatal(err)
+	}
+	attrs, err := obj.Attrs(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := obj.NewReader(ctx)
+	r.IfNoneMatch = attrs.SHA1
+	if _, err := ioutil.ReadAll(r); err != b2.ErrNotModified {
+		t.Errorf("reading unchanged object: got %v, want ErrNotModified", err)
+	}
+	if r.SHA1() != attrs.SHA1 {
+		t.Errorf("SHA1(): got %q, want %q", r.SHA1(), attrs.SHA1)
+	}
+	r.Close()
+
+	if err := writeObject(ctx, obj, []byte("version two"), 1e4); err != nil {
+		t.Fatal(err)
+	}
+	r = obj.NewReader(ctx)
+	r.IfNoneMatch = attrs.SHA1
+	got, err := ioutil.ReadAll(r)
+	r.Close()
+	if err != nil {
+		t.Fatalf("reading changed object: %v", err)
+	}
+	if string(got) != "version two" {
+		t.Errorf("reading changed object: got %q, want %q", got, "version two")
+	}
+}
+
+func TestObjectChangedDuringRead(t *testing.T) {
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+
+	v1 := bytes.Repeat([]byte("1"), 100)
+	v2 := bytes.Repeat([]byte("2"), 100)
+
+	// The first chunk isn't requested until the second has been answered
+	// from v1, and then the object is overwritten with v2.
+	var obj *b2.Object
+	var armed int32
+	var first, second sync.Once
+	secondDone := make(chan struct{})
+	chunk := func(req *http.Request) string {
+		if atomic.LoadInt32(&armed) == 0 || req.Header.Get("X-Blazer-Method") != "b2_download_file_by_name" {
+			return ""
+		}
+		return req.Header.Get("Range")
+	}
+	before := func(req *http.Request) {
+		if chunk(req) != "bytes=0-9" {
+			return
+		}
+		first.Do(func() {
+			<-secondDone
+			if err := writeObject(ctx, obj, v2, 1e4); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+	after := func(req *http.Request) {
+		if chunk(req) == "bytes=10-19" {
+			second.Do(func() { close(secondDone) })
+		}
+	}
+	_, _, bucket := newTestBucket(ctx, t, "b2test-bucket", b2.Transport(hookTransport{rt: http.DefaultTransport, before: before, after: after}))
+	obj = bucket.Object("changing")
+	if err := writeObject(ctx, obj, v1, 1e4); err != nil {
+		t.Fatal(err)
+	}
+
+	atomic.StoreInt32(&armed, 1)
+	r := obj.NewReader(ctx)
+	r.ChunkSize = 10
+	r.ConcurrentDownloads = 2
+	_, err := ioutil.ReadAll(r)
+	r.Close()
+	if !errors.Is(err, b2.ErrObjectChanged) {
+		t.Errorf("reading an object replaced mid-read: got %v, want ErrObjectChanged", err)
+	}
+
+	// Once the version is known, later chunks are read by ID, and the read
+	// completes from the version it started with.
+	r = obj.NewReader(ctx)
+	r.ChunkSize = 10
+	buf := make([]byte, 10)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		t.Fatal(err)
+	}
+	if err := writeObject(ctx, obj, v1, 1e4); err != nil {
+		t.Fatal(err)
+	}
+	rest, err := ioutil.ReadAll(r)
+	r.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := append(buf, rest...); !bytes.Equal(got, v2) {
+		t.Errorf("reading by ID: got %q, want %q", got, v2)
+	}
+}
+
+func TestPruneHiddenVersions(t *testing.T) {
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	_, _, bucket := newTestBucket(ctx, t, "b2test-prune")
+	write := func(names ...string) {
+		for _, name := range names {
+			if err := writeObject(ctx, bucket.Object(name), []byte(name), 1e4); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	hide := func(names ...string) {
+		for _, name := range names {
+			if err := bucket.Object(name).Hide(ctx); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	versions := func() []string {
+		var names []string
+		iter := bucket.List(ctx, b2.ListHidden())
+		for iter.Next() {
+			names = append(names, iter.Object().Name())
+		}
+		if err := iter.Err(); err != nil {
+			t.Fatal(err)
+		}
+		return names
+	}
+
+	write("a", "a", "b", "c", "d", "e")
+	hide("a", "b", "d")
+	write("d")
+	time.Sleep(10 * time.Millisecond)
+	cutoff := time.Now()
+	time.Sleep(10 * time.Millisecond)
+	hide("e")
+
+	var found []string
+	rep, err := bucket.PruneHiddenVersions(ctx, time.Since(cutoff), 2, b2.PruneDryRun(), b2.ReportProgress(func(it b2.ReportItem) { found = append(found, it.Name) }))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"a", "b"}; rep.Counts[b2.Deleted] != 2 || !rep.DryRun || !reflect.DeepEqual(found, want) {
+		t.Errorf("dry run: got %+v, %v, want 2 deleted, %v", rep, found, want)
+	}
+	if got, want := versions(), []string{"a", "a", "a", "b", "b", "c", "d", "d", "d", "e", "e"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("versions after dry run: got %v, want %v", got, want)
+	}
+
+	canceled, stop := context.WithCancel(ctx)
+	stop()
+	if _, err := bucket.PruneHiddenVersions(canceled, time.Since(cutoff), 2); err != context.Canceled {
+		t.Errorf("PruneHiddenVersions with canceled context: got %v, want %v", err, context.Canceled)
+	}
+
+	rep, err = bucket.PruneHiddenVersions(ctx, time.Since(cutoff), 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a has two versions of one byte each, and b one.
+	if len(rep.Items) != 2 || rep.Counts[b2.Deleted] != 2 || rep.Bytes != 3 || rep.DryRun {
+		t.Errorf("PruneHiddenVersions: got %+v, want 2 objects and 3 bytes deleted", rep)
+	}
+	if got, want := versions(), []string{"c", "d", "d", "d", "e", "e"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("versions after pruning: got %v, want %v", got, want)
+	}
+}
+
+func TestNameState(t *testing.T) {
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	srv, client, bucket := newTestBucket(ctx, t, "b2test-state")
+	for _, name := range []string{"live", "hidden", "hiddenx", "revived"} {
+		if err := writeObject(ctx, bucket.Object(name), []byte(name), 1e4); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, name := range []string{"hidden", "revived"} {
+		if err := bucket.Object(name).Hide(ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := writeObject(ctx, bucket.Object("revived"), []byte("again"), 1e4); err != nil {
+		t.Fatal(err)
+	}
+
+	// A started large file is not a version of its name.
+	acct, err := base.AuthorizeAccount(ctx, "b2test-account", "b2test-key", base.SetAPIBase(srv.URL()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	bb, err := acct.ListBuckets(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, b := range bb {
+		if b.Name == "b2test-state" {
+			if _, err := b.StartLargeFile(ctx, "started", "", nil); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	for name, want := range map[string]struct {
+		state b2.State
+		size  int64
+	}{
+		"live":    {b2.Live, 4},
+		"hidden":  {b2.Hidden, 0},
+		"hiddenx": {b2.Live, 7},
+		"revived": {b2.Live, 5},
+		"hid":     {b2.Absent, 0},
+		"started": {b2.Absent, 0},
+		"nothing": {b2.Absent, 0},
+	} {
+		before := client.Stats().Calls["b2_list_file_versions"]
+		st, attrs, err := bucket.NameState(ctx, name)
+		if err != nil {
+			t.Errorf("NameState(%q): %v", name, err)
+			continue
+		}
+		if st != want.state {
+			t.Errorf("NameState(%q): got %v, want %v", name, st, want.state)
+		}
+		if (attrs == nil) != (want.state == b2.Absent) {
+			t.Errorf("NameState(%q): got attrs %+v for state %v", name, attrs, st)
+		}
+		if attrs != nil && (attrs.Name != name || attrs.Size != want.size) {
+			t.Errorf("NameState(%q): got attrs for %q of size %d, want size %d", name, attrs.Name, attrs.Size, want.size)
+		}
+		if n := client.Stats().Calls["b2_list_file_versions"] - before; name != "started" && n != 1 {
+			t.Errorf("NameState(%q): made %d list calls, want 1", name, n)
+		}
+	}
+}
+
+func TestMigrate(t *testing.T) {
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+
+	srv, client := newTestClient(ctx, t)
+	other, err := srv.NewClient(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	src, err := client.NewBucket(ctx, "b2test-migrate-src", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mtime := time.Unix(1500000000, 0)
+	contents := map[string][]byte{
+		"a":     []byte("small"),
+		"b/big": bytes.Repeat([]byte("large"), 5e3),
+		"c":     []byte("another"),
+	}
+	for name, data := range contents {
+		w := src.Object(name).NewWriter(ctx, b2.WithAttrsOption(&b2.Attrs{
+			ContentType:  "text/x-" + strings.Replace(name, "/", "-", -1),
+			Info:         map[string]string{"origin": name},
+			LastModified: mtime,
+		}))
+		w.ChunkSize = 1e4
+		if _, err := io.Copy(w, bytes.NewReader(data)); err != nil {
+			t.Fatal(err)
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := writeObject(ctx, src.Object("hidden"), []byte("hidden"), 1e4); err != nil {
+		t.Fatal(err)
+	}
+	if err := src.Object("hidden").Hide(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	check := func(dst *b2.Bucket) {
+		for name, data := range contents {
+			attrs, err := dst.Object(name).Attrs(ctx)
+			if err != nil {
+				t.Errorf("%s: %v", name, err)
+				continue
+			}
+			want := "text/x-" + strings.Replace(name, "/", "-", -1)
+			if attrs.ContentType != want || attrs.Info["origin"] != name || !attrs.LastModified.Equal(mtime) {
+				t.Errorf("%s: got %q, %v, %v, want %q, origin %q, %v", name, attrs.ContentType, attrs.Info, attrs.LastModified, want, name, mtime)
+			}
+			got, err := readObject(ctx, dst.Object(name), 0, -1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, data) {
+				t.Errorf("%s: migrated contents differ", name)
+			}
+		}
+		if _, err := dst.Object("hidden").Attrs(ctx); !b2.IsNotExist(err) {
+			t.Errorf("hidden: got %v, want not-exist", err)
+		}
+	}
+
+	// Buckets from the same client are copied server-side.
+	dst, err := client.NewBucket(ctx, "b2test-migrate-dst", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rep, err := b2.Migrate(ctx, src, dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rep.Items) != 3 || rep.Counts[b2.Copied] != 3 {
+		t.Errorf("Migrate: got %+v, want 3 objects copied", rep)
+	}
+	check(dst)
+
+	// Running again finds nothing to do.
+	rep, err = b2.Migrate(ctx, src, dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rep.Items) != 3 || rep.Counts[b2.Skipped] != 3 || rep.Bytes != 0 {
+		t.Errorf("Migrate again: got %+v, want 3 objects skipped", rep)
+	}
+
+	// Buckets from different clients are streamed through; an interrupted
+	// migration resumes from its cursor.
+	far, err := other.NewBucket(ctx, "b2test-migrate-far", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stopped, stop := context.WithCancel(ctx)
+	var first []string
+	rep, err = b2.Migrate(stopped, src, far, b2.MigrateConcurrency(1), b2.ReportProgress(func(r b2.ReportItem) {
+		first = append(first, r.Name)
+		stop()
+	}))
+	if err != context.Canceled {
+		t.Errorf("interrupted Migrate: got %v, want %v", err, context.Canceled)
+	}
+	if want := []string{"a"}; !reflect.DeepEqual(first, want) {
+		t.Errorf("interrupted Migrate: got %v, want %v", first, want)
+	}
+	var rest []string
+	rep, err = b2.Migrate(ctx, src, far, b2.MigrateCursor(rep.Cursor), b2.MigrateConcurrency(1), b2.ReportProgress(func(r b2.ReportItem) {
+		if r.Action != b2.Streamed {
+			t.Errorf("%s: got %v, want %v", r.Name, r.Action, b2.Streamed)
+		}
+		rest = append(rest, r.Name)
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"b/big", "c"}; !reflect.DeepEqual(rest, want) {
+		t.Errorf("resumed Migrate: got %v, want %v", rest, want)
+	}
+	check(far)
+
+	// Failures are collected, unless StopOnError is given.
+	capped, err := srv.NewClient(ctx, b2.Transport(hookTransport{
+		rt: http.DefaultTransport,
+		before: func(req *http.Request) {
+			if req.Header.Get("X-Bz-File-Name") == "c" {
+				req.Header.Set("X-Bz-Test-Mode", "force_cap_exceeded")
+			}
+		},
+		after: func(*http.Request) {},
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	full, err := capped.NewBucket(ctx, "b2test-migrate-full", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rep, err = b2.Migrate(ctx, src, full)
+	if err == nil || rep.Counts[b2.Failed] != 1 || rep.Counts[b2.Streamed] != 2 {
+		t.Errorf("Migrate with a failure: got %v, %+v, want 1 failed and 2 streamed", err, rep)
+	}
+	for _, it := range rep.Items {
+		if (it.Name == "c") != (it.Action == b2.Failed) || (it.Action == b2.Failed) != errors.Is(it.Err, b2.ErrCapExceeded) {
+			t.Errorf("Migrate with a failure: got %+v", it)
+		}
+	}
+	data, err := json.Marshal(rep)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var back b2.Report
+	if err := json.Unmarshal(data, &back); err != nil {
+		t.Fatal(err)
+	}
+	if len(back.Items) != len(rep.Items) || !reflect.DeepEqual(back.Counts, rep.Counts) || back.Bytes != rep.Bytes || back.Cursor != rep.Cursor {
+		t.Errorf("Report JSON: got %+v, want %+v", back, rep)
+	}
+	for i, it := range back.Items {
+		want := rep.Items[i]
+		if it.Name != want.Name || it.Action != want.Action || (it.Err == nil) != (want.Err == nil) || it.Err != nil && it.Err.Error() != want.Err.Error() {
+			t.Errorf("Report JSON: item %d: got %+v, want %+v", i, it, want)
+		}
+	}
+
+	stopAt, err := capped.NewBucket(ctx, "b2test-migrate-stop", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"c", "d"} {
+		data := []byte(name)
+		if err := writeObject(ctx, src.Object(name), data, 1e4); err != nil {
+			t.Fatal(err)
+		}
+	}
+	rep, err = b2.Migrate(ctx, src, stopAt, b2.MigrateConcurrency(1), b2.StopOnError())
+	if !errors.Is(err, b2.ErrCapExceeded) {
+		t.Errorf("Migrate with StopOnError: got %v, want %v", err, b2.ErrCapExceeded)
+	}
+	var names []string
+	for _, it := range rep.Items {
+		names = append(names, it.Name)
+	}
+	if want := []string{"a", "b/big", "c"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("Migrate with StopOnError: got %v, want %v", names, want)
+	}
+}
+
+// TestMigrateFake checks that Migrate works with a fake bucket on either side.
+func TestMigrateFake(t *testing.T) {
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+
+	_, client, src := newTestBucket(ctx, t, "b2test-migrate-fake")
+	contents := map[string][]byte{
+		"a":     []byte("small"),
+		"b/big": bytes.Repeat([]byte("large"), 5e3),
+	}
+	for name, data := range contents {
+		if err := writeObject(ctx, src.Object(name), data, 1e4); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	mem := &memBucket{objs: make(map[string]memEntry)}
+	rep, err := b2.Migrate(ctx, src, mem)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rep.Counts[b2.Streamed] != 2 {
+		t.Errorf("Migrate to fake: got %+v, want 2 objects streamed", rep)
+	}
+	for name, data := range contents {
+		if got := mem.objs[name].data; !bytes.Equal(got, data) {
+			t.Errorf("%s: fake holds %d bytes, want %d", name, len(got), len(data))
+		}
+	}
+	rep, err = b2.Migrate(ctx, src, mem)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rep.Counts[b2.Skipped] != 2 {
+		t.Errorf("Migrate to fake again: got %+v, want 2 objects skipped", rep)
+	}
+
+	dst, err := client.NewBucket(ctx, "b2test-migrate-from-fake", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rep, err = b2.Migrate(ctx, mem, dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rep.Counts[b2.Streamed] != 2 {
+		t.Errorf("Migrate from fake: got %+v, want 2 objects streamed", rep)
+	}
+	for name, data := range contents {
+		got, err := readObject(ctx, dst.Object(name), 0, -1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, data) {
+			t.Errorf("%s: migrated contents differ", name)
+		}
+	}
+}
+
+// memBucket is a fake b2.BucketInterface that keeps its objects in memory.
+type memBucket struct {
+	mu   sync.Mutex
+	objs map[string]memEntry
+}
+
+type memEntry struct {
+	data  []byte
+	attrs b2.Attrs
+}
+
+func (m *memBucket) Name() string { return "mem" }
+
+func (m *memBucket) Attrs(context.Context) (*b2.BucketAttrs, error) {
+	return &b2.BucketAttrs{}, nil
+}
+
+func (m *memBucket) ObjectNamed(name string) b2.ObjectInterface {
+	return memObject{b: m, name: name}
+}
+
+func (m *memBucket) ListObjects(context.Context, ...b2.ListOption) b2.ObjectIteratorInterface {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var names []string
+	for name := range m.objs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return &memIterator{b: m, names: names, i: -1}
+}
+
+type memObject struct {
+	b    *memBucket
+	name string
+}
+
+func (o memObject) Name() string { return o.name }
+
+func (o memObject) Attrs(context.Context) (*b2.Attrs, error) {
+	o.b.mu.Lock()
+	defer o.b.mu.Unlock()
+	e, ok := o.b.objs[o.name]
+	if !ok {
+		return nil, fmt.Errorf("%s: %w", o.name, b2.ErrNotExist)
+	}
+	attrs := e.attrs
+	return &attrs, nil
+}
+
+func (o memObject) Delete(context.Context) error {
+	o.b.mu.Lock()
+	defer o.b.mu.Unlock()
+	delete(o.b.objs, o.name)
+	return nil
+}
+
+func (o memObject) Download(context.Context) io.ReadCloser {
+	o.b.mu.Lock()
+	defer o.b.mu.Unlock()
+	return ioutil.NopCloser(bytes.NewReader(o.b.objs[o.name].data))
+}
+
+func (o memObject) Upload(ctx context.Context, r io.Reader, opts ...b2.WriterOption) (*b2.Attrs, error) {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	attrs := b2.Attrs{
+		Name: o.name,
+		Size: int64(len(data)),
+		SHA1: fmt.Sprintf("%x", sha1.Sum(data)),
+	}
+	o.b.mu.Lock()
+	defer o.b.mu.Unlock()
+	o.b.objs[o.name] = memEntry{data: data, attrs: attrs}
+	return &attrs, nil
+}
+
+type memIterator struct {
+	b     *memBucket
+	names []string
+	i     int
+}
+
+func (it *memIterator) Next() bool {
+	it.i++
+	return it.i < len(it.names)
+}
+
+func (it *memIterator) Current() b2.ObjectInterface {
+	return memObject{b: it.b, name: it.names[it.i]}
+}
+
+func (it *memIterator) Cursor() string { return "" }
+func (it *memIterator) Err() error     { return nil }
+func (it *memIterator) Close() error   { return nil }
+
+// TestMigrateUnknownSHA1 checks that large files without large_file_sha1 are
+// recognized as already migrated by their size and last-modified time.
+func TestMigrateUnknownSHA1(t *testing.T) {
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+
+	srv, client := newTestClient(ctx, t)
+	other, err := srv.NewClient(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	src, err := client.NewBucket(ctx, "b2test-migrate-src", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// With the info entries all used, the Writer has no room to record the
+	// large file's SHA1.
+	write := func(mtime time.Time) {
+		info := make(map[string]string)
+		for i := 0; i < 9; i++ {
+			info[fmt.Sprintf("key%d", i)] = "value"
+		}
+		w := src.Object("big").NewWriter(ctx, b2.WithAttrsOption(&b2.Attrs{Info: info, LastModified: mtime}))
+		w.ChunkSize = 1e4
+		if _, err := io.Copy(w, bytes.NewReader(bytes.Repeat([]byte("large"), 5e3))); err != nil {
+			t.Fatal(err)
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write(time.Unix(1500000000, 0))
+	if attrs, err := src.Object("big").Attrs(ctx); err != nil || attrs.SHA1 != "none" {
+		t.Fatalf("source object: got %v, %v, want SHA1 \"none\"", attrs, err)
+	}
+
+	near, err := client.NewBucket(ctx, "b2test-migrate-near", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	far, err := other.NewBucket(ctx, "b2test-migrate-far", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	migrate := func(dst *b2.Bucket, want b2.Action) {
+		t.Helper()
+		rep, err := b2.Migrate(ctx, src, dst)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(rep.Items) != 1 || rep.Items[0].Action != want {
+			t.Errorf("Migrate to %s: got %+v, want %v", dst.Name(), rep.Items, want)
+		}
+	}
+	migrate(near, b2.Copied)
+	migrate(near, b2.Skipped)
+	migrate(far, b2.Streamed)
+	migrate(far, b2.Skipped)
+
+	// A new version with the same size but a different time is migrated.
+	write(time.Unix(1600000000, 0))
+	migrate(near, b2.Copied)
+	migrate(far, b2.Streamed)
+}
+
+func TestObjectVersion(t *testing.T) {
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	_, _, bucket := newTestBucket(ctx, t, "b2test-version")
+
+	for _, size := range []int{10, 25e3} {
+		first := bytes.Repeat([]byte{'1'}, size)
+		w := bucket.Object("obj").NewWriter(ctx, b2.WithAttrsOption(&b2.Attrs{
+			ContentType: "text/x-first",
+			Info:        map[string]string{"which": "first"},
+		}))
+		w.ChunkSize = 1e4
+		if _, _, err := w.ObjectVersion(); err == nil {
+			t.Error("ObjectVersion before Close: got no error")
+		}
+		if _, err := io.Copy(w, bytes.NewReader(first)); err != nil {
+			t.Fatal(err)
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+		obj, attrs, err := w.ObjectVersion()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if attrs.ID == "" || attrs.Name != "obj" || attrs.Size != int64(size) || attrs.ContentType != "text/x-first" || attrs.Info["which"] != "first" || attrs.UploadTimestamp.IsZero() {
+			t.Errorf("%d bytes: got attrs %+v", size, attrs)
+		}
+		if want := fmt.Sprintf("%x", sha1.Sum(first)); attrs.SHA1 != want {
+			t.Errorf("%d bytes: SHA1: got %q, want %q", size, attrs.SHA1, want)
+		}
+
+		// The handle keeps reading the version that was written.
+		if err := writeObject(ctx, bucket.Object("obj"), []byte("second"), 1e4); err != nil {
+			t.Fatal(err)
+		}
+		got, err := readObject(ctx, obj, 0, -1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, first) {
+			t.Errorf("%d bytes: read back %q, want the first version", size, got[:10])
+		}
+		vattrs, err := obj.Attrs(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if vattrs.ID != attrs.ID {
+			t.Errorf("%d bytes: Attrs: got version %q, want %q", size, vattrs.ID, attrs.ID)
+		}
+	}
+}
+
+// TestConcurrentObject is most useful with the race detector.
+func TestConcurrentObject(t *testing.T) {
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+
+	_, _, bucket := newTestBucket(ctx, t, "b2test-concurrent")
+	obj := bucket.Object("obj")
+	mtime := time.Unix(1500000000, 0)
+
+	// Each version is made of a single repeated byte, so that a reader can
+	// tell if it got a mixture of versions.
+	write := func(c byte, size int) (*b2.Attrs, error) {
+		w := obj.NewWriter(ctx, b2.WithAttrsOption(&b2.Attrs{LastModified: mtime}))
+		w.ChunkSize = 1e4
+		if _, err := io.Copy(w, bytes.NewReader(bytes.Repeat([]byte{c}, size))); err != nil {
+			w.Close()
+			return nil, err
+		}
+		if err := w.Close(); err != nil {
+			return nil, err
+		}
+		attrs, err := w.File()
+		if err != nil {
+			return nil, err
+		}
+		v, vattrs, err := w.ObjectVersion()
+		if err != nil {
+			return nil, err
+		}
+		if vattrs.ID != attrs.ID {
+			t.Errorf("ObjectVersion: got version %q, want %q", vattrs.ID, attrs.ID)
+		}
+		if got, err := v.Attrs(ctx); err == nil && got.ID != attrs.ID {
+			t.Errorf("ObjectVersion: Attrs got version %q, want %q", got.ID, attrs.ID)
+		}
+		return attrs, nil
+	}
+	if _, err := write('a', 100); err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 10; j++ {
+				switch (i + j) % 5 {
+				case 0:
+					if _, err := obj.Attrs(ctx); err != nil && !b2.IsNotExist(err) {
+						t.Errorf("Attrs: %v", err)
+					}
+				case 1:
+					got, err := readObject(ctx, obj, 0, -1)
+					if err != nil {
+						if !b2.IsNotExist(err) {
+							t.Errorf("NewReader: %v", err)
+						}
+						continue
+					}
+					if len(got) > 0 && !bytes.Equal(got, bytes.Repeat(got[:1], len(got))) {
+						t.Errorf("NewReader: read a mixture of versions")
+					}
+				case 2:
+					if _, err := write(byte('b'+i), 10+2e3*j); err != nil {
+						t.Errorf("NewWriter: %v", err)
+					}
+				case 3:
+					if err := obj.Delete(ctx); err != nil && !b2.IsNotExist(err) {
+						t.Errorf("Delete: %v", err)
+					}
+				case 4:
+					if _, err := bucket.Attrs(ctx); err != nil {
+						t.Errorf("Bucket.Attrs: %v", err)
+					}
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	// The handle reports the version it last wrote, and reports it the same
+	// way each time.
+	want, err := write('z', 25e3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		got, err := obj.Attrs(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.ID != want.ID || got.Size != want.Size || !got.LastModified.Equal(mtime) {
+			t.Errorf("Attrs: got %+v, want %+v", got, want)
+		}
+	}
+}
+
+func TestVerify(t *testing.T) {
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+
+	srv, _, bucket := newTestBucket(ctx, t, "b2test-verify")
+
+	write := func(name string, data []byte, info map[string]string) string {
+		w := bucket.Object(name).NewWriter(ctx, b2.WithAttrsOption(&b2.Attrs{Info: info}))
+		w.ChunkSize = 1e4
+		if _, err := io.Copy(w, bytes.NewReader(data)); err != nil {
+			t.Fatal(err)
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+		attrs, err := w.File()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return attrs.ID
+	}
+	var total int64
+	ids := make(map[string]string)
+	for _, name := range []string{"a", "b", "c", "d", "large"} {
+		data := []byte(strings.Repeat(name, 10))
+		if name == "large" {
+			data = bytes.Repeat([]byte("large"), 5e3)
+		}
+		sum := sha256.Sum256(data)
+		ids[name] = write(name, data, map[string]string{"sha256": fmt.Sprintf("%x", sum)})
+		total += int64(len(data))
+	}
+	var names []string
+	for i := 0; i < 40; i++ {
+		name := fmt.Sprintf("many/%02d", i)
+		write(name, []byte(name), nil)
+		names = append(names, name)
+	}
+
+	rep, err := bucket.Verify(ctx, b2.VerifyPrefix("many/"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rep.Counts[b2.Verified] != 40 || rep.Partial {
+		t.Errorf("Verify many/: got %+v, want 40 verified", rep)
+	}
+
+	rep, err = bucket.Verify(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rep.Counts[b2.Verified] != 45 || rep.Bytes != total+int64(len(names)*len(names[0])) {
+		t.Errorf("Verify: got %+v, want 45 verified", rep)
+	}
+
+	// Damage the stored contents of b, and record the wrong SHA256 for c.
+	srv.CorruptFile(ids["b"])
+	write("c", []byte(strings.Repeat("c", 10)), map[string]string{"sha256": "bogus"})
+
+	want := map[string]string{"b": "SHA1", "c": "SHA256"}
+	rep, err = bucket.Verify(ctx, b2.VerifyPrefix(""), b2.VerifyConcurrency(2))
+	if err == nil || rep.Counts[b2.Mismatched] != 2 || rep.Counts[b2.Verified] != 43 {
+		t.Errorf("Verify with damage: got %v, %+v, want 2 mismatched", err, rep)
+	}
+	for _, it := range rep.Items {
+		if it.Action != b2.Mismatched {
+			continue
+		}
+		if what, ok := want[it.Name]; !ok || !errors.Is(it.Err, b2.ErrMismatch) || !strings.Contains(it.Err.Error(), what) {
+			t.Errorf("Verify with damage: got %+v", it)
+		}
+	}
+
+	// HEAD requests only see B2's own record, which still agrees with the
+	// listing.
+	rep, err = bucket.Verify(ctx, b2.VerifyHeadOnly())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rep.Counts[b2.Verified] != 45 {
+		t.Errorf("Verify with HEAD: got %+v, want 45 verified", rep)
+	}
+
+	// A sample leaves some out.
+	rep, err = bucket.Verify(ctx, b2.VerifyPrefix("many/"), b2.VerifySample(0.5))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := rep.Counts[b2.Verified]; n == 0 || n == 40 {
+		t.Errorf("Verify half: verified %d of 40", n)
+	}
+
+	// A budget splits the verification into runs that resume from each
+	// other's cursors.  Each object takes longer than the budget, so each run
+	// gets through two: the first, and the one already waiting for it.
+	var got []string
+	var cursor string
+	for runs := 0; ; runs++ {
+		if runs > len(names) {
+			t.Fatalf("Verify with a budget: no progress after %d runs", runs)
+		}
+		rep, err := bucket.Verify(ctx, b2.VerifyPrefix("many/"), b2.VerifyConcurrency(1), b2.VerifyCursor(cursor), b2.VerifyBudget(20*time.Millisecond),
+			b2.ReportProgress(func(it b2.ReportItem) { time.Sleep(30 * time.Millisecond) }))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, it := range rep.Items {
+			got = append(got, it.Name)
+		}
+		if !rep.Partial {
+			break
+		}
+		if len(rep.Items) == 0 {
+			t.Fatalf("Verify with a budget: run %d verified nothing", runs)
+		}
+		cursor = rep.Cursor
+	}
+	if !reflect.DeepEqual(got, names) {
+		t.Errorf("Verify with a budget: got %v, want %v", got, names)
+	}
+}
+
+func TestTransformedReader(t *testing.T) {
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	_, _, bucket := newTestBucket(ctx, t, "b2test-transform")
+
+	want := bytes.Repeat([]byte("compress me "), 1e4)
+	buf := &bytes.Buffer{}
+	gz := gzip.NewWriter(buf)
+	gz.Write(want)
+	gz.Close()
+	stored := buf.Bytes()
+	obj := bucket.Object("obj.gz")
+	if err := writeObject(ctx, obj, stored, 1e6); err != nil {
+		t.Fatal(err)
+	}
+
+	var d b2.Download = b2.NewTransformedReader(obj.NewReader(ctx), func(r io.Reader) (io.Reader, error) {
+		return gzip.NewReader(r)
+	})
+	got, err := ioutil.ReadAll(d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("read %d bytes, want %d decompressed bytes", len(got), len(want))
+	}
+	if !d.Transformed() {
+		t.Error("Transformed: got false, want true")
+	}
+	if d.StoredLength() != int64(len(stored)) {
+		t.Errorf("StoredLength: got %d, want %d", d.StoredLength(), len(stored))
+	}
+	if sum := fmt.Sprintf("%x", sha1.Sum(stored)); d.StoredSHA1() != sum {
+		t.Errorf("StoredSHA1: got %q, want %q", d.StoredSHA1(), sum)
+	}
+	if err, ok := d.Verify(); err != nil || !ok {
+		t.Errorf("Verify: got %v, %v, want the stored bytes verified", err, ok)
+	}
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// A plain Reader is a Download whose stream is the stored bytes.
+	d = obj.NewReader(ctx)
+	defer d.Close()
+	if d.Transformed() || d.StoredLength() != int64(len(stored)) {
+		t.Errorf("Reader: got Transformed %v, StoredLength %d", d.Transformed(), d.StoredLength())
+	}
+}
@@ -0,0 +1,98 @@
+// Copyright 2018, the Blazer authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package b2
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+// Object names always separate their parts with '/', but local paths use the
+// host's separator, which on Windows is '\'.  Tools that map files to objects
+// should convert between the two with NameFromPath and PathFromName rather
+// than with filepath.Join or filepath.Walk alone, which would otherwise
+// produce objects named like "photos\2016\a.jpg" on Windows.
+
+// NameFromPath returns the object name for p, a relative path using the
+// host's separator.  It returns an error for paths that are absolute, that
+// climb out of their root with "..", or that contain a backslash that isn't a
+// separator, since such a name would be read back as a different path on
+// Windows.
+func NameFromPath(p string) (string, error) {
+	return nameFromPath(p, filepath.Separator, filepath.VolumeName(p))
+}
+
+// PathFromName returns the relative path, using the host's separator, for the
+// object name.  It returns an error for names that are absolute, that climb
+// out of their root with "..", that have empty or "." parts, or that contain a
+// backslash, none of which can be mapped to a path under a local root without
+// ambiguity.
+func PathFromName(name string) (string, error) {
+	return pathFromName(name, filepath.Separator)
+}
+
+// nameFromPath is NameFromPath for a host whose separator is sep.
+func nameFromPath(p string, sep byte, volume string) (string, error) {
+	if volume != "" {
+		return "", fmt.Errorf("b2: %q: path has a volume name", p)
+	}
+	name := p
+	if sep != '/' {
+		name = strings.Replace(p, string(sep), "/", -1)
+	}
+	if strings.Contains(name, `\`) {
+		return "", fmt.Errorf("b2: %q: path contains a backslash", p)
+	}
+	if err := checkName(name); err != nil {
+		return "", fmt.Errorf("b2: %q: %v", p, err)
+	}
+	return name, nil
+}
+
+// pathFromName is PathFromName for a host whose separator is sep.
+func pathFromName(name string, sep byte) (string, error) {
+	if strings.Contains(name, `\`) {
+		return "", fmt.Errorf("b2: %q: name contains a backslash", name)
+	}
+	if err := checkName(name); err != nil {
+		return "", fmt.Errorf("b2: %q: %v", name, err)
+	}
+	if sep == '/' {
+		return name, nil
+	}
+	return strings.Replace(name, "/", string(sep), -1), nil
+}
+
+// checkName reports whether name, with '/' separators, names something under
+// a root.
+func checkName(name string) error {
+	if name == "" {
+		return errors.New("empty name")
+	}
+	if strings.HasPrefix(name, "/") {
+		return errors.New("absolute name")
+	}
+	for _, part := range strings.Split(name, "/") {
+		switch part {
+		case "":
+			return errors.New("empty path element")
+		case ".", "..":
+			return fmt.Errorf("%q path element", part)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,182 @@
+// Copyright 2018, the Blazer authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package b2
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// PruneDryRun makes PruneHiddenVersions find the names it would prune without
+// deleting anything.
+func PruneDryRun() BulkOption {
+	return func(b *bulkOptions) {
+		b.dryRun = true
+	}
+}
+
+// PruneHiddenVersions deletes every version of each object whose newest
+// version is a hide marker uploaded more than olderThan ago, including the
+// marker itself, so that the name no longer appears in version listings.
+// Objects are pruned by up to concurrency goroutines at once; each object's
+// marker is deleted last, so that an object that is only partly pruned
+// remains hidden.
+//
+// The report lists each object pruned, as Deleted, with the total size of its
+// versions.  Unless ContinueOnError is given, PruneHiddenVersions stops at
+// the first error.  It checks ctx before every deletion, so that a canceled
+// context stops it promptly.
+func (b *Bucket) PruneHiddenVersions(ctx context.Context, olderThan time.Duration, concurrency int, opts ...BulkOption) (*Report, error) {
+	start := time.Now()
+	var p bulkOptions
+	for _, opt := range opts {
+		opt(&p)
+	}
+	stopOnError := p.stop(true)
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	cutoff := time.Now().Add(-olderThan)
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var (
+		mu   sync.Mutex
+		rep  = newReport()
+		perr error
+	)
+	rep.DryRun = p.dryRun
+	fail := func(err error) {
+		mu.Lock()
+		defer mu.Unlock()
+		if perr == nil {
+			perr = err
+		}
+		cancel()
+	}
+	done := func(it ReportItem) {
+		mu.Lock()
+		defer mu.Unlock()
+		rep.add(it)
+		if p.progress != nil {
+			p.progress(it)
+		}
+	}
+
+	ch := make(chan []*Object)
+	var wg sync.WaitGroup
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for versions := range ch {
+				it := pruneItem(versions)
+				if err := pruneVersions(ctx, versions); err != nil {
+					if ctx.Err() != nil {
+						// Abandoned, not failed.
+						continue
+					}
+					it.Action, it.Err = Failed, err
+				}
+				done(it)
+				if it.Err != nil && stopOnError {
+					fail(it.Err)
+				}
+			}
+		}()
+	}
+
+	// send hands off the versions of one name, newest first, if they are to
+	// be pruned.
+	send := func(versions []*Object) bool {
+		if len(versions) == 0 {
+			return true
+		}
+		marker := versions[0]
+		if objectState(marker.f.status()) != Hider || !marker.f.timestamp().Before(cutoff) {
+			return true
+		}
+		if p.dryRun {
+			done(pruneItem(versions))
+			return true
+		}
+		select {
+		case ch <- versions:
+			return true
+		case <-ctx.Done():
+			return false
+		}
+	}
+
+	var versions []*Object
+	iter := b.List(ctx, ListHidden(), ListSkip(Started))
+	for iter.Next() {
+		obj := iter.Object()
+		if len(versions) > 0 && versions[0].name != obj.name {
+			if !send(versions) {
+				break
+			}
+			versions = nil
+		}
+		versions = append(versions, obj)
+	}
+	if err := iter.Err(); err != nil {
+		fail(err)
+	} else if ctx.Err() == nil {
+		send(versions)
+	}
+	close(ch)
+	wg.Wait()
+
+	mu.Lock()
+	defer mu.Unlock()
+	rep.Elapsed = time.Since(start)
+	if perr == nil {
+		// The caller's context may have been canceled between deletions.
+		perr = ctx.Err()
+	}
+	if perr == nil {
+		perr = rep.err("prune")
+	}
+	return rep, perr
+}
+
+// pruneItem describes the pruning of versions, which all have one name.
+func pruneItem(versions []*Object) ReportItem {
+	it := ReportItem{
+		Name:   versions[0].name,
+		Action: Deleted,
+	}
+	for _, v := range versions {
+		it.Size += v.f.size()
+	}
+	return it
+}
+
+// pruneVersions deletes versions, which are ordered newest first, from the
+// oldest up.
+func pruneVersions(ctx context.Context, versions []*Object) error {
+	for i := len(versions) - 1; i >= 0; i-- {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := versions[i].Delete(ctx); err != nil {
+			return err
+		}
+	}
+	return nil
+}
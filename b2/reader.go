@@ -17,7 +17,6 @@ package b2
 import (
 	"bytes"
 	"context"
-	"crypto/sha1"
 	"errors"
 	"fmt"
 	"hash"
@@ -30,6 +29,13 @@ import (
 
 var errNoMoreContent = errors.New("416: out of content")
 
+// ErrNotModified is returned by a Reader whose IfNoneMatch matches the object.
+var ErrNotModified = errors.New("b2: object not modified")
+
+// ErrObjectChanged is returned by a Reader when the object it was reading was
+// replaced by a new version partway through.
+var ErrObjectChanged = errors.New("b2: object changed during read")
+
 // Reader reads files from B2.
 type Reader struct {
 	// ConcurrentDownloads is the number of simultaneous downloads to pull from
@@ -42,6 +48,12 @@ type Reader struct {
 	// 10MB.
 	ChunkSize int
 
+	// IfNoneMatch, if set, is the SHA1 of a copy of the object that the caller
+	// already has.  If the object's SHA1 still matches it, Read returns
+	// ErrNotModified instead of downloading the object again, and
+	// ContentType, Size, SHA1, and Info report the attributes that B2 sent.
+	IfNoneMatch string
+
 	ctx        context.Context
 	cancel     context.CancelFunc // cancels ctx
 	o          *Object
@@ -59,6 +71,11 @@ type Reader struct {
 	readOffEnd bool
 	sha1       string
 
+	pin    sync.Once  // resolves id, for readers of a particular version
+	idmux  sync.Mutex // guards id, for readers of the current version
+	id     string
+	pinErr error
+
 	rmux  sync.Mutex // guards rcond
 	rcond *sync.Cond
 
@@ -67,6 +84,14 @@ type Reader struct {
 
 	smux sync.Mutex
 	smap map[int]*meteredReader
+
+	amux    sync.Mutex // guards the object attributes below
+	hasAtt  bool
+	ctype   string
+	fsize   int64
+	fsha1   string
+	finfo   map[string]string
+	statErr error // from the last HEAD request, if it failed
 }
 
 type rchunk struct {
@@ -85,7 +110,7 @@ func (r *Reader) setErr(err error) {
 	r.emux.Lock()
 	defer r.emux.Unlock()
 	if r.err == nil {
-		r.err = err
+		r.err = r.wrap(err)
 		r.cancel()
 	}
 }
@@ -94,16 +119,71 @@ func (r *Reader) setErrNoCancel(err error) {
 	r.emux.Lock()
 	defer r.emux.Unlock()
 	if r.err == nil {
-		r.err = err
+		r.err = r.wrap(err)
 	}
 }
 
+func (r *Reader) wrap(err error) error {
+	return wrap("read", r.o.b.Name(), r.name, err)
+}
+
 func (r *Reader) getErr() error {
 	r.emux.RLock()
 	defer r.emux.RUnlock()
 	return r.err
 }
 
+// download fetches part of the object.  The first request for an object read
+// by name is made by name; once a response has identified the version being
+// read, the rest are made by ID, so that an object overwritten mid-read isn't
+// spliced together from two versions.
+func (r *Reader) download(ctx context.Context, offset, size int64, header bool) (beFileReaderInterface, error) {
+	id, err := r.fileID()
+	if err != nil {
+		return nil, err
+	}
+	if id == "" {
+		return r.o.b.backend().downloadFileByName(ctx, r.name, r.IfNoneMatch, offset, size, header)
+	}
+	return r.o.b.backend().downloadFileByID(ctx, id, r.IfNoneMatch, offset, size, header)
+}
+
+// fileID returns the ID of the version being read, if it is known.
+func (r *Reader) fileID() (string, error) {
+	if r.o.asOf.IsZero() {
+		r.idmux.Lock()
+		defer r.idmux.Unlock()
+		return r.id, nil
+	}
+	r.pin.Do(func() {
+		f, err := r.o.b.version(r.ctx, r.name, r.o.asOf)
+		if err != nil {
+			r.pinErr = err
+			return
+		}
+		r.id = f.id()
+	})
+	return r.id, r.pinErr
+}
+
+// sawID records the ID of the version a response came from.  Requests made by
+// name before the ID was known may come from a different version, in which
+// case ErrObjectChanged is returned.
+func (r *Reader) sawID(id string) error {
+	if id == "" || !r.o.asOf.IsZero() {
+		return nil
+	}
+	r.idmux.Lock()
+	defer r.idmux.Unlock()
+	if r.id == "" {
+		r.id = id
+	}
+	if r.id != id {
+		return ErrObjectChanged
+	}
+	return nil
+}
+
 func (r *Reader) thread() {
 	go func() {
 		for {
@@ -120,7 +200,6 @@ func (r *Reader) thread() {
 			r.rmux.Lock()
 			chunkID := r.chwid
 			r.chwid++
-			r.rmux.Unlock()
 			offset := int64(chunkID*r.csize) + r.offset
 			size := int64(r.csize)
 			if r.length > 0 {
@@ -130,34 +209,64 @@ func (r *Reader) thread() {
 				}
 				r.length -= size
 			}
+			r.rmux.Unlock()
 			var b backoff
 		redo:
-			fr, err := r.o.b.b.downloadFileByName(r.ctx, r.name, offset, size, false)
-			if err == errNoMoreContent {
+			ctx, wd := r.o.b.c.opts.watchResponse(r.ctx)
+			fr, err := r.download(ctx, offset, size, false)
+			if err != nil {
+				err = wd.done(err)
+			}
+			if err == errStalled {
+				blog.V(1).Infof("b2 reader %d: %v; retrying after %v", chunkID, err, b)
+				if err := b.wait(r.ctx); err != nil {
+					r.setErr(err)
+					r.rcond.Broadcast()
+					return
+				}
+				goto redo
+			}
+			if errors.Is(err, errNoMoreContent) {
 				// this read generated a 416 so we are entirely past the end of the object
-				r.readOffEnd = true
 				buf.final = true
 				r.rmux.Lock()
+				r.readOffEnd = true
 				r.chunks[chunkID] = buf
 				r.rmux.Unlock()
 				r.rcond.Broadcast()
 				return
 			}
+			if errors.Is(err, ErrNotModified) {
+				r.setAttrs(fr)
+			}
 			if err != nil {
 				r.setErr(err)
 				r.rcond.Broadcast()
 				return
 			}
+			if err := r.sawID(fr.id()); err != nil {
+				fr.Close()
+				wd.done(nil)
+				r.setErr(err)
+				r.rcond.Broadcast()
+				return
+			}
 			rsize, _, sha1, _ := fr.stats()
-			if len(sha1) == 40 && r.sha1 != sha1 {
+			if len(sha1) == 40 {
+				r.rmux.Lock()
 				r.sha1 = sha1
+				r.rmux.Unlock()
+			}
+			if chunkID == 0 {
+				r.setAttrs(fr)
 			}
-			mr := &meteredReader{r: noopResetter{fr}, size: int(rsize)}
+			mr := &meteredReader{r: wd.reader(noopResetter{fr}), size: int(rsize)}
 			r.smux.Lock()
 			r.smap[chunkID] = mr
 			r.smux.Unlock()
 			i, err := copyContext(r.ctx, buf, mr)
 			fr.Close()
+			err = wd.done(err)
 			r.smux.Lock()
 			r.smap[chunkID] = nil
 			r.smux.Unlock()
@@ -229,7 +338,7 @@ func (r *Reader) initFunc() {
 		r.thread()
 		r.chbuf <- &rchunk{}
 	}
-	r.vrfy = sha1.New()
+	r.vrfy = r.o.b.c.opts.newHash()
 }
 
 func (r *Reader) Read(p []byte) (int, error) {
@@ -240,7 +349,7 @@ func (r *Reader) Read(p []byte) (int, error) {
 	chunk, err := r.curChunk()
 	if err != nil {
 		r.setErrNoCancel(err)
-		return 0, err
+		return 0, r.wrap(err)
 	}
 	n, err := chunk.Read(p)
 	r.vrfy.Write(p[:n]) // Hash.Write never returns an error.
@@ -260,6 +369,56 @@ func (r *Reader) Read(p []byte) (int, error) {
 	return n, err
 }
 
+// WriteTo writes the object to w until it is exhausted or an error occurs.  It
+// buffers no more than ConcurrentDownloads chunks of ChunkSize bytes, just as
+// Read does, and so it is safe to use with a slow or unbounded destination,
+// such as a pipe.  If a write to w fails, the remaining downloads are canceled
+// and the error is returned.
+//
+// Note that io.Copy will automatically choose to use WriteTo.
+func (r *Reader) WriteTo(w io.Writer) (int64, error) {
+	if err := r.getErr(); err != nil {
+		if err == io.EOF {
+			return 0, nil
+		}
+		return 0, err
+	}
+	r.init.Do(r.initFunc)
+	var n int64
+	for {
+		chunk, err := r.curChunk()
+		if err != nil {
+			if err == io.EOF {
+				return n, nil
+			}
+			r.setErrNoCancel(err)
+			return n, r.wrap(err)
+		}
+		b := chunk.Bytes()
+		k, err := w.Write(b)
+		r.vrfy.Write(b[:k]) // Hash.Write never returns an error.
+		r.read += k
+		n += int64(k)
+		chunk.Next(k)
+		if err == nil && k < len(b) {
+			err = io.ErrShortWrite
+		}
+		if err != nil {
+			// The destination has gone away; stop downloading.
+			r.setErr(err)
+			return n, r.wrap(err)
+		}
+		if chunk.final {
+			close(r.chbuf)
+			r.setErrNoCancel(io.EOF)
+			return n, nil
+		}
+		r.chrid++
+		chunk.Reset()
+		r.chbuf <- chunk
+	}
+}
+
 func (r *Reader) status() *ReaderStatus {
 	r.smux.Lock()
 	defer r.smux.Unlock()
@@ -275,6 +434,119 @@ func (r *Reader) status() *ReaderStatus {
 	return rs
 }
 
+// setAttrs records the object's attributes from a download response.  Only
+// the first response is used, so that the values are consistent.
+func (r *Reader) setAttrs(fr beFileReaderInterface) {
+	r.amux.Lock()
+	defer r.amux.Unlock()
+	r.setAttrsLocked(fr)
+}
+
+func (r *Reader) setAttrsLocked(fr beFileReaderInterface) {
+	if r.hasAtt {
+		return
+	}
+	_, ctype, sha1, info := fr.stats()
+	r.hasAtt = true
+	r.ctype = ctype
+	r.fsize = fr.fileSize()
+	r.fsha1 = sha1
+	r.finfo = info
+}
+
+// stat populates the object's attributes, if they have not already been
+// recorded from the first chunk's response, by issuing a HEAD request.  The
+// request is made without holding amux, so that it doesn't hold up readers of
+// attributes that are already known; if it fails, the error is kept for
+// StatErr.
+func (r *Reader) stat() {
+	r.amux.Lock()
+	has := r.hasAtt
+	r.amux.Unlock()
+	if has {
+		return
+	}
+	fr, err := r.download(r.ctx, 0, 0, true)
+	if err != nil && !errors.Is(err, ErrNotModified) {
+		blog.V(1).Infof("b2 reader: stat %s: %v", r.name, err)
+		r.setStatErr(err)
+		return
+	}
+	fr.Close()
+	if err := r.sawID(fr.id()); err != nil {
+		// The object has been replaced since the read began; don't report
+		// the new version's attributes.
+		r.setStatErr(err)
+		return
+	}
+	r.amux.Lock()
+	defer r.amux.Unlock()
+	r.setAttrsLocked(fr)
+}
+
+func (r *Reader) setStatErr(err error) {
+	r.amux.Lock()
+	defer r.amux.Unlock()
+	if !r.hasAtt {
+		r.statErr = r.wrap(err)
+	}
+}
+
+// StatErr returns the error that kept the object's attributes from being
+// determined, if ContentType, Size, SHA1, or Info returned the zero value
+// because of one.  It returns nil once the attributes are known.
+func (r *Reader) StatErr() error {
+	r.amux.Lock()
+	defer r.amux.Unlock()
+	if r.hasAtt {
+		return nil
+	}
+	return r.statErr
+}
+
+// ContentType returns the object's content type.  It is populated from the
+// response to the first chunk; if called before the first Read, it may make a
+// HEAD request to the service.  If the attributes cannot be determined, the
+// zero value is returned, and StatErr reports why.
+func (r *Reader) ContentType() string {
+	r.stat()
+	r.amux.Lock()
+	defer r.amux.Unlock()
+	return r.ctype
+}
+
+// Size returns the size of the entire object, regardless of any range
+// requested.  It is subject to the same caveats as ContentType.
+func (r *Reader) Size() int64 {
+	r.stat()
+	r.amux.Lock()
+	defer r.amux.Unlock()
+	return r.fsize
+}
+
+// SHA1 returns the object's SHA1 hash, as recorded by B2 or, for large files,
+// in the large_file_sha1 info entry.  It is subject to the same caveats as
+// ContentType.
+func (r *Reader) SHA1() string {
+	r.stat()
+	r.amux.Lock()
+	defer r.amux.Unlock()
+	return r.fsha1
+}
+
+// Info returns the object's user-supplied metadata.  It is subject to the same
+// caveats as ContentType.
+func (r *Reader) Info() map[string]string {
+	r.stat()
+	r.amux.Lock()
+	defer r.amux.Unlock()
+	info := make(map[string]string)
+	for k, v := range r.finfo {
+		info[k] = v
+	}
+	return info
+}
+
 // Verify checks the SHA1 hash on download and compares it to the SHA1 hash
 // submitted on upload.  If the two differ, this returns an error.  If the
 // correct hash could not be calculated (if, for example, the entire object was
@@ -282,7 +554,10 @@ func (r *Reader) status() *ReaderStatus {
 // hash was not sent), this returns (nil, false).
 func (r *Reader) Verify() (error, bool) {
 	got := fmt.Sprintf("%x", r.vrfy.Sum(nil))
-	if r.sha1 == got {
+	r.rmux.Lock()
+	want, readOffEnd := r.sha1, r.readOffEnd
+	r.rmux.Unlock()
+	if want == got {
 		return nil, true
 	}
 	// TODO: if the exact length of the file is requested AND the checksum is
@@ -290,10 +565,10 @@ func (r *Reader) Verify() (error, bool) {
 	// because there's no good way that I can tell to determine that we've hit
 	// the end of the file without reading off the end.  Consider reading N+1
 	// bytes at the very end to close this hole.
-	if r.offset > 0 || !r.readOffEnd || len(r.sha1) != 40 {
+	if r.offset > 0 || !readOffEnd || len(want) != 40 {
 		return nil, false
 	}
-	return fmt.Errorf("bad hash: got %v, want %v", got, r.sha1), true
+	return fmt.Errorf("bad hash: got %v, want %v", got, want), true
 }
 
 // strip a writer of any non-Write methods
@@ -0,0 +1,390 @@
+// Copyright 2018, the Blazer authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package b2
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// Action says what a bulk operation, such as Migrate or
+// PruneHiddenVersions, did with one object.
+type Action int
+
+const (
+	// Failed means that the operation could not be carried out on the
+	// object.
+	Failed Action = iota
+	// Skipped means that there was nothing to do: for Migrate, the
+	// destination already held the object, with the same SHA1.
+	Skipped
+	// Copied means that the object was copied by B2, without passing through
+	// the client.
+	Copied
+	// Streamed means that the object was downloaded and uploaded again.
+	Streamed
+	// Deleted means that every version of the object was deleted.
+	Deleted
+	// Verified means that the object matched its listed metadata.
+	Verified
+	// Mismatched means that the object did not match its listed metadata;
+	// the item's error says how.
+	Mismatched
+)
+
+var actionNames = map[Action]string{
+	Failed:     "failed",
+	Skipped:    "skipped",
+	Copied:     "copied",
+	Streamed:   "streamed",
+	Deleted:    "deleted",
+	Verified:   "verified",
+	Mismatched: "mismatched",
+}
+
+func (a Action) String() string {
+	if s, ok := actionNames[a]; ok {
+		return s
+	}
+	return fmt.Sprintf("Action(%d)", int(a))
+}
+
+// MarshalText implements encoding.TextMarshaler, so that actions are written
+// by name in JSON, including as the keys of Report.Counts.
+func (a Action) MarshalText() ([]byte, error) {
+	if _, ok := actionNames[a]; !ok {
+		return nil, fmt.Errorf("b2: unknown action %d", int(a))
+	}
+	return []byte(a.String()), nil
+}
+
+// UnmarshalText implements encoding.TextUnmarshaler.
+func (a *Action) UnmarshalText(text []byte) error {
+	for act, s := range actionNames {
+		if s == string(text) {
+			*a = act
+			return nil
+		}
+	}
+	return fmt.Errorf("b2: unknown action %q", text)
+}
+
+// ReportItem is the outcome of a bulk operation for one object.
+type ReportItem struct {
+	Name   string
+	Action Action
+	Size   int64 // the bytes copied, streamed, deleted, or verified
+	Err    error // set if Action is Failed
+
+	// Cursor, if set, resumes the operation after the crash of a previous
+	// run; see MigrateCursor.  Every object before it has been dealt with,
+	// though some objects after it may have been too.
+	Cursor string
+}
+
+type jsonReportItem struct {
+	Name   string `json:"name"`
+	Action Action `json:"action"`
+	Size   int64  `json:"size,omitempty"`
+	Err    string `json:"error,omitempty"`
+	Cursor string `json:"cursor,omitempty"`
+}
+
+// MarshalJSON implements json.Marshaler; Err is written as its message.
+func (it ReportItem) MarshalJSON() ([]byte, error) {
+	j := jsonReportItem{
+		Name:   it.Name,
+		Action: it.Action,
+		Size:   it.Size,
+		Cursor: it.Cursor,
+	}
+	if it.Err != nil {
+		j.Err = it.Err.Error()
+	}
+	return json.Marshal(j)
+}
+
+// UnmarshalJSON implements json.Unmarshaler.  Err, if set, is restored as an
+// error with the same message, but not the same type.
+func (it *ReportItem) UnmarshalJSON(data []byte) error {
+	var j jsonReportItem
+	if err := json.Unmarshal(data, &j); err != nil {
+		return err
+	}
+	*it = ReportItem{
+		Name:   j.Name,
+		Action: j.Action,
+		Size:   j.Size,
+		Cursor: j.Cursor,
+	}
+	if j.Err != "" {
+		it.Err = errors.New(j.Err)
+	}
+	return nil
+}
+
+// Report collects the results of a bulk operation.  It can be marshaled to
+// JSON as it is.
+//
+// Every bulk operation in this package returns a Report: Migrate,
+// Bucket.PruneHiddenVersions, and Bucket.Verify.  There are no helpers to
+// empty a bucket, sync two buckets, delete every version of an object, or
+// cancel unfinished large files; any that are added, and any other bulk
+// operation, should report through a Report in the same way, with one item
+// per object and the same meaning for each Action.
+type Report struct {
+	// Items lists the objects dealt with, in the order they were finished.
+	// Objects that needed nothing done are included, as Skipped.
+	Items []ReportItem `json:"items"`
+
+	// Counts totals the items by action.
+	Counts map[Action]int `json:"counts"`
+
+	// Bytes is the total size of the items copied, streamed, deleted, or
+	// verified.
+	Bytes int64 `json:"bytes"`
+
+	// Elapsed is how long the operation took.  In JSON, it is written in
+	// nanoseconds.
+	Elapsed time.Duration `json:"elapsed"`
+
+	// DryRun is set if nothing was changed, and Items lists what would have
+	// been.
+	DryRun bool `json:"dryRun,omitempty"`
+
+	// Partial is set if the operation stopped before it was done, because its
+	// time budget ran out; it can be resumed from Cursor.
+	Partial bool `json:"partial,omitempty"`
+
+	// Cursor is the cursor of the last item; if the operation was
+	// interrupted, it is where the next run should resume.
+	Cursor string `json:"cursor,omitempty"`
+}
+
+func newReport() *Report {
+	return &Report{Counts: make(map[Action]int)}
+}
+
+// add records the outcome for one object.
+func (r *Report) add(it ReportItem) {
+	r.Items = append(r.Items, it)
+	r.Counts[it.Action]++
+	if it.Action != Failed && it.Action != Skipped {
+		r.Bytes += it.Size
+	}
+	if it.Cursor != "" {
+		r.Cursor = it.Cursor
+	}
+}
+
+// err returns an error summarizing the items with errors, if there are any.
+func (r *Report) err(what string) error {
+	var n int
+	var first *ReportItem
+	for i, it := range r.Items {
+		if it.Err != nil {
+			n++
+			if first == nil {
+				first = &r.Items[i]
+			}
+		}
+	}
+	if n == 0 {
+		return nil
+	}
+	return fmt.Errorf("b2: %d of %d objects failed to %s; first: %s: %v", n, len(r.Items), what, first.Name, first.Err)
+}
+
+// A BulkOption configures a bulk operation, such as Migrate or
+// PruneHiddenVersions.  Options that don't apply to an operation are ignored.
+type BulkOption func(*bulkOptions)
+
+type errorPolicy int
+
+const (
+	defaultPolicy errorPolicy = iota
+	stopPolicy
+	continuePolicy
+)
+
+type bulkOptions struct {
+	onError  errorPolicy
+	progress func(ReportItem)
+
+	concurrency int           // for Migrate and Verify
+	cursor      string        // for Migrate and Verify
+	dryRun      bool          // for PruneHiddenVersions
+	prefix      string        // for Verify
+	headOnly    bool          // for Verify
+	sample      float64       // for Verify
+	budget      time.Duration // for Verify
+}
+
+// stop reports whether the operation should stop at its first failure, given
+// the operation's default.
+func (b *bulkOptions) stop(def bool) bool {
+	switch b.onError {
+	case stopPolicy:
+		return true
+	case continuePolicy:
+		return false
+	}
+	return def
+}
+
+// StopOnError ends the operation at the first object that fails, which is
+// the default for PruneHiddenVersions.  The operation returns that object's
+// error.
+func StopOnError() BulkOption {
+	return func(b *bulkOptions) {
+		b.onError = stopPolicy
+	}
+}
+
+// ContinueOnError keeps going when an object fails, which is the default for
+// Migrate.  Failures are listed in the report, and the operation returns an
+// error summarizing them once it is done.
+func ContinueOnError() BulkOption {
+	return func(b *bulkOptions) {
+		b.onError = continuePolicy
+	}
+}
+
+// ReportProgress calls f with the outcome for each object as it is finished.
+// Calls to f are not made concurrently, but the operation does not proceed
+// while f runs.
+func ReportProgress(f func(ReportItem)) BulkOption {
+	return func(b *bulkOptions) {
+		b.progress = f
+	}
+}
+
+// runBulk lists the objects in src and calls do on each, from up to
+// m.concurrency goroutines at once, collecting the results.  Each item is
+// given the cursor that resumes after every object finished so far.  Objects
+// abandoned because ctx was canceled, or because the operation stopped at
+// another object's failure, are not reported, and are left to the next run.
+func runBulk(ctx context.Context, src BucketInterface, m bulkOptions, stopOnError bool, what string, do func(context.Context, ObjectInterface) ReportItem) (*Report, error) {
+	start := time.Now()
+	if m.concurrency < 1 {
+		m.concurrency = 1
+	}
+	wctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var (
+		mu      sync.Mutex
+		rep     = newReport()
+		ferr    error                  // the first failure, if stopping on it
+		cursors = make(map[int]string) // resuming at each pending object
+		done    = make(map[int]bool)
+		low     int // every object before low is done
+	)
+	// finish marks object seq done, and reports res if it is set.
+	finish := func(seq int, res *ReportItem) {
+		mu.Lock()
+		defer mu.Unlock()
+		done[seq] = true
+		for done[low] {
+			delete(done, low)
+			delete(cursors, low)
+			low++
+		}
+		if res == nil {
+			return
+		}
+		res.Cursor = cursors[low]
+		rep.add(*res)
+		if m.progress != nil {
+			m.progress(*res)
+		}
+		if res.Err != nil && stopOnError && ferr == nil {
+			ferr = res.Err
+			cancel()
+		}
+	}
+
+	type job struct {
+		seq int
+		obj ObjectInterface
+	}
+	ch := make(chan job)
+	var wg sync.WaitGroup
+	for i := 0; i < m.concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := range ch {
+				res := do(wctx, j.obj)
+				if res.Action == Failed && wctx.Err() != nil {
+					// Abandoned, not failed; the cursor must not move past it.
+					continue
+				}
+				finish(j.seq, &res)
+			}
+		}()
+	}
+
+	iter := src.ListObjects(wctx, ListPrefix(m.prefix), WithCursor(m.cursor))
+	for seq := 0; ; seq++ {
+		mu.Lock()
+		cursors[seq] = iter.Cursor()
+		mu.Unlock()
+		if m.budget > 0 && time.Since(start) >= m.budget {
+			mu.Lock()
+			rep.Partial = true
+			mu.Unlock()
+			break
+		}
+		if !iter.Next() {
+			break
+		}
+		if m.sample > 0 && m.sample < 1 && rand.Float64() >= m.sample {
+			finish(seq, nil)
+			continue
+		}
+		select {
+		case ch <- job{seq: seq, obj: iter.Current()}:
+		case <-wctx.Done():
+		}
+		if wctx.Err() != nil {
+			break
+		}
+	}
+	iter.Close()
+	close(ch)
+	wg.Wait()
+	lerr := iter.Err()
+
+	mu.Lock()
+	defer mu.Unlock()
+	rep.Elapsed = time.Since(start)
+	rep.Cursor = cursors[low]
+	if ferr != nil {
+		return rep, ferr
+	}
+	if lerr == nil {
+		lerr = ctx.Err()
+	}
+	if lerr != nil {
+		return rep, lerr
+	}
+	return rep, rep.err(what)
+}
@@ -0,0 +1,132 @@
+// Copyright 2018, the Blazer authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package b2_test
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/kurin/blazer/b2"
+	"github.com/kurin/blazer/b2/b2test"
+	"github.com/kurin/blazer/base"
+)
+
+// The tests in package b2_test exercise the client against the in-memory
+// server in b2test.
+
+// newTestClient starts a b2test server, which is closed when t finishes, and
+// returns it along with a client made with opts.
+func newTestClient(ctx context.Context, t *testing.T, opts ...b2.ClientOption) (*b2test.Server, *b2.Client) {
+	t.Helper()
+	srv := b2test.NewServer()
+	t.Cleanup(srv.Close)
+	client, err := srv.NewClient(ctx, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return srv, client
+}
+
+// newTestBucket is like newTestClient, and also creates a bucket called name.
+func newTestBucket(ctx context.Context, t *testing.T, name string, opts ...b2.ClientOption) (*b2test.Server, *b2.Client, *b2.Bucket) {
+	t.Helper()
+	srv, client := newTestClient(ctx, t, opts...)
+	bucket, err := client.NewBucket(ctx, name, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return srv, client, bucket
+}
+
+// bucketID returns the ID that srv gave the bucket called name.
+func bucketID(ctx context.Context, t *testing.T, srv *b2test.Server, name string) string {
+	t.Helper()
+	acct, err := base.AuthorizeAccount(ctx, "b2test-account", "b2test-key", base.SetAPIBase(srv.URL()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	bs, err := acct.ListBuckets(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, b := range bs {
+		if b.Name == name {
+			return b.ID
+		}
+	}
+	t.Fatalf("no bucket called %s", name)
+	return ""
+}
+
+func writeObject(ctx context.Context, o *b2.Object, data []byte, chunkSize int) error {
+	w := o.NewWriter(ctx)
+	w.ChunkSize = chunkSize
+	w.ConcurrentUploads = 3
+	if _, err := io.Copy(w, bytes.NewBuffer(data)); err != nil {
+		w.Close()
+		return err
+	}
+	return w.Close()
+}
+
+func readObject(ctx context.Context, o *b2.Object, offset, length int64) ([]byte, error) {
+	r := o.NewRangeReader(ctx, offset, length)
+	r.ChunkSize = 1e3
+	defer r.Close()
+	return ioutil.ReadAll(r)
+}
+
+// hookTransport calls before and after each request.
+type hookTransport struct {
+	rt            http.RoundTripper
+	before, after func(*http.Request)
+}
+
+func (ht hookTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	ht.before(req)
+	defer ht.after(req)
+	return ht.rt.RoundTrip(req)
+}
+
+// denyTransport answers list requests for one bucket the way B2 answers a key
+// restricted to another bucket.
+type denyTransport struct {
+	rt     http.RoundTripper
+	bucket string // id
+}
+
+func (dt denyTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if strings.HasSuffix(req.URL.Path, "/b2_list_file_names") && req.Body != nil {
+		body, err := ioutil.ReadAll(req.Body)
+		if err != nil {
+			return nil, err
+		}
+		req.Body = ioutil.NopCloser(bytes.NewReader(body))
+		if bytes.Contains(body, []byte(dt.bucket)) {
+			return &http.Response{
+				StatusCode: http.StatusForbidden,
+				Header:     http.Header{"Content-Type": {"application/json"}},
+				Body:       ioutil.NopCloser(strings.NewReader(`{"status":403,"code":"access_denied","message":"not entitled"}`)),
+				Request:    req,
+			}, nil
+		}
+	}
+	return dt.rt.RoundTrip(req)
+}
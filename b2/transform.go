@@ -0,0 +1,127 @@
+// Copyright 2018, the Blazer authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package b2
+
+import (
+	"io"
+	"io/ioutil"
+	"sync"
+)
+
+// A Download is a stream of an object's contents.  Its stored length and SHA1
+// describe the bytes that B2 holds; when Transformed reports true, those are
+// not the bytes that Read returns, and so they must not be passed on as, for
+// example, an HTTP Content-Length.
+//
+// Both Reader and TransformedReader are Downloads.
+type Download interface {
+	io.ReadCloser
+
+	// StoredLength is the size of the object as stored.
+	StoredLength() int64
+
+	// StoredSHA1 is the SHA1 of the object as stored; see Reader.SHA1.
+	StoredSHA1() string
+
+	// Transformed reports whether Read returns something other than the
+	// stored bytes.
+	Transformed() bool
+
+	// Verify checks the stored bytes against StoredSHA1; see Reader.Verify.
+	Verify() (error, bool)
+}
+
+// StoredLength returns Size.
+func (r *Reader) StoredLength() int64 { return r.Size() }
+
+// StoredSHA1 returns SHA1.
+func (r *Reader) StoredSHA1() string { return r.SHA1() }
+
+// Transformed returns false; a Reader returns the stored bytes.
+func (r *Reader) Transformed() bool { return false }
+
+// TransformedReader reads an object through a transformation, such as
+// decompression.  Its Read returns the transformed bytes, but its stored
+// length and SHA1 describe, and Verify checks, the bytes that B2 holds.
+type TransformedReader struct {
+	r *Reader
+	f func(io.Reader) (io.Reader, error)
+
+	init sync.Once
+	t    io.Reader
+	err  error
+}
+
+// NewTransformedReader returns a TransformedReader that reads r through f.  f
+// is called on the first Read; for example, to decompress gzipped objects:
+//
+//	tr := b2.NewTransformedReader(obj.NewReader(ctx), func(r io.Reader) (io.Reader, error) {
+//	  return gzip.NewReader(r)
+//	})
+//
+// If the reader f returns is an io.Closer, it is closed by Close.
+func NewTransformedReader(r *Reader, f func(io.Reader) (io.Reader, error)) *TransformedReader {
+	return &TransformedReader{r: r, f: f}
+}
+
+// Read reads transformed bytes.  Once the transformed stream ends, the rest of
+// the stored stream is read and discarded, so that Verify can check all of
+// it.
+func (t *TransformedReader) Read(p []byte) (int, error) {
+	t.init.Do(func() { t.t, t.err = t.f(t.r) })
+	if t.err != nil {
+		return 0, t.err
+	}
+	n, err := t.t.Read(p)
+	if err == io.EOF {
+		if _, derr := io.Copy(ioutil.Discard, t.r); derr != nil {
+			err = derr
+		}
+	}
+	return n, err
+}
+
+// Close closes the transformation, if it is an io.Closer, and the underlying
+// Reader.
+func (t *TransformedReader) Close() error {
+	var err error
+	if c, ok := t.t.(io.Closer); ok {
+		err = c.Close()
+	}
+	if rerr := t.r.Close(); err == nil {
+		err = rerr
+	}
+	return err
+}
+
+// StoredLength returns the size of the object as stored.
+func (t *TransformedReader) StoredLength() int64 { return t.r.Size() }
+
+// StoredSHA1 returns the SHA1 of the object as stored.
+func (t *TransformedReader) StoredSHA1() string { return t.r.SHA1() }
+
+// Transformed returns true.
+func (t *TransformedReader) Transformed() bool { return true }
+
+// Verify checks the stored bytes read so far against StoredSHA1, as
+// Reader.Verify does.
+func (t *TransformedReader) Verify() (error, bool) { return t.r.Verify() }
+
+// ContentType returns the object's content type, which describes the stored
+// bytes.
+func (t *TransformedReader) ContentType() string { return t.r.ContentType() }
+
+// Info returns the object's user-supplied metadata.
+func (t *TransformedReader) Info() map[string]string { return t.r.Info() }
@@ -0,0 +1,398 @@
+// Copyright 2017, the Blazer authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package b2
+
+import (
+	"context"
+	"io"
+	"strings"
+	"sync"
+)
+
+// UsageCount is a number of object versions and their total size in bytes.
+type UsageCount struct {
+	Objects int64
+	Bytes   int64
+}
+
+func (u *UsageCount) add(size int64) {
+	u.Objects++
+	u.Bytes += size
+}
+
+func (u *UsageCount) sum(v UsageCount) {
+	u.Objects += v.Objects
+	u.Bytes += v.Bytes
+}
+
+// Usage breaks down the storage used by a bucket, or by part of one.
+type Usage struct {
+	// Live counts the current version of each object.
+	Live UsageCount
+
+	// Hidden counts the versions that are not current: those superseded by a
+	// newer version, and those hidden with Hide.  The markers that hide
+	// objects are not counted.
+	Hidden UsageCount
+
+	// Unfinished counts large files that were started but never finished or
+	// canceled.  B2 does not report their size, so it is counted as zero.
+	Unfinished UsageCount
+}
+
+func (u *Usage) sum(v Usage) {
+	u.Live.sum(v.Live)
+	u.Hidden.sum(v.Hidden)
+	u.Unfinished.sum(v.Unfinished)
+}
+
+// BucketUsage is the storage used by a bucket.
+type BucketUsage struct {
+	Usage
+
+	// Prefixes breaks the bucket's usage down by the leading path components
+	// of object names; see UsagePrefixDepth.  Objects with no more than that
+	// many components are counted under "".
+	Prefixes map[string]*Usage
+}
+
+func (b *BucketUsage) copy() *BucketUsage {
+	c := &BucketUsage{
+		Usage:    b.Usage,
+		Prefixes: make(map[string]*Usage, len(b.Prefixes)),
+	}
+	for k, v := range b.Prefixes {
+		u := *v
+		c.Prefixes[k] = &u
+	}
+	return c
+}
+
+// UsageReport is the storage used by an account, as returned by Usage.
+type UsageReport struct {
+	// Buckets holds the usage of each bucket, by name.
+	Buckets map[string]*BucketUsage
+
+	// Cursor is nil if every bucket was walked completely.  Otherwise, the
+	// report is partial, and Cursor can be passed to UsageResume to finish it.
+	Cursor *UsageCursor
+}
+
+// Total returns the usage of every bucket in the report, combined.
+func (r UsageReport) Total() Usage {
+	var u Usage
+	for _, b := range r.Buckets {
+		u.sum(b.Usage)
+	}
+	return u
+}
+
+// UsageCursor records the progress of a call to Usage, so that a walk that is
+// interrupted can be resumed with UsageResume instead of starting over.  It
+// can be saved with encoding/json.
+type UsageCursor struct {
+	// Buckets holds the usage counted so far, by bucket name.
+	Buckets map[string]*BucketUsage
+
+	// Positions records where to continue in each bucket that has been
+	// partially walked.
+	Positions map[string]UsagePosition
+
+	// Done lists the buckets that have been walked completely.
+	Done map[string]bool
+
+	// Depth is the prefix depth the usage was counted with.
+	Depth int
+}
+
+// UsagePosition is a place in a bucket's listing of object versions.
+type UsagePosition struct {
+	// StartName and StartID identify the next version to list.
+	StartName string
+	StartID   string
+
+	// LastName is the name of the last version counted; further versions
+	// with that name are not current.
+	LastName string
+}
+
+func (c *UsageCursor) copy() *UsageCursor {
+	n := &UsageCursor{
+		Buckets:   make(map[string]*BucketUsage, len(c.Buckets)),
+		Positions: make(map[string]UsagePosition, len(c.Positions)),
+		Done:      make(map[string]bool, len(c.Done)),
+		Depth:     c.Depth,
+	}
+	for k, v := range c.Buckets {
+		n.Buckets[k] = v.copy()
+	}
+	for k, v := range c.Positions {
+		n.Positions[k] = v
+	}
+	for k, v := range c.Done {
+		n.Done[k] = v
+	}
+	return n
+}
+
+// UsageProgress is passed to the function given to UsageProgressFunc after
+// each page of object versions is counted.
+type UsageProgress struct {
+	// Bucket is the bucket the page was from.
+	Bucket string
+
+	// Objects is the number of object versions counted so far by this call to
+	// Usage.
+	Objects int64
+
+	// Cursor can be used to resume the walk from this point.
+	Cursor *UsageCursor
+}
+
+type usageOptions struct {
+	depth    int
+	workers  int
+	progress func(UsageProgress)
+	resume   *UsageCursor
+}
+
+// A UsageOption alters the behavior of Usage.
+type UsageOption func(*usageOptions)
+
+// UsagePrefixDepth sets the number of "/"-separated components of object
+// names by which BucketUsage.Prefixes is broken down.  The default is 1, which
+// counts each top-level "directory" of each bucket separately.  Zero disables
+// the breakdown.
+func UsagePrefixDepth(n int) UsageOption {
+	return func(o *usageOptions) {
+		o.depth = n
+	}
+}
+
+// UsageConcurrency sets the number of buckets that are walked at once.  The
+// default is 4.
+func UsageConcurrency(n int) UsageOption {
+	return func(o *usageOptions) {
+		o.workers = n
+	}
+}
+
+// UsageProgressFunc calls f after each page of object versions is counted.
+// Calls to f are not made concurrently, but Usage does not proceed while f
+// runs, so f should return quickly.
+func UsageProgressFunc(f func(UsageProgress)) UsageOption {
+	return func(o *usageOptions) {
+		o.progress = f
+	}
+}
+
+// UsageResume continues the walk recorded by c, which comes from an earlier
+// UsageReport or UsageProgress.  The prefix depth recorded in c is used.
+// Buckets that were completely walked are not walked again, even if they
+// have changed, and buckets that have since been created are walked from the
+// start.
+func UsageResume(c *UsageCursor) UsageOption {
+	return func(o *usageOptions) {
+		o.resume = c
+	}
+}
+
+// Usage walks every version of every object in every bucket in the account,
+// and reports the number of objects and bytes stored.  Buckets are walked
+// concurrently; see UsageConcurrency.  This can take a long time for large
+// accounts.  If it fails, or if ctx ends before every bucket has been walked,
+// the partial report is returned along with the error, and its Cursor can be
+// used to resume the walk.
+func (c *Client) Usage(ctx context.Context, opts ...UsageOption) (UsageReport, error) {
+	o := usageOptions{depth: 1, workers: 4}
+	for _, f := range opts {
+		f(&o)
+	}
+	u := &usageWalk{opts: o}
+	if o.resume != nil {
+		u.cur = o.resume.copy()
+		u.opts.depth = u.cur.Depth
+	} else {
+		u.cur = &UsageCursor{
+			Buckets:   make(map[string]*BucketUsage),
+			Positions: make(map[string]UsagePosition),
+			Done:      make(map[string]bool),
+			Depth:     o.depth,
+		}
+	}
+	if u.opts.workers < 1 {
+		u.opts.workers = 1
+	}
+
+	all, err := c.ListBuckets(ctx)
+	if err != nil {
+		return u.report(err), err
+	}
+	// Done is written by the workers, so the buckets left to walk are chosen
+	// before any start.
+	var buckets []*Bucket
+	u.mu.Lock()
+	for _, b := range all {
+		if !u.cur.Done[b.Name()] {
+			buckets = append(buckets, b)
+		}
+	}
+	u.mu.Unlock()
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	ch := make(chan *Bucket)
+	errs := make(chan error, len(buckets))
+	var wg sync.WaitGroup
+	for i := 0; i < u.opts.workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for b := range ch {
+				if err := u.walk(ctx, b); err != nil {
+					errs <- err
+					cancel()
+				}
+			}
+		}()
+	}
+	var sent int
+	for _, b := range buckets {
+		if ctx.Err() != nil {
+			break
+		}
+		select {
+		case ch <- b:
+			sent++
+		case <-ctx.Done():
+		}
+	}
+	close(ch)
+	wg.Wait()
+	close(errs)
+	err = <-errs
+	if err == nil && sent < len(buckets) {
+		// The context ended between buckets, and so no walk failed, but some
+		// buckets were never started.
+		err = ctx.Err()
+	}
+	return u.report(err), err
+}
+
+type usageWalk struct {
+	opts usageOptions
+
+	mu      sync.Mutex
+	cur     *UsageCursor
+	objects int64
+
+	pmu sync.Mutex // serializes calls to opts.progress
+}
+
+func (u *usageWalk) report(err error) UsageReport {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	cur := u.cur.copy()
+	r := UsageReport{Buckets: cur.Buckets}
+	if err != nil {
+		r.Cursor = cur
+	}
+	return r
+}
+
+// prefix returns the first depth components of name, or "" if name has no
+// more components than that.
+func (u *usageWalk) prefix(name string) string {
+	if u.opts.depth < 1 {
+		return ""
+	}
+	i := 0
+	for n := 0; n < u.opts.depth; n++ {
+		j := strings.Index(name[i:], "/")
+		if j < 0 {
+			return ""
+		}
+		i += j + 1
+	}
+	return name[:i]
+}
+
+func (u *usageWalk) walk(ctx context.Context, b *Bucket) error {
+	name := b.Name()
+	u.mu.Lock()
+	pos := u.cur.Positions[name]
+	u.mu.Unlock()
+	c := &cursor{name: pos.StartName, id: pos.StartID}
+	for {
+		var objs []*Object
+		next, err := b.listObjects(ctx, 1000, c, func(o *Object) { objs = append(objs, o) })
+		if err != nil && err != io.EOF {
+			return wrap("usage", name, "", err)
+		}
+		u.mu.Lock()
+		bu, ok := u.cur.Buckets[name]
+		if !ok {
+			bu = &BucketUsage{Prefixes: make(map[string]*Usage)}
+			u.cur.Buckets[name] = bu
+		}
+		for _, o := range objs {
+			pu := bu.Prefixes[u.prefix(o.name)]
+			if pu == nil && u.opts.depth > 0 {
+				pu = &Usage{}
+				bu.Prefixes[u.prefix(o.name)] = pu
+			}
+			count := func(f func(*Usage) *UsageCount, size int64) {
+				f(&bu.Usage).add(size)
+				if pu != nil {
+					f(pu).add(size)
+				}
+			}
+			switch objectState(o.f.status()) {
+			case Started:
+				count(func(u *Usage) *UsageCount { return &u.Unfinished }, 0)
+				continue // an unfinished file doesn't supersede anything
+			case Uploaded:
+				if o.name == pos.LastName {
+					count(func(u *Usage) *UsageCount { return &u.Hidden }, o.f.size())
+				} else {
+					count(func(u *Usage) *UsageCount { return &u.Live }, o.f.size())
+				}
+			}
+			pos.LastName = o.name
+		}
+		u.objects += int64(len(objs))
+		done := err == io.EOF || next == nil
+		if done {
+			delete(u.cur.Positions, name)
+			u.cur.Done[name] = true
+		} else {
+			pos.StartName, pos.StartID = next.name, next.id
+			u.cur.Positions[name] = pos
+		}
+		var p *UsageProgress
+		if u.opts.progress != nil {
+			p = &UsageProgress{Bucket: name, Objects: u.objects, Cursor: u.cur.copy()}
+		}
+		u.mu.Unlock()
+		if p != nil {
+			u.pmu.Lock()
+			u.opts.progress(*p)
+			u.pmu.Unlock()
+		}
+		if done {
+			return nil
+		}
+		c = next
+	}
+}
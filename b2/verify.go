@@ -0,0 +1,188 @@
+// Copyright 2018, the Blazer authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package b2
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"time"
+)
+
+// ErrMismatch is wrapped by the errors of objects that Verify finds don't
+// match their listed metadata.
+var ErrMismatch = errors.New("b2: object does not match its metadata")
+
+// sha256InfoKey is the fileInfo key under which Verify looks for an object's
+// SHA256, in hex.
+const sha256InfoKey = "sha256"
+
+// VerifyPrefix restricts Verify to objects whose names begin with prefix.
+func VerifyPrefix(prefix string) BulkOption {
+	return func(b *bulkOptions) {
+		b.prefix = prefix
+	}
+}
+
+// VerifyHeadOnly makes Verify check each object with a HEAD request instead of
+// downloading it: the size, SHA1, and "sha256" fileInfo that B2 returns for
+// the object must match those in the listing.  This is much cheaper, but
+// trusts B2's record of the object's hashes.
+func VerifyHeadOnly() BulkOption {
+	return func(b *bulkOptions) {
+		b.headOnly = true
+	}
+}
+
+// VerifySample makes Verify check only a random fraction of the objects, such
+// as 0.01 for one percent, for a cheap spot check.  Objects that are passed
+// over are not reported.
+func VerifySample(fraction float64) BulkOption {
+	return func(b *bulkOptions) {
+		b.sample = fraction
+	}
+}
+
+// VerifyBudget limits the time Verify spends: once d has passed, it starts on
+// no more objects, and returns when those it has started are done.  The
+// report is then Partial, and its Cursor resumes the verification.
+func VerifyBudget(d time.Duration) BulkOption {
+	return func(b *bulkOptions) {
+		b.budget = d
+	}
+}
+
+// VerifyCursor resumes a verification from the cursor of an earlier run's
+// Report.
+func VerifyCursor(cursor string) BulkOption {
+	return func(b *bulkOptions) {
+		b.cursor = cursor
+	}
+}
+
+// VerifyConcurrency sets the number of objects Verify checks at once.  The
+// default is four.
+func VerifyConcurrency(n int) BulkOption {
+	return func(b *bulkOptions) {
+		b.concurrency = n
+	}
+}
+
+// Verify checks that the current version of each object in the bucket matches
+// the metadata in the bucket's listing.  Each object is downloaded, and its
+// size, SHA1, and SHA256 compared to the listed size, SHA1, and "sha256"
+// fileInfo entry.  Objects with neither hash, such as large files uploaded
+// without large_file_sha1, are Skipped.  VerifyHeadOnly avoids downloading.
+//
+// Objects that match are reported as Verified, and those that don't as
+// Mismatched, with an error wrapping ErrMismatch that says how.  Unless
+// StopOnError is given, Verify checks every object, and returns an error
+// once it is done if any were Mismatched or Failed.
+//
+// Long verifications can be split up with VerifyBudget and VerifyCursor.
+func (b *Bucket) Verify(ctx context.Context, opts ...BulkOption) (*Report, error) {
+	m := bulkOptions{concurrency: 4}
+	for _, opt := range opts {
+		opt(&m)
+	}
+	return runBulk(ctx, b, m, m.stop(false), "verify", func(ctx context.Context, obj ObjectInterface) ReportItem {
+		// b is a *Bucket, and so lists *Objects.
+		return verifyObject(ctx, obj.(*Object), m.headOnly)
+	})
+}
+
+// verifyObject checks obj, as listed, against its contents or, if headOnly is
+// set, against the headers B2 returns for it.
+func verifyObject(ctx context.Context, obj *Object, headOnly bool) ReportItem {
+	res := ReportItem{Name: obj.name}
+	fail := func(err error) ReportItem {
+		res.Action = Failed
+		res.Err = err
+		return res
+	}
+	mismatch := func(what string, got, want interface{}) ReportItem {
+		res.Action = Mismatched
+		res.Err = fmt.Errorf("%w: %s is %v, listed as %v", ErrMismatch, what, got, want)
+		return res
+	}
+	if err := ctx.Err(); err != nil {
+		return fail(err)
+	}
+	attrs, err := obj.Attrs(ctx)
+	if err != nil {
+		return fail(err)
+	}
+	res.Size = attrs.Size
+	want256 := attrs.Info[sha256InfoKey]
+	hasSHA1 := attrs.SHA1 != "" && attrs.SHA1 != "none"
+
+	if headOnly {
+		fr, err := obj.b.backend().downloadFileByID(ctx, obj.f.id(), "", 0, 0, true)
+		if err != nil {
+			return fail(obj.wrap("verify", err))
+		}
+		fr.Close()
+		size, _, sha, info := fr.stats()
+		if v, ok := info[largeFileSHA1Key]; ok {
+			sha = v
+		}
+		switch {
+		case int64(size) != attrs.Size:
+			return mismatch("size", size, attrs.Size)
+		case sha != attrs.SHA1:
+			return mismatch("SHA1", sha, attrs.SHA1)
+		case info[sha256InfoKey] != want256:
+			return mismatch("SHA256", info[sha256InfoKey], want256)
+		}
+		res.Action = Verified
+		return res
+	}
+
+	if !hasSHA1 && want256 == "" {
+		res.Action = Skipped
+		return res
+	}
+	// Read the listed version, even if the object has since been replaced.
+	v := &Object{name: obj.name, b: obj.b, f: obj.f, pinned: true}
+	r := v.NewReader(ctx)
+	defer r.Close()
+	h1 := obj.b.c.opts.newHash()
+	var h256 hash.Hash
+	dst := io.Writer(h1)
+	if want256 != "" {
+		h256 = sha256.New()
+		dst = io.MultiWriter(h1, h256)
+	}
+	n, err := io.Copy(dst, r)
+	if err != nil {
+		return fail(err)
+	}
+	if n != attrs.Size {
+		return mismatch("size", n, attrs.Size)
+	}
+	if got := fmt.Sprintf("%x", h1.Sum(nil)); hasSHA1 && got != attrs.SHA1 {
+		return mismatch("SHA1", got, attrs.SHA1)
+	}
+	if h256 != nil {
+		if got := fmt.Sprintf("%x", h256.Sum(nil)); got != want256 {
+			return mismatch("SHA256", got, want256)
+		}
+	}
+	res.Action = Verified
+	return res
+}
@@ -0,0 +1,157 @@
+// Copyright 2017, the Blazer authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package b2
+
+import (
+	"context"
+	"errors"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// MinThroughput sets a floor on the speed of chunk uploads and downloads: a
+// transfer that moves fewer than bytes in any window is aborted and retried on
+// a new connection, as though it had failed.  This catches connections that
+// stall without closing, which a deadline generous enough for a large object
+// would not.  Only the body is timed: the wait for a download's first byte,
+// and for B2's reply to an upload whose body has been sent, are not counted.
+// By default there is no floor.
+func MinThroughput(bytes int64, window time.Duration) ClientOption {
+	return func(c *clientOptions) {
+		c.minBytes = bytes
+		c.window = window
+	}
+}
+
+// errStalled replaces the error from a transfer that the watchdog aborted.
+var errStalled = errors.New("b2: transfer stalled")
+
+// A watchdog cancels a transfer that falls below the client's minimum
+// throughput.  It only watches the transfer of the body: it begins when the
+// body starts to move and ends once the body has been read to its end, so
+// that neither the wait for a download's first byte nor the time B2 takes to
+// reply to a fully sent upload counts as a stall.  A nil *watchdog watches
+// nothing.
+type watchdog struct {
+	n        int64 // bytes moved; accessed atomically
+	stalled  int32 // accessed atomically
+	finished int32 // set once the body reaches EOF; accessed atomically
+	cancel   context.CancelFunc
+	begun    chan struct{}
+	once     sync.Once
+	stop     chan struct{}
+}
+
+// watch returns a context for one attempt at an upload, and a watchdog that
+// cancels it if too few bytes pass through the watchdog's readers.  The
+// watchdog begins at once.  The caller must call done when the attempt is
+// over.
+func (o clientOptions) watch(ctx context.Context) (context.Context, *watchdog) {
+	ctx, w := o.watchResponse(ctx)
+	w.begin()
+	return ctx, w
+}
+
+// watchResponse is like watch, for downloads: the watchdog begins with the
+// first byte of the response body.
+func (o clientOptions) watchResponse(ctx context.Context) (context.Context, *watchdog) {
+	if o.minBytes <= 0 || o.window <= 0 {
+		return ctx, nil
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	w := &watchdog{
+		cancel: cancel,
+		begun:  make(chan struct{}),
+		stop:   make(chan struct{}),
+	}
+	go w.run(o.minBytes, o.window)
+	return ctx, w
+}
+
+func (w *watchdog) begin() {
+	if w == nil {
+		return
+	}
+	w.once.Do(func() { close(w.begun) })
+}
+
+func (w *watchdog) run(min int64, window time.Duration) {
+	select {
+	case <-w.stop:
+		return
+	case <-w.begun:
+	}
+	t := time.NewTicker(window)
+	defer t.Stop()
+	var last int64
+	for {
+		select {
+		case <-w.stop:
+			return
+		case <-t.C:
+		}
+		if atomic.LoadInt32(&w.finished) != 0 {
+			return
+		}
+		n := atomic.LoadInt64(&w.n)
+		if n-last < min {
+			atomic.StoreInt32(&w.stalled, 1)
+			w.cancel()
+			return
+		}
+		last = n
+	}
+}
+
+// reader returns r, counting the bytes read from it as progress.
+func (w *watchdog) reader(r readResetter) readResetter {
+	if w == nil {
+		return r
+	}
+	return watchedReader{readResetter: r, w: w}
+}
+
+// done stops the watchdog and cancels the attempt's context.  If the watchdog
+// aborted the attempt, err is replaced with errStalled.
+func (w *watchdog) done(err error) error {
+	if w == nil {
+		return err
+	}
+	close(w.stop)
+	w.cancel()
+	if err != nil && atomic.LoadInt32(&w.stalled) != 0 {
+		return errStalled
+	}
+	return err
+}
+
+type watchedReader struct {
+	readResetter
+	w *watchdog
+}
+
+func (r watchedReader) Read(p []byte) (int, error) {
+	n, err := r.readResetter.Read(p)
+	if n > 0 {
+		r.w.begin()
+	}
+	atomic.AddInt64(&r.w.n, int64(n))
+	if err == io.EOF {
+		atomic.StoreInt32(&r.w.finished, 1)
+	}
+	return n, err
+}
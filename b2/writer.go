@@ -18,17 +18,24 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"hash"
 	"io"
+	"mime"
+	"net/http"
+	"path"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
 
+	"github.com/kurin/blazer/internal/b2types"
 	"github.com/kurin/blazer/internal/blog"
 )
 
 // Writer writes data into Backblaze.  It automatically switches to the large
-// file API if the file exceeds ChunkSize bytes.  Due to that and other
-// Backblaze API details, there is a large buffer.
+// file API if the file exceeds both ChunkSize bytes and the smallest part B2
+// accepts (5MB).  Due to that and other Backblaze API details, there is a
+// large buffer.
 //
 // Changes to public Writer attributes must be made before the first call to
 // Write.
@@ -41,7 +48,9 @@ type Writer struct {
 
 	// Resume an upload.  If true, and the upload is a large file, and a file of
 	// the same name was started but not finished, then assume that we are
-	// resuming that file, and don't upload duplicate chunks.
+	// resuming that file, and don't upload duplicate chunks.  A resumed large
+	// file is not canceled when writing fails, so that it can be resumed
+	// again; use Cancel to remove it.
 	Resume bool
 
 	// ChunkSize is the size, in bytes, of each individual part, when writing
@@ -61,6 +70,7 @@ type Writer struct {
 	FileBufferDir string
 
 	contentType string
+	sniff       bool
 	info        map[string]string
 
 	csize       int
@@ -74,6 +84,7 @@ type Writer struct {
 	start       sync.Once
 	once        sync.Once
 	done        sync.Once
+	cancelOnce  sync.Once
 	file        beLargeFileInterface
 	seen        map[int]string
 	everStarted bool
@@ -84,9 +95,20 @@ type Writer struct {
 
 	cidx int
 	w    writeBuffer
+	held []writeBuffer // full chunks kept back; see cutChunk
 
-	emux sync.RWMutex
-	err  error
+	// hsh and size track the whole stream, for the large_file_sha1 fileInfo
+	// entry.
+	hsh  hash.Hash
+	size int64
+
+	emux      sync.RWMutex
+	err       error
+	cancelErr error // from b2_cancel_large_file
+	finished  bool
+	closed    bool
+	attrs     *Attrs          // set by a successful Close
+	result    beFileInterface // the version written, set with attrs
 
 	smux sync.RWMutex
 	smap map[int]*meteredReader
@@ -98,24 +120,126 @@ type chunk struct {
 }
 
 func (w *Writer) setErr(err error) {
-	if err == nil || err == io.EOF {
+	if !w.fail(err) || w.Resume {
+		// A resumed large file is left in place, so that the upload can be
+		// resumed again.
 		return
 	}
+	w.cancelLargeFile(nil)
+}
+
+// fail records err as the Writer's error and cancels its context, unless an
+// error has already been recorded or the upload has finished.  It reports
+// whether err was recorded.
+func (w *Writer) fail(err error) bool {
+	if err == nil || err == io.EOF {
+		return false
+	}
 	w.emux.Lock()
 	defer w.emux.Unlock()
-	if w.err != nil {
-		return
+	if w.err != nil || w.finished {
+		return false
 	}
 	blog.V(1).Infof("error writing %s: %v", w.name, err)
-	w.err = err
+	w.err = w.wrap(err)
 	w.cancel()
-	if w.ctxf == nil {
+	return true
+}
+
+func (w *Writer) wrap(err error) error {
+	return wrap("write", w.o.b.Name(), w.name, err)
+}
+
+// cleanupTimeout bounds the time spent canceling a large file after an error,
+// when the caller hasn't supplied a context via WithCancelOnError.
+const cleanupTimeout = time.Minute
+
+// cancelLargeFile calls b2_cancel_large_file, if a large file has been
+// started, so that its parts don't linger.  The call is only ever made once;
+// every call to cancelLargeFile returns its result.  If ctx is nil, the
+// context comes from WithCancelOnError, or is a background context with a
+// timeout.
+func (w *Writer) cancelLargeFile(ctx context.Context) error {
+	w.cancelOnce.Do(func() {
+		w.emux.RLock()
+		file := w.file
+		ctxf := w.ctxf
+		w.emux.RUnlock()
+		if file == nil {
+			return
+		}
+		if ctx == nil {
+			if ctxf != nil {
+				ctx = ctxf()
+			} else {
+				c, cancel := context.WithTimeout(context.Background(), cleanupTimeout)
+				defer cancel()
+				ctx = c
+			}
+		}
+		err := file.cancel(ctx)
+		if err != nil {
+			blog.V(1).Infof("b2 writer: cancel %s: %v", w.name, err)
+		}
+		w.emux.Lock()
+		w.cancelErr = err
+		w.emux.Unlock()
+		if w.errf != nil {
+			w.errf(err)
+		}
+	})
+	w.emux.RLock()
+	defer w.emux.RUnlock()
+	return w.cancelErr
+}
+
+// closeBuffer releases the buffered chunks, if any.
+func (w *Writer) closeBuffer() {
+	for _, buf := range w.held {
+		buf.Close()
+	}
+	w.held = nil
+	if w.w == nil {
 		return
 	}
-	if w.errf == nil {
-		w.errf = func(error) {}
+	if err := w.w.Close(); err != nil {
+		// this is non-fatal, but alarming
+		blog.V(1).Infof("close %s: %v", w.name, err)
+	}
+	w.w = nil
+}
+
+// Cancel aborts the upload.  If a large file has been started, it is removed
+// with b2_cancel_large_file, using ctx, and Cancel returns any error from that
+// call; this is so even for a Writer with Resume set.  Any buffered data is
+// released, and subsequent calls to Close return context.Canceled without
+// uploading anything.  For small files, which are only sent on Close, there is
+// nothing to remove, and Cancel returns nil.  Calling Cancel after a
+// successful Close does nothing.
+func (w *Writer) Cancel(ctx context.Context) error {
+	w.emux.RLock()
+	finished := w.finished
+	w.emux.RUnlock()
+	if finished {
+		return nil
 	}
-	w.errf(w.file.cancel(w.ctxf()))
+	w.fail(context.Canceled)
+	w.wg.Wait()
+	w.closeBuffer()
+	if w.everStarted {
+		w.o.b.c.removeWriter(w)
+	}
+	return w.cancelLargeFile(ctx)
+}
+
+// ErrWriterClosed is returned by Write, ReadFrom, and Flush when they are
+// called after Close.
+var ErrWriterClosed = errors.New("b2: write to closed Writer")
+
+func (w *Writer) isClosed() bool {
+	w.emux.RLock()
+	defer w.emux.RUnlock()
+	return w.closed
 }
 
 func (w *Writer) getErr() error {
@@ -147,6 +271,20 @@ func sleepCtx(ctx context.Context, d time.Duration) error {
 	}
 }
 
+// freshPartURL returns a new upload URL in place of fc if fc's host is slow.
+// If getting one fails, fc is kept; it still works.
+func (w *Writer) freshPartURL(fc beFileChunkInterface) beFileChunkInterface {
+	if !w.o.b.r.hostSlow(fc.host()) {
+		return fc
+	}
+	f, err := w.file.getUploadPartURL(w.ctx)
+	if err != nil {
+		blog.V(1).Infof("b2 writer: couldn't replace upload URL for slow host %s: %v", fc.host(), err)
+		return fc
+	}
+	return f
+}
+
 func (w *Writer) thread() {
 	w.wg.Add(1)
 	go func() {
@@ -161,8 +299,17 @@ func (w *Writer) thread() {
 			var cnk chunk
 			select {
 			case cnk = <-w.ready:
-			case <-w.cdone:
-				return
+			default:
+				// No part is waiting, so there is time to replace a URL
+				// for a slow host before the next one comes.
+				fc = w.freshPartURL(fc)
+				select {
+				case cnk = <-w.ready:
+				case <-w.cdone:
+					return
+				case <-w.ctx.Done():
+					return
+				}
 			}
 			if sha, ok := w.seen[cnk.id]; ok {
 				if sha != cnk.buf.Hash() {
@@ -184,13 +331,16 @@ func (w *Writer) thread() {
 			w.registerChunk(cnk.id, mr)
 			sleep := time.Millisecond * 15
 		redo:
-			n, err := fc.uploadPart(w.ctx, mr, cnk.buf.Hash(), cnk.buf.Len(), cnk.id)
+			ctx, wd := w.o.b.c.opts.watch(w.ctx)
+			n, err := fc.uploadPart(ctx, wd.reader(mr), cnk.buf.Hash(), cnk.buf.Len(), cnk.id)
+			err = wd.done(err)
 			if n != cnk.buf.Len() || err != nil {
-				if w.o.b.r.reupload(err) {
+				if w.o.b.r.reupload(err) || err == errStalled || isHostFailing(err) {
 					if err := sleepCtx(w.ctx, sleep); err != nil {
 						w.setErr(err)
 						w.completeChunk(cnk.id)
 						cnk.buf.Close() // TODO: log error
+						return
 					}
 					sleep *= 2
 					if sleep > time.Second*15 {
@@ -219,6 +369,11 @@ func (w *Writer) thread() {
 	}()
 }
 
+// newHash returns a hash from the client's HashFunc.
+func (w *Writer) newHash() hash.Hash {
+	return w.o.b.c.opts.newHash()
+}
+
 func (w *Writer) init() {
 	w.start.Do(func() {
 		w.everStarted = true
@@ -226,14 +381,12 @@ func (w *Writer) init() {
 		w.smap = make(map[int]*meteredReader)
 		w.smux.Unlock()
 		w.o.b.c.addWriter(w)
-		w.csize = w.ChunkSize
-		if w.csize == 0 {
-			w.csize = 1e8
-		}
+		w.csize = w.chunkSize()
+		w.hsh = w.newHash()
 		if w.newBuffer == nil {
-			w.newBuffer = func() (writeBuffer, error) { return newMemoryBuffer(), nil }
+			w.newBuffer = func() (writeBuffer, error) { return newMemoryBuffer(w.newHash), nil }
 			if w.UseFileBuffer {
-				w.newBuffer = func() (writeBuffer, error) { return newFileBuffer(w.FileBufferDir) }
+				w.newBuffer = func() (writeBuffer, error) { return newFileBuffer(w.FileBufferDir, w.newHash) }
 			}
 		}
 		v, err := w.newBuffer()
@@ -245,8 +398,39 @@ func (w *Writer) init() {
 	})
 }
 
+func (w *Writer) chunkSize() int {
+	if w.ChunkSize == 0 {
+		return 1e8
+	}
+	return w.ChunkSize
+}
+
+// partRoom decides where the parts of a large file begin and end; Write and
+// ReadFrom both cut parts with it.  Every part but the last holds exactly
+// ChunkSize bytes, so that part n covers bytes [(n-1)*ChunkSize, n*ChunkSize)
+// of the stream.  Parts are cut by the goroutine calling Write or ReadFrom
+// before they are handed to an upload thread, and a retried part resends the
+// same bytes, so the parts and their SHA1s depend only on the stream and
+// ChunkSize, not on ConcurrentUploads or on which uploads failed.  The one
+// exception is Flush, which ends a part early at the caller's request; the
+// parts after it are again ChunkSize bytes long.
+//
+// partRoom returns the number of bytes that still belong in a part that holds
+// have bytes, given that left bytes remain in the stream, or that the length
+// is unknown if left is negative.
+func partRoom(csize int64, have int, left int64) int64 {
+	room := csize - int64(have)
+	if left >= 0 && left < room {
+		room = left
+	}
+	return room
+}
+
 // Write satisfies the io.Writer interface.
 func (w *Writer) Write(p []byte) (int, error) {
+	if w.isClosed() {
+		return 0, ErrWriterClosed
+	}
 	if len(p) == 0 {
 		return 0, nil
 	}
@@ -254,16 +438,22 @@ func (w *Writer) Write(p []byte) (int, error) {
 	if err := w.getErr(); err != nil {
 		return 0, err
 	}
-	left := w.csize - w.w.Len()
-	if len(p) < left {
-		return w.w.Write(p)
+	// A full buffer is only sent once more data arrives, so that an object of
+	// exactly one chunk is sent by Close as a simple file, and a large file
+	// always has at least two parts.
+	left := int(partRoom(int64(w.csize), w.w.Len(), -1))
+	if len(p) <= left {
+		n, err := w.w.Write(p)
+		w.track(p[:n])
+		return n, w.wrap(err)
 	}
 	i, err := w.w.Write(p[:left])
+	w.track(p[:i])
 	if err != nil {
 		w.setErr(err)
-		return i, err
+		return i, w.wrap(err)
 	}
-	if err := w.sendChunk(); err != nil {
+	if err := w.cutChunk(); err != nil {
 		w.setErr(err)
 		return i, w.getErr()
 	}
@@ -274,13 +464,79 @@ func (w *Writer) Write(p []byte) (int, error) {
 	return i + k, err
 }
 
-func (w *Writer) getUploadURL(ctx context.Context) (beURLInterface, error) {
-	u := w.o.b.urlPool.get()
-	if u == nil {
-		return w.o.b.b.getUploadURL(w.ctx)
+func (w *Writer) track(p []byte) {
+	w.hsh.Write(p) // Hash.Write never returns an error.
+	w.size += int64(len(p))
+}
+
+// largeFileSHA1Key is the fileInfo entry that, by convention among B2 clients,
+// holds the SHA1 of the entire contents of a large file.
+const largeFileSHA1Key = "large_file_sha1"
+
+// setInfo sets the given fileInfo entry, unless doing so would exceed B2's
+// limit of ten keys.
+func (w *Writer) setInfo(key, val string) bool {
+	if w.info == nil {
+		w.info = make(map[string]string)
+	}
+	if _, ok := w.info[key]; !ok && len(w.info) >= 10 {
+		return false
 	}
+	w.info[key] = val
+	return true
+}
+
+// maxCopySize is the largest object that b2_copy_file will copy in a single
+// call.
+const maxCopySize = 5e9
 
-	return u, nil
+// addLargeFileSHA1 replaces the finished large file f with a server-side copy
+// whose fileInfo includes the SHA1 of the entire stream.  This is only done
+// for streams of unknown length, whose SHA1 isn't known when the large file is
+// started; ReadFrom gives it at the start for seekable sources.  It is best
+// effort: if anything goes wrong, or the stream is too large to copy, f is
+// left in place.
+func (w *Writer) addLargeFileSHA1(f beFileInterface) beFileInterface {
+	if _, ok := w.info[largeFileSHA1Key]; ok {
+		return f
+	}
+	if w.size > maxCopySize {
+		blog.V(1).Infof("b2 writer: %s is too large to copy; not setting %s", w.name, largeFileSHA1Key)
+		return f
+	}
+	if !w.setInfo(largeFileSHA1Key, fmt.Sprintf("%x", w.hsh.Sum(nil))) {
+		return f
+	}
+	ctype := w.ctype()
+	nf, err := w.o.b.backend().copyFile(w.ctx, f.id(), w.name, ctype, w.info)
+	if err != nil {
+		blog.V(1).Infof("b2 writer: couldn't set %s on %s: %v", largeFileSHA1Key, w.name, err)
+		return f
+	}
+	if err := f.deleteFileVersion(w.ctx); err != nil {
+		blog.V(1).Infof("b2 writer: couldn't remove superseded version of %s: %v", w.name, err)
+	}
+	return nf
+}
+
+// avoidHost reports whether upload URLs for host should be replaced when
+// there is a choice.
+func (w *Writer) avoidHost(host string) bool {
+	return w.o.b.r.hostFailing(host) || w.o.b.r.hostSlow(host)
+}
+
+func (w *Writer) getUploadURL(ctx context.Context) (beURLInterface, error) {
+	for {
+		u := w.o.b.urlPool.get()
+		if u == nil {
+			return w.o.b.backend().getUploadURL(w.ctx)
+		}
+		// Pooled URLs for hosts that have since started failing, or that are
+		// slow, are dropped.
+		if !w.avoidHost(u.host()) {
+			return u, nil
+		}
+	}
 }
 
 func (w *Writer) simpleWriteFile() error {
@@ -290,12 +546,14 @@ func (w *Writer) simpleWriteFile() error {
 	}
 	// This defer needs to be in a func() so that we put whatever the value of ue
 	// is at function exit.
-	defer func() { w.o.b.urlPool.put(ue) }()
+	defer func() {
+		if !w.avoidHost(ue.host()) {
+			w.o.b.urlPool.put(ue)
+		}
+	}()
 	sha1 := w.w.Hash()
-	ctype := w.contentType
-	if ctype == "" {
-		ctype = "application/octet-stream"
-	}
+	w.sniffContentType()
+	ctype := w.ctype()
 	r, err := w.w.Reader()
 	if err != nil {
 		return err
@@ -303,12 +561,21 @@ func (w *Writer) simpleWriteFile() error {
 	mr := &meteredReader{r: r, size: w.w.Len()}
 	w.registerChunk(1, mr)
 	defer w.completeChunk(1)
+	var b backoff
 redo:
-	f, err := ue.uploadFile(w.ctx, mr, int(w.w.Len()), w.name, ctype, sha1, w.info)
+	ctx, wd := w.o.b.c.opts.watch(w.ctx)
+	f, err := ue.uploadFile(ctx, wd.reader(mr), int(w.w.Len()), w.name, ctype, sha1, w.info)
+	err = wd.done(err)
 	if err != nil {
-		if w.o.b.r.reupload(err) {
-			blog.V(2).Infof("b2 writer: %v; retrying", err)
-			u, err := w.o.b.b.getUploadURL(w.ctx)
+		if w.o.b.r.reupload(err) || err == errStalled || isHostFailing(err) {
+			blog.V(2).Infof("b2 writer: %v; retrying after %v", err, b)
+			if isHostFailing(err) {
+				// A new URL may well name the same host; don't hammer it.
+				if err := b.wait(w.ctx); err != nil {
+					return err
+				}
+			}
+			u, err := w.o.b.backend().getUploadURL(w.ctx)
 			if err != nil {
 				return err
 			}
@@ -317,17 +584,184 @@ redo:
 		}
 		return err
 	}
-	w.o.f = f
+	w.o.setFile(f)
+	w.setAttrs(f, sha1)
+	return nil
+}
+
+// autoContentType asks B2 to choose the content type from the object's
+// name.
+const autoContentType = "b2/x-auto"
+
+func (w *Writer) ctype() string {
+	if w.contentType == "" {
+		return autoContentType
+	}
+	return w.contentType
+}
+
+// sniffContentType sets the content type from the object's first bytes and
+// name, if the caller asked for that and didn't set one.  It must be called
+// with the first chunk in w.w, which is left unread.
+func (w *Writer) sniffContentType() {
+	if !w.sniff || w.contentType != "" {
+		return
+	}
+	n := w.w.Len()
+	if w.w.Hash() == "hex_digits_at_end" {
+		n -= 40
+	}
+	if n > 512 {
+		n = 512
+	}
+	head := make([]byte, n)
+	if r, err := w.w.Reader(); err == nil {
+		n, _ = io.ReadFull(r, head)
+		head = head[:n]
+		r.Reset()
+	}
+	w.contentType = sniff(w.name, head)
+}
+
+// sniff determines the content type of data that begins with head.  When the
+// data looks like generic text or binary, the name's extension is used
+// instead, if it is known.
+func sniff(name string, head []byte) string {
+	ctype := http.DetectContentType(head)
+	if ctype == "application/octet-stream" || strings.HasPrefix(ctype, "text/plain") {
+		if ext := mime.TypeByExtension(path.Ext(name)); ext != "" {
+			return ext
+		}
+	}
+	return ctype
+}
+
+// setAttrs records the attributes of the uploaded object f for File.
+func (w *Writer) setAttrs(f beFileInterface, sha1 string) {
+	ctype := w.ctype()
+	if ctype == autoContentType {
+		// B2 reports the type it chose.
+		if fi, err := f.getFileInfo(w.ctx); err == nil && fi != nil {
+			_, _, _, ctype, _, _, _ = fi.stats()
+		}
+	}
+	info := make(map[string]string)
+	for k, v := range w.info {
+		info[k] = v
+	}
+	var mtime time.Time
+	if v, ok := info["src_last_modified_millis"]; ok {
+		if ms, err := b2types.ParseMillis(v); err == nil {
+			mtime = ms.Time()
+		}
+		delete(info, "src_last_modified_millis")
+	}
+	w.emux.Lock()
+	defer w.emux.Unlock()
+	w.finished = true
+	w.result = f
+	w.attrs = &Attrs{
+		ID:              f.id(),
+		Name:            w.name,
+		Size:            f.size(),
+		ContentType:     ctype,
+		Status:          Uploaded,
+		UploadTimestamp: f.timestamp(),
+		SHA1:            sha1,
+		LastModified:    mtime,
+		Info:            info,
+	}
+}
+
+// File returns the attributes of the object that was uploaded.  It returns an
+// error if Close has not been called, or if it did not succeed.  For large
+// files, SHA1 is "none" unless the SHA1 of the whole stream is known.
+func (w *Writer) File() (*Attrs, error) {
+	w.emux.RLock()
+	defer w.emux.RUnlock()
+	if w.err != nil {
+		return nil, w.err
+	}
+	if w.attrs == nil {
+		return nil, errors.New("b2: File called before Close")
+	}
+	attrs := *w.attrs
+	attrs.Info = make(map[string]string)
+	for k, v := range w.attrs.Info {
+		attrs.Info[k] = v
+	}
+	return &attrs, nil
+}
+
+// ObjectVersion returns a handle to the version of the object that was
+// uploaded, along with its attributes.  Unlike an Object from Bucket.Object,
+// the handle reads and deletes that version by its ID, even if the object has
+// since been overwritten, and so it can be passed on without racing with
+// other writers.  Like File, it returns an error if Close has not been called,
+// or if it did not succeed.
+func (w *Writer) ObjectVersion() (*Object, *Attrs, error) {
+	attrs, err := w.File()
+	if err != nil {
+		return nil, nil, err
+	}
+	w.emux.RLock()
+	defer w.emux.RUnlock()
+	return &Object{
+		name:   w.name,
+		b:      w.o.b,
+		f:      w.result,
+		pinned: true,
+	}, attrs, nil
+}
+
+// defaultMinPartSize is the smallest part B2 accepts, other than the last,
+// if the authorization did not say.
+const defaultMinPartSize = 5e6
+
+// minPartSize returns the smallest part B2 accepts, other than the last.
+func (w *Writer) minPartSize() int64 {
+	if n := w.o.b.r.minPartSize(); n > 0 {
+		return int64(n)
+	}
+	return defaultMinPartSize
+}
+
+// Flush sends any buffered data to B2 as a part of the large file being
+// written, which can be used to checkpoint long streams.  The part is
+// uploaded in the background; failures are reported by subsequent calls to
+// Write and Close.  It returns an error if the Writer has not yet switched to
+// the large file API (that is, until more than ChunkSize bytes have been
+// written), because the first chunk is sent by Close as a simple file if no
+// more data follows.  B2 requires every part but the last to be at least 5MB,
+// and so Flush also returns an error, and sends nothing, if less than that is
+// buffered; the data is sent with the next part instead.
+func (w *Writer) Flush() error {
+	if w.isClosed() {
+		return ErrWriterClosed
+	}
+	if err := w.getErr(); err != nil {
+		return err
+	}
+	if w.cidx == 0 {
+		return errors.New("b2: Flush called before a large file was started")
+	}
+	if w.w.Len() == 0 {
+		return nil
+	}
+	if min := w.minPartSize(); int64(w.w.Len()) < min {
+		return fmt.Errorf("b2: Flush called with %d bytes buffered; parts must be at least %d bytes", w.w.Len(), min)
+	}
+	if err := w.sendChunk(); err != nil {
+		w.setErr(err)
+		return w.getErr()
+	}
 	return nil
 }
 
 func (w *Writer) getLargeFile() (beLargeFileInterface, error) {
 	if !w.Resume {
-		ctype := w.contentType
-		if ctype == "" {
-			ctype = "application/octet-stream"
-		}
-		return w.o.b.b.startLargeFile(w.ctx, w.name, ctype, w.info)
+		w.sniffContentType()
+		return w.o.b.backend().startLargeFile(w.ctx, w.name, w.ctype(), w.info)
 	}
 	var got bool
 	iter := w.o.b.List(w.ctx, ListPrefix(w.name), ListUnfinished())
@@ -374,7 +808,22 @@ func (w *Writer) getLargeFile() (beLargeFileInterface, error) {
 	return fi.compileParts(size, seen), nil
 }
 
+// sendChunk sends the buffer in w.w as the next part of the large file, which
+// it starts if necessary, and readies a new buffer.
 func (w *Writer) sendChunk() error {
+	if err := w.sendBuffer(w.w); err != nil {
+		return err
+	}
+	v, err := w.newBuffer()
+	if err != nil {
+		return err
+	}
+	w.w = v
+	return nil
+}
+
+// sendBuffer hands buf to an upload thread as the next part.
+func (w *Writer) sendBuffer(buf writeBuffer) error {
 	var err error
 	w.once.Do(func() {
 		lf, e := w.getLargeFile()
@@ -382,7 +831,9 @@ func (w *Writer) sendChunk() error {
 			err = e
 			return
 		}
+		w.emux.Lock()
 		w.file = lf
+		w.emux.Unlock()
 		w.ready = make(chan chunk)
 		w.cdone = make(chan struct{})
 		if w.ConcurrentUploads < 1 {
@@ -391,6 +842,17 @@ func (w *Writer) sendChunk() error {
 		for i := 0; i < w.ConcurrentUploads; i++ {
 			w.thread()
 		}
+		// If the context is canceled while the caller isn't writing, the
+		// upload would otherwise be orphaned.
+		w.wg.Add(1)
+		go func() {
+			defer w.wg.Done()
+			select {
+			case <-w.ctx.Done():
+				w.setErr(w.ctx.Err())
+			case <-w.cdone:
+			}
+		}()
 	})
 	if err != nil {
 		return err
@@ -400,23 +862,83 @@ func (w *Writer) sendChunk() error {
 		return nil
 	case w.ready <- chunk{
 		id:  w.cidx + 1,
-		buf: w.w,
+		buf: buf,
 	}:
 	case <-w.ctx.Done():
 		return w.ctx.Err()
 	}
 	w.cidx++
-	v, err := w.newBuffer()
+	return nil
+}
+
+// cutChunk sends the full buffer in w.w as the next part.  While the stream
+// is shorter than minPartSize, which can happen when ChunkSize is smaller
+// than that, full buffers are held back instead: B2 would refuse the parts of
+// a large file that small, and so if the stream ends there, Close sends it as
+// a simple file.  Once the stream is longer, the held buffers are sent first,
+// in order.
+func (w *Writer) cutChunk() error {
+	if w.cidx == 0 && w.size < w.minPartSize() {
+		if len(w.held) == 0 {
+			// The content type is sniffed from the first chunk.
+			w.sniffContentType()
+		}
+		w.held = append(w.held, w.w)
+		v, err := w.newBuffer()
+		if err != nil {
+			return err
+		}
+		w.w = v
+		return nil
+	}
+	for len(w.held) > 0 {
+		buf := w.held[0]
+		w.held = w.held[1:]
+		if err := w.sendBuffer(buf); err != nil {
+			buf.Close()
+			return err
+		}
+	}
+	return w.sendChunk()
+}
+
+// joinHeld gathers any held buffers, and the one in w.w, into a single buffer
+// in w.w, for a simple upload.
+func (w *Writer) joinHeld() error {
+	if len(w.held) == 0 {
+		return nil
+	}
+	nb, err := w.newBuffer()
 	if err != nil {
 		return err
 	}
-	w.w = v
+	for _, buf := range append(w.held, w.w) {
+		r, err := buf.Reader()
+		if err == nil {
+			_, err = io.Copy(nb, r)
+		}
+		buf.Close()
+		if err != nil {
+			nb.Close()
+			return err
+		}
+	}
+	w.held = nil
+	w.w = nb
 	return nil
 }
 
 // ReadFrom reads all of r into w, returning the first error or no error if r
 // returns io.EOF.  If r is also an io.Seeker, ReadFrom will stream r directly
 // over the wire instead of buffering it locally.  This reduces memory usage.
+// A large object from such an r is read twice: once to hash it, so that its
+// SHA1 can be recorded in large_file_sha1 from the start, and once to send it.
+//
+// Otherwise, as with a pipe, the length of r need not be known in advance: r
+// is buffered a chunk at a time, and once it exceeds ChunkSize it is sent as a
+// large file whose last part holds whatever remains.  If r returns an error
+// other than io.EOF, the upload is abandoned: any large file is canceled, and
+// Close returns the error instead of committing a truncated object.
 //
 // Do not issue multiple calls to ReadFrom, or mix ReadFrom and Write.  If you
 // have multiple readers you want to concatenate into the same B2 object, use
@@ -427,14 +949,26 @@ func (w *Writer) sendChunk() error {
 // ReadFrom currently doesn't handle w.Resume; if w.Resume is true, ReadFrom
 // will act as if r is not an io.Seeker.
 func (w *Writer) ReadFrom(r io.Reader) (int64, error) {
+	if w.isClosed() {
+		return 0, ErrWriterClosed
+	}
 	rs, ok := r.(io.ReadSeeker)
 	if !ok || w.Resume {
-		return copyContext(w.ctx, w, r)
+		// Write fails as soon as the writer's context is canceled, so the copy
+		// is done in the foreground; copying in the background would let Close
+		// race with a Write still in flight.
+		n, err := io.Copy(onlyWriter{w}, r)
+		if err != nil {
+			// If r failed, the object is incomplete; it must not be committed by
+			// a later call to Close, and any large file should be canceled now.
+			w.setErr(err)
+		}
+		return n, err
 	}
 	blog.V(2).Info("streaming without buffer")
 	size, err := rs.Seek(0, io.SeekEnd)
 	if err != nil {
-		return 0, err
+		return 0, w.wrap(err)
 	}
 	var ra io.ReaderAt
 	if rat, ok := r.(io.ReaderAt); ok {
@@ -442,6 +976,33 @@ func (w *Writer) ReadFrom(r io.Reader) (int64, error) {
 	} else {
 		ra = enReaderAt(rs)
 	}
+	// Parts are sent with their SHA1s.  These, and the SHA1 of the whole
+	// object, are computed in one pass before anything is sent, so that
+	// large_file_sha1 can be given when the large file is started rather than
+	// added afterwards with a copy.  If the object is small enough to be sent
+	// in one request, it is instead hashed as it is sent.  So is an object no
+	// longer than minPartSize, even if it is longer than ChunkSize, since B2
+	// would refuse the parts of a large file that small.
+	csize := int64(w.chunkSize())
+	large := size > csize && size > w.minPartSize()
+	var sums []string
+	if large {
+		whole := w.newHash()
+		for offset := int64(0); offset < size; {
+			n := partRoom(csize, 0, size-offset)
+			hsh := w.newHash()
+			if _, err := copyContext(w.ctx, io.MultiWriter(whole, hsh), io.NewSectionReader(ra, offset, n)); err != nil {
+				w.setErr(err)
+				return 0, w.wrap(err)
+			}
+			sums = append(sums, fmt.Sprintf("%x", hsh.Sum(nil)))
+			offset += n
+		}
+		w.size = size
+		if !w.setInfo(largeFileSHA1Key, fmt.Sprintf("%x", whole.Sum(nil))) {
+			blog.V(1).Infof("b2 writer: no room for %s on %s", largeFileSHA1Key, w.name)
+		}
+	}
 	var offset int64
 	var wrote int64
 	w.newBuffer = func() (writeBuffer, error) {
@@ -449,28 +1010,30 @@ func (w *Writer) ReadFrom(r io.Reader) (int64, error) {
 		if left <= 0 {
 			// We're done sending real chunks; send empty chunks from now on so that
 			// Close() works.
-			w.newBuffer = func() (writeBuffer, error) { return newMemoryBuffer(), nil }
-			w.w = newMemoryBuffer()
+			w.newBuffer = func() (writeBuffer, error) { return newMemoryBuffer(w.newHash), nil }
+			w.w = newMemoryBuffer(w.newHash)
 			return nil, io.EOF
 		}
-		csize := int64(w.csize)
-		if left < csize {
-			csize = left
+		n := left
+		var sum string
+		if large {
+			n = partRoom(csize, 0, left)
+			sum, sums = sums[0], sums[1:]
 		}
-		nb := newNonBuffer(ra, offset, csize)
-		wrote += csize // TODO: this is kind of a total lie
-		offset += csize
+		nb := newNonBuffer(ra, offset, n, sum, w.newHash)
+		wrote += n // TODO: this is kind of a total lie
+		offset += n
 		return nb, nil
 	}
 	w.init()
-	if size < int64(w.csize) {
+	if !large {
 		// the magic happens on w.Close()
 		return size, nil
 	}
 	for {
 		if err := w.sendChunk(); err != nil {
 			if err != io.EOF {
-				return wrote, err
+				return wrote, w.wrap(err)
 			}
 			return wrote, nil
 		}
@@ -478,22 +1041,46 @@ func (w *Writer) ReadFrom(r io.Reader) (int64, error) {
 }
 
 // Close satisfies the io.Closer interface.  It is critical to check the return
-// value of Close for all writers.
+// value of Close for all writers.  Close may be called more than once; each
+// call returns the first error encountered while writing, if any.  If writing
+// failed, any large file that was started has been canceled by the time Close
+// returns, unless Resume is set.  Once Close has been called, Write returns
+// ErrWriterClosed.
 func (w *Writer) Close() error {
+	w.emux.Lock()
+	w.closed = true
+	w.emux.Unlock()
 	w.done.Do(func() {
+		defer w.cancel()
+		defer func() {
+			if w.getErr() != nil && !w.Resume {
+				// The goroutine that hit the error may still be canceling the
+				// large file; this waits for it to finish.
+				w.cancelLargeFile(nil)
+			}
+		}()
+		if w.getErr() != nil {
+			// Either the write failed or the upload was canceled; in both cases
+			// the large file, if any, has already been cleaned up.
+			w.wg.Wait()
+			if w.everStarted {
+				w.o.b.c.removeWriter(w)
+			}
+			w.closeBuffer()
+			return
+		}
 		if !w.everStarted {
 			w.init()
 			w.setErr(w.simpleWriteFile())
 			return
 		}
 		defer w.o.b.c.removeWriter(w)
-		defer func() {
-			if err := w.w.Close(); err != nil {
-				// this is non-fatal, but alarming
-				blog.V(1).Infof("close %s: %v", w.name, err)
-			}
-		}()
+		defer w.closeBuffer()
 		if w.cidx == 0 {
+			if err := w.joinHeld(); err != nil {
+				w.setErr(err)
+				return
+			}
 			w.setErr(w.simpleWriteFile())
 			return
 		}
@@ -507,12 +1094,25 @@ func (w *Writer) Close() error {
 		// channel for this.
 		close(w.cdone)
 		w.wg.Wait()
+		if err := w.ctx.Err(); err != nil {
+			w.setErr(err)
+			return
+		}
 		f, err := w.file.finishLargeFile(w.ctx)
 		if err != nil {
 			w.setErr(err)
 			return
 		}
-		w.o.f = f
+		w.emux.Lock()
+		w.finished = true
+		w.emux.Unlock()
+		f = w.addLargeFileSHA1(f)
+		w.o.setFile(f)
+		sum, ok := w.info[largeFileSHA1Key]
+		if !ok {
+			sum = "none"
+		}
+		w.setAttrs(f, sum)
 	})
 	return w.getErr()
 }
@@ -524,10 +1124,10 @@ func (w *Writer) withAttrs(attrs *Attrs) *Writer {
 		w.info[k] = v
 	}
 	if len(w.info) < 10 && attrs.SHA1 != "" {
-		w.info["large_file_sha1"] = attrs.SHA1
+		w.info[largeFileSHA1Key] = attrs.SHA1
 	}
 	if len(w.info) < 10 && !attrs.LastModified.IsZero() {
-		w.info["src_last_modified_millis"] = fmt.Sprintf("%d", attrs.LastModified.UnixNano()/1e6)
+		w.info["src_last_modified_millis"] = b2types.ToMillis(attrs.LastModified).String()
 	}
 	return w
 }
@@ -542,11 +1142,24 @@ func WithAttrsOption(attrs *Attrs) WriterOption {
 	}
 }
 
-// WithCancelOnError requests the writer, if it has started a large file
-// upload, to call b2_cancel_large_file on any permanent error.  It calls ctxf
-// to obtain a context with which to cancel the file; this is to allow callers
-// to set specific timeouts.  If errf is non-nil, then it is called with the
-// (possibly nil) output of b2_cancel_large_file.
+// WithContentSniffing causes the writer, if no content type is given, to
+// choose one from the first 512 bytes of the object as http.DetectContentType
+// does, falling back on the object name's extension for generic text and
+// binary data.  Otherwise, the content type is "b2/x-auto", which has B2
+// choose one from the name alone.
+func WithContentSniffing() WriterOption {
+	return func(w *Writer) {
+		w.sniff = true
+	}
+}
+
+// WithCancelOnError customizes how the writer, if it has started a large file
+// upload, calls b2_cancel_large_file on any permanent error (which it always
+// does, unless Resume is set).  It calls ctxf to obtain a context with which
+// to cancel the file; this is to allow callers to set specific timeouts.  By
+// default, a background context with a timeout of one minute is used.
+// Writer.Cancel uses the context passed to it instead.  If errf is non-nil,
+// then it is called with the (possibly nil) output of b2_cancel_large_file.
 func WithCancelOnError(ctxf func() context.Context, errf func(error)) WriterOption {
 	return func(w *Writer) {
 		w.ctxf = ctxf
@@ -0,0 +1,731 @@
+// Copyright 2018, the Blazer authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package b2_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/kurin/blazer/b2"
+)
+
+func TestDefaultObjectAttrs(t *testing.T) {
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	_, client := newTestClient(ctx, t)
+	bucket, err := client.NewBucket(ctx, "defaults", &b2.BucketAttrs{
+		Type: b2.Private,
+		DefaultObjectAttrs: &b2.Attrs{
+			ContentType: "text/csv",
+			Info: map[string]string{
+				"owner":            "ingest",
+				"b2-cache-control": "max-age=3600",
+			},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	table := []struct {
+		desc  string
+		opts  []b2.WriterOption
+		ctype string
+		info  map[string]string
+	}{
+		{
+			desc:  "bucket defaults",
+			ctype: "text/csv",
+			info:  map[string]string{"owner": "ingest", "b2-cache-control": "max-age=3600"},
+		},
+		{
+			desc: "object attrs override",
+			opts: []b2.WriterOption{b2.WithAttrsOption(&b2.Attrs{
+				ContentType: "application/json",
+				Info:        map[string]string{"owner": "billing", "run": "7"},
+			})},
+			ctype: "application/json",
+			info:  map[string]string{"owner": "billing", "run": "7", "b2-cache-control": "max-age=3600"},
+		},
+	}
+	for _, e := range table {
+		obj := bucket.Object(e.desc)
+		w := obj.NewWriter(ctx, e.opts...)
+		if _, err := w.Write([]byte("a,b,c")); err != nil {
+			t.Fatal(err)
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+		attrs, err := obj.Attrs(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if attrs.ContentType != e.ctype {
+			t.Errorf("%s: got content type %q, want %q", e.desc, attrs.ContentType, e.ctype)
+		}
+		if !reflect.DeepEqual(attrs.Info, e.info) {
+			t.Errorf("%s: got info %v, want %v", e.desc, attrs.Info, e.info)
+		}
+	}
+
+	// Without bucket defaults, the library default applies.
+	bare, err := client.Bucket(ctx, "defaults")
+	if err != nil {
+		t.Fatal(err)
+	}
+	obj := bare.Object("no defaults")
+	if err := writeObject(ctx, obj, []byte("data"), 1e4); err != nil {
+		t.Fatal(err)
+	}
+	attrs, err := obj.Attrs(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if attrs.ContentType != "application/octet-stream" || len(attrs.Info) != 0 {
+		t.Errorf("no defaults: got content type %q and info %v", attrs.ContentType, attrs.Info)
+	}
+
+	battrs, err := bucket.Attrs(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if battrs.DefaultObjectAttrs == nil || battrs.DefaultObjectAttrs.ContentType != "text/csv" {
+		t.Errorf("Attrs: got defaults %+v, want content type text/csv", battrs.DefaultObjectAttrs)
+	}
+}
+
+func TestContentType(t *testing.T) {
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	_, _, bucket := newTestBucket(ctx, t, "ctypes")
+
+	png := append([]byte("\x89PNG\x0D\x0A\x1A\x0A"), bytes.Repeat([]byte{7}, 3e4)...)
+	table := []struct {
+		name     string
+		data     []byte
+		opts     []b2.WriterOption
+		readFrom bool
+		want     string
+	}{
+		{name: "page.html", data: []byte("hello"), want: "text/html; charset=utf-8"},
+		{name: "noext", data: png, want: "application/octet-stream"},
+		{name: "noext-sniffed", data: png, opts: []b2.WriterOption{b2.WithContentSniffing()}, want: "image/png"},
+		{name: "noext-sniffed-readfrom", data: png, opts: []b2.WriterOption{b2.WithContentSniffing()}, readFrom: true, want: "image/png"},
+		{name: "data.json", data: []byte(`{"a": 1}`), opts: []b2.WriterOption{b2.WithContentSniffing()}, want: "application/json"},
+		{
+			name: "explicit.png",
+			data: png,
+			opts: []b2.WriterOption{b2.WithContentSniffing(), b2.WithAttrsOption(&b2.Attrs{ContentType: "application/x-custom"})},
+			want: "application/x-custom",
+		},
+	}
+	for _, e := range table {
+		obj := bucket.Object(e.name)
+		w := obj.NewWriter(ctx, e.opts...)
+		w.ChunkSize = 1e4
+		var err error
+		if e.readFrom {
+			_, err = w.ReadFrom(bytes.NewReader(e.data))
+		} else {
+			_, err = io.Copy(w, bytes.NewReader(e.data))
+		}
+		if err != nil {
+			t.Fatalf("%s: %v", e.name, err)
+		}
+		if err := w.Close(); err != nil {
+			t.Fatalf("%s: %v", e.name, err)
+		}
+		attrs, err := w.File()
+		if err != nil {
+			t.Fatalf("%s: %v", e.name, err)
+		}
+		if attrs.ContentType != e.want {
+			t.Errorf("%s: Writer.File: got content type %q, want %q", e.name, attrs.ContentType, e.want)
+		}
+		if attrs, err = obj.Attrs(ctx); err != nil {
+			t.Fatalf("%s: %v", e.name, err)
+		}
+		if attrs.ContentType != e.want {
+			t.Errorf("%s: Object.Attrs: got content type %q, want %q", e.name, attrs.ContentType, e.want)
+		}
+		got, err := readObject(ctx, obj, 0, -1)
+		if err != nil {
+			t.Fatalf("%s: %v", e.name, err)
+		}
+		if !bytes.Equal(got, e.data) {
+			t.Errorf("%s: read back %d bytes that differ from the %d written", e.name, len(got), len(e.data))
+		}
+	}
+}
+
+func TestSimpleUploadFallback(t *testing.T) {
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	_, client, bucket := newTestBucket(ctx, t, "boundaries")
+
+	const chunk = 1e4
+	for _, size := range []int{0, chunk - 1, chunk, chunk + 1} {
+		for _, readFrom := range []bool{false, true} {
+			name := fmt.Sprintf("obj-%d-%v", size, readFrom)
+			data := bytes.Repeat([]byte("z"), size)
+			before := client.Stats().Calls["b2_start_large_file"]
+			w := bucket.Object(name).NewWriter(ctx)
+			w.ChunkSize = chunk
+			var err error
+			if readFrom {
+				_, err = w.ReadFrom(bytes.NewReader(data))
+			} else {
+				_, err = io.Copy(w, bytes.NewBuffer(data))
+			}
+			if err != nil {
+				t.Fatalf("%s: %v", name, err)
+			}
+			if err := w.Close(); err != nil {
+				t.Fatalf("%s: Close: %v", name, err)
+			}
+			large := client.Stats().Calls["b2_start_large_file"] > before
+			if want := size > chunk; large != want {
+				t.Errorf("%s: used the large file API: got %v, want %v", name, large, want)
+			}
+			got, err := readObject(ctx, bucket.Object(name), 0, -1)
+			if err != nil {
+				t.Fatalf("%s: %v", name, err)
+			}
+			if !bytes.Equal(got, data) {
+				t.Errorf("%s: read %d bytes, want %d", name, len(got), len(data))
+			}
+		}
+	}
+}
+
+// stallingTransport stalls the first request made for each listed B2 method:
+// uploads never send their body, and downloads stop partway through the
+// reply.  The stalled request hangs until it is canceled.
+type stallingTransport struct {
+	rt http.RoundTripper
+
+	mu      sync.Mutex
+	pending map[string]bool
+	stalled int
+}
+
+func (st *stallingTransport) stall(method string) bool {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if !st.pending[method] {
+		return false
+	}
+	st.pending[method] = false
+	st.stalled++
+	return true
+}
+
+func (st *stallingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	method := req.Header.Get("X-Blazer-Method")
+	if !st.stall(method) {
+		return st.rt.RoundTrip(req)
+	}
+	if !strings.HasPrefix(method, "b2_download") {
+		<-req.Context().Done()
+		return nil, req.Context().Err()
+	}
+	resp, err := st.rt.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body = &stallingBody{ReadCloser: resp.Body, ctx: req.Context(), left: 10}
+	return resp, nil
+}
+
+type stallingBody struct {
+	io.ReadCloser
+	ctx  context.Context
+	left int
+}
+
+func (b *stallingBody) Read(p []byte) (int, error) {
+	if b.left == 0 {
+		<-b.ctx.Done()
+		return 0, b.ctx.Err()
+	}
+	if len(p) > b.left {
+		p = p[:b.left]
+	}
+	n, err := b.ReadCloser.Read(p)
+	b.left -= n
+	return n, err
+}
+
+func TestMinThroughput(t *testing.T) {
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+
+	st := &stallingTransport{
+		rt: http.DefaultTransport,
+		pending: map[string]bool{
+			"b2_upload_file":           true,
+			"b2_upload_part":           true,
+			"b2_download_file_by_name": true,
+		},
+	}
+	_, _, bucket := newTestBucket(ctx, t, "b2test-bucket", b2.Transport(st), b2.MinThroughput(1, 100*time.Millisecond))
+
+	files := map[string][]byte{
+		"small": []byte("hello, world"),
+		"large": bytes.Repeat([]byte("0123456789abcdef"), 1e3+7),
+	}
+	for name, data := range files {
+		if err := writeObject(ctx, bucket.Object(name), data, 1e4); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+	}
+	for name, data := range files {
+		got, err := readObject(ctx, bucket.Object(name), 0, -1)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if !bytes.Equal(got, data) {
+			t.Errorf("%s: got %d bytes, want %d", name, len(got), len(data))
+		}
+	}
+	if st.stalled != 3 {
+		t.Errorf("stalled %d requests, want 3", st.stalled)
+	}
+}
+
+func TestPipes(t *testing.T) {
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	_, client, bucket := newTestBucket(ctx, t, "b2test-pipes")
+	data := make([]byte, 25e3)
+	for i := range data {
+		data[i] = byte(i * 7)
+	}
+	errBoom := errors.New("boom")
+
+	// produce writes data to a pipe in uneven pieces, stopping with err after
+	// n bytes.
+	produce := func(n int, err error) io.Reader {
+		pr, pw := io.Pipe()
+		go func() {
+			for off := 0; off < n; off += 777 {
+				end := off + 777
+				if end > n {
+					end = n
+				}
+				if _, err := pw.Write(data[off:end]); err != nil {
+					return
+				}
+			}
+			pw.CloseWithError(err)
+		}()
+		return pr
+	}
+
+	// An upload of unknown length becomes a large file whose last part is short.
+	w := bucket.Object("piped").NewWriter(ctx)
+	w.ChunkSize = 1e4
+	if _, err := io.Copy(w, produce(len(data), nil)); err != nil {
+		t.Fatalf("io.Copy to writer: %v", err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if n := client.Stats().Calls["b2_upload_part"]; n != 3 {
+		t.Errorf("b2_upload_part calls: got %d, want 3", n)
+	}
+
+	// An upload whose source fails is abandoned, not committed.
+	w = bucket.Object("broken").NewWriter(ctx)
+	w.ChunkSize = 1e4
+	if _, err := io.Copy(w, produce(15e3, errBoom)); !errors.Is(err, errBoom) {
+		t.Errorf("io.Copy from failed pipe: got %v, want %v", err, errBoom)
+	}
+	if err := w.Close(); !errors.Is(err, errBoom) {
+		t.Errorf("Close after failed pipe: got %v, want %v", err, errBoom)
+	}
+	if _, err := bucket.Object("broken").Attrs(ctx); !b2.IsNotExist(err) {
+		t.Errorf("Attrs of abandoned object: got %v, want not-exist", err)
+	}
+	iter := bucket.List(ctx, b2.ListUnfinished())
+	for iter.Next() {
+		t.Errorf("unfinished large file %q was not canceled", iter.Object().Name())
+	}
+	if err := iter.Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	// A download drained into a pipe arrives intact.
+	pr, pw := io.Pipe()
+	r := bucket.Object("piped").NewReader(ctx)
+	r.ChunkSize = 1e3
+	r.ConcurrentDownloads = 2
+	go func() {
+		_, err := io.Copy(pw, r)
+		pw.CloseWithError(err)
+	}()
+	got, err := ioutil.ReadAll(pr)
+	if err != nil {
+		t.Fatalf("reading downloaded pipe: %v", err)
+	}
+	r.Close()
+	if !bytes.Equal(got, data) {
+		t.Errorf("downloaded %d bytes through a pipe; they don't match the %d uploaded", len(got), len(data))
+	}
+
+	// A consumer that stops early stops the download.
+	calls := func() int64 {
+		s := client.Stats()
+		return s.Calls["b2_download_file_by_name"] + s.Calls["b2_download_file_by_id"]
+	}
+	before := calls()
+	pr, pw = io.Pipe()
+	r = bucket.Object("piped").NewReader(ctx)
+	r.ChunkSize = 1e3
+	r.ConcurrentDownloads = 2
+	defer r.Close()
+	errc := make(chan error)
+	go func() {
+		_, err := r.WriteTo(pw)
+		errc <- err
+	}()
+	if _, err := io.ReadFull(pr, make([]byte, 2500)); err != nil {
+		t.Fatal(err)
+	}
+	pr.Close()
+	select {
+	case err := <-errc:
+		if !errors.Is(err, io.ErrClosedPipe) {
+			t.Errorf("WriteTo closed pipe: got %v, want %v", err, io.ErrClosedPipe)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("WriteTo didn't notice the closed pipe")
+	}
+	if n := calls() - before; n > 6 {
+		t.Errorf("download calls after the consumer stopped: got %d, want no more than 6", n)
+	}
+}
+
+// busyTransport answers the first n requests for a method with a 503.
+type busyTransport struct {
+	rt http.RoundTripper
+
+	mu   sync.Mutex
+	left map[string]int
+}
+
+func (bt *busyTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	method := req.Header.Get("X-Blazer-Method")
+	bt.mu.Lock()
+	busy := bt.left[method] > 0
+	if busy {
+		bt.left[method]--
+	}
+	bt.mu.Unlock()
+	if !busy {
+		return bt.rt.RoundTrip(req)
+	}
+	if req.Body != nil {
+		io.Copy(ioutil.Discard, req.Body)
+		req.Body.Close()
+	}
+	return &http.Response{
+		Status:     "503 Service Unavailable",
+		StatusCode: http.StatusServiceUnavailable,
+		Header:     make(http.Header),
+		Body:       ioutil.NopCloser(strings.NewReader(`{"status": 503, "code": "service_unavailable", "message": "busy"}`)),
+		Request:    req,
+	}, nil
+}
+
+func TestUploadHostStats(t *testing.T) {
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+
+	bt := &busyTransport{
+		rt: http.DefaultTransport,
+		left: map[string]int{
+			"b2_upload_file": 3,
+			"b2_upload_part": 3,
+		},
+	}
+	_, client, bucket := newTestBucket(ctx, t, "b2test-hosts", b2.Transport(bt), b2.UploadHostFailures(2, time.Minute))
+	if err := writeObject(ctx, bucket.Object("small"), []byte("small"), 1e4); err != nil {
+		t.Fatal(err)
+	}
+	if err := writeObject(ctx, bucket.Object("large"), bytes.Repeat([]byte("large"), 5e3), 1e4); err != nil {
+		t.Fatal(err)
+	}
+
+	stats := client.Status().Stats
+	if len(stats.UploadHosts) != 1 {
+		t.Fatalf("UploadHosts: got %v, want one host", stats.UploadHosts)
+	}
+	for host, hs := range stats.UploadHosts {
+		// One simple upload and three parts succeeded, after six failures.
+		if hs.Uploads != 10 || hs.Errors != 6 || hs.RecentErrors != 6 || !hs.Failing {
+			t.Errorf("UploadHosts[%q]: got %+v, want 10 uploads, 6 errors, 6 recent, and failing", host, hs)
+		}
+	}
+	// Each failure past the second gives up on the host and fetches a new URL.
+	if n := stats.Calls["b2_get_upload_url"]; n < 2 {
+		t.Errorf("b2_get_upload_url calls: got %d, want at least 2", n)
+	}
+}
+
+func TestDeterministicParts(t *testing.T) {
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Minute)
+	defer cancel()
+
+	// The stream is kept small enough for the in-memory server; what matters is
+	// that it spans many parts.
+	size, csize := int64(64e6), int(1e6)
+	if testing.Short() {
+		size = 8e6
+	}
+	stream := func() io.Reader { return io.LimitReader(rand.New(rand.NewSource(1181)), size) }
+	data, err := ioutil.ReadAll(stream())
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := fmt.Sprintf("%x", sha1.Sum(data))
+
+	var mu sync.Mutex
+	parts := make(map[string]string) // by part number
+	bt := &busyTransport{rt: http.DefaultTransport, left: make(map[string]int)}
+	ht := hookTransport{
+		rt: bt,
+		before: func(req *http.Request) {
+			if req.Header.Get("X-Blazer-Method") != "b2_upload_part" {
+				return
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			parts[req.Header.Get("X-Bz-Part-Number")] = req.Header.Get("X-Bz-Content-Sha1")
+		},
+		after: func(*http.Request) {},
+	}
+	_, _, bucket := newTestBucket(ctx, t, "b2test-parts", b2.Transport(ht))
+
+	var first map[string]string
+	for _, tc := range []struct {
+		conc     int
+		failures int
+		seekable bool
+	}{
+		{conc: 1},
+		{conc: 4, failures: 5},
+		{conc: 16, failures: 20},
+		{conc: 4, seekable: true},
+	} {
+		mu.Lock()
+		parts = make(map[string]string)
+		mu.Unlock()
+		bt.mu.Lock()
+		bt.left["b2_upload_part"] = tc.failures
+		bt.mu.Unlock()
+
+		name := fmt.Sprintf("stream-%d-%v", tc.conc, tc.seekable)
+		w := bucket.Object(name).NewWriter(ctx)
+		w.ChunkSize = csize
+		w.ConcurrentUploads = tc.conc
+		src := stream()
+		if tc.seekable {
+			src = bytes.NewReader(data)
+		}
+		if _, err := io.Copy(w, src); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if err := w.Close(); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		attrs, err := bucket.Object(name).Attrs(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if attrs.SHA1 != want {
+			t.Errorf("%s: SHA1: got %q, want %q", name, attrs.SHA1, want)
+		}
+
+		mu.Lock()
+		got := parts
+		mu.Unlock()
+		if n, want := int64(len(got)), (size+int64(csize)-1)/int64(csize); n != want {
+			t.Errorf("%s: got %d parts, want %d", name, n, want)
+		}
+		if first == nil {
+			first = got
+			continue
+		}
+		if !reflect.DeepEqual(got, first) {
+			t.Errorf("%s: part SHA1s differ from those with one upload thread", name)
+		}
+	}
+}
+
+// countingHash is SHA1, counting the bytes it hashes.
+type countingHash struct {
+	hash.Hash
+	n *int64
+}
+
+func (c countingHash) Write(p []byte) (int, error) {
+	atomic.AddInt64(c.n, int64(len(p)))
+	return c.Hash.Write(p)
+}
+
+func TestHashFunc(t *testing.T) {
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	var hashed int64
+	_, _, bucket := newTestBucket(ctx, t, "b2test-hash", b2.HashFunc(func() hash.Hash { return countingHash{Hash: sha1.New(), n: &hashed} }))
+
+	data := bytes.Repeat([]byte("hash me "), 5e3)
+	want := fmt.Sprintf("%x", sha1.Sum(data))
+	for _, e := range []struct {
+		name  string
+		src   io.Reader
+		chunk int
+	}{
+		{name: "small", src: struct{ io.Reader }{bytes.NewReader(data)}, chunk: 1e5},
+		{name: "streamed", src: struct{ io.Reader }{bytes.NewReader(data)}, chunk: 1e4},
+		{name: "seekable", src: bytes.NewReader(data), chunk: 1e4},
+	} {
+		obj := bucket.Object(e.name)
+		atomic.StoreInt64(&hashed, 0)
+		w := obj.NewWriter(ctx)
+		w.ChunkSize = e.chunk
+		if _, err := w.ReadFrom(e.src); err != nil {
+			t.Fatal(err)
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if n := atomic.LoadInt64(&hashed); n < int64(len(data)) {
+			t.Errorf("%s: upload hashed %d bytes with HashFunc, want at least %d", e.name, n, len(data))
+		}
+		attrs, err := w.File()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if attrs.SHA1 != want {
+			t.Errorf("%s: SHA1: got %q, want %q", e.name, attrs.SHA1, want)
+		}
+
+		atomic.StoreInt64(&hashed, 0)
+		r := obj.NewReader(ctx)
+		got, err := ioutil.ReadAll(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.Close()
+		if !bytes.Equal(got, data) {
+			t.Errorf("%s: read back different data", e.name)
+		}
+		if n := atomic.LoadInt64(&hashed); n != int64(len(data)) {
+			t.Errorf("%s: download hashed %d bytes with HashFunc, want %d", e.name, n, len(data))
+		}
+	}
+}
+
+// countingReadSeeker counts the bytes read through ReadAt.
+type countingReadSeeker struct {
+	*bytes.Reader
+	n int64
+}
+
+func (cr *countingReadSeeker) ReadAt(p []byte, off int64) (int, error) {
+	n, err := cr.Reader.ReadAt(p, off)
+	atomic.AddInt64(&cr.n, int64(n))
+	return n, err
+}
+
+// TestSeekableHashedFirst checks that a seekable source is read once to hash
+// it, before any part is sent, and once more to send it.
+func TestSeekableHashedFirst(t *testing.T) {
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	size, csize := int64(10e6), int(1e6)
+	data := make([]byte, size)
+	rand.New(rand.NewSource(1165)).Read(data)
+	src := &countingReadSeeker{Reader: bytes.NewReader(data)}
+
+	// read is how much of the source had been read when the first part was
+	// sent.
+	read := int64(-1)
+	ht := hookTransport{
+		rt: http.DefaultTransport,
+		before: func(req *http.Request) {
+			if req.Header.Get("X-Blazer-Method") == "b2_upload_part" {
+				atomic.CompareAndSwapInt64(&read, -1, atomic.LoadInt64(&src.n))
+			}
+		},
+		after: func(*http.Request) {},
+	}
+	_, _, bucket := newTestBucket(ctx, t, "b2test-seekable", b2.Transport(ht))
+	obj := bucket.Object("obj")
+	w := obj.NewWriter(ctx)
+	w.ChunkSize = csize
+	w.ConcurrentUploads = 2
+	if _, err := w.ReadFrom(src); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if n := atomic.LoadInt64(&read); n < size {
+		t.Errorf("first part sent after reading %d of %d bytes; want the whole source hashed first", n, size)
+	}
+	if n := atomic.LoadInt64(&src.n); n != 2*size {
+		t.Errorf("read %d bytes of the source; want %d", n, 2*size)
+	}
+	attrs, err := obj.Attrs(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := attrs.Info["large_file_sha1"], fmt.Sprintf("%x", sha1.Sum(data)); got != want {
+		t.Errorf("large_file_sha1: got %q, want %q", got, want)
+	}
+}
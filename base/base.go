@@ -23,26 +23,31 @@ package base
 import (
 	"bytes"
 	"context"
+	"crypto/sha1"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"net/http"
+	neturl "net/url"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
 
+	"github.com/kurin/blazer"
 	"github.com/kurin/blazer/internal/b2types"
 	"github.com/kurin/blazer/internal/blog"
 )
 
 const (
 	APIBase          = "https://api.backblazeb2.com"
-	DefaultUserAgent = "blazer/0.5.3"
+	DefaultUserAgent = "blazer/" + blazer.Version
 )
 
 type b2err struct {
@@ -51,6 +56,7 @@ type b2err struct {
 	retry   int
 	code    int
 	msgCode string
+	diag    *Diagnostics
 }
 
 func (e b2err) Error() string {
@@ -60,12 +66,24 @@ func (e b2err) Error() string {
 	return fmt.Sprintf("%s: %d: %s", e.method, e.code, e.msg)
 }
 
+// asB2err finds the B2 error in err's chain, if there is one, so that callers
+// which wrap errors from this package can still use Action, Code, and friends.
+func asB2err(err error) (b2err, bool) {
+	var e b2err
+	ok := errors.As(err, &e)
+	return e, ok
+}
+
 // Action checks an error and returns a recommended course of action.
 func Action(err error) ErrAction {
-	e, ok := err.(b2err)
+	e, ok := asB2err(err)
 	if !ok {
 		return Punt
 	}
+	if isCapCode(e.msgCode) {
+		// Waiting won't help, whatever Retry-After says.
+		return Punt
+	}
 	if e.retry > 0 {
 		return Retry
 	}
@@ -95,13 +113,34 @@ func Action(err error) ErrAction {
 	return Punt
 }
 
+// isCapCode reports whether code is one of the codes B2 uses when an account
+// reaches one of its caps.
+func isCapCode(code string) bool {
+	switch code {
+	case "cap_exceeded", "storage_cap_exceeded", "download_cap_exceeded", "transaction_cap_exceeded":
+		return true
+	}
+	return false
+}
+
+// CapExceeded reports whether err is the result of the account reaching one
+// of its caps, and if so, which one: "storage", "download", or "transaction",
+// or "" if B2 didn't say.
+func CapExceeded(err error) (string, bool) {
+	e, ok := asB2err(err)
+	if !ok || !isCapCode(e.msgCode) {
+		return "", false
+	}
+	return strings.TrimSuffix(strings.TrimSuffix(e.msgCode, "cap_exceeded"), "_"), true
+}
+
 // ErrAction is an action that a caller can take when any function returns an
 // error.
 type ErrAction int
 
 // Code returns the error code and message.
 func Code(err error) (int, string) {
-	e, ok := err.(b2err)
+	e, ok := asB2err(err)
 	if !ok {
 		return 0, ""
 	}
@@ -110,7 +149,7 @@ func Code(err error) (int, string) {
 
 // MsgCode returns the error code, msgCode and message.
 func MsgCode(err error) (int, string, string) {
-	e, ok := err.(b2err)
+	e, ok := asB2err(err)
 	if !ok {
 		return 0, "", ""
 	}
@@ -144,10 +183,9 @@ func mkErr(resp *http.Response) error {
 	}
 	logResponse(resp, data)
 	msg := &b2types.ErrorMessage{}
-	if err := json.Unmarshal(data, msg); err != nil {
-		if msgBody != "" {
-			msgBody = fmt.Sprintf("couldn't read message body: %v", err)
-		}
+	if err := json.Unmarshal(data, msg); err != nil && msgBody == "" {
+		// This is often an HTML page from a proxy.
+		msgBody = fmt.Sprintf("%s: couldn't decode error response %s: %v", resp.Status, snippet(data), err)
 	}
 	if msgBody == "" {
 		msgBody = msg.Msg
@@ -168,6 +206,7 @@ func mkErr(resp *http.Response) error {
 		code:    resp.StatusCode,
 		msgCode: msg.Code,
 		method:  resp.Request.Header.Get("X-Blazer-Method"),
+		diag:    diagnose(resp),
 	}
 }
 
@@ -176,13 +215,100 @@ func mkErr(resp *http.Response) error {
 // indicates Retry, the user should implement their own exponential backoff,
 // beginning with one second.
 func Backoff(err error) time.Duration {
-	e, ok := err.(b2err)
+	e, ok := asB2err(err)
 	if !ok {
 		return 0
 	}
 	return time.Duration(e.retry) * time.Second
 }
 
+// retryErr annotates the error that ended a retry loop with the history of
+// the attempts before it.
+type retryErr struct {
+	err        error
+	last       error // the final attempt's error, if err is from a context
+	attempts   int
+	waited     time.Duration
+	retryAfter time.Duration
+}
+
+func (e *retryErr) Error() string {
+	if e.last != nil {
+		return fmt.Sprintf("%v (after %d attempts and %v of backoff; last error: %v)", e.err, e.attempts, e.waited, e.last)
+	}
+	return fmt.Sprintf("%v (after %d attempts and %v of backoff)", e.err, e.attempts, e.waited)
+}
+
+func (e *retryErr) Unwrap() error { return e.err }
+
+// WithRetries annotates err, the error that ended a retry loop, with the
+// number of attempts made, the total time spent waiting between them, and the
+// last Retry-After the service sent, for Attempts, Waited, and RetryAfter to
+// report.  It is for callers that retry requests themselves.  Errors from a
+// single attempt, and context errors, are returned unchanged.
+func WithRetries(err error, attempts int, waited, retryAfter time.Duration) error {
+	if err == nil || attempts < 2 || err == context.Canceled || err == context.DeadlineExceeded {
+		return err
+	}
+	return &retryErr{err: err, attempts: attempts, waited: waited, retryAfter: retryAfter}
+}
+
+// Interrupted annotates ctxErr, the error of the context that cut a retry loop
+// short, with the loop's history, as WithRetries does, and with last, the
+// error from the final attempt.  The result still satisfies errors.Is(err,
+// ctxErr), and LastError reports last.
+func Interrupted(ctxErr, last error, attempts int, waited, retryAfter time.Duration) error {
+	if last == nil {
+		return ctxErr
+	}
+	return &retryErr{err: ctxErr, last: last, attempts: attempts, waited: waited, retryAfter: retryAfter}
+}
+
+// LastError returns the error from the final attempt of a retry loop that was
+// cut short by its context, or err if there was no such attempt.
+func LastError(err error) error {
+	var e *retryErr
+	if errors.As(err, &e) && e.last != nil {
+		return e.last
+	}
+	return err
+}
+
+// Attempts returns the number of attempts that were made before err was
+// returned.  Errors that were not retried count as one attempt.
+func Attempts(err error) int {
+	if err == nil {
+		return 0
+	}
+	var e *retryErr
+	if !errors.As(err, &e) {
+		return 1
+	}
+	return e.attempts
+}
+
+// Waited returns the total time spent backing off between the attempts that
+// led to err.
+func Waited(err error) time.Duration {
+	var e *retryErr
+	if !errors.As(err, &e) {
+		return 0
+	}
+	return e.waited
+}
+
+// RetryAfter returns the last Retry-After sent by the service over all the
+// attempts that led to err.  Unlike Backoff, which considers only the final
+// error, it reports a value even when the final attempt failed for some other
+// reason.
+func RetryAfter(err error) time.Duration {
+	var e *retryErr
+	if errors.As(err, &e) && e.retryAfter > 0 {
+		return e.retryAfter
+	}
+	return Backoff(err)
+}
+
 func logRequest(req *http.Request, args []byte) {
 	if !blog.V(2) {
 		return
@@ -224,10 +350,6 @@ func logResponse(resp *http.Response, reply []byte) {
 	blog.V(2).Infof("<< %s (%s) %s {%s} (no reply)", method, id, resp.Status, hstr)
 }
 
-func millitime(t int64) time.Time {
-	return time.Unix(t/1000, t%1000*1e6)
-}
-
 type b2Options struct {
 	transport       http.RoundTripper
 	failSomeUploads bool
@@ -235,6 +357,8 @@ type b2Options struct {
 	capExceeded     bool
 	apiBase         string
 	userAgent       string
+	counters        *Counters
+	diagnostics     bool // see KeepDiagnostics
 }
 
 func (o *b2Options) addHeaders(req *http.Request) {
@@ -273,24 +397,87 @@ func (o *b2Options) getTransport() http.RoundTripper {
 
 // B2 holds account information for Backblaze.
 type B2 struct {
+	// mu guards the fields that Update replaces.  Request builders read them
+	// all at once, through snapshot, so that a request never pairs one
+	// session's token with another's URLs.
+	mu          sync.RWMutex
 	accountID   string
 	authToken   string
 	apiURI      string
 	downloadURI string
 	minPartSize int
+	absMinPart  int
 	opts        *b2Options
-	bucket      string // restricted to this bucket if present
-	pfx         string // restricted to objects with this prefix if present
+
+	bucket string   // restricted to this bucket if present
+	pfx    string   // restricted to objects with this prefix if present
+	caps   []string // capabilities of the key
+
+	// ignoresINM is set once a download has shown that B2 does not honor
+	// If-None-Match.
+	ignoresINM int32
 }
 
-// Update replaces the B2 object with a new one, in-place.
+// session is a consistent copy of the credentials, endpoints and key
+// restrictions of a B2.
+type session struct {
+	accountID   string
+	authToken   string
+	apiURI      string
+	downloadURI string
+	minPartSize int
+	absMinPart  int
+	opts        *b2Options
+	bucket      string
+	pfx         string
+	caps        []string
+}
+
+func (b *B2) snapshot() session {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return session{
+		accountID:   b.accountID,
+		authToken:   b.authToken,
+		apiURI:      b.apiURI,
+		downloadURI: b.downloadURI,
+		minPartSize: b.minPartSize,
+		absMinPart:  b.absMinPart,
+		opts:        b.opts,
+		bucket:      b.bucket,
+		pfx:         b.pfx,
+		caps:        b.caps,
+	}
+}
+
+// Update replaces the B2 object with a new one, in-place.  It is safe to call
+// while other goroutines are making requests with b.
 func (b *B2) Update(n *B2) {
-	b.accountID = n.accountID
-	b.authToken = n.authToken
-	b.apiURI = n.apiURI
-	b.downloadURI = n.downloadURI
-	b.minPartSize = n.minPartSize
-	b.opts = n.opts
+	c := n.snapshot()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.accountID = c.accountID
+	b.authToken = c.authToken
+	b.apiURI = c.apiURI
+	b.downloadURI = c.downloadURI
+	b.minPartSize = c.minPartSize
+	b.absMinPart = c.absMinPart
+	b.opts = c.opts
+	b.bucket = c.bucket
+	b.pfx = c.pfx
+	b.caps = c.caps
+}
+
+// AbsoluteMinPartSize returns the smallest part B2 accepts in a large file,
+// other than the last, as given in the b2_authorize_account reply.
+func (b *B2) AbsoluteMinPartSize() int {
+	return b.snapshot().absMinPart
+}
+
+// Capabilities returns the capabilities of the key the account was authorized
+// with, as listed in the allowed block of the b2_authorize_account reply.
+func (b *B2) Capabilities() []string {
+	return append([]string(nil), b.snapshot().caps...)
 }
 
 type httpReply struct {
@@ -301,6 +488,11 @@ type httpReply struct {
 func makeNetRequest(ctx context.Context, req *http.Request, rt http.RoundTripper) (*http.Response, error) {
 	req = req.WithContext(ctx)
 	resp, err := rt.RoundTrip(req)
+	if err != nil && ctx.Err() != nil {
+		// Whatever the transport says, the request failed because it was
+		// canceled, and shouldn't be retried.
+		return nil, ctx.Err()
+	}
 	switch err {
 	case nil:
 		return resp, nil
@@ -316,6 +508,21 @@ func makeNetRequest(ctx context.Context, req *http.Request, rt http.RoundTripper
 	}
 }
 
+// ctxReader fails once its context is done.  Upload bodies are wrapped in one
+// so that a canceled upload stops within a buffer's worth of data, rather
+// than whenever the transport next notices.
+type ctxReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (cr ctxReader) Read(p []byte) (int, error) {
+	if err := cr.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return cr.r.Read(p)
+}
+
 type requestBody struct {
 	size int64
 	body io.Reader
@@ -373,11 +580,28 @@ func (k *keepFinalBytes) Read(p []byte) (int, error) {
 var reqID int64
 
 func (o *b2Options) makeRequest(ctx context.Context, method, verb, uri string, b2req, b2resp interface{}, headers map[string]string, body *requestBody) error {
+	_, err := o.request(ctx, method, verb, uri, b2req, b2resp, headers, body)
+	return err
+}
+
+// request is makeRequest, but also returns the Diagnostics of a successful
+// reply if the options call for them.
+func (o *b2Options) request(ctx context.Context, method, verb, uri string, b2req, b2resp interface{}, headers map[string]string, body *requestBody) (*Diagnostics, error) {
+	o.counters.call(method)
 	var args []byte
+	if body != nil {
+		// This is file data.
+		o.counters.start()
+		defer o.counters.stop()
+		body = &requestBody{
+			body: o.counters.countUp(ctxReader{ctx: ctx, r: body.body}),
+			size: body.size,
+		}
+	}
 	if b2req != nil {
 		enc, err := json.Marshal(b2req)
 		if err != nil {
-			return err
+			return nil, err
 		}
 		args = enc
 		body = &requestBody{
@@ -387,7 +611,7 @@ func (o *b2Options) makeRequest(ctx context.Context, method, verb, uri string, b
 	}
 	req, err := http.NewRequest(verb, uri, body.getBody())
 	if err != nil {
-		return err
+		return nil, err
 	}
 	req.ContentLength = body.getSize()
 	for k, v := range headers {
@@ -402,30 +626,63 @@ func (o *b2Options) makeRequest(ctx context.Context, method, verb, uri string, b
 	logRequest(req, args)
 	resp, err := makeNetRequest(ctx, req, o.getTransport())
 	if err != nil {
-		return err
+		o.counters.fail(err)
+		return nil, err
 	}
 	defer resp.Body.Close()
 	if resp.StatusCode != 200 {
-		return mkErr(resp)
-	}
-	var replyArgs []byte
-	if b2resp != nil {
-		rbuf := &bytes.Buffer{}
-		r := io.TeeReader(resp.Body, rbuf)
-		decoder := json.NewDecoder(r)
-		if err := decoder.Decode(b2resp); err != nil {
-			return err
-		}
-		replyArgs = rbuf.Bytes()
-	} else {
-		ra, err := ioutil.ReadAll(resp.Body)
+		err := mkErr(resp)
+		o.counters.fail(err)
+		return nil, err
+	}
+	// The reply is decoded as it is read.  Only its beginning is kept, for
+	// error messages, unless it is to be logged.
+	reply := &cappedBuffer{max: snippetSize}
+	if blog.V(2) {
+		reply.max = maxLoggedReply
+	}
+	r := io.TeeReader(resp.Body, reply)
+	var decErr error
+	switch b2resp := b2resp.(type) {
+	case nil:
+	case streamDecoder:
+		decErr = b2resp.decode(json.NewDecoder(r))
+	default:
+		decErr = json.NewDecoder(r).Decode(b2resp)
+	}
+	// Reading the reply fully means the connection can be reused even if it
+	// can't be decoded.
+	_, err = io.Copy(ioutil.Discard, r)
+	logResponse(resp, reply.logged())
+	if b2resp == nil {
 		if err != nil {
 			blog.V(1).Infof("%s: couldn't read response: %v", method, err)
 		}
-		replyArgs = ra
+		return nil, nil
 	}
-	logResponse(resp, replyArgs)
-	return nil
+	if decErr != nil {
+		if err != nil {
+			return nil, fmt.Errorf("%s: couldn't read response: %v", method, err)
+		}
+		return nil, fmt.Errorf("%s: couldn't decode response %s: %v", method, snippet(reply.buf), decErr)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: couldn't read response: %v", method, err)
+	}
+	if o.diagnostics {
+		return diagnose(resp), nil
+	}
+	return nil, nil
+}
+
+const snippetSize = 256
+
+// snippet returns the beginning of a reply, for error messages.
+func snippet(data []byte) string {
+	if len(data) > snippetSize {
+		return fmt.Sprintf("%q...", data[:snippetSize])
+	}
+	return fmt.Sprintf("%q", data)
 }
 
 // AuthorizeAccount wraps b2_authorize_account.
@@ -448,8 +705,10 @@ func AuthorizeAccount(ctx context.Context, account, key string, opts ...AuthOpti
 		apiURI:      b2resp.URI,
 		downloadURI: b2resp.DownloadURI,
 		minPartSize: b2resp.PartSize,
+		absMinPart:  b2resp.AbsMinPartSize,
 		bucket:      b2resp.Allowed.Bucket,
 		pfx:         b2resp.Allowed.Prefix,
+		caps:        b2resp.Allowed.Capabilities,
 		opts:        b2opts,
 	}, nil
 }
@@ -515,8 +774,57 @@ type LifecycleRule struct {
 	DaysHiddenUntilDeleted int
 }
 
-// CreateBucket wraps b2_create_bucket.
+// BucketNameError is returned for a bucket name that B2 won't accept.
+type BucketNameError struct {
+	Name   string
+	Reason string
+
+	// Err is the error from B2, for names that are rejected by the service
+	// rather than by ValidateBucketName.
+	Err error
+}
+
+func (e BucketNameError) Error() string {
+	return fmt.Sprintf("invalid bucket name %q: %s", e.Name, e.Reason)
+}
+
+func (e BucketNameError) Unwrap() error { return e.Err }
+
+// ValidateBucketName checks name against B2's rules for bucket names, which
+// must be between 6 and 50 characters long, consist only of letters, digits,
+// and "-", and not begin with "b2-".  It returns a BucketNameError describing
+// the first rule broken, or nil.  A valid name may still be rejected by
+// CreateBucket if another account is using it.
+func ValidateBucketName(name string) error {
+	bad := func(format string, args ...interface{}) error {
+		return BucketNameError{Name: name, Reason: fmt.Sprintf(format, args...)}
+	}
+	switch {
+	case len(name) < 6:
+		return bad("it is shorter than 6 characters")
+	case len(name) > 50:
+		return bad("it is longer than 50 characters")
+	case strings.HasPrefix(strings.ToLower(name), "b2-"):
+		return bad(`names beginning with "b2-" are reserved`)
+	}
+	for _, r := range name {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '-':
+		default:
+			return bad("%q is not a letter, digit, or hyphen", r)
+		}
+	}
+	return nil
+}
+
+// CreateBucket wraps b2_create_bucket.  The name is checked with
+// ValidateBucketName before anything is sent, and a name that B2 reports is
+// already in use is returned as a BucketNameError.
 func (b *B2) CreateBucket(ctx context.Context, name, btype string, info map[string]string, rules []LifecycleRule) (*Bucket, error) {
+	if err := ValidateBucketName(name); err != nil {
+		return nil, err
+	}
+	c := b.snapshot()
 	if btype != "allPublic" {
 		btype = "allPrivate"
 	}
@@ -529,7 +837,7 @@ func (b *B2) CreateBucket(ctx context.Context, name, btype string, info map[stri
 		})
 	}
 	b2req := &b2types.CreateBucketRequest{
-		AccountID:      b.accountID,
+		AccountID:      c.accountID,
 		Name:           name,
 		Type:           btype,
 		Info:           info,
@@ -537,9 +845,12 @@ func (b *B2) CreateBucket(ctx context.Context, name, btype string, info map[stri
 	}
 	b2resp := &b2types.CreateBucketResponse{}
 	headers := map[string]string{
-		"Authorization": b.authToken,
+		"Authorization": c.authToken,
 	}
-	if err := b.opts.makeRequest(ctx, "b2_create_bucket", "POST", b.apiURI+b2types.V1api+"b2_create_bucket", b2req, b2resp, headers, nil); err != nil {
+	if err := c.opts.makeRequest(ctx, "b2_create_bucket", "POST", c.apiURI+b2types.V1api+"b2_create_bucket", b2req, b2resp, headers, nil); err != nil {
+		if _, code, _ := MsgCode(err); code == "duplicate_bucket_name" {
+			return nil, BucketNameError{Name: name, Reason: "it is already in use", Err: err}
+		}
 		return nil, err
 	}
 	var respRules []LifecycleRule
@@ -562,14 +873,15 @@ func (b *B2) CreateBucket(ctx context.Context, name, btype string, info map[stri
 
 // DeleteBucket wraps b2_delete_bucket.
 func (b *Bucket) DeleteBucket(ctx context.Context) error {
+	c := b.b2.snapshot()
 	b2req := &b2types.DeleteBucketRequest{
-		AccountID: b.b2.accountID,
+		AccountID: c.accountID,
 		BucketID:  b.ID,
 	}
 	headers := map[string]string{
-		"Authorization": b.b2.authToken,
+		"Authorization": c.authToken,
 	}
-	return b.b2.opts.makeRequest(ctx, "b2_delete_bucket", "POST", b.b2.apiURI+b2types.V1api+"b2_delete_bucket", b2req, nil, headers, nil)
+	return c.opts.makeRequest(ctx, "b2_delete_bucket", "POST", c.apiURI+b2types.V1api+"b2_delete_bucket", b2req, nil, headers, nil)
 }
 
 // Bucket holds B2 bucket details.
@@ -581,10 +893,14 @@ type Bucket struct {
 	ID             string
 	rev            int
 	b2             *B2
+
+	mu  sync.Mutex
+	url *URL // an idle upload URL, kept for Put
 }
 
 // Update wraps b2_update_bucket.
 func (b *Bucket) Update(ctx context.Context) (*Bucket, error) {
+	c := b.b2.snapshot()
 	var rules []b2types.LifecycleRule
 	for _, rule := range b.LifecycleRules {
 		rules = append(rules, b2types.LifecycleRule{
@@ -594,7 +910,7 @@ func (b *Bucket) Update(ctx context.Context) (*Bucket, error) {
 		})
 	}
 	b2req := &b2types.UpdateBucketRequest{
-		AccountID: b.b2.accountID,
+		AccountID: c.accountID,
 		BucketID:  b.ID,
 		// Name:           b.Name,
 		Type:           b.Type,
@@ -603,10 +919,10 @@ func (b *Bucket) Update(ctx context.Context) (*Bucket, error) {
 		IfRevisionIs:   b.rev,
 	}
 	headers := map[string]string{
-		"Authorization": b.b2.authToken,
+		"Authorization": c.authToken,
 	}
 	b2resp := &b2types.UpdateBucketResponse{}
-	if err := b.b2.opts.makeRequest(ctx, "b2_update_bucket", "POST", b.b2.apiURI+b2types.V1api+"b2_update_bucket", b2req, b2resp, headers, nil); err != nil {
+	if err := c.opts.makeRequest(ctx, "b2_update_bucket", "POST", c.apiURI+b2types.V1api+"b2_update_bucket", b2req, b2resp, headers, nil); err != nil {
 		return nil, err
 	}
 	var respRules []LifecycleRule
@@ -629,20 +945,37 @@ func (b *Bucket) Update(ctx context.Context) (*Bucket, error) {
 
 // BaseURL returns the base part of the download URLs.
 func (b *Bucket) BaseURL() string {
-	return b.b2.downloadURI
+	return b.b2.snapshot().downloadURI
 }
 
 // ListBuckets wraps b2_list_buckets.
 func (b *B2) ListBuckets(ctx context.Context) ([]*Bucket, error) {
+	return b.listBuckets(ctx, "")
+}
+
+// ListBucketsByName wraps b2_list_buckets, asking only for the bucket called
+// name.  Unlike an unfiltered listing, this is allowed for a key that is
+// restricted to that bucket.  If there is no such bucket, the list is empty.
+func (b *B2) ListBucketsByName(ctx context.Context, name string) ([]*Bucket, error) {
+	return b.listBuckets(ctx, name)
+}
+
+func (b *B2) listBuckets(ctx context.Context, name string) ([]*Bucket, error) {
+	c := b.snapshot()
 	b2req := &b2types.ListBucketsRequest{
-		AccountID: b.accountID,
-		Bucket:    b.bucket,
+		AccountID: c.accountID,
+		Bucket:    c.bucket,
+	}
+	if name != "" {
+		// B2 takes either filter, and the name is the one asked for.
+		b2req.Bucket = ""
+		b2req.Name = name
 	}
 	b2resp := &b2types.ListBucketsResponse{}
 	headers := map[string]string{
-		"Authorization": b.authToken,
+		"Authorization": c.authToken,
 	}
-	if err := b.opts.makeRequest(ctx, "b2_list_buckets", "POST", b.apiURI+b2types.V1api+"b2_list_buckets", b2req, b2resp, headers, nil); err != nil {
+	if err := c.opts.makeRequest(ctx, "b2_list_buckets", "POST", c.apiURI+b2types.V1api+"b2_list_buckets", b2req, b2resp, headers, nil); err != nil {
 		return nil, err
 	}
 	var buckets []*Bucket
@@ -676,6 +1009,20 @@ type URL struct {
 	bucket *Bucket
 }
 
+// Host returns the host that the URL uploads to.
+func (url *URL) Host() string {
+	return hostOf(url.uri)
+}
+
+// hostOf returns the host part of uri, or "" if it can't be parsed.
+func hostOf(uri string) string {
+	u, err := neturl.Parse(uri)
+	if err != nil {
+		return ""
+	}
+	return u.Host
+}
+
 // Reload reloads URL in-place, by reissuing a b2_get_upload_url and
 // overwriting the previous values.
 func (url *URL) Reload(ctx context.Context) error {
@@ -690,14 +1037,15 @@ func (url *URL) Reload(ctx context.Context) error {
 
 // GetUploadURL wraps b2_get_upload_url.
 func (b *Bucket) GetUploadURL(ctx context.Context) (*URL, error) {
+	c := b.b2.snapshot()
 	b2req := &b2types.GetUploadURLRequest{
 		BucketID: b.ID,
 	}
 	b2resp := &b2types.GetUploadURLResponse{}
 	headers := map[string]string{
-		"Authorization": b.b2.authToken,
+		"Authorization": c.authToken,
 	}
-	if err := b.b2.opts.makeRequest(ctx, "b2_get_upload_url", "POST", b.b2.apiURI+b2types.V1api+"b2_get_upload_url", b2req, b2resp, headers, nil); err != nil {
+	if err := c.opts.makeRequest(ctx, "b2_get_upload_url", "POST", c.apiURI+b2types.V1api+"b2_get_upload_url", b2req, b2resp, headers, nil); err != nil {
 		return nil, err
 	}
 	return &URL{
@@ -708,15 +1056,34 @@ func (b *Bucket) GetUploadURL(ctx context.Context) (*URL, error) {
 	}, nil
 }
 
+// The actions B2 reports for a file, found in File.Status and FileInfo.Status.
+const (
+	// ActionUpload is a complete file.
+	ActionUpload = "upload"
+	// ActionHide is a marker that hides earlier versions of a file name.
+	ActionHide = "hide"
+	// ActionStart is a large file that has been started but not finished or
+	// canceled.
+	ActionStart = "start"
+	// ActionFolder is not a file, but a common prefix that ends in the
+	// delimiter of a listing.
+	ActionFolder = "folder"
+)
+
 // File represents a B2 file.
 type File struct {
 	Name      string
 	Size      int64
-	Status    string
+	Status    string // One of the Action constants.
 	Timestamp time.Time
 	Info      *FileInfo
 	ID        string
-	b2        *B2
+
+	// Diagnostics describes the reply that created the File, if
+	// KeepDiagnostics was given.
+	Diagnostics *Diagnostics
+
+	b2 *B2
 }
 
 // File returns a bare File struct, but with the appropriate id and b2
@@ -727,6 +1094,7 @@ func (b *Bucket) File(id, name string) *File {
 
 // UploadFile wraps b2_upload_file.
 func (url *URL) UploadFile(ctx context.Context, r io.Reader, size int, name, contentType, sha1 string, info map[string]string) (*File, error) {
+	c := url.b2.snapshot()
 	headers := map[string]string{
 		"Authorization":     url.token,
 		"X-Bz-File-Name":    name,
@@ -737,30 +1105,148 @@ func (url *URL) UploadFile(ctx context.Context, r io.Reader, size int, name, con
 	for k, v := range info {
 		headers[fmt.Sprintf("X-Bz-Info-%s", k)] = v
 	}
+	if sha1 == "hex_digits_at_end" {
+		r = &keepFinalBytes{r: r, remain: size}
+	}
 	b2resp := &b2types.UploadFileResponse{}
-	if err := url.b2.opts.makeRequest(ctx, "b2_upload_file", "POST", url.uri, nil, b2resp, headers, &requestBody{body: r, size: int64(size)}); err != nil {
+	diag, err := c.opts.request(ctx, "b2_upload_file", "POST", url.uri, nil, b2resp, headers, &requestBody{body: r, size: int64(size)})
+	if err != nil {
+		return nil, err
+	}
+	if err := checkSHA1("b2_upload_file", sha1, r, b2resp.SHA1); err != nil {
 		return nil, err
 	}
 	return &File{
 		Name:      name,
-		Size:      int64(size),
-		Timestamp: millitime(b2resp.Timestamp),
+		Size:      b2resp.Size,
+		Timestamp: b2resp.Timestamp.Time(),
 		Status:    b2resp.Action,
 		ID:        b2resp.FileID,
-		b2:        url.b2,
+		Info: &FileInfo{
+			Name:        name,
+			SHA1:        b2resp.SHA1,
+			Size:        b2resp.Size,
+			ContentType: b2resp.ContentType,
+			Info:        b2resp.Info,
+			Status:      b2resp.Action,
+			Timestamp:   b2resp.Timestamp.Time(),
+		},
+		Diagnostics: diag,
+		b2:          url.b2,
 	}, nil
 }
 
+// SHA1MismatchError is returned when B2 reports a different SHA1 for uploaded
+// data than the one that was sent.  This means either that the data was
+// corrupted in transit in a way that B2 didn't notice, or that there is a bug.
+type SHA1MismatchError struct {
+	Method   string
+	Sent     string
+	Received string
+}
+
+func (e SHA1MismatchError) Error() string {
+	return fmt.Sprintf("%s: sent data with SHA1 %s, but B2 reports %s", e.Method, e.Sent, e.Received)
+}
+
+// checkSHA1 compares the SHA1 of the data sent through r with the one B2
+// reports.
+func checkSHA1(method, sent string, r io.Reader, got string) error {
+	switch sent {
+	case "do_not_verify":
+		return nil
+	case "hex_digits_at_end":
+		sent = string(r.(*keepFinalBytes).sha[:])
+	}
+	if sent != got {
+		return SHA1MismatchError{Method: method, Sent: sent, Received: got}
+	}
+	return nil
+}
+
+// Put uploads data as the named file.  It is a convenience for small objects,
+// such as manifests and markers, that are held in memory: Put gets an upload
+// URL, which it keeps on the bucket for the next call, computes the SHA1, and,
+// because it can replay data, retries the upload whenever Action recommends
+// Retry or AttemptNewUpload.  Other errors, and the cancellation of ctx, are
+// returned to the caller.
+func (b *Bucket) Put(ctx context.Context, name string, data []byte, contentType string, info map[string]string) (*File, error) {
+	sum := fmt.Sprintf("%x", sha1.Sum(data))
+	backoff := 100 * time.Millisecond
+	var waited, retryAfter time.Duration
+	var last error
+	for attempts := 1; ; attempts++ {
+		f, err := b.put(ctx, name, data, contentType, sum, info)
+		if err == nil {
+			return f, nil
+		}
+		if cerr := ctx.Err(); cerr != nil {
+			return nil, Interrupted(cerr, err, attempts, waited, retryAfter)
+		}
+		switch Action(err) {
+		case Retry, AttemptNewUpload:
+		default:
+			return nil, WithRetries(err, attempts, waited, retryAfter)
+		}
+		last = err
+		wait := Backoff(err)
+		if wait > 0 {
+			retryAfter = wait
+		} else {
+			wait = backoff
+			if backoff < 30*time.Second {
+				backoff *= 2
+			}
+		}
+		t := time.NewTimer(wait)
+		start := time.Now()
+		select {
+		case <-t.C:
+			waited += wait
+		case <-ctx.Done():
+			t.Stop()
+			waited += time.Since(start)
+			return nil, Interrupted(ctx.Err(), last, attempts, waited, retryAfter)
+		}
+	}
+}
+
+// put makes one attempt at uploading data.  The cached upload URL is taken
+// for the duration of the upload, since B2 upload URLs cannot be used
+// concurrently, and is only returned to the cache if the upload succeeds.
+func (b *Bucket) put(ctx context.Context, name string, data []byte, contentType, sum string, info map[string]string) (*File, error) {
+	b.mu.Lock()
+	url := b.url
+	b.url = nil
+	b.mu.Unlock()
+	if url == nil {
+		u, err := b.GetUploadURL(ctx)
+		if err != nil {
+			return nil, err
+		}
+		url = u
+	}
+	f, err := url.UploadFile(ctx, bytes.NewReader(data), len(data), name, contentType, sum, info)
+	if err != nil {
+		return nil, err
+	}
+	b.mu.Lock()
+	b.url = url
+	b.mu.Unlock()
+	return f, nil
+}
+
 // DeleteFileVersion wraps b2_delete_file_version.
 func (f *File) DeleteFileVersion(ctx context.Context) error {
+	c := f.b2.snapshot()
 	b2req := &b2types.DeleteFileVersionRequest{
 		Name:   f.Name,
 		FileID: f.ID,
 	}
 	headers := map[string]string{
-		"Authorization": f.b2.authToken,
+		"Authorization": c.authToken,
 	}
-	return f.b2.opts.makeRequest(ctx, "b2_delete_file_version", "POST", f.b2.apiURI+b2types.V1api+"b2_delete_file_version", b2req, nil, headers, nil)
+	return c.opts.makeRequest(ctx, "b2_delete_file_version", "POST", c.apiURI+b2types.V1api+"b2_delete_file_version", b2req, nil, headers, nil)
 }
 
 // LargeFile holds information necessary to implement B2 large file support.
@@ -768,13 +1254,29 @@ type LargeFile struct {
 	ID string
 	b2 *B2
 
-	mu     sync.Mutex
-	size   int64
-	hashes map[int]string
+	mu    sync.Mutex
+	parts partTable
+}
+
+// Parts returns the parts that have been uploaded with UploadPart or passed to
+// CompileParts, in order.
+func (l *LargeFile) Parts() []PartInfo {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.parts.list()
+}
+
+// NextPartIndex returns the index that follows the highest one uploaded; it is
+// 1 if no parts have been uploaded.
+func (l *LargeFile) NextPartIndex() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.parts.next()
 }
 
 // StartLargeFile wraps b2_start_large_file.
 func (b *Bucket) StartLargeFile(ctx context.Context, name, contentType string, info map[string]string) (*LargeFile, error) {
+	c := b.b2.snapshot()
 	b2req := &b2types.StartLargeFileRequest{
 		BucketID:    b.ID,
 		Name:        name,
@@ -783,27 +1285,27 @@ func (b *Bucket) StartLargeFile(ctx context.Context, name, contentType string, i
 	}
 	b2resp := &b2types.StartLargeFileResponse{}
 	headers := map[string]string{
-		"Authorization": b.b2.authToken,
+		"Authorization": c.authToken,
 	}
-	if err := b.b2.opts.makeRequest(ctx, "b2_start_large_file", "POST", b.b2.apiURI+b2types.V1api+"b2_start_large_file", b2req, b2resp, headers, nil); err != nil {
+	if err := c.opts.makeRequest(ctx, "b2_start_large_file", "POST", c.apiURI+b2types.V1api+"b2_start_large_file", b2req, b2resp, headers, nil); err != nil {
 		return nil, err
 	}
 	return &LargeFile{
-		ID:     b2resp.ID,
-		b2:     b.b2,
-		hashes: make(map[int]string),
+		ID: b2resp.ID,
+		b2: b.b2,
 	}, nil
 }
 
 // CancelLargeFile wraps b2_cancel_large_file.
 func (l *LargeFile) CancelLargeFile(ctx context.Context) error {
+	c := l.b2.snapshot()
 	b2req := &b2types.CancelLargeFileRequest{
 		ID: l.ID,
 	}
 	headers := map[string]string{
-		"Authorization": l.b2.authToken,
+		"Authorization": c.authToken,
 	}
-	return l.b2.opts.makeRequest(ctx, "b2_cancel_large_file", "POST", l.b2.apiURI+b2types.V1api+"b2_cancel_large_file", b2req, nil, headers, nil)
+	return c.opts.makeRequest(ctx, "b2_cancel_large_file", "POST", c.apiURI+b2types.V1api+"b2_cancel_large_file", b2req, nil, headers, nil)
 }
 
 // FilePart is a piece of a started, but not finished, large file upload.
@@ -815,6 +1317,7 @@ type FilePart struct {
 
 // ListParts wraps b2_list_parts.
 func (f *File) ListParts(ctx context.Context, next, count int) ([]*FilePart, int, error) {
+	c := f.b2.snapshot()
 	b2req := &b2types.ListPartsRequest{
 		ID:    f.ID,
 		Start: next,
@@ -822,9 +1325,9 @@ func (f *File) ListParts(ctx context.Context, next, count int) ([]*FilePart, int
 	}
 	b2resp := &b2types.ListPartsResponse{}
 	headers := map[string]string{
-		"Authorization": f.b2.authToken,
+		"Authorization": c.authToken,
 	}
-	if err := f.b2.opts.makeRequest(ctx, "b2_list_parts", "POST", f.b2.apiURI+b2types.V1api+"b2_list_parts", b2req, b2resp, headers, nil); err != nil {
+	if err := c.opts.makeRequest(ctx, "b2_list_parts", "POST", c.apiURI+b2types.V1api+"b2_list_parts", b2req, b2resp, headers, nil); err != nil {
 		return nil, 0, err
 	}
 	var parts []*FilePart
@@ -842,16 +1345,16 @@ func (f *File) ListParts(ctx context.Context, next, count int) ([]*FilePart, int
 // mapping of completed part numbers to SHA1 strings; size is the total size of
 // all the completed parts to this point.
 func (f *File) CompileParts(size int64, seen map[int]string) *LargeFile {
-	s := make(map[int]string)
-	for k, v := range seen {
-		s[k] = v
+	l := &LargeFile{
+		ID: f.ID,
+		b2: f.b2,
 	}
-	return &LargeFile{
-		ID:     f.ID,
-		b2:     f.b2,
-		size:   size,
-		hashes: s,
+	l.parts.parts = make(map[int]PartInfo)
+	for k, v := range seen {
+		l.parts.parts[k] = PartInfo{Index: k, SHA1: v}
 	}
+	l.parts.size = size
+	return l
 }
 
 // FileChunk holds information necessary for uploading file chunks.
@@ -861,6 +1364,11 @@ type FileChunk struct {
 	file  *LargeFile
 }
 
+// Host returns the host that the chunk uploads to.
+func (fc *FileChunk) Host() string {
+	return hostOf(fc.url)
+}
+
 type getUploadPartURLRequest struct {
 	ID string `json:"fileId"`
 }
@@ -872,14 +1380,15 @@ type getUploadPartURLResponse struct {
 
 // GetUploadPartURL wraps b2_get_upload_part_url.
 func (l *LargeFile) GetUploadPartURL(ctx context.Context) (*FileChunk, error) {
+	c := l.b2.snapshot()
 	b2req := &getUploadPartURLRequest{
 		ID: l.ID,
 	}
 	b2resp := &getUploadPartURLResponse{}
 	headers := map[string]string{
-		"Authorization": l.b2.authToken,
+		"Authorization": c.authToken,
 	}
-	if err := l.b2.opts.makeRequest(ctx, "b2_get_upload_part_url", "POST", l.b2.apiURI+b2types.V1api+"b2_get_upload_part_url", b2req, b2resp, headers, nil); err != nil {
+	if err := c.opts.makeRequest(ctx, "b2_get_upload_part_url", "POST", c.apiURI+b2types.V1api+"b2_get_upload_part_url", b2req, b2resp, headers, nil); err != nil {
 		return nil, err
 	}
 	return &FileChunk{
@@ -900,8 +1409,18 @@ func (fc *FileChunk) Reload(ctx context.Context) error {
 	return nil
 }
 
-// UploadPart wraps b2_upload_part.
+// UploadPart wraps b2_upload_part.  Parts are numbered from 1.  Uploading a
+// part again with the same contents is harmless, but UploadPart returns an
+// error if a part with the given index has already been uploaded with
+// different contents.
 func (fc *FileChunk) UploadPart(ctx context.Context, r io.Reader, sha1 string, size, index int) (int, error) {
+	fc.file.mu.Lock()
+	err := fc.file.parts.check("b2_upload_part", index, sha1)
+	fc.file.mu.Unlock()
+	if err != nil {
+		return 0, err
+	}
+	c := fc.file.b2.snapshot()
 	headers := map[string]string{
 		"Authorization":     fc.token,
 		"X-Bz-Part-Number":  fmt.Sprintf("%d", index),
@@ -911,52 +1430,96 @@ func (fc *FileChunk) UploadPart(ctx context.Context, r io.Reader, sha1 string, s
 	if sha1 == "hex_digits_at_end" {
 		r = &keepFinalBytes{r: r, remain: size}
 	}
-	if err := fc.file.b2.opts.makeRequest(ctx, "b2_upload_part", "POST", fc.url, nil, nil, headers, &requestBody{body: r, size: int64(size)}); err != nil {
+	b2resp := &b2types.UploadPartResponse{}
+	if err := c.opts.makeRequest(ctx, "b2_upload_part", "POST", fc.url, nil, b2resp, headers, &requestBody{body: r, size: int64(size)}); err != nil {
+		return 0, err
+	}
+	if err := checkSHA1("b2_upload_part", sha1, r, b2resp.SHA1); err != nil {
 		return 0, err
 	}
+	// Record what B2 says it received; this is what FinishLargeFile sends.
 	fc.file.mu.Lock()
-	if sha1 == "hex_digits_at_end" {
-		sha1 = string(r.(*keepFinalBytes).sha[:])
+	defer fc.file.mu.Unlock()
+	if err := fc.file.parts.add("b2_upload_part", PartInfo{Index: index, Size: b2resp.Size, SHA1: b2resp.SHA1}); err != nil {
+		return 0, err
 	}
-	fc.file.hashes[index] = sha1
-	fc.file.size += int64(size)
-	fc.file.mu.Unlock()
 	return size, nil
 }
 
 // FinishLargeFile wraps b2_finish_large_file.
 func (l *LargeFile) FinishLargeFile(ctx context.Context) (*File, error) {
+	c := l.b2.snapshot()
 	l.mu.Lock()
 	defer l.mu.Unlock()
+	hashes, err := l.parts.hashes("b2_finish_large_file")
+	if err != nil {
+		return nil, err
+	}
 	b2req := &b2types.FinishLargeFileRequest{
 		ID:     l.ID,
-		Hashes: make([]string, len(l.hashes)),
+		Hashes: hashes,
 	}
 	b2resp := &b2types.FinishLargeFileResponse{}
-	for k, v := range l.hashes {
-		if len(b2req.Hashes) < k {
-			return nil, fmt.Errorf("b2_finish_large_file: invalid index %d", k)
-		}
-		b2req.Hashes[k-1] = v
-	}
 	headers := map[string]string{
-		"Authorization": l.b2.authToken,
+		"Authorization": c.authToken,
 	}
-	if err := l.b2.opts.makeRequest(ctx, "b2_finish_large_file", "POST", l.b2.apiURI+b2types.V1api+"b2_finish_large_file", b2req, b2resp, headers, nil); err != nil {
+	if err := c.opts.makeRequest(ctx, "b2_finish_large_file", "POST", c.apiURI+b2types.V1api+"b2_finish_large_file", b2req, b2resp, headers, nil); err != nil {
 		return nil, err
 	}
+	size := b2resp.Size
+	if size == 0 {
+		// Not every server reports it; the parts add up to the same thing.
+		size = l.parts.size
+	}
 	return &File{
 		Name:      b2resp.Name,
-		Size:      l.size,
-		Timestamp: millitime(b2resp.Timestamp),
+		Size:      size,
+		Timestamp: b2resp.Timestamp.Time(),
 		Status:    b2resp.Action,
 		ID:        b2resp.FileID,
-		b2:        l.b2,
+		Info: &FileInfo{
+			Name:        b2resp.Name,
+			SHA1:        b2resp.SHA1,
+			Size:        size,
+			ContentType: b2resp.ContentType,
+			Info:        b2resp.Info,
+			Status:      b2resp.Action,
+			Timestamp:   b2resp.Timestamp.Time(),
+		},
+		b2: l.b2,
 	}, nil
 }
 
-// ListUnfinishedLargeFiles wraps b2_list_unfinished_large_files.
+// Page size limits for the list calls.  B2 bills a listing transaction for
+// every maxListCount files requested, however few are returned, and a count
+// of zero would get a server default; see listCount.
+const (
+	maxListCount           = 1000
+	maxListUnfinishedCount = 100
+	maxListKeysCount       = 10000
+)
+
+// listCount validates count for the given list call.  Zero means the maximum;
+// larger counts are reduced to it.
+func listCount(method string, count, max int) (int, error) {
+	switch {
+	case count < 0:
+		return 0, fmt.Errorf("%s: invalid count %d", method, count)
+	case count == 0, count > max:
+		return max, nil
+	}
+	return count, nil
+}
+
+// ListUnfinishedLargeFiles wraps b2_list_unfinished_large_files.  Count is
+// the page size; zero, or anything over 100, requests 100 files, and negative
+// counts are an error.
 func (b *Bucket) ListUnfinishedLargeFiles(ctx context.Context, count int, continuation string) ([]*File, string, error) {
+	count, err := listCount("b2_list_unfinished_large_files", count, maxListUnfinishedCount)
+	if err != nil {
+		return nil, "", err
+	}
+	c := b.b2.snapshot()
 	b2req := &b2types.ListUnfinishedLargeFilesRequest{
 		BucketID:     b.ID,
 		Continuation: continuation,
@@ -964,9 +1527,9 @@ func (b *Bucket) ListUnfinishedLargeFiles(ctx context.Context, count int, contin
 	}
 	b2resp := &b2types.ListUnfinishedLargeFilesResponse{}
 	headers := map[string]string{
-		"Authorization": b.b2.authToken,
+		"Authorization": c.authToken,
 	}
-	if err := b.b2.opts.makeRequest(ctx, "b2_list_unfinished_large_files", "POST", b.b2.apiURI+b2types.V1api+"b2_list_unfinished_large_files", b2req, b2resp, headers, nil); err != nil {
+	if err := c.opts.makeRequest(ctx, "b2_list_unfinished_large_files", "POST", c.apiURI+b2types.V1api+"b2_list_unfinished_large_files", b2req, b2resp, headers, nil); err != nil {
 		return nil, "", err
 	}
 	cont := b2resp.Continuation
@@ -974,24 +1537,49 @@ func (b *Bucket) ListUnfinishedLargeFiles(ctx context.Context, count int, contin
 	for _, f := range b2resp.Files {
 		files = append(files, &File{
 			Name:      f.Name,
-			Timestamp: millitime(f.Timestamp),
+			Timestamp: f.Timestamp.Time(),
 			b2:        b.b2,
 			ID:        f.FileID,
 			Info: &FileInfo{
 				Name:        f.Name,
 				ContentType: f.ContentType,
 				Info:        f.Info,
-				Timestamp:   millitime(f.Timestamp),
+				Timestamp:   f.Timestamp.Time(),
 			},
 		})
 	}
 	return files, cont, nil
 }
 
-// ListFileNames wraps b2_list_file_names.
+// ListFileNames wraps b2_list_file_names.  Only the current version of each
+// file is listed, so every File has status ActionUpload, or ActionFolder if a
+// delimiter is given.  Count is the page size; zero, or anything over 1000,
+// requests 1000 files, and negative counts are an error.
 func (b *Bucket) ListFileNames(ctx context.Context, count int, continuation, prefix, delimiter string) ([]*File, string, error) {
+	var files []*File
+	cont, err := b.ListFileNamesFunc(ctx, count, continuation, prefix, delimiter, func(f *File) error {
+		files = append(files, f)
+		return nil
+	})
+	if err != nil {
+		return nil, "", err
+	}
+	return files, cont, nil
+}
+
+// ListFileNamesFunc is ListFileNames, but calls fn with each file as soon as
+// it is decoded from the reply, rather than returning the whole page.  If fn
+// returns an error, the rest of the page is discarded and the error returned.
+// fn may have been called for some of the files on a page whose reply later
+// turns out to be truncated or malformed; the error is returned all the same.
+func (b *Bucket) ListFileNamesFunc(ctx context.Context, count int, continuation, prefix, delimiter string, fn func(*File) error) (string, error) {
+	count, err := listCount("b2_list_file_names", count, maxListCount)
+	if err != nil {
+		return "", err
+	}
+	c := b.b2.snapshot()
 	if prefix == "" {
-		prefix = b.b2.pfx
+		prefix = c.pfx
 	}
 	b2req := &b2types.ListFileNamesRequest{
 		Count:        count,
@@ -1000,42 +1588,73 @@ func (b *Bucket) ListFileNames(ctx context.Context, count int, continuation, pre
 		Prefix:       prefix,
 		Delimiter:    delimiter,
 	}
-	b2resp := &b2types.ListFileNamesResponse{}
+	b2resp := &listReply{
+		fn: func(f *b2types.GetFileInfoResponse) error { return fn(b.listedFile(f)) },
+	}
 	headers := map[string]string{
-		"Authorization": b.b2.authToken,
+		"Authorization": c.authToken,
 	}
-	if err := b.b2.opts.makeRequest(ctx, "b2_list_file_names", "POST", b.b2.apiURI+b2types.V1api+"b2_list_file_names", b2req, b2resp, headers, nil); err != nil {
-		return nil, "", err
+	if err := c.opts.makeRequest(ctx, "b2_list_file_names", "POST", c.apiURI+b2types.V1api+"b2_list_file_names", b2req, b2resp, headers, nil); err != nil {
+		if b2resp.err != nil {
+			return "", b2resp.err
+		}
+		return "", err
 	}
-	cont := b2resp.Continuation
+	return b2resp.nextName, nil
+}
+
+// listedFile converts a file from a listing.
+func (b *Bucket) listedFile(f *b2types.GetFileInfoResponse) *File {
+	return &File{
+		Name:      f.Name,
+		Size:      f.Size,
+		Status:    f.Action,
+		Timestamp: f.Timestamp.Time(),
+		Info: &FileInfo{
+			Name:        f.Name,
+			SHA1:        f.SHA1,
+			MD5:         f.MD5,
+			Size:        f.Size,
+			ContentType: f.ContentType,
+			Info:        f.Info,
+			Status:      f.Action,
+			Timestamp:   f.Timestamp.Time(),
+		},
+		ID: f.FileID,
+		b2: b.b2,
+	}
+}
+
+// ListFileVersions wraps b2_list_file_versions.  Every version of every file
+// is listed, including hide markers (ActionHide) and unfinished large files
+// (ActionStart), as well as ActionFolder entries if a delimiter is given.
+// Files are ordered by name and, within a name, newest first.  Count is the
+// page size, as with ListFileNames.
+func (b *Bucket) ListFileVersions(ctx context.Context, count int, startName, startID, prefix, delimiter string) ([]*File, string, string, error) {
 	var files []*File
-	for _, f := range b2resp.Files {
-		files = append(files, &File{
-			Name:      f.Name,
-			Size:      f.Size,
-			Status:    f.Action,
-			Timestamp: millitime(f.Timestamp),
-			Info: &FileInfo{
-				Name:        f.Name,
-				SHA1:        f.SHA1,
-				MD5:         f.MD5,
-				Size:        f.Size,
-				ContentType: f.ContentType,
-				Info:        f.Info,
-				Status:      f.Action,
-				Timestamp:   millitime(f.Timestamp),
-			},
-			ID: f.FileID,
-			b2: b.b2,
-		})
+	name, id, err := b.ListFileVersionsFunc(ctx, count, startName, startID, prefix, delimiter, func(f *File) error {
+		files = append(files, f)
+		return nil
+	})
+	if err != nil {
+		return nil, "", "", err
 	}
-	return files, cont, nil
+	newestFirst(files)
+	return files, name, id, nil
 }
 
-// ListFileVersions wraps b2_list_file_versions.
-func (b *Bucket) ListFileVersions(ctx context.Context, count int, startName, startID, prefix, delimiter string) ([]*File, string, string, error) {
+// ListFileVersionsFunc is ListFileVersions, but calls fn with each file as
+// soon as it is decoded from the reply, in the manner of ListFileNamesFunc.
+// Files are passed in the order B2 sends them, which ListFileVersions only
+// double-checks.
+func (b *Bucket) ListFileVersionsFunc(ctx context.Context, count int, startName, startID, prefix, delimiter string, fn func(*File) error) (string, string, error) {
+	count, err := listCount("b2_list_file_versions", count, maxListCount)
+	if err != nil {
+		return "", "", err
+	}
+	c := b.b2.snapshot()
 	if prefix == "" {
-		prefix = b.b2.pfx
+		prefix = c.pfx
 	}
 	b2req := &b2types.ListFileVersionsRequest{
 		BucketID:  b.ID,
@@ -1045,39 +1664,83 @@ func (b *Bucket) ListFileVersions(ctx context.Context, count int, startName, sta
 		Prefix:    prefix,
 		Delimiter: delimiter,
 	}
-	b2resp := &b2types.ListFileVersionsResponse{}
+	b2resp := &listReply{
+		fn: func(f *b2types.GetFileInfoResponse) error { return fn(b.listedFile(f)) },
+	}
 	headers := map[string]string{
-		"Authorization": b.b2.authToken,
+		"Authorization": c.authToken,
 	}
-	if err := b.b2.opts.makeRequest(ctx, "b2_list_file_versions", "POST", b.b2.apiURI+b2types.V1api+"b2_list_file_versions", b2req, b2resp, headers, nil); err != nil {
-		return nil, "", "", err
+	if err := c.opts.makeRequest(ctx, "b2_list_file_versions", "POST", c.apiURI+b2types.V1api+"b2_list_file_versions", b2req, b2resp, headers, nil); err != nil {
+		if b2resp.err != nil {
+			return "", "", b2resp.err
+		}
+		return "", "", err
 	}
-	var files []*File
-	for _, f := range b2resp.Files {
-		files = append(files, &File{
-			Name:      f.Name,
-			Size:      f.Size,
-			Status:    f.Action,
-			Timestamp: millitime(f.Timestamp),
-			Info: &FileInfo{
-				Name:        f.Name,
-				SHA1:        f.SHA1,
-				MD5:         f.MD5,
-				Size:        f.Size,
-				ContentType: f.ContentType,
-				Info:        f.Info,
-				Status:      f.Action,
-				Timestamp:   millitime(f.Timestamp),
-			},
-			ID: f.FileID,
-			b2: b.b2,
-		})
+	return b2resp.nextName, b2resp.nextID, nil
+}
+
+// newestFirst sorts each run of versions of the same name by upload time,
+// newest first.  B2 already returns them this way; this makes it a promise.
+func newestFirst(files []*File) {
+	for i := 0; i < len(files); {
+		j := i + 1
+		for j < len(files) && files[j].Name == files[i].Name {
+			j++
+		}
+		run := files[i:j]
+		sort.SliceStable(run, func(a, b int) bool { return run[a].Timestamp.After(run[b].Timestamp) })
+		i = j
 	}
-	return files, b2resp.NextName, b2resp.NextID, nil
+}
+
+// CopyFile wraps b2_copy_file.  The file identified by src is copied into this
+// bucket with the given name.  If contentType is empty and info is nil, the
+// source file's metadata is copied; otherwise it is replaced.
+func (b *Bucket) CopyFile(ctx context.Context, src, name, contentType string, info map[string]string) (*File, error) {
+	c := b.b2.snapshot()
+	b2req := &b2types.CopyFileRequest{
+		SourceID:     src,
+		Name:         name,
+		DestBucketID: b.ID,
+	}
+	if contentType != "" || info != nil {
+		b2req.MetadataDirective = "REPLACE"
+		b2req.ContentType = contentType
+		b2req.Info = info
+		if b2req.Info == nil {
+			b2req.Info = map[string]string{}
+		}
+	}
+	b2resp := &b2types.CopyFileResponse{}
+	headers := map[string]string{
+		"Authorization": c.authToken,
+	}
+	if err := c.opts.makeRequest(ctx, "b2_copy_file", "POST", c.apiURI+b2types.V1api+"b2_copy_file", b2req, b2resp, headers, nil); err != nil {
+		return nil, err
+	}
+	return &File{
+		Name:      b2resp.Name,
+		Size:      b2resp.Size,
+		Status:    b2resp.Action,
+		Timestamp: b2resp.Timestamp.Time(),
+		Info: &FileInfo{
+			Name:        b2resp.Name,
+			SHA1:        b2resp.SHA1,
+			MD5:         b2resp.MD5,
+			Size:        b2resp.Size,
+			ContentType: b2resp.ContentType,
+			Info:        b2resp.Info,
+			Status:      b2resp.Action,
+			Timestamp:   b2resp.Timestamp.Time(),
+		},
+		ID: b2resp.FileID,
+		b2: b.b2,
+	}, nil
 }
 
 // GetDownloadAuthorization wraps b2_get_download_authorization.
 func (b *Bucket) GetDownloadAuthorization(ctx context.Context, prefix string, valid time.Duration, contentDisposition string) (string, error) {
+	c := b.b2.snapshot()
 	b2req := &b2types.GetDownloadAuthorizationRequest{
 		BucketID:           b.ID,
 		Prefix:             prefix,
@@ -1086,9 +1749,9 @@ func (b *Bucket) GetDownloadAuthorization(ctx context.Context, prefix string, va
 	}
 	b2resp := &b2types.GetDownloadAuthorizationResponse{}
 	headers := map[string]string{
-		"Authorization": b.b2.authToken,
+		"Authorization": c.authToken,
 	}
-	if err := b.b2.opts.makeRequest(ctx, "b2_get_download_authorization", "POST", b.b2.apiURI+b2types.V1api+"b2_get_download_authorization", b2req, b2resp, headers, nil); err != nil {
+	if err := c.opts.makeRequest(ctx, "b2_get_download_authorization", "POST", c.apiURI+b2types.V1api+"b2_get_download_authorization", b2req, b2resp, headers, nil); err != nil {
 		return "", err
 	}
 	return b2resp.Token, nil
@@ -1102,6 +1765,43 @@ type FileReader struct {
 	SHA1          string
 	ID            string
 	Info          map[string]string
+
+	// Size is the size of the entire file, which differs from ContentLength
+	// for ranged requests.
+	Size int64
+
+	// UploadTimestamp is when the file was uploaded, or the zero time if the
+	// reply didn't say.
+	UploadTimestamp time.Time
+
+	// Diagnostics describes the reply, if KeepDiagnostics was given.
+	Diagnostics *Diagnostics
+}
+
+// infoValue returns the value of key in info from a download.  B2 stores info
+// keys in lower case, but net/http canonicalizes the headers they arrive in,
+// so the keys are matched without regard to case.
+func infoValue(info map[string]string, key string) string {
+	for k, v := range info {
+		if strings.EqualFold(k, key) {
+			return v
+		}
+	}
+	return ""
+}
+
+// fileSize returns the size of the whole file from a download response.
+func fileSize(resp *http.Response, clen int64) int64 {
+	cr := resp.Header.Get("Content-Range")
+	i := strings.LastIndex(cr, "/")
+	if i < 0 {
+		return clen
+	}
+	size, err := strconv.ParseInt(cr[i+1:], 10, 64)
+	if err != nil {
+		return clen
+	}
+	return size
 }
 
 func mkRange(offset, size int64) string {
@@ -1114,37 +1814,115 @@ func mkRange(offset, size int64) string {
 	return fmt.Sprintf("bytes=%d-%d", offset, offset+size-1)
 }
 
+// ErrNotModified is returned by conditional downloads when the file's SHA1
+// matches the one the caller supplied.
+var ErrNotModified = errors.New("not modified")
+
 // DownloadFileByName wraps b2_download_file_by_name.
 func (b *Bucket) DownloadFileByName(ctx context.Context, name string, offset, size int64, header bool) (*FileReader, error) {
-	uri := fmt.Sprintf("%s/file/%s/%s", b.b2.downloadURI, b.Name, escape(name))
+	return b.DownloadFileByNameIfNoneMatch(ctx, name, "", offset, size, header)
+}
+
+// DownloadFileByNameIfNoneMatch is DownloadFileByName, made conditional on the
+// file's SHA1 differing from sha1.  If it does not differ, ErrNotModified is
+// returned along with a FileReader whose body is empty and whose other fields
+// are populated from the response headers, where B2 provides them.  An empty
+// sha1 makes the download unconditional.
+func (b *Bucket) DownloadFileByNameIfNoneMatch(ctx context.Context, name, sha1 string, offset, size int64, header bool) (*FileReader, error) {
+	path := fmt.Sprintf("/file/%s/%s", b.Name, escape(name))
+	return b.download(ctx, "b2_download_file_by_name", path, sha1, offset, size, header)
+}
+
+// DownloadFileByID wraps b2_download_file_by_id.  Unlike DownloadFileByName, it
+// can read versions of a file other than the current one.
+func (b *Bucket) DownloadFileByID(ctx context.Context, id string, offset, size int64, header bool) (*FileReader, error) {
+	return b.DownloadFileByIDIfNoneMatch(ctx, id, "", offset, size, header)
+}
+
+// DownloadFileByIDIfNoneMatch is DownloadFileByID, made conditional in the
+// manner of DownloadFileByNameIfNoneMatch.
+func (b *Bucket) DownloadFileByIDIfNoneMatch(ctx context.Context, id, sha1 string, offset, size int64, header bool) (*FileReader, error) {
+	path := fmt.Sprintf("%sb2_download_file_by_id?fileId=%s", b2types.V1api, escape(id))
+	return b.download(ctx, "b2_download_file_by_id", path, sha1, offset, size, header)
+}
+
+// sameSHA1 reports whether the SHA1 of a download matches an entity tag
+// supplied by the caller, which may be quoted.
+func sameSHA1(sha1, etag string) bool {
+	return sha1 != "" && sha1 != "none" && strings.EqualFold(sha1, strings.Trim(etag, `"`))
+}
+
+func (b *Bucket) download(ctx context.Context, apiMethod, path, etag string, offset, size int64, header bool) (*FileReader, error) {
+	if etag == "" {
+		return b.fetch(ctx, apiMethod, path, "", offset, size, header)
+	}
+	if atomic.LoadInt32(&b.b2.ignoresINM) != 0 {
+		// B2 has ignored If-None-Match before, so check the SHA1 with a HEAD
+		// request rather than risk downloading the whole file for nothing.
+		fr, err := b.fetch(ctx, apiMethod, path, "", offset, size, true)
+		if err != nil {
+			return nil, err
+		}
+		if sameSHA1(fr.SHA1, etag) {
+			return fr, ErrNotModified
+		}
+		if header {
+			return fr, nil
+		}
+		return b.fetch(ctx, apiMethod, path, "", offset, size, false)
+	}
+	fr, err := b.fetch(ctx, apiMethod, path, etag, offset, size, header)
+	if err != nil {
+		return fr, err
+	}
+	if sameSHA1(fr.SHA1, etag) {
+		atomic.StoreInt32(&b.b2.ignoresINM, 1)
+		fr.Close()
+		fr.ReadCloser = http.NoBody
+		return fr, ErrNotModified
+	}
+	return fr, nil
+}
+
+func (b *Bucket) fetch(ctx context.Context, apiMethod, path, etag string, offset, size int64, header bool) (*FileReader, error) {
+	c := b.b2.snapshot()
 	method := "GET"
 	if header {
 		method = "HEAD"
 	}
-	req, err := http.NewRequest(method, uri, nil)
+	req, err := http.NewRequest(method, c.downloadURI+path, nil)
 	if err != nil {
 		return nil, err
 	}
-	req.Header.Set("Authorization", b.b2.authToken)
+	req.Header.Set("Authorization", c.authToken)
 	req.Header.Set("X-Blazer-Request-ID", fmt.Sprintf("%d", atomic.AddInt64(&reqID, 1)))
-	req.Header.Set("X-Blazer-Method", "b2_download_file_by_name")
-	b.b2.opts.addHeaders(req)
+	req.Header.Set("X-Blazer-Method", apiMethod)
+	c.opts.addHeaders(req)
 	rng := mkRange(offset, size)
 	if rng != "" {
 		req.Header.Set("Range", rng)
 	}
+	if etag != "" {
+		req.Header.Set("If-None-Match", `"`+strings.Trim(etag, `"`)+`"`)
+	}
 	logRequest(req, nil)
-	resp, err := makeNetRequest(ctx, req, b.b2.opts.getTransport())
+	counters := c.opts.counters
+	counters.call(apiMethod)
+	resp, err := makeNetRequest(ctx, req, c.opts.getTransport())
 	if err != nil {
+		counters.fail(err)
 		return nil, err
 	}
 	logResponse(resp, nil)
-	if resp.StatusCode != 200 && resp.StatusCode != 206 {
+	notModified := resp.StatusCode == http.StatusNotModified
+	if resp.StatusCode != 200 && resp.StatusCode != 206 && !notModified {
 		defer resp.Body.Close()
-		return nil, mkErr(resp)
+		err := mkErr(resp)
+		counters.fail(err)
+		return nil, err
 	}
 	clen, err := strconv.ParseInt(resp.Header.Get("Content-Length"), 10, 64)
-	if err != nil {
+	if err != nil && !notModified {
 		resp.Body.Close()
 		return nil, err
 	}
@@ -1166,36 +1944,51 @@ func (b *Bucket) DownloadFileByName(ctx context.Context, name string, offset, si
 		info[name] = val
 	}
 	sha1 := resp.Header.Get("X-Bz-Content-Sha1")
-	if sha1 == "none" && info["Large_file_sha1"] != "" {
-		sha1 = info["Large_file_sha1"]
+	if v := infoValue(info, "large_file_sha1"); sha1 == "none" && v != "" {
+		sha1 = v
 	}
-	return &FileReader{
-		ReadCloser:    resp.Body,
+	fr := &FileReader{
+		ReadCloser:    counters.countDown(resp.Body),
 		SHA1:          sha1,
 		ID:            resp.Header.Get("X-Bz-File-Id"),
 		ContentType:   resp.Header.Get("Content-Type"),
 		ContentLength: int(clen),
 		Info:          info,
-	}, nil
+		Size:          fileSize(resp, clen),
+	}
+	if ms, err := b2types.ParseMillis(resp.Header.Get("X-Bz-Upload-Timestamp")); err == nil {
+		fr.UploadTimestamp = ms.Time()
+	}
+	if c.opts.diagnostics {
+		fr.Diagnostics = diagnose(resp)
+	}
+	if notModified {
+		resp.Body.Close()
+		fr.ReadCloser = http.NoBody
+		fr.ContentLength = 0
+		return fr, ErrNotModified
+	}
+	return fr, nil
 }
 
 // HideFile wraps b2_hide_file.
 func (b *Bucket) HideFile(ctx context.Context, name string) (*File, error) {
+	c := b.b2.snapshot()
 	b2req := &b2types.HideFileRequest{
 		BucketID: b.ID,
 		File:     name,
 	}
 	b2resp := &b2types.HideFileResponse{}
 	headers := map[string]string{
-		"Authorization": b.b2.authToken,
+		"Authorization": c.authToken,
 	}
-	if err := b.b2.opts.makeRequest(ctx, "b2_hide_file", "POST", b.b2.apiURI+b2types.V1api+"b2_hide_file", b2req, b2resp, headers, nil); err != nil {
+	if err := c.opts.makeRequest(ctx, "b2_hide_file", "POST", c.apiURI+b2types.V1api+"b2_hide_file", b2req, b2resp, headers, nil); err != nil {
 		return nil, err
 	}
 	return &File{
 		Status:    b2resp.Action,
 		Name:      name,
-		Timestamp: millitime(b2resp.Timestamp),
+		Timestamp: b2resp.Timestamp.Time(),
 		b2:        b.b2,
 		ID:        b2resp.ID,
 	}, nil
@@ -1215,19 +2008,20 @@ type FileInfo struct {
 
 // GetFileInfo wraps b2_get_file_info.
 func (f *File) GetFileInfo(ctx context.Context) (*FileInfo, error) {
+	c := f.b2.snapshot()
 	b2req := &b2types.GetFileInfoRequest{
 		ID: f.ID,
 	}
 	b2resp := &b2types.GetFileInfoResponse{}
 	headers := map[string]string{
-		"Authorization": f.b2.authToken,
+		"Authorization": c.authToken,
 	}
-	if err := f.b2.opts.makeRequest(ctx, "b2_get_file_info", "POST", f.b2.apiURI+b2types.V1api+"b2_get_file_info", b2req, b2resp, headers, nil); err != nil {
+	if err := c.opts.makeRequest(ctx, "b2_get_file_info", "POST", c.apiURI+b2types.V1api+"b2_get_file_info", b2req, b2resp, headers, nil); err != nil {
 		return nil, err
 	}
 	f.Status = b2resp.Action
 	f.Name = b2resp.Name
-	f.Timestamp = millitime(b2resp.Timestamp)
+	f.Timestamp = b2resp.Timestamp.Time()
 	f.Info = &FileInfo{
 		Name:        b2resp.Name,
 		SHA1:        b2resp.SHA1,
@@ -1236,7 +2030,7 @@ func (f *File) GetFileInfo(ctx context.Context) (*FileInfo, error) {
 		ContentType: b2resp.ContentType,
 		Info:        b2resp.Info,
 		Status:      b2resp.Action,
-		Timestamp:   millitime(b2resp.Timestamp),
+		Timestamp:   b2resp.Timestamp.Time(),
 	}
 	return f.Info, nil
 }
@@ -1248,13 +2042,16 @@ type Key struct {
 	Name         string
 	Capabilities []string
 	Expires      time.Time
+	BucketID     string // the bucket the key is restricted to, if any
+	Prefix       string // the file name prefix the key is restricted to, if any
 	b2           *B2
 }
 
 // CreateKey wraps b2_create_key.
 func (b *B2) CreateKey(ctx context.Context, name string, caps []string, valid time.Duration, bucketID string, prefix string) (*Key, error) {
+	c := b.snapshot()
 	b2req := &b2types.CreateKeyRequest{
-		AccountID:    b.accountID,
+		AccountID:    c.accountID,
 		Capabilities: caps,
 		Name:         name,
 		Valid:        int(valid.Seconds()),
@@ -1263,9 +2060,9 @@ func (b *B2) CreateKey(ctx context.Context, name string, caps []string, valid ti
 	}
 	b2resp := &b2types.CreateKeyResponse{}
 	headers := map[string]string{
-		"Authorization": b.authToken,
+		"Authorization": c.authToken,
 	}
-	if err := b.opts.makeRequest(ctx, "b2_create_key", "POST", b.apiURI+b2types.V1api+"b2_create_key", b2req, b2resp, headers, nil); err != nil {
+	if err := c.opts.makeRequest(ctx, "b2_create_key", "POST", c.apiURI+b2types.V1api+"b2_create_key", b2req, b2resp, headers, nil); err != nil {
 		return nil, err
 	}
 	return &Key{
@@ -1273,34 +2070,45 @@ func (b *B2) CreateKey(ctx context.Context, name string, caps []string, valid ti
 		ID:           b2resp.ID,
 		Secret:       b2resp.Secret,
 		Capabilities: b2resp.Capabilities,
-		Expires:      millitime(b2resp.Expires),
+		Expires:      b2resp.Expires.Time(),
+		BucketID:     b2resp.BucketID,
+		Prefix:       b2resp.Prefix,
 		b2:           b,
 	}, nil
 }
 
 // Delete wraps b2_delete_key.
 func (k *Key) Delete(ctx context.Context) error {
+	c := k.b2.snapshot()
 	b2req := &b2types.DeleteKeyRequest{
 		KeyID: k.ID,
 	}
 	headers := map[string]string{
-		"Authorization": k.b2.authToken,
+		"Authorization": c.authToken,
 	}
-	return k.b2.opts.makeRequest(ctx, "b2_delete_key", "POST", k.b2.apiURI+b2types.V1api+"b2_delete_key", b2req, nil, headers, nil)
+	return c.opts.makeRequest(ctx, "b2_delete_key", "POST", c.apiURI+b2types.V1api+"b2_delete_key", b2req, nil, headers, nil)
 }
 
-// ListKeys wraps b2_list_keys.
-func (b *B2) ListKeys(ctx context.Context, max int, next string) ([]*Key, string, error) {
+// ListKeys wraps b2_list_keys.  Count is the page size; zero, or anything
+// over 10000, requests 10000 keys, and negative counts are an error.  The
+// next page begins at the returned key ID, which is empty after the last page.
+// Listed keys never include their secrets.
+func (b *B2) ListKeys(ctx context.Context, count int, next string) ([]*Key, string, error) {
+	count, err := listCount("b2_list_keys", count, maxListKeysCount)
+	if err != nil {
+		return nil, "", err
+	}
+	c := b.snapshot()
 	b2req := &b2types.ListKeysRequest{
-		AccountID: b.accountID,
-		Max:       max,
+		AccountID: c.accountID,
+		Max:       count,
 		Next:      next,
 	}
 	headers := map[string]string{
-		"Authorization": b.authToken,
+		"Authorization": c.authToken,
 	}
 	b2resp := &b2types.ListKeysResponse{}
-	if err := b.opts.makeRequest(ctx, "b2_list_keys", "POST", b.apiURI+b2types.V1api+"b2_list_keys", b2req, b2resp, headers, nil); err != nil {
+	if err := c.opts.makeRequest(ctx, "b2_list_keys", "POST", c.apiURI+b2types.V1api+"b2_list_keys", b2req, b2resp, headers, nil); err != nil {
 		return nil, "", err
 	}
 	var keys []*Key
@@ -1309,7 +2117,9 @@ func (b *B2) ListKeys(ctx context.Context, max int, next string) ([]*Key, string
 			Name:         key.Name,
 			ID:           key.ID,
 			Capabilities: key.Capabilities,
-			Expires:      millitime(key.Expires),
+			Expires:      key.Expires.Time(),
+			BucketID:     key.BucketID,
+			Prefix:       key.Prefix,
 			b2:           b,
 		})
 	}
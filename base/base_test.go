@@ -0,0 +1,971 @@
+// Copyright 2018, the Blazer authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package base
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/kurin/blazer"
+	"github.com/kurin/blazer/internal/b2types"
+)
+
+// slowZeros simulates a large upload source, yielding zeroes a little at a
+// time.
+type slowZeros struct {
+	n int64 // bytes read so far
+}
+
+func (z *slowZeros) Read(p []byte) (int, error) {
+	time.Sleep(time.Millisecond)
+	if len(p) > 1<<15 {
+		p = p[:1<<15]
+	}
+	for i := range p {
+		p[i] = 0
+	}
+	atomic.AddInt64(&z.n, int64(len(p)))
+	return len(p), nil
+}
+
+func TestUploadCancellation(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		io.Copy(ioutil.Discard, r.Body)
+		rw.Write([]byte("{}"))
+	}))
+	defer srv.Close()
+
+	const size = 500e6
+	b2 := &B2{authToken: "token", opts: &b2Options{}}
+
+	lf := &LargeFile{ID: "id", b2: b2}
+	fc := &FileChunk{url: srv.URL, token: "token", file: lf}
+	url := &URL{uri: srv.URL, token: "token", b2: b2}
+
+	table := []struct {
+		desc   string
+		upload func(context.Context, io.Reader) error
+	}{
+		{
+			desc: "UploadPart",
+			upload: func(ctx context.Context, r io.Reader) error {
+				_, err := fc.UploadPart(ctx, r, "hex_digits_at_end", size, 1)
+				return err
+			},
+		},
+		{
+			desc: "UploadFile",
+			upload: func(ctx context.Context, r io.Reader) error {
+				_, err := url.UploadFile(ctx, r, size, "name", "application/octet-stream", "hex_digits_at_end", nil)
+				return err
+			},
+		},
+	}
+
+	for _, e := range table {
+		src := &slowZeros{}
+		ctx, cancel := context.WithCancel(context.Background())
+		done := make(chan error, 1)
+		go func() { done <- e.upload(ctx, src) }()
+		time.Sleep(100 * time.Millisecond)
+		cancel()
+		canceled := time.Now()
+		select {
+		case err := <-done:
+			if err != context.Canceled {
+				t.Errorf("%s: got %v, want %v", e.desc, err, context.Canceled)
+			}
+			if d := time.Since(canceled); d > time.Second {
+				t.Errorf("%s: took %v to abort", e.desc, d)
+			}
+		case <-time.After(10 * time.Second):
+			t.Fatalf("%s: upload was not aborted", e.desc)
+		}
+		if n := atomic.LoadInt64(&src.n); n >= size {
+			t.Errorf("%s: the whole source was read", e.desc)
+		}
+	}
+
+	if parts := lf.Parts(); len(parts) != 0 {
+		t.Errorf("UploadPart: canceled part was recorded: %+v", parts)
+	}
+}
+
+func TestUndecodableReplies(t *testing.T) {
+	const page = "<html><body>502 Bad Gateway</body></html>"
+	var conns int32
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/bad_gateway" {
+			rw.WriteHeader(http.StatusBadGateway)
+		}
+		rw.Write([]byte(page))
+	}))
+	srv.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			atomic.AddInt32(&conns, 1)
+		}
+	}
+	srv.Start()
+	defer srv.Close()
+
+	ctx := context.Background()
+	opts := &b2Options{}
+	for _, path := range []string{"/ok", "/ok", "/bad_gateway"} {
+		resp := &b2types.ListBucketsResponse{}
+		err := opts.makeRequest(ctx, "b2_list_buckets", "POST", srv.URL+path, &b2types.ListBucketsRequest{}, resp, nil, nil)
+		if err == nil {
+			t.Fatalf("%s: expected an error", path)
+		}
+		if !strings.Contains(err.Error(), "502 Bad Gateway") {
+			t.Errorf("%s: error %q doesn't include the reply", path, err)
+		}
+	}
+	if n := atomic.LoadInt32(&conns); n != 1 {
+		t.Errorf("got %d connections, want 1", n)
+	}
+}
+
+func TestUploadSHA1(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		data, _ := ioutil.ReadAll(r.Body)
+		if r.Header.Get("X-Bz-Content-Sha1") == "hex_digits_at_end" {
+			data = data[:len(data)-40]
+		}
+		sum := fmt.Sprintf("%x", sha1.Sum(data))
+		if r.URL.Path == "/corrupt" {
+			sum = fmt.Sprintf("%x", sha1.Sum(nil))
+		}
+		json.NewEncoder(rw).Encode(map[string]interface{}{
+			"fileId":        "id",
+			"partNumber":    1,
+			"contentLength": len(data),
+			"contentSha1":   sum,
+		})
+	}))
+	defer srv.Close()
+
+	ctx := context.Background()
+	b2 := &B2{authToken: "token", opts: &b2Options{}}
+	data := []byte("some data")
+	sum := fmt.Sprintf("%x", sha1.Sum(data))
+	withSum := func() io.Reader { return io.MultiReader(bytes.NewReader(data), strings.NewReader(sum)) }
+
+	for _, path := range []string{"/ok", "/corrupt"} {
+		lf := &LargeFile{ID: "id", b2: b2}
+		fc := &FileChunk{url: srv.URL + path, token: "token", file: lf}
+		url := &URL{uri: srv.URL + path, token: "token", b2: b2}
+
+		_, perr := fc.UploadPart(ctx, withSum(), "hex_digits_at_end", len(data)+40, 1)
+		f, ferr := url.UploadFile(ctx, withSum(), len(data)+40, "name", "text/plain", "hex_digits_at_end", nil)
+
+		if path == "/corrupt" {
+			for _, err := range []error{perr, ferr} {
+				if _, ok := err.(SHA1MismatchError); !ok {
+					t.Errorf("%s: got %v, want a SHA1MismatchError", path, err)
+				}
+			}
+			if parts := lf.Parts(); len(parts) != 0 {
+				t.Errorf("%s: mismatched part was recorded: %+v", path, parts)
+			}
+			continue
+		}
+		if perr != nil || ferr != nil {
+			t.Fatalf("%s: UploadPart: %v, UploadFile: %v", path, perr, ferr)
+		}
+		if parts := lf.Parts(); len(parts) != 1 || parts[0] != (PartInfo{Index: 1, Size: int64(len(data)), SHA1: sum}) {
+			t.Errorf("%s: parts recorded as %+v; want part 1, SHA1 %q, size %d", path, parts, sum, len(data))
+		}
+		if f.Info == nil || f.Info.SHA1 != sum || f.Size != int64(len(data)) {
+			t.Errorf("%s: file recorded as %+v, size %d; want SHA1 %q, size %d", path, f.Info, f.Size, sum, len(data))
+		}
+	}
+}
+
+func TestConcurrentUpdate(t *testing.T) {
+	// Each server only accepts its own token, so a request that pairs one
+	// session's URL with another's token fails.
+	var mismatched int32
+	newServer := func(token string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+			if r.Header.Get("Authorization") != token {
+				atomic.AddInt32(&mismatched, 1)
+			}
+			rw.Write([]byte(`{"buckets":[]}`))
+		}))
+	}
+	srv1, srv2 := newServer("token1"), newServer("token2")
+	defer srv1.Close()
+	defer srv2.Close()
+	sessions := []*B2{
+		{accountID: "id", authToken: "token1", apiURI: srv1.URL, opts: &b2Options{}, caps: []string{"listBuckets"}},
+		{accountID: "id", authToken: "token2", apiURI: srv2.URL, opts: &b2Options{}, caps: []string{"listBuckets", "listFiles"}, bucket: "b1", pfx: "logs/"},
+	}
+
+	ctx := context.Background()
+	b2 := &B2{}
+	b2.Update(sessions[0])
+
+	done := make(chan struct{})
+	updated := make(chan struct{})
+	go func() {
+		defer close(updated)
+		for i := 0; ; i++ {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			b2.Update(sessions[i%2])
+		}
+	}()
+
+	errs := make(chan error, 10)
+	for i := 0; i < cap(errs); i++ {
+		go func() {
+			for j := 0; j < 20; j++ {
+				if _, err := b2.ListBuckets(ctx); err != nil {
+					errs <- err
+					return
+				}
+				if caps := b2.Capabilities(); len(caps) == 0 {
+					errs <- fmt.Errorf("Capabilities: got none")
+					return
+				}
+			}
+			errs <- nil
+		}()
+	}
+	for i := 0; i < cap(errs); i++ {
+		if err := <-errs; err != nil {
+			t.Error(err)
+		}
+	}
+	close(done)
+	<-updated
+	if n := atomic.LoadInt32(&mismatched); n != 0 {
+		t.Errorf("%d requests used the wrong token", n)
+	}
+
+	b2.Update(sessions[1])
+	if caps := b2.Capabilities(); !reflect.DeepEqual(caps, sessions[1].caps) {
+		t.Errorf("Capabilities after Update: got %v, want %v", caps, sessions[1].caps)
+	}
+	if c := b2.snapshot(); c.bucket != "b1" || c.pfx != "logs/" {
+		t.Errorf("after Update: bucket %q, prefix %q; want %q, %q", c.bucket, c.pfx, "b1", "logs/")
+	}
+}
+
+func TestPut(t *testing.T) {
+	data := []byte(`{"manifest": true}`)
+	sum := fmt.Sprintf("%x", sha1.Sum(data))
+	var urls, uploads int32
+	var srv *httptest.Server
+	srv = httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		fail := func(status int, code string) {
+			rw.WriteHeader(status)
+			json.NewEncoder(rw).Encode(map[string]interface{}{"status": status, "code": code, "message": code})
+		}
+		if strings.HasSuffix(r.URL.Path, "b2_get_upload_url") {
+			n := atomic.AddInt32(&urls, 1)
+			json.NewEncoder(rw).Encode(map[string]string{
+				"uploadUrl":          srv.URL + "/upload",
+				"authorizationToken": fmt.Sprintf("upload%d", n),
+			})
+			return
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		switch atomic.AddInt32(&uploads, 1) {
+		case 1:
+			fail(503, "service_unavailable")
+			return
+		case 2:
+			fail(401, "expired_auth_token")
+			return
+		}
+		if got := r.Header.Get("X-Bz-Content-Sha1"); got != sum || !bytes.Equal(body, data) {
+			fail(400, "bad_request")
+			return
+		}
+		json.NewEncoder(rw).Encode(map[string]interface{}{
+			"fileId":        "id",
+			"fileName":      r.Header.Get("X-Bz-File-Name"),
+			"action":        "upload",
+			"contentLength": len(body),
+			"contentSha1":   sum,
+		})
+	}))
+	defer srv.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	b2 := &B2{authToken: "token", apiURI: srv.URL, opts: &b2Options{}}
+	bucket := &Bucket{Name: "bucket", ID: "bucket-id", b2: b2}
+
+	for i := 0; i < 2; i++ {
+		f, err := bucket.Put(ctx, "manifest.json", data, "application/json", nil)
+		if err != nil {
+			t.Fatalf("Put #%d: %v", i+1, err)
+		}
+		if f.Name != "manifest.json" || f.Size != int64(len(data)) || f.Info.SHA1 != sum {
+			t.Errorf("Put #%d: got %+v", i+1, f)
+		}
+	}
+	// Both failures cost an upload URL; the second Put reuses the third.
+	if n := atomic.LoadInt32(&urls); n != 3 {
+		t.Errorf("got %d upload URLs, want 3", n)
+	}
+	if n := atomic.LoadInt32(&uploads); n != 4 {
+		t.Errorf("got %d uploads, want 4", n)
+	}
+}
+
+func TestPutRetryHistory(t *testing.T) {
+	var uploads int32
+	var srv *httptest.Server
+	srv = httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		fail := func(status int, code string) {
+			rw.WriteHeader(status)
+			json.NewEncoder(rw).Encode(map[string]interface{}{"status": status, "code": code, "message": code})
+		}
+		if strings.HasSuffix(r.URL.Path, "b2_get_upload_url") {
+			json.NewEncoder(rw).Encode(map[string]string{
+				"uploadUrl":          srv.URL + "/upload",
+				"authorizationToken": "upload",
+			})
+			return
+		}
+		ioutil.ReadAll(r.Body)
+		switch atomic.AddInt32(&uploads, 1) {
+		case 1:
+			rw.Header().Set("Retry-After", "1")
+			fail(503, "service_unavailable")
+		case 2:
+			fail(503, "service_unavailable")
+		default:
+			fail(400, "bad_request")
+		}
+	}))
+	defer srv.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	bucket := &Bucket{Name: "bucket", ID: "bucket-id", b2: &B2{authToken: "token", apiURI: srv.URL, opts: &b2Options{}}}
+	_, err := bucket.Put(ctx, "file", []byte("data"), "", nil)
+	if code, _ := Code(err); code != 400 {
+		t.Fatalf("Put: got %v, want a 400", err)
+	}
+	if n := Attempts(err); n != 3 {
+		t.Errorf("Attempts(%v): got %d, want 3", err, n)
+	}
+	if d := Waited(err); d != 1100*time.Millisecond {
+		t.Errorf("Waited(%v): got %v, want 1.1s", err, d)
+	}
+	if d := RetryAfter(err); d != time.Second {
+		t.Errorf("RetryAfter(%v): got %v, want 1s", err, d)
+	}
+	if d := Backoff(err); d != 0 {
+		t.Errorf("Backoff(%v): got %v, want 0", err, d)
+	}
+
+	// Errors that weren't retried carry no history.
+	err = b2err{code: 400, msg: "bad request"}
+	if n, d := Attempts(err), Waited(err); n != 1 || d != 0 {
+		t.Errorf("unretried error: got %d attempts and %v waited, want 1 and 0", n, d)
+	}
+	if got := WithRetries(context.Canceled, 5, time.Second, 0); got != context.Canceled {
+		t.Errorf("WithRetries(context.Canceled): got %v", got)
+	}
+}
+
+func TestPutRetryDeadline(t *testing.T) {
+	var uploads int32
+	var srv *httptest.Server
+	srv = httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, "b2_get_upload_url") {
+			json.NewEncoder(rw).Encode(map[string]string{
+				"uploadUrl":          srv.URL + "/upload",
+				"authorizationToken": "upload",
+			})
+			return
+		}
+		ioutil.ReadAll(r.Body)
+		atomic.AddInt32(&uploads, 1)
+		rw.WriteHeader(503)
+		json.NewEncoder(rw).Encode(map[string]interface{}{"status": 503, "code": "service_unavailable", "message": "busy"})
+	}))
+	defer srv.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+	bucket := &Bucket{Name: "bucket", ID: "bucket-id", b2: &B2{authToken: "token", apiURI: srv.URL, opts: &b2Options{}}}
+	_, err := bucket.Put(ctx, "file", []byte("data"), "", nil)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Put: got %v, want %v", err, context.DeadlineExceeded)
+	}
+	if n, want := Attempts(err), int(atomic.LoadInt32(&uploads)); n < 2 || n != want {
+		t.Errorf("Attempts(%v): got %d, want %d", err, n, want)
+	}
+	if d := Waited(err); d < 200*time.Millisecond || d > 600*time.Millisecond {
+		t.Errorf("Waited(%v): got %v, want between 200ms and 600ms", err, d)
+	}
+	if code, _ := Code(LastError(err)); code != 503 {
+		t.Errorf("LastError(%v): got %v, want a 503", err, LastError(err))
+	}
+}
+
+// cancelTransport reads each reply in full and then, on the nth upload,
+// cancels the request's context, so that the attempt fails with the reply's
+// error after the context has ended.
+type cancelTransport struct {
+	n       int32
+	uploads *int32
+	cancel  context.CancelFunc
+}
+
+func (ct cancelTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := http.DefaultTransport.RoundTrip(req)
+	if err != nil || !strings.HasSuffix(req.URL.Path, "/upload") {
+		return resp, err
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+	if atomic.AddInt32(ct.uploads, 1) == ct.n {
+		ct.cancel()
+	}
+	return resp, nil
+}
+
+func TestPutInterruptedKeepsLastError(t *testing.T) {
+	var srv *httptest.Server
+	var replies int32
+	srv = httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, "b2_get_upload_url") {
+			json.NewEncoder(rw).Encode(map[string]string{
+				"uploadUrl":          srv.URL + "/upload",
+				"authorizationToken": "upload",
+			})
+			return
+		}
+		ioutil.ReadAll(r.Body)
+		n := atomic.AddInt32(&replies, 1)
+		rw.WriteHeader(503)
+		json.NewEncoder(rw).Encode(map[string]interface{}{"status": 503, "code": "service_unavailable", "message": fmt.Sprintf("busy %d", n)})
+	}))
+	defer srv.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var uploads int32
+	opts := &b2Options{transport: cancelTransport{n: 2, uploads: &uploads, cancel: cancel}}
+	bucket := &Bucket{Name: "bucket", ID: "bucket-id", b2: &B2{authToken: "token", apiURI: srv.URL, opts: opts}}
+	_, err := bucket.Put(ctx, "file", []byte("data"), "", nil)
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("Put: got %v, want %v", err, context.Canceled)
+	}
+	if n := Attempts(err); n != 2 {
+		t.Errorf("Attempts(%v): got %d, want 2", err, n)
+	}
+	if last := LastError(err); last == nil || !strings.Contains(last.Error(), "busy 2") {
+		t.Errorf("LastError(%v): got %v, want the second attempt's error", err, last)
+	}
+}
+
+func TestLargeFileParts(t *testing.T) {
+	var requests int32
+	srv := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		data, _ := ioutil.ReadAll(r.Body)
+		n, _ := strconv.Atoi(r.Header.Get("X-Bz-Part-Number"))
+		json.NewEncoder(rw).Encode(map[string]interface{}{
+			"fileId":        "id",
+			"partNumber":    n,
+			"contentLength": len(data),
+			"contentSha1":   fmt.Sprintf("%x", sha1.Sum(data)),
+		})
+	}))
+	defer srv.Close()
+
+	ctx := context.Background()
+	lf := &LargeFile{ID: "id", b2: &B2{authToken: "token", opts: &b2Options{}}}
+	fc := &FileChunk{url: srv.URL, token: "token", file: lf}
+	upload := func(index int, data string) error {
+		sum := fmt.Sprintf("%x", sha1.Sum([]byte(data)))
+		_, err := fc.UploadPart(ctx, strings.NewReader(data), sum, len(data), index)
+		return err
+	}
+
+	if n := lf.NextPartIndex(); n != 1 {
+		t.Errorf("NextPartIndex: got %d, want 1", n)
+	}
+	for _, p := range []struct {
+		index int
+		data  string
+	}{{2, "second"}, {1, "first"}, {1, "first"}} {
+		if err := upload(p.index, p.data); err != nil {
+			t.Fatalf("part %d: %v", p.index, err)
+		}
+	}
+	want := []PartInfo{
+		{Index: 1, Size: 5, SHA1: fmt.Sprintf("%x", sha1.Sum([]byte("first")))},
+		{Index: 2, Size: 6, SHA1: fmt.Sprintf("%x", sha1.Sum([]byte("second")))},
+	}
+	if got := lf.Parts(); !reflect.DeepEqual(got, want) {
+		t.Errorf("Parts: got %+v, want %+v", got, want)
+	}
+	if n := lf.NextPartIndex(); n != 3 {
+		t.Errorf("NextPartIndex: got %d, want 3", n)
+	}
+
+	before := atomic.LoadInt32(&requests)
+	if err := upload(1, "different"); err == nil {
+		t.Error("uploading part 1 with different contents: got no error")
+	}
+	if err := upload(0, "zero"); err == nil {
+		t.Error("uploading part 0: got no error")
+	}
+	if n := atomic.LoadInt32(&requests) - before; n != 0 {
+		t.Errorf("rejected parts made %d requests", n)
+	}
+	if got := lf.Parts(); !reflect.DeepEqual(got, want) {
+		t.Errorf("Parts after rejected uploads: got %+v, want %+v", got, want)
+	}
+}
+
+func TestListCount(t *testing.T) {
+	var got int32
+	srv := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		var req struct {
+			Count int32 `json:"maxFileCount"`
+		}
+		json.NewDecoder(r.Body).Decode(&req)
+		atomic.StoreInt32(&got, req.Count)
+		rw.Write([]byte(`{"files":[]}`))
+	}))
+	defer srv.Close()
+
+	ctx := context.Background()
+	bucket := &Bucket{Name: "bucket", ID: "id", b2: &B2{authToken: "token", apiURI: srv.URL, opts: &b2Options{}}}
+	list := map[string]func(int) error{
+		"b2_list_file_names": func(n int) error {
+			_, _, err := bucket.ListFileNames(ctx, n, "", "", "")
+			return err
+		},
+		"b2_list_file_versions": func(n int) error {
+			_, _, _, err := bucket.ListFileVersions(ctx, n, "", "", "", "")
+			return err
+		},
+		"b2_list_unfinished_large_files": func(n int) error {
+			_, _, err := bucket.ListUnfinishedLargeFiles(ctx, n, "")
+			return err
+		},
+	}
+	table := []struct {
+		method  string
+		count   int
+		want    int32
+		wantErr bool
+	}{
+		{method: "b2_list_file_names", count: 0, want: 1000},
+		{method: "b2_list_file_names", count: 10, want: 10},
+		{method: "b2_list_file_names", count: 1000, want: 1000},
+		{method: "b2_list_file_names", count: 10000, want: 1000},
+		{method: "b2_list_file_names", count: -1, wantErr: true},
+		{method: "b2_list_file_versions", count: 0, want: 1000},
+		{method: "b2_list_file_versions", count: 5000, want: 1000},
+		{method: "b2_list_file_versions", count: -5, wantErr: true},
+		{method: "b2_list_unfinished_large_files", count: 0, want: 100},
+		{method: "b2_list_unfinished_large_files", count: 1000, want: 100},
+		{method: "b2_list_unfinished_large_files", count: 50, want: 50},
+	}
+	for _, e := range table {
+		atomic.StoreInt32(&got, -1)
+		err := list[e.method](e.count)
+		if e.wantErr {
+			if err == nil {
+				t.Errorf("%s(%d): got no error", e.method, e.count)
+			}
+			if n := atomic.LoadInt32(&got); n != -1 {
+				t.Errorf("%s(%d): sent a request with count %d", e.method, e.count, n)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s(%d): %v", e.method, e.count, err)
+			continue
+		}
+		if n := atomic.LoadInt32(&got); n != e.want {
+			t.Errorf("%s(%d): sent count %d, want %d", e.method, e.count, n, e.want)
+		}
+	}
+}
+
+func TestConditionalDownload(t *testing.T) {
+	const (
+		data = "hello, world"
+		sum  = "b7e23ec29af22b0b4e41da31e868d57226121c84"
+	)
+	for _, honor := range []bool{true, false} {
+		var methods []string
+		srv := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+			methods = append(methods, r.Method)
+			h := rw.Header()
+			h.Set("Content-Length", strconv.Itoa(len(data)))
+			h.Set("Content-Type", "text/plain")
+			h.Set("X-Bz-Content-Sha1", sum)
+			if honor && r.Header.Get("If-None-Match") == `"`+sum+`"` {
+				rw.WriteHeader(http.StatusNotModified)
+				return
+			}
+			if r.Method == "GET" {
+				io.WriteString(rw, data)
+			}
+		}))
+		bucket := &Bucket{Name: "bucket", ID: "id", b2: &B2{authToken: "token", downloadURI: srv.URL, opts: &b2Options{}}}
+
+		ctx := context.Background()
+		for i := 0; i < 2; i++ {
+			methods = nil
+			fr, err := bucket.DownloadFileByNameIfNoneMatch(ctx, "file", sum, 0, 0, false)
+			if err != ErrNotModified {
+				t.Fatalf("honor=%v: conditional download: got %v, want ErrNotModified", honor, err)
+			}
+			if fr.SHA1 != sum {
+				t.Errorf("honor=%v: conditional download: got SHA1 %q, want %q", honor, fr.SHA1, sum)
+			}
+			if b, _ := ioutil.ReadAll(fr); len(b) != 0 {
+				t.Errorf("honor=%v: conditional download: got body %q", honor, b)
+			}
+			// Once B2 is known to ignore If-None-Match, only a HEAD is sent.
+			want := []string{"GET"}
+			if !honor && i > 0 {
+				want = []string{"HEAD"}
+			}
+			if !reflect.DeepEqual(methods, want) {
+				t.Errorf("honor=%v, attempt %d: sent %v, want %v", honor, i, methods, want)
+			}
+		}
+
+		fr, err := bucket.DownloadFileByNameIfNoneMatch(ctx, "file", "0123456789012345678901234567890123456789", 0, 0, false)
+		if err != nil {
+			t.Fatalf("honor=%v: changed download: %v", honor, err)
+		}
+		b, err := ioutil.ReadAll(fr)
+		fr.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(b) != data {
+			t.Errorf("honor=%v: changed download: got %q, want %q", honor, b, data)
+		}
+		srv.Close()
+	}
+}
+
+// versionsPage returns a b2_list_file_versions reply listing n files, each
+// with info of about infoSize bytes.
+func versionsPage(n, infoSize int) []byte {
+	resp := b2types.ListFileVersionsResponse{NextName: "next", NextID: "next-id"}
+	info := map[string]string{"pad": strings.Repeat("x", infoSize)}
+	for i := 0; i < n; i++ {
+		resp.Files = append(resp.Files, b2types.GetFileInfoResponse{
+			FileID: fmt.Sprintf("id%d", i),
+			Name:   fmt.Sprintf("file%04d", i),
+			Action: "upload",
+			Info:   info,
+		})
+	}
+	data, _ := json.Marshal(resp)
+	return data
+}
+
+func TestListFileVersionsFunc(t *testing.T) {
+	page := versionsPage(10, 10)
+	srv := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		rw.Write(page)
+	}))
+	defer srv.Close()
+
+	ctx := context.Background()
+	bucket := &Bucket{Name: "bucket", ID: "id", b2: &B2{authToken: "token", apiURI: srv.URL, opts: &b2Options{}}}
+	files, name, id, err := bucket.ListFileVersions(ctx, 10, "", "", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 10 || name != "next" || id != "next-id" {
+		t.Fatalf("ListFileVersions: got %d files and next %q, %q; want 10 files and next \"next\", \"next-id\"", len(files), name, id)
+	}
+	if files[3].Name != "file0003" || files[3].ID != "id3" || len(files[3].Info.Info["pad"]) != 10 {
+		t.Errorf("ListFileVersions: got %+v", files[3])
+	}
+
+	stop := errors.New("stop")
+	var n int
+	_, _, err = bucket.ListFileVersionsFunc(ctx, 10, "", "", "", "", func(*File) error {
+		n++
+		if n == 3 {
+			return stop
+		}
+		return nil
+	})
+	if err != stop {
+		t.Errorf("ListFileVersionsFunc: got error %v, want %v", err, stop)
+	}
+	if n != 3 {
+		t.Errorf("ListFileVersionsFunc: called fn %d times, want 3", n)
+	}
+}
+
+func BenchmarkListFileVersions(b *testing.B) {
+	page := versionsPage(1000, 10<<10)
+	srv := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		rw.Write(page)
+	}))
+	defer srv.Close()
+
+	ctx := context.Background()
+	bucket := &Bucket{Name: "bucket", ID: "id", b2: &B2{authToken: "token", apiURI: srv.URL, opts: &b2Options{}}}
+	b.ReportAllocs()
+	b.SetBytes(int64(len(page)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, _, _, err := bucket.ListFileVersions(ctx, 1000, "", "", "", ""); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestListKeys(t *testing.T) {
+	all := []b2types.Key{
+		{ID: "k1", Secret: "s1", Name: "global", Capabilities: []string{"listFiles", "writeFiles"}},
+		{ID: "k2", Secret: "s2", Name: "scoped", Capabilities: []string{"writeFiles"}, BucketID: "b1", Prefix: "logs/"},
+		{ID: "k3", Secret: "s3", Name: "reader", Capabilities: []string{"readFiles"}},
+	}
+	var counts []int
+	srv := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		req := &b2types.ListKeysRequest{}
+		json.NewDecoder(r.Body).Decode(req)
+		counts = append(counts, req.Max)
+		resp := &b2types.ListKeysResponse{}
+		for i, k := range all {
+			if k.ID < req.Next {
+				continue
+			}
+			if len(resp.Keys) == 2 {
+				resp.Next = all[i].ID
+				break
+			}
+			resp.Keys = append(resp.Keys, k)
+		}
+		json.NewEncoder(rw).Encode(resp)
+	}))
+	defer srv.Close()
+
+	ctx := context.Background()
+	b2 := &B2{authToken: "token", apiURI: srv.URL, opts: &b2Options{}}
+	var keys []*Key
+	var next string
+	for {
+		page, n, err := b2.ListKeys(ctx, 0, next)
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys = append(keys, page...)
+		if n == "" {
+			break
+		}
+		next = n
+	}
+	if !reflect.DeepEqual(counts, []int{10000, 10000}) {
+		t.Errorf("ListKeys: sent counts %v, want [10000 10000]", counts)
+	}
+	if len(keys) != len(all) {
+		t.Fatalf("ListKeys: got %d keys, want %d", len(keys), len(all))
+	}
+	for i, k := range keys {
+		if k.Secret != "" {
+			t.Errorf("ListKeys: key %s has a secret", k.ID)
+		}
+		if k.ID != all[i].ID || k.BucketID != all[i].BucketID || k.Prefix != all[i].Prefix || !reflect.DeepEqual(k.Capabilities, all[i].Capabilities) {
+			t.Errorf("ListKeys: got %+v, want %+v", k, all[i])
+		}
+	}
+	if _, _, err := b2.ListKeys(ctx, -1, ""); err == nil {
+		t.Error("ListKeys(-1): got no error")
+	}
+}
+
+func TestValidateBucketName(t *testing.T) {
+	table := []struct {
+		name string
+		ok   bool
+	}{
+		{name: "my-bucket", ok: true},
+		{name: "ABCdef", ok: true},
+		{name: strings.Repeat("a", 50), ok: true},
+		{name: "short"},
+		{name: strings.Repeat("a", 51)},
+		{name: "b2-reserved"},
+		{name: "B2-reserved"},
+		{name: "under_score"},
+		{name: "dotted.name"},
+		{name: "ünicode-name"},
+	}
+	for _, e := range table {
+		err := ValidateBucketName(e.name)
+		if e.ok {
+			if err != nil {
+				t.Errorf("ValidateBucketName(%q): %v", e.name, err)
+			}
+			continue
+		}
+		if _, ok := err.(BucketNameError); !ok {
+			t.Errorf("ValidateBucketName(%q): got %v, want a BucketNameError", e.name, err)
+		}
+	}
+
+	var requests int32
+	srv := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		rw.WriteHeader(400)
+		json.NewEncoder(rw).Encode(map[string]interface{}{"status": 400, "code": "duplicate_bucket_name", "message": "Bucket name is already in use."})
+	}))
+	defer srv.Close()
+	ctx := context.Background()
+	b2 := &B2{authToken: "token", apiURI: srv.URL, opts: &b2Options{}}
+	if _, err := b2.CreateBucket(ctx, "b2-bucket", "", nil, nil); err == nil || atomic.LoadInt32(&requests) != 0 {
+		t.Errorf("CreateBucket(b2-bucket): got %v after %d requests, want an error without any", err, requests)
+	}
+	_, err := b2.CreateBucket(ctx, "taken-name", "", nil, nil)
+	var berr BucketNameError
+	if !errors.As(err, &berr) || berr.Name != "taken-name" {
+		t.Errorf("CreateBucket(taken-name): got %v, want a BucketNameError", err)
+	}
+	if code, _ := Code(err); code != 400 {
+		t.Errorf("CreateBucket(taken-name): got code %d, want 400", code)
+	}
+}
+
+func TestDiagnostics(t *testing.T) {
+	var fail int32 = 1
+	srv := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		ioutil.ReadAll(r.Body)
+		h := rw.Header()
+		h.Set("X-Bz-Upload-Timestamp", "1500000000000")
+		h.Set("Set-Cookie", "session=secret")
+		if atomic.CompareAndSwapInt32(&fail, 1, 0) {
+			rw.WriteHeader(503)
+			json.NewEncoder(rw).Encode(map[string]interface{}{"status": 503, "code": "service_unavailable", "message": "try again"})
+			return
+		}
+		json.NewEncoder(rw).Encode(map[string]interface{}{"fileId": "id", "fileName": "file", "action": "upload", "contentSha1": "da39a3ee5e6b4b0d3255bfef95601890afd80709"})
+	}))
+	defer srv.Close()
+
+	ctx := context.Background()
+	b2 := &B2{authToken: "token", apiURI: srv.URL, opts: &b2Options{}}
+	KeepDiagnostics()(b2.opts)
+	url := &URL{uri: srv.URL + "/upload", token: "upload-token", b2: b2}
+	check := func(d *Diagnostics, status string) {
+		t.Helper()
+		if d == nil {
+			t.Fatal("no diagnostics")
+		}
+		if d.Method != "b2_upload_file" || d.Status != status || d.RequestID == "" || !strings.HasPrefix(srv.URL, "http://"+d.Host) {
+			t.Errorf("got %+v", d)
+		}
+		if d.Version != blazer.Version {
+			t.Errorf("Version: got %q, want %q", d.Version, blazer.Version)
+		}
+		if got := d.Header.Get("X-Bz-Upload-Timestamp"); got != "1500000000000" {
+			t.Errorf("X-Bz-Upload-Timestamp: got %q", got)
+		}
+		if _, ok := d.Header["Set-Cookie"]; ok {
+			t.Error("Set-Cookie was kept")
+		}
+	}
+
+	_, err := url.UploadFile(ctx, bytes.NewReader(nil), 0, "file", "", "da39a3ee5e6b4b0d3255bfef95601890afd80709", nil)
+	if err == nil {
+		t.Fatal("UploadFile: got no error")
+	}
+	check(Diagnose(fmt.Errorf("wrapped: %w", err)), "503 Service Unavailable")
+
+	f, err := url.UploadFile(ctx, bytes.NewReader(nil), 0, "file", "", "da39a3ee5e6b4b0d3255bfef95601890afd80709", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	check(f.Diagnostics, "200 OK")
+
+	if d := Diagnose(errors.New("not from B2")); d != nil {
+		t.Errorf("Diagnose: got %+v for an error not from B2", d)
+	}
+}
+
+func TestCapExceeded(t *testing.T) {
+	var code string
+	srv := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		ioutil.ReadAll(r.Body)
+		rw.Header().Set("Retry-After", "5")
+		rw.WriteHeader(403)
+		json.NewEncoder(rw).Encode(map[string]interface{}{"status": 403, "code": code, "message": "cap exceeded"})
+	}))
+	defer srv.Close()
+
+	ctx := context.Background()
+	b2 := &B2{authToken: "token", apiURI: srv.URL, opts: &b2Options{}}
+	url := &URL{uri: srv.URL + "/upload", token: "upload-token", b2: b2}
+	for c, want := range map[string]string{
+		"storage_cap_exceeded":     "storage",
+		"download_cap_exceeded":    "download",
+		"transaction_cap_exceeded": "transaction",
+		"cap_exceeded":             "",
+	} {
+		code = c
+		_, err := url.UploadFile(ctx, bytes.NewReader(nil), 0, "file", "", "da39a3ee5e6b4b0d3255bfef95601890afd80709", nil)
+		if err == nil {
+			t.Fatal("UploadFile: got no error")
+		}
+		if got := Action(err); got != Punt {
+			t.Errorf("%s: Action: got %v, want Punt", c, got)
+		}
+		if got, ok := CapExceeded(fmt.Errorf("wrapped: %w", err)); !ok || got != want {
+			t.Errorf("%s: CapExceeded: got %q, %v, want %q, true", c, got, ok, want)
+		}
+	}
+	code = "access_denied"
+	_, err := url.UploadFile(ctx, bytes.NewReader(nil), 0, "file", "", "da39a3ee5e6b4b0d3255bfef95601890afd80709", nil)
+	if c, ok := CapExceeded(err); ok {
+		t.Errorf("access_denied: CapExceeded: got %q, true, want false", c)
+	}
+}
@@ -0,0 +1,121 @@
+// Copyright 2018, the Blazer authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package base
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/kurin/blazer/internal/b2types"
+)
+
+// maxLoggedReply is the most of a reply that is kept for trace logging.
+const maxLoggedReply = 64 << 10
+
+// cappedBuffer keeps the first max bytes written to it and discards the rest.
+type cappedBuffer struct {
+	buf       []byte
+	max       int
+	truncated bool
+}
+
+func (c *cappedBuffer) Write(p []byte) (int, error) {
+	n := len(p)
+	if room := c.max - len(c.buf); n > room {
+		p = p[:room]
+		c.truncated = true
+	}
+	c.buf = append(c.buf, p...)
+	return n, nil
+}
+
+// logged returns the bytes kept, marked if any were discarded.
+func (c *cappedBuffer) logged() []byte {
+	if !c.truncated {
+		return c.buf
+	}
+	return append(c.buf[:len(c.buf):len(c.buf)], "...(truncated)"...)
+}
+
+// streamDecoder is implemented by replies that decode themselves from the
+// response body as it arrives, rather than all at once.
+type streamDecoder interface {
+	decode(*json.Decoder) error
+}
+
+// listReply decodes the reply to b2_list_file_names or b2_list_file_versions,
+// handing each file to fn as it is decoded, so that a page is never held in
+// memory both as JSON and as Files.
+type listReply struct {
+	nextName string
+	nextID   string
+	fn       func(*b2types.GetFileInfoResponse) error
+	err      error // from fn
+}
+
+func (l *listReply) decode(dec *json.Decoder) error {
+	if err := expectDelim(dec, '{'); err != nil {
+		return err
+	}
+	for dec.More() {
+		t, err := dec.Token()
+		if err != nil {
+			return err
+		}
+		switch t {
+		case "nextFileName":
+			err = dec.Decode(&l.nextName)
+		case "nextFileId":
+			err = dec.Decode(&l.nextID)
+		case "files":
+			err = l.files(dec)
+		default:
+			var skip json.RawMessage
+			err = dec.Decode(&skip)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return expectDelim(dec, '}')
+}
+
+func (l *listReply) files(dec *json.Decoder) error {
+	if err := expectDelim(dec, '['); err != nil {
+		return err
+	}
+	for dec.More() {
+		f := &b2types.GetFileInfoResponse{}
+		if err := dec.Decode(f); err != nil {
+			return err
+		}
+		if err := l.fn(f); err != nil {
+			l.err = err
+			return err
+		}
+	}
+	return expectDelim(dec, ']')
+}
+
+func expectDelim(dec *json.Decoder, d json.Delim) error {
+	t, err := dec.Token()
+	if err != nil {
+		return err
+	}
+	if t != d {
+		return fmt.Errorf("expected %v, got %v", d, t)
+	}
+	return nil
+}
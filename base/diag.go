@@ -0,0 +1,93 @@
+// Copyright 2018, the Blazer authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package base
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/kurin/blazer"
+)
+
+// Diagnostics describes the HTTP exchange behind a reply from B2, with the
+// details Backblaze support asks for.  It never includes credentials.
+type Diagnostics struct {
+	// Method is the B2 API method, such as "b2_upload_file".
+	Method string
+
+	// Host is the host that answered the request.  For uploads, this names
+	// the pod that received the data.
+	Host string
+
+	// Status is the response's status line, such as "503 Service
+	// Unavailable".
+	Status string
+
+	// RequestID is the X-Blazer-Request-ID header sent with the request.
+	RequestID string
+
+	// Version is the version of Blazer that made the request.
+	Version string
+
+	// Header holds those response headers that are useful for debugging and
+	// safe to share; see diagHeaders.
+	Header http.Header
+}
+
+// diagHeaders are the response headers copied into Diagnostics.
+var diagHeaders = []string{
+	"Date",
+	"Retry-After",
+	"Server",
+	"X-Bz-Content-Sha1",
+	"X-Bz-File-Id",
+	"X-Bz-Upload-Timestamp",
+}
+
+func diagnose(resp *http.Response) *Diagnostics {
+	d := &Diagnostics{
+		Method:    resp.Request.Header.Get("X-Blazer-Method"),
+		Host:      resp.Request.URL.Host,
+		Status:    resp.Status,
+		RequestID: resp.Request.Header.Get("X-Blazer-Request-ID"),
+		Version:   blazer.Version,
+		Header:    make(http.Header),
+	}
+	for _, h := range diagHeaders {
+		if v, ok := resp.Header[h]; ok {
+			d.Header[h] = append([]string(nil), v...)
+		}
+	}
+	return d
+}
+
+// Diagnose returns the diagnostics of the reply that caused err, or nil if
+// err did not come from a reply.
+func Diagnose(err error) *Diagnostics {
+	var e b2err
+	if !errors.As(err, &e) {
+		return nil
+	}
+	return e.diag
+}
+
+// KeepDiagnostics returns an AuthOption that records Diagnostics on
+// successful uploads and downloads, in File.Diagnostics and
+// FileReader.Diagnostics, as well as on errors.
+func KeepDiagnostics() AuthOption {
+	return func(o *b2Options) {
+		o.diagnostics = true
+	}
+}
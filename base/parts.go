@@ -0,0 +1,106 @@
+// Copyright 2018, the Blazer authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package base
+
+import (
+	"fmt"
+	"sort"
+)
+
+// PartInfo describes a part of a large file that has been uploaded.
+type PartInfo struct {
+	// Index is the part number, starting at 1.
+	Index int
+
+	// Size is the size of the part as reported by B2.  It is zero for parts
+	// passed to CompileParts, whose individual sizes are not known.
+	Size int64
+
+	// SHA1 is the hex-encoded SHA1 of the part as reported by B2.
+	SHA1 string
+}
+
+// partTable records the parts of a large file that have been uploaded.  The
+// zero value is an empty table.  Callers must synchronize access.
+type partTable struct {
+	parts map[int]PartInfo
+	size  int64 // the total size of all parts
+}
+
+// check reports an error if a part with the given index has already been
+// recorded with a different SHA1.  An empty or non-hex sha1 is never in
+// conflict.
+func (t *partTable) check(method string, index int, sha1 string) error {
+	if index < 1 {
+		return fmt.Errorf("%s: invalid part number %d", method, index)
+	}
+	if len(sha1) != 40 {
+		return nil
+	}
+	if p, ok := t.parts[index]; ok && p.SHA1 != sha1 {
+		return fmt.Errorf("%s: part %d was already uploaded with SHA1 %s, not %s", method, index, p.SHA1, sha1)
+	}
+	return nil
+}
+
+// add records an uploaded part.  Recording the same part twice has no effect.
+func (t *partTable) add(method string, p PartInfo) error {
+	if err := t.check(method, p.Index, p.SHA1); err != nil {
+		return err
+	}
+	if _, ok := t.parts[p.Index]; ok {
+		return nil
+	}
+	if t.parts == nil {
+		t.parts = make(map[int]PartInfo)
+	}
+	t.parts[p.Index] = p
+	t.size += p.Size
+	return nil
+}
+
+// list returns the recorded parts, in order.
+func (t *partTable) list() []PartInfo {
+	ps := make([]PartInfo, 0, len(t.parts))
+	for _, p := range t.parts {
+		ps = append(ps, p)
+	}
+	sort.Slice(ps, func(i, j int) bool { return ps[i].Index < ps[j].Index })
+	return ps
+}
+
+// next returns one more than the highest recorded index.
+func (t *partTable) next() int {
+	var n int
+	for i := range t.parts {
+		if i > n {
+			n = i
+		}
+	}
+	return n + 1
+}
+
+// hashes returns the SHA1s of the recorded parts, in order, as
+// b2_finish_large_file requires.  The parts must be numbered 1 through n.
+func (t *partTable) hashes(method string) ([]string, error) {
+	hs := make([]string, len(t.parts))
+	for i, p := range t.list() {
+		if p.Index != i+1 {
+			return nil, fmt.Errorf("%s: part %d is missing", method, i+1)
+		}
+		hs[i] = p.SHA1
+	}
+	return hs, nil
+}
@@ -0,0 +1,174 @@
+// Copyright 2018, the Blazer authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package base
+
+import (
+	"context"
+	"io"
+	"strconv"
+	"sync"
+	"sync/atomic"
+)
+
+// Counters accumulates statistics about the requests made to B2.  It is safe
+// for concurrent use, and is cheap enough to leave on: every update is a
+// single atomic operation.  The zero value is ready to use.
+type Counters struct {
+	calls  sync.Map // method name -> *int64
+	errors sync.Map // error code -> *int64
+
+	bytesUp   int64
+	bytesDown int64
+	inFlight  int64
+}
+
+// Stats is a snapshot of a Counters.
+type Stats struct {
+	// Calls is the number of requests made, by API method.  Retries are
+	// counted separately.
+	Calls map[string]int64
+
+	// Errors is the number of failed requests, by B2 error code (such as
+	// "bad_request") if there is one, and otherwise by HTTP status.  Requests
+	// that fail without a response are counted under "network", except those
+	// abandoned because their context ended, which aren't counted.
+	Errors map[string]int64
+
+	// BytesUp and BytesDown count file data sent to and received from B2.
+	BytesUp   int64
+	BytesDown int64
+
+	// InFlight is the number of uploads and downloads in progress.
+	InFlight int64
+}
+
+func incr(m *sync.Map, key string) {
+	v, ok := m.Load(key)
+	if !ok {
+		v, _ = m.LoadOrStore(key, new(int64))
+	}
+	atomic.AddInt64(v.(*int64), 1)
+}
+
+func snapshot(m *sync.Map) map[string]int64 {
+	r := make(map[string]int64)
+	m.Range(func(k, v interface{}) bool {
+		r[k.(string)] = atomic.LoadInt64(v.(*int64))
+		return true
+	})
+	return r
+}
+
+// Stats returns the current values of c.
+func (c *Counters) Stats() Stats {
+	return Stats{
+		Calls:     snapshot(&c.calls),
+		Errors:    snapshot(&c.errors),
+		BytesUp:   atomic.LoadInt64(&c.bytesUp),
+		BytesDown: atomic.LoadInt64(&c.bytesDown),
+		InFlight:  atomic.LoadInt64(&c.inFlight),
+	}
+}
+
+// All of the following are no-ops on a nil *Counters.
+
+func (c *Counters) call(method string) {
+	if c == nil {
+		return
+	}
+	incr(&c.calls, method)
+}
+
+func (c *Counters) fail(err error) {
+	if c == nil || err == nil || err == context.Canceled || err == context.DeadlineExceeded {
+		return
+	}
+	code := "network"
+	if e, ok := asB2err(err); ok && e.code != 0 {
+		code = e.msgCode
+		if code == "" {
+			code = strconv.Itoa(e.code)
+		}
+	}
+	incr(&c.errors, code)
+}
+
+func (c *Counters) start() {
+	if c == nil {
+		return
+	}
+	atomic.AddInt64(&c.inFlight, 1)
+}
+
+func (c *Counters) stop() {
+	if c == nil {
+		return
+	}
+	atomic.AddInt64(&c.inFlight, -1)
+}
+
+// countingReader adds the bytes read through it to *n.
+type countingReader struct {
+	r io.Reader
+	n *int64
+}
+
+func (cr countingReader) Read(p []byte) (int, error) {
+	n, err := cr.r.Read(p)
+	atomic.AddInt64(cr.n, int64(n))
+	return n, err
+}
+
+func (c *Counters) countUp(r io.Reader) io.Reader {
+	if c == nil {
+		return r
+	}
+	return countingReader{r: r, n: &c.bytesUp}
+}
+
+// downloadBody counts the bytes of a download, which is in flight until it is
+// closed.
+type downloadBody struct {
+	io.ReadCloser
+	c    *Counters
+	once sync.Once
+}
+
+func (d *downloadBody) Read(p []byte) (int, error) {
+	n, err := d.ReadCloser.Read(p)
+	atomic.AddInt64(&d.c.bytesDown, int64(n))
+	return n, err
+}
+
+func (d *downloadBody) Close() error {
+	d.once.Do(d.c.stop)
+	return d.ReadCloser.Close()
+}
+
+func (c *Counters) countDown(rc io.ReadCloser) io.ReadCloser {
+	if c == nil {
+		return rc
+	}
+	c.start()
+	return &downloadBody{ReadCloser: rc, c: c}
+}
+
+// WithCounters returns an AuthOption that records statistics about every
+// request in c.  The same Counters may be shared among sessions.
+func WithCounters(c *Counters) AuthOption {
+	return func(o *b2Options) {
+		o.counters = c
+	}
+}
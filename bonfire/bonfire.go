@@ -27,6 +27,7 @@ import (
 	"strconv"
 	"sync"
 
+	"github.com/kurin/blazer/b2"
 	"github.com/kurin/blazer/internal/pyre"
 )
 
@@ -44,9 +45,22 @@ func (f FS) PartWriter(id string, part int) (io.WriteCloser, error) {
 	return f.open(fp)
 }
 
+// objectDir returns the directory that holds the versions of the named
+// object.  Object names always use '/', whatever the host's separator is.
+func (f FS) objectDir(bucket, name string) (string, error) {
+	p, err := b2.PathFromName(name)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(string(f), bucket, p), nil
+}
+
 func (f FS) Writer(bucket, name, id string) (io.WriteCloser, error) {
-	fp := filepath.Join(string(f), bucket, name, id)
-	return f.open(fp)
+	dir, err := f.objectDir(bucket, name)
+	if err != nil {
+		return nil, err
+	}
+	return f.open(filepath.Join(dir, id))
 }
 
 func (f FS) Parts(id string) ([]string, error) {
@@ -115,7 +129,11 @@ func (f FS) Finish(fileId string) error {
 	if err != nil {
 		return err
 	}
-	w, err := f.open(filepath.Join(string(f), info.Bucket, info.Name, fileId))
+	dir, err := f.objectDir(info.Bucket, info.Name)
+	if err != nil {
+		return err
+	}
+	w, err := f.open(filepath.Join(dir, fileId))
 	if err != nil {
 		return err
 	}
@@ -139,7 +157,10 @@ func (f FS) Finish(fileId string) error {
 }
 
 func (f FS) ObjectByName(bucket, name string) (pyre.DownloadableObject, error) {
-	dir := filepath.Join(string(f), bucket, name)
+	dir, err := f.objectDir(bucket, name)
+	if err != nil {
+		return nil, err
+	}
 	d, err := os.Open(dir)
 	if err != nil {
 		return nil, err
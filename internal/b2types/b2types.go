@@ -76,6 +76,7 @@ type DeleteBucketRequest struct {
 type ListBucketsRequest struct {
 	AccountID string `json:"accountId"`
 	Bucket    string `json:"bucketId,omitempty"`
+	Name      string `json:"bucketName,omitempty"`
 }
 
 type ListBucketsResponse struct {
@@ -104,6 +105,13 @@ type GetUploadURLResponse struct {
 
 type UploadFileResponse GetFileInfoResponse
 
+type UploadPartResponse struct {
+	ID     string `json:"fileId"`
+	Number int    `json:"partNumber"`
+	Size   int64  `json:"contentLength"`
+	SHA1   string `json:"contentSha1"`
+}
+
 type DeleteFileVersionRequest struct {
 	Name   string `json:"fileName"`
 	FileID string `json:"fileId"`
@@ -155,10 +163,14 @@ type FinishLargeFileRequest struct {
 }
 
 type FinishLargeFileResponse struct {
-	Name      string `json:"fileName"`
-	FileID    string `json:"fileId"`
-	Timestamp int64  `json:"uploadTimestamp"`
-	Action    string `json:"action"`
+	Name        string            `json:"fileName"`
+	FileID      string            `json:"fileId"`
+	Timestamp   Millis            `json:"uploadTimestamp,omitempty"`
+	Action      string            `json:"action"`
+	Size        int64             `json:"contentLength,omitempty"`
+	ContentType string            `json:"contentType,omitempty"`
+	SHA1        string            `json:"contentSha1,omitempty"`
+	Info        map[string]string `json:"fileInfo,omitempty"`
 }
 
 type ListFileNamesRequest struct {
@@ -196,7 +208,7 @@ type HideFileRequest struct {
 
 type HideFileResponse struct {
 	ID        string `json:"fileId"`
-	Timestamp int64  `json:"uploadTimestamp"`
+	Timestamp Millis `json:"uploadTimestamp,omitempty"`
 	Action    string `json:"action"`
 }
 
@@ -215,9 +227,20 @@ type GetFileInfoResponse struct {
 	ContentType string            `json:"contentType,omitempty"`
 	Info        map[string]string `json:"fileInfo,omitempty"`
 	Action      string            `json:"action,omitempty"`
-	Timestamp   int64             `json:"uploadTimestamp,omitempty"`
+	Timestamp   Millis            `json:"uploadTimestamp,omitempty"`
 }
 
+type CopyFileRequest struct {
+	SourceID          string            `json:"sourceFileId"`
+	Name              string            `json:"fileName"`
+	DestBucketID      string            `json:"destinationBucketId,omitempty"`
+	MetadataDirective string            `json:"metadataDirective,omitempty"`
+	ContentType       string            `json:"contentType,omitempty"`
+	Info              map[string]string `json:"fileInfo,omitempty"`
+}
+
+type CopyFileResponse GetFileInfoResponse
+
 type GetDownloadAuthorizationRequest struct {
 	BucketID           string `json:"bucketId"`
 	Prefix             string `json:"fileNamePrefix"`
@@ -257,7 +280,7 @@ type Key struct {
 	AccountID    string   `json:"accountId"`
 	Capabilities []string `json:"capabilities"`
 	Name         string   `json:"keyName"`
-	Expires      int64    `json:"expirationTimestamp"`
+	Expires      Millis   `json:"expirationTimestamp,omitempty"`
 	BucketID     string   `json:"bucketId"`
 	Prefix       string   `json:"namePrefix"`
 }
@@ -0,0 +1,58 @@
+// Copyright 2018, the Blazer authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package b2types
+
+import (
+	"strconv"
+	"time"
+)
+
+// Millis is a time as B2 represents it: milliseconds since the Unix epoch.
+// Zero means no time at all, so that an unset field can be omitted, and
+// converts to the zero time.Time rather than to 1970.
+type Millis int64
+
+// ToMillis converts t, truncated to the millisecond.
+func ToMillis(t time.Time) Millis {
+	if t.IsZero() {
+		return 0
+	}
+	return Millis(t.Unix()*1e3 + int64(t.Nanosecond()/1e6))
+}
+
+// Time converts m to a time.Time.
+func (m Millis) Time() time.Time {
+	if m == 0 {
+		return time.Time{}
+	}
+	ms := int64(m)
+	sec, rem := ms/1e3, ms%1e3
+	if rem < 0 {
+		sec, rem = sec-1, rem+1e3
+	}
+	return time.Unix(sec, rem*1e6)
+}
+
+// String formats m as a decimal, the form B2 uses in file info, such as
+// src_last_modified_millis.
+func (m Millis) String() string {
+	return strconv.FormatInt(int64(m), 10)
+}
+
+// ParseMillis parses a decimal timestamp in the form String returns.
+func ParseMillis(s string) (Millis, error) {
+	ms, err := strconv.ParseInt(s, 10, 64)
+	return Millis(ms), err
+}
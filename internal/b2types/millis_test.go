@@ -0,0 +1,74 @@
+// Copyright 2018, the Blazer authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package b2types
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestMillisRoundTrip(t *testing.T) {
+	table := []time.Time{
+		time.Unix(1, 0),
+		time.Unix(1528249315, 123e6),
+		time.Unix(1528249315, 999e6),
+		time.Unix(-1, 1e6),
+		time.Unix(-86400*365, 500e6),
+		time.Date(2262, 1, 1, 0, 0, 0, 7e6, time.UTC),
+	}
+	for _, want := range table {
+		m := ToMillis(want)
+		if got := m.Time(); !got.Equal(want) {
+			t.Errorf("ToMillis(%v).Time(): got %v", want, got)
+		}
+		p, err := ParseMillis(m.String())
+		if err != nil {
+			t.Errorf("ParseMillis(%q): %v", m, err)
+			continue
+		}
+		if p != m {
+			t.Errorf("ParseMillis(%q): got %d, want %d", m, p, m)
+		}
+	}
+
+	// Sub-millisecond precision is truncated, not rounded.
+	if got, want := ToMillis(time.Unix(10, 1999999)).Time(), time.Unix(10, 1e6); !got.Equal(want) {
+		t.Errorf("truncation: got %v, want %v", got, want)
+	}
+}
+
+func TestMillisZero(t *testing.T) {
+	if m := ToMillis(time.Time{}); m != 0 {
+		t.Errorf("ToMillis(time.Time{}): got %d, want 0", m)
+	}
+	if tm := Millis(0).Time(); !tm.IsZero() {
+		t.Errorf("Millis(0).Time(): got %v, want the zero time", tm)
+	}
+	b, err := json.Marshal(GetFileInfoResponse{FileID: "id"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := string(b), `{"fileId":"id"}`; got != want {
+		t.Errorf("marshaling a zero timestamp: got %s, want %s", got, want)
+	}
+	resp := &GetFileInfoResponse{}
+	if err := json.Unmarshal([]byte(`{"uploadTimestamp":1528249315123}`), resp); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := resp.Timestamp.Time(), time.Unix(1528249315, 123e6); !got.Equal(want) {
+		t.Errorf("unmarshaling: got %v, want %v", got, want)
+	}
+}
@@ -19,13 +19,20 @@
 package blog
 
 import (
+	"fmt"
 	"log"
 	"os"
 	"strconv"
+
+	"github.com/kurin/blazer"
 )
 
 var level int32
 
+// prefix begins every line, so that logs from a fleet can be matched to the
+// version of the library that wrote them.
+const prefix = "blazer/" + blazer.Version + ": "
+
 type Verbose bool
 
 func init() {
@@ -39,13 +46,13 @@ func init() {
 
 func (v Verbose) Info(a ...interface{}) {
 	if v {
-		log.Print(a...)
+		log.Print(prefix + fmt.Sprint(a...))
 	}
 }
 
 func (v Verbose) Infof(format string, a ...interface{}) {
 	if v {
-		log.Printf(format, a...)
+		log.Print(prefix + fmt.Sprintf(format, a...))
 	}
 }
 
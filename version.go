@@ -0,0 +1,21 @@
+// Copyright 2018, the Blazer authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package blazer is the root of the Blazer module.  The B2 client is in
+// package github.com/kurin/blazer/b2.
+package blazer
+
+// Version is the version of Blazer.  It is sent in the User-Agent header of
+// every request, and recorded in trace logs and error diagnostics.
+const Version = "0.5.3"